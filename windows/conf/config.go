@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"net/netip"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +28,9 @@ const KeyLength = 32
 type Endpoint struct {
 	Host string
 	Port uint16
+	// LastPort ends the range of ports an obfuscator target publishes from
+	// Port on. It is zero for a single port.
+	LastPort uint16
 }
 
 type (
@@ -42,6 +46,10 @@ type Config struct {
 
 	Obfuscation *Obfuscation
 
+	// Warnings are problems the parser found that do not stop the tunnel
+	// from starting but likely stop it from working well.
+	Warnings []string
+
 	TrailingComments []string
 }
 
@@ -52,22 +60,61 @@ const (
 	ObfuscationModeSocks5
 )
 
+// AutoMTU is how the tunnel service fits the interface MTU to the overhead
+// of an instance: not at all, to DefaultPathMTU, or to the path MTU the
+// obfuscator discovers.
+type AutoMTU int
+
+const (
+	AutoMTUOff AutoMTU = iota
+	AutoMTUOn
+	AutoMTUProbe
+)
+
+func (a AutoMTU) String() string {
+	switch a {
+	case AutoMTUOn:
+		return "on"
+	case AutoMTUProbe:
+		return "probe"
+	}
+	return "off"
+}
+
 type Obfuscation struct {
 	Mode             ObfuscationMode
 	SourceListenPort uint16
 	Target           Endpoint
+	FallbackTargets  []Endpoint
+	FailoverTimeout  uint16
+	PortHopInterval  uint16
+	PortHopSilence   uint16
+	Resolver         string
+	ResolveInterval  uint16
 	Key              string
+	PreviousKeys     []PreviousKey
 	Masking          phobos.Masking
 	ObfuscateBytes   uint16
 	MaxDummy         uint16
+	Padding          phobos.PaddingPolicy
 	MediaPayloadType uint8
 	MediaSSRC        uint32
 	MediaClock       uint16
+	MediaProfile     phobos.MediaProfile
+	CoverTraffic     uint16
+	AutoMTU          AutoMTU
+	Capture          string
 	Login            string
 	Password         string
 
+	// TargetHosts keeps the host names of Targets() from before
+	// ResolveEndpoints replaced them with addresses, so the obfuscator can
+	// re-resolve them. An entry is empty for a target given as an address.
+	TargetHosts []string
+
 	RxBytes Bytes
 	TxBytes Bytes
+	Stats   *phobos.UDPProxyStats
 
 	Comments       SectionComments
 	Socks5Comments SectionComments
@@ -75,6 +122,16 @@ type Obfuscation struct {
 
 const Socks5TunnelMTU = 1500
 
+const (
+	// DefaultPathMTU is the path MTU EffectiveMTU fits the tunnel under,
+	// that of Ethernet.
+	DefaultPathMTU = 1500
+	// DefaultMTU is what WireGuard runs an interface at when none is set:
+	// DefaultPathMTU less an IPv6 and a UDP header and WireGuard's own 32
+	// bytes.
+	DefaultMTU = 1420
+)
+
 var (
 	Socks5TunnelAddresses = []netip.Prefix{
 		netip.MustParsePrefix("10.42.0.2/32"),
@@ -102,20 +159,371 @@ func (conf *Config) IsSocks5() bool {
 	return conf.Obfuscation != nil && conf.Obfuscation.Mode == ObfuscationModeSocks5
 }
 
+// EffectiveMTU is the largest tunnel MTU whose packets still fit
+// DefaultPathMTU once each attached instance has masked them, or the
+// configured MTU when that is lower. A SOCKS5 tunnel carries no WireGuard
+// packets, so its MTU stands.
+func (conf *Config) EffectiveMTU() uint16 {
+	return conf.FitMTU(DefaultPathMTU)
+}
+
+// FitMTU is EffectiveMTU for a path MTU of pathMTU.
+func (conf *Config) FitMTU(pathMTU int) uint16 {
+	mtu := conf.Interface.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	if conf.IsSocks5() {
+		return mtu
+	}
+	overhead := DefaultPathMTU - DefaultMTU
+	for i := range conf.Peers {
+		if o := conf.Peers[i].Obfuscation; o != nil {
+			overhead = max(overhead, DefaultPathMTU-DefaultMTU+o.Overhead())
+		}
+	}
+	return uint16(max(min(int(mtu), pathMTU-overhead), 0))
+}
+
+// AutoMTU reports how an attached instance asks for the interface MTU to be
+// fitted, the most thorough way any of them does.
+func (conf *Config) AutoMTU() AutoMTU {
+	autoMTU := AutoMTUOff
+	for i := range conf.Peers {
+		if o := conf.Peers[i].Obfuscation; o != nil {
+			autoMTU = max(autoMTU, o.AutoMTU)
+		}
+	}
+	return autoMTU
+}
+
+func (conf *Config) warnAboutMTU() {
+	for i := range conf.Peers {
+		o := conf.Peers[i].Obfuscation
+		if o == nil || o.Padding.Mode == phobos.PaddingNone || len(o.Padding.Sizes) == 0 {
+			continue
+		}
+		if size := slices.Max(o.Padding.Sizes); size > phobos.DefaultPaddingMTU {
+			conf.Warnings = append(conf.Warnings, l18n.Sprintf("Padding size %s exceeds the %s bytes a path MTU of %s carries; packets are padded no further than the path allows", strconv.Itoa(size), strconv.Itoa(phobos.DefaultPaddingMTU), strconv.Itoa(DefaultPathMTU)))
+			break
+		}
+	}
+	if conf.Interface.MTU == 0 || conf.AutoMTU() != AutoMTUOff {
+		return
+	}
+	if effective := conf.EffectiveMTU(); conf.Interface.MTU > effective {
+		conf.Warnings = append(conf.Warnings, l18n.Sprintf("MTU %s with obfuscation overhead exceeds the path MTU of %s; use %s or less, or set auto-mtu", strconv.Itoa(int(conf.Interface.MTU)), strconv.Itoa(DefaultPathMTU), strconv.Itoa(int(effective))))
+	}
+}
+
 func (conf *Config) applySocks5InterfaceDefaults() {
 	conf.Interface.Addresses = slices.Clone(Socks5TunnelAddresses)
 	conf.Interface.DNS = slices.Clone(Socks5TunnelDNS)
 	conf.Interface.MTU = Socks5TunnelMTU
 }
 
+// Targets lists the primary target followed by the fallbacks, in the order
+// the obfuscator tries them.
+func (o *Obfuscation) Targets() []Endpoint {
+	return append([]Endpoint{o.Target}, o.FallbackTargets...)
+}
+
+// TargetLastPorts lists the last port of each target's range, zero for a
+// target with a single port, in the order of Targets.
+func (o *Obfuscation) TargetLastPorts() []uint16 {
+	ports := make([]uint16, 0, 1+len(o.FallbackTargets))
+	for _, target := range o.Targets() {
+		ports = append(ports, target.LastPort)
+	}
+	return ports
+}
+
+func (o *Obfuscation) TargetsString() string {
+	targets := make([]string, 0, 1+len(o.FallbackTargets))
+	for _, target := range o.Targets() {
+		targets = append(targets, target.String())
+	}
+	return strings.Join(targets, ", ")
+}
+
+// PreviousKey is an obfuscation key the server may still use after the
+// preset was rotated, accepted until Expires.
+type PreviousKey struct {
+	Key     string
+	Expires time.Time
+}
+
+func (k PreviousKey) String() string {
+	expires := k.Expires.UTC()
+	if expires.Equal(expires.Truncate(24 * time.Hour)) {
+		return k.Key + " " + expires.Format(time.DateOnly)
+	}
+	return k.Key + " " + expires.Format(time.RFC3339)
+}
+
+func (o *Obfuscation) PreviousKeysString() string {
+	keys := make([]string, 0, len(o.PreviousKeys))
+	for _, key := range o.PreviousKeys {
+		keys = append(keys, key.String())
+	}
+	return strings.Join(keys, ", ")
+}
+
+func (o *Obfuscation) PreviousKeyParams() []phobos.PreviousKey {
+	keys := make([]phobos.PreviousKey, 0, len(o.PreviousKeys))
+	for _, key := range o.PreviousKeys {
+		keys = append(keys, phobos.PreviousKey{Key: []byte(key.Key), Expires: key.Expires})
+	}
+	return keys
+}
+
+// resolvesOwnTargets reports whether o names a resolver other than the
+// system one, which then looks up its targets in place of the system
+// resolver.
+func (o *Obfuscation) resolvesOwnTargets() bool {
+	resolver, err := phobos.NewResolver(o.Resolver, nil)
+	return err == nil && resolver != phobos.SystemResolver
+}
+
+// resolveEndpoints resolves the named endpoints of config with resolve.
+// Obfuscator targets with a resolver of their own are left named for the
+// obfuscator to look up, and so is the endpoint of their peer, which the
+// obfuscator's listener replaces, so that the system resolver never sees
+// those names.
+func (config *Config) resolveEndpoints(resolve func(*Endpoint) error) error {
+	for i := range config.Peers {
+		o := config.Peers[i].Obfuscation
+		if o == nil || !o.resolvesOwnTargets() {
+			if err := resolve(&config.Peers[i].Endpoint); err != nil {
+				return err
+			}
+		}
+		if o != nil {
+			if err := o.resolveTargets(resolve); err != nil {
+				return err
+			}
+		}
+	}
+	if config.Obfuscation != nil {
+		return config.Obfuscation.resolveTargets(resolve)
+	}
+	return nil
+}
+
+func (o *Obfuscation) resolveTargets(resolve func(*Endpoint) error) error {
+	o.rememberTargetHosts()
+	if o.resolvesOwnTargets() {
+		return nil
+	}
+	if err := resolve(&o.Target); err != nil {
+		return err
+	}
+	for j := range o.FallbackTargets {
+		if err := resolve(&o.FallbackTargets[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Obfuscation) rememberTargetHosts() {
+	o.TargetHosts = o.TargetHosts[:0]
+	for _, target := range o.Targets() {
+		host := ""
+		if _, err := netip.ParseAddr(target.Host); err != nil && !target.IsEmpty() {
+			single := Endpoint{Host: target.Host, Port: target.Port}
+			host = single.String()
+		}
+		o.TargetHosts = append(o.TargetHosts, host)
+	}
+}
+
+// PaddingSizesString formats the padding sizes as padding-sizes takes them,
+// with a ":weight" suffix where a distribution weight is not 1.
+func (o *Obfuscation) PaddingSizesString() string {
+	sizes := make([]string, 0, len(o.Padding.Sizes))
+	for i, size := range o.Padding.Sizes {
+		entry := strconv.Itoa(size)
+		if i < len(o.Padding.Weights) && o.Padding.Weights[i] != 1 {
+			entry += ":" + strconv.Itoa(o.Padding.Weights[i])
+		}
+		sizes = append(sizes, entry)
+	}
+	return strings.Join(sizes, ", ")
+}
+
+// Overhead is how many bytes o adds to the largest WireGuard packets, that
+// of the masking header. The obfuscator's dummy data never takes a packet
+// past 1024 bytes, and the proxy caps padding at the largest UDP payload
+// the path carries, so neither grows them past the path MTU.
+func (o *Obfuscation) Overhead() int {
+	return phobos.WrapOverhead(o.Masking, o.MediaParams())
+}
+
 func (o *Obfuscation) MediaParams() phobos.MediaParams {
-	params := phobos.MediaParams{PayloadType: o.MediaPayloadType, SSRC: o.MediaSSRC}
+	params := phobos.MediaParams{PayloadType: o.MediaPayloadType, SSRC: o.MediaSSRC, Profile: o.MediaProfile}
 	if o.MediaClock > 0 {
 		params.TimestampStep = uint16(90000 / uint32(o.MediaClock))
 	}
 	return params
 }
 
+// DiagnoseConfig is what phobos.Diagnose needs to probe the server of o.
+// The WireGuard keys of a UDP instance are the caller's to fill in.
+func (o *Obfuscation) DiagnoseConfig() (phobos.DiagnoseConfig, error) {
+	resolver, err := phobos.NewResolver(o.Resolver, nil)
+	if err != nil {
+		return phobos.DiagnoseConfig{}, err
+	}
+	target := Endpoint{Host: o.Target.Host, Port: o.Target.Port}
+	return phobos.DiagnoseConfig{
+		Socks5:         o.Mode == ObfuscationModeSocks5,
+		Target:         target.String(),
+		TargetLastPort: o.Target.LastPort,
+		Resolver:       resolver,
+		Key:            []byte(o.Key),
+		Masking:        o.Masking,
+		Media:          o.MediaParams(),
+		ObfuscateBytes: int(o.ObfuscateBytes),
+		Login:          o.Login,
+		Password:       o.Password,
+	}, nil
+}
+
+// UDPProxyConfig is what phobos.NewUDPProxy needs to carry a peer through
+// o, and what a running proxy is moved to by Reconfigure once o changes.
+// control binds the sockets of the resolver. The socket control of the
+// proxy itself, its capture, its logging and its path MTU callback are the
+// caller's to fill in.
+func (o *Obfuscation) UDPProxyConfig(control phobos.SocketControl) (phobos.UDPProxyConfig, error) {
+	target, err := obfuscatorTarget(&o.Target)
+	if err != nil {
+		return phobos.UDPProxyConfig{}, err
+	}
+	fallbacks := make([]netip.AddrPort, 0, len(o.FallbackTargets))
+	for i := range o.FallbackTargets {
+		fallback, err := obfuscatorTarget(&o.FallbackTargets[i])
+		if err != nil {
+			return phobos.UDPProxyConfig{}, err
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+	resolver, err := phobos.NewResolver(o.Resolver, control)
+	if err != nil {
+		return phobos.UDPProxyConfig{}, err
+	}
+	var pathMTUInterval time.Duration
+	if o.AutoMTU == AutoMTUProbe {
+		pathMTUInterval = phobos.DefaultPathMTUInterval
+	}
+	return phobos.UDPProxyConfig{
+		Target:          target,
+		FallbackTargets: fallbacks,
+		FailoverTimeout: time.Duration(o.FailoverTimeout) * time.Second,
+		PortHopInterval: time.Duration(o.PortHopInterval) * time.Second,
+		PortHopSilence:  time.Duration(o.PortHopSilence) * time.Second,
+		TargetLastPorts: o.TargetLastPorts(),
+		TargetHosts:     o.TargetHosts,
+		Resolver:        resolver,
+		ResolveInterval: time.Duration(o.ResolveInterval) * time.Second,
+		Key:             []byte(o.Key),
+		PreviousKeys:    o.PreviousKeyParams(),
+		Masking:         o.Masking,
+		Media:           o.MediaParams(),
+		MaxDummy:        int(o.MaxDummy),
+		ObfuscateBytes:  int(o.ObfuscateBytes),
+		Padding:         o.Padding,
+		CoverBudget:     int(o.CoverTraffic) * 1000 / 8,
+		PathMTUInterval: pathMTUInterval,
+	}, nil
+}
+
+// Socks5Config is UDPProxyConfig for the SOCKS5 client of a SOCKS5 mode
+// instance. Its socket control, capture and logging are the caller's.
+func (o *Obfuscation) Socks5Config(control phobos.SocketControl) (phobos.Socks5Config, error) {
+	target, err := obfuscatorTarget(&o.Target)
+	if err != nil {
+		return phobos.Socks5Config{}, err
+	}
+	resolver, err := phobos.NewResolver(o.Resolver, control)
+	if err != nil {
+		return phobos.Socks5Config{}, err
+	}
+	var targetHost string
+	if len(o.TargetHosts) > 0 {
+		targetHost = o.TargetHosts[0]
+	}
+	return phobos.Socks5Config{
+		Target:          target,
+		TargetHost:      targetHost,
+		Resolver:        resolver,
+		ResolveInterval: time.Duration(o.ResolveInterval) * time.Second,
+		Key:             []byte(o.Key),
+		PreviousKeys:    o.PreviousKeyParams(),
+		Masking:         o.Masking,
+		Media:           o.MediaParams(),
+		Login:           o.Login,
+		Password:        o.Password,
+		ListenPort:      o.SourceListenPort,
+	}, nil
+}
+
+// obfuscatorTarget returns the address of a resolved obfuscator target, or
+// the zero address for one left named for the obfuscator's own resolver,
+// which looks it up at Start from TargetHosts.
+func obfuscatorTarget(endpoint *Endpoint) (netip.AddrPort, error) {
+	if endpoint.IsEmpty() {
+		return netip.AddrPort{}, fmt.Errorf("obfuscator target is empty")
+	}
+	addr, err := netip.ParseAddr(endpoint.Host)
+	if err != nil {
+		return netip.AddrPort{}, nil
+	}
+	return netip.AddrPortFrom(addr, endpoint.Port), nil
+}
+
+// ReloadsObfuscation reports whether a running tunnel started from old can
+// move to config by handing its obfuscator the new settings, without a
+// restart. That is so when the two differ only in the settings of their
+// instances, and not in those the tunnel is built around: which peers have
+// one, its mode, its local port, its capture file, and how the interface
+// MTU is fitted to its overhead.
+func (config *Config) ReloadsObfuscation(old *Config) bool {
+	if config.Name != old.Name || withoutObfuscation(config) != withoutObfuscation(old) {
+		return false
+	}
+	if !reloadsInstance(config.Obfuscation, old.Obfuscation) {
+		return false
+	}
+	for i := range config.Peers {
+		if !reloadsInstance(config.Peers[i].Obfuscation, old.Peers[i].Obfuscation) {
+			return false
+		}
+	}
+	return true
+}
+
+func reloadsInstance(o, old *Obfuscation) bool {
+	if o == nil || old == nil {
+		return o == old
+	}
+	if o.Mode != old.Mode || o.SourceListenPort != old.SourceListenPort || o.Capture != old.Capture || o.AutoMTU != old.AutoMTU {
+		return false
+	}
+	return o.AutoMTU == AutoMTUOff || o.Overhead() == old.Overhead()
+}
+
+// withoutObfuscation is config in wg-quick form with its instances left out.
+func withoutObfuscation(config *Config) string {
+	stripped := *config
+	stripped.Obfuscation = nil
+	stripped.Peers = slices.Clone(config.Peers)
+	for i := range stripped.Peers {
+		stripped.Peers[i].Obfuscation = nil
+	}
+	return stripped.ToWgQuick()
+}
+
 type Interface struct {
 	PrivateKey Key
 	Addresses  []netip.Prefix
@@ -188,10 +596,14 @@ func (conf *Config) IntersectsWith(other *Config) bool {
 }
 
 func (e *Endpoint) String() string {
+	port := strconv.Itoa(int(e.Port))
+	if e.LastPort > e.Port {
+		port += "-" + strconv.Itoa(int(e.LastPort))
+	}
 	if strings.IndexByte(e.Host, ':') != -1 {
-		return fmt.Sprintf("[%s]:%d", e.Host, e.Port)
+		return fmt.Sprintf("[%s]:%s", e.Host, port)
 	}
-	return fmt.Sprintf("%s:%d", e.Host, e.Port)
+	return fmt.Sprintf("%s:%s", e.Host, port)
 }
 
 func (e *Endpoint) IsEmpty() bool {
@@ -336,6 +748,7 @@ func (conf *Config) DeduplicateNetworkEntries() {
 
 func (o *Obfuscation) redact() {
 	o.Key = ""
+	o.PreviousKeys = nil
 	o.Login = ""
 	o.Password = ""
 	o.Comments = SectionComments{}
@@ -95,20 +95,5 @@ func resolveEndpoint(endpoint *Endpoint) error {
 }
 
 func (config *Config) ResolveEndpoints() error {
-	for i := range config.Peers {
-		if err := resolveEndpoint(&config.Peers[i].Endpoint); err != nil {
-			return err
-		}
-		if o := config.Peers[i].Obfuscation; o != nil {
-			if err := resolveEndpoint(&o.Target); err != nil {
-				return err
-			}
-		}
-	}
-	if config.Obfuscation != nil {
-		if err := resolveEndpoint(&config.Obfuscation.Target); err != nil {
-			return err
-		}
-	}
-	return nil
+	return config.resolveEndpoints(resolveEndpoint)
 }
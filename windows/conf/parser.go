@@ -10,6 +10,7 @@ import (
 	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/text/encoding/unicode"
 
@@ -68,7 +69,30 @@ func parseEndpoint(s string) (*Endpoint, error) {
 		}
 		host = host[1 : len(host)-1]
 	}
-	return &Endpoint{host, port}, nil
+	return &Endpoint{Host: host, Port: port}, nil
+}
+
+// parseTargetEndpoint parses an obfuscator target, which may publish a
+// range of ports, as in host:51822-51861.
+func parseTargetEndpoint(s string) (*Endpoint, error) {
+	i := strings.LastIndexByte(s, ':')
+	dash := strings.IndexByte(s[i+1:], '-')
+	if i < 0 || dash < 0 {
+		return parseEndpoint(s)
+	}
+	e, err := parseEndpoint(s[:i+1+dash])
+	if err != nil {
+		return nil, err
+	}
+	last, err := parsePort(s[i+2+dash:])
+	if err != nil {
+		return nil, err
+	}
+	if last <= e.Port {
+		return nil, &ParseError{l18n.Sprintf("Invalid port range"), s[i+1:]}
+	}
+	e.LastPort = last
+	return e, nil
 }
 
 func parseMTU(s string) (uint16, error) {
@@ -117,6 +141,18 @@ func parseTableOff(s string) (bool, error) {
 	return false, err
 }
 
+func parseAutoMTU(s string) (AutoMTU, error) {
+	switch strings.ToLower(s) {
+	case "on":
+		return AutoMTUOn, nil
+	case "probe":
+		return AutoMTUProbe, nil
+	case "off":
+		return AutoMTUOff, nil
+	}
+	return AutoMTUOff, &ParseError{l18n.Sprintf("Invalid auto-mtu"), s}
+}
+
 func parseKeyBase64(s string) (*Key, error) {
 	k, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
@@ -162,7 +198,7 @@ func parseObfuscationMode(s string) (ObfuscationMode, error) {
 
 func parseMasking(s string) (phobos.Masking, error) {
 	masking, ok := phobos.ParseMasking(s)
-	if !ok && !strings.EqualFold(strings.TrimSpace(s), "auto") {
+	if !ok {
 		return 0, &ParseError{l18n.Sprintf("Invalid masking type"), s}
 	}
 	return masking, nil
@@ -180,6 +216,54 @@ func parseMediaSSRC(s string) (uint32, error) {
 	return uint32(v), nil
 }
 
+func parsePreviousKeys(s string) ([]PreviousKey, error) {
+	entries, err := splitList(s)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]PreviousKey, 0, len(entries))
+	for _, entry := range entries {
+		key, expiry, ok := strings.Cut(entry, " ")
+		if !ok {
+			return nil, &ParseError{l18n.Sprintf("A previous key needs an expiry time"), entry}
+		}
+		expiry = strings.TrimSpace(expiry)
+		expires, err := time.Parse(time.RFC3339, expiry)
+		if err != nil {
+			expires, err = time.Parse(time.DateOnly, expiry)
+		}
+		if err != nil {
+			return nil, &ParseError{l18n.Sprintf("Invalid expiry time"), expiry}
+		}
+		keys = append(keys, PreviousKey{Key: key, Expires: expires})
+	}
+	return keys, nil
+}
+
+func parsePaddingSizes(s string) ([]int, []int, error) {
+	entries, err := splitList(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sizes, weights []int
+	for _, entry := range entries {
+		size, weight, weighted := strings.Cut(entry, ":")
+		v, err := strconv.ParseUint(strings.TrimSpace(size), 10, 16)
+		if err != nil || v == 0 {
+			return nil, nil, &ParseError{l18n.Sprintf("Invalid padding size"), entry}
+		}
+		w := uint64(1)
+		if weighted {
+			if w, err = strconv.ParseUint(strings.TrimSpace(weight), 10, 16); err != nil || w == 0 {
+				return nil, nil, &ParseError{l18n.Sprintf("Invalid padding weight"), entry}
+			}
+		}
+		sizes = append(sizes, int(v))
+		weights = append(weights, int(w))
+	}
+	return sizes, weights, nil
+}
+
 type parserState int
 
 const (
@@ -203,6 +287,34 @@ func (o *Obfuscation) validate() error {
 	if len(o.Key) == 0 {
 		return &ParseError{l18n.Sprintf("An obfuscator instance must have a key"), l18n.Sprintf("[none specified]")}
 	}
+	if o.Mode == ObfuscationModeSocks5 && len(o.FallbackTargets) > 0 {
+		return &ParseError{l18n.Sprintf("Fallback targets are only available in WireGuard mode"), o.TargetsString()}
+	}
+	if o.Mode == ObfuscationModeSocks5 && o.Target.LastPort > 0 {
+		return &ParseError{l18n.Sprintf("Port ranges are only available in WireGuard mode"), o.Target.String()}
+	}
+	if o.Mode == ObfuscationModeSocks5 && (o.PortHopInterval > 0 || o.PortHopSilence > 0) {
+		return &ParseError{l18n.Sprintf("Port hopping is only available in WireGuard mode"), "socks5"}
+	}
+	// No SOCKS5 server speaks TURN yet, so the client must not offer it.
+	if o.Mode == ObfuscationModeSocks5 && (!o.Masking.Stream() || o.Masking == phobos.MaskingTURN) {
+		return &ParseError{l18n.Sprintf("%s masking is only available in WireGuard mode", o.Masking), o.Masking.String()}
+	}
+	if o.Mode == ObfuscationModeWireGuard && !o.Masking.Datagram() {
+		return &ParseError{l18n.Sprintf("%s masking is only available in SOCKS5 mode", o.Masking), o.Masking.String()}
+	}
+	if o.Mode == ObfuscationModeSocks5 && (o.Padding.Mode != phobos.PaddingNone || len(o.Padding.Sizes) > 0) {
+		return &ParseError{l18n.Sprintf("Padding is only available in WireGuard mode"), o.Padding.Mode.String()}
+	}
+	if err := o.Padding.Validate(); err != nil {
+		return &ParseError{l18n.Sprintf("Invalid padding sizes for %s", o.Padding.Mode), o.PaddingSizesString()}
+	}
+	if o.MediaProfile != phobos.MediaProfileRTP && (o.Mode == ObfuscationModeSocks5 || (o.Masking != phobos.MaskingMEDIA && o.Masking != phobos.MaskingAuto)) {
+		return &ParseError{l18n.Sprintf("The %s media profile needs MEDIA masking in WireGuard mode", o.MediaProfile), o.Masking.String()}
+	}
+	if o.CoverTraffic > 0 && (o.Mode == ObfuscationModeSocks5 || (o.Masking != phobos.MaskingMEDIA && o.Masking != phobos.MaskingAuto)) {
+		return &ParseError{l18n.Sprintf("Cover traffic needs MEDIA masking in WireGuard mode"), o.Masking.String()}
+	}
 	return nil
 }
 
@@ -490,13 +602,59 @@ func FromWgQuick(s, name string) (*Config, error) {
 				}
 				obfuscation.SourceListenPort = p
 			case "target":
-				e, err := parseEndpoint(val)
+				targets, err := splitList(val)
+				if err != nil {
+					return nil, err
+				}
+				obfuscation.FallbackTargets = nil
+				for i, target := range targets {
+					e, err := parseTargetEndpoint(target)
+					if err != nil {
+						return nil, err
+					}
+					if i == 0 {
+						obfuscation.Target = *e
+					} else {
+						obfuscation.FallbackTargets = append(obfuscation.FallbackTargets, *e)
+					}
+				}
+			case "failover-timeout":
+				t, err := parseUint16(val, "failover-timeout")
+				if err != nil {
+					return nil, err
+				}
+				obfuscation.FailoverTimeout = t
+			case "port-hop-interval":
+				t, err := parseUint16(val, "port-hop-interval")
+				if err != nil {
+					return nil, err
+				}
+				obfuscation.PortHopInterval = t
+			case "port-hop-silence":
+				t, err := parseUint16(val, "port-hop-silence")
 				if err != nil {
 					return nil, err
 				}
-				obfuscation.Target = *e
+				obfuscation.PortHopSilence = t
+			case "resolver":
+				if _, err := phobos.NewResolver(val, nil); err != nil {
+					return nil, &ParseError{l18n.Sprintf("Invalid resolver"), val}
+				}
+				obfuscation.Resolver = val
+			case "resolve-interval":
+				t, err := parseUint16(val, "resolve-interval")
+				if err != nil {
+					return nil, err
+				}
+				obfuscation.ResolveInterval = t
 			case "key":
 				obfuscation.Key = val
+			case "previous-keys":
+				keys, err := parsePreviousKeys(val)
+				if err != nil {
+					return nil, err
+				}
+				obfuscation.PreviousKeys = keys
 			case "masking":
 				m, err := parseMasking(val)
 				if err != nil {
@@ -518,6 +676,24 @@ func FromWgQuick(s, name string) (*Config, error) {
 					return nil, err
 				}
 				obfuscation.MaxDummy = d
+			case "padding":
+				mode, ok := phobos.ParsePaddingMode(val)
+				if !ok {
+					return nil, &ParseError{l18n.Sprintf("Invalid padding mode"), val}
+				}
+				obfuscation.Padding.Mode = mode
+			case "padding-sizes":
+				sizes, weights, err := parsePaddingSizes(val)
+				if err != nil {
+					return nil, err
+				}
+				obfuscation.Padding.Sizes, obfuscation.Padding.Weights = sizes, weights
+			case "auto-mtu":
+				autoMTU, err := parseAutoMTU(val)
+				if err != nil {
+					return nil, err
+				}
+				obfuscation.AutoMTU = autoMTU
 			case "media-pt":
 				pt, err := strconv.ParseUint(val, 10, 8)
 				if err != nil || pt > 127 {
@@ -536,6 +712,20 @@ func FromWgQuick(s, name string) (*Config, error) {
 					return nil, &ParseError{l18n.Sprintf("Invalid media clock"), val}
 				}
 				obfuscation.MediaClock = clock
+			case "media-profile":
+				profile, ok := phobos.ParseMediaProfile(val)
+				if !ok {
+					return nil, &ParseError{l18n.Sprintf("Invalid media profile"), val}
+				}
+				obfuscation.MediaProfile = profile
+			case "cover-traffic":
+				rate, err := parseUint16(val, "cover-traffic")
+				if err != nil {
+					return nil, err
+				}
+				obfuscation.CoverTraffic = rate
+			case "capture":
+				obfuscation.Capture = val
 			case "source-if", "verbose", "idle-timeout", "max-clients", "threads",
 				"fwmark", "static-bindings", "socks5-users", "socks5-stats":
 			default:
@@ -613,6 +803,7 @@ func FromWgQuick(s, name string) (*Config, error) {
 			return nil, &ParseError{l18n.Sprintf("All peers must have public keys"), l18n.Sprintf("[none specified]")}
 		}
 	}
+	conf.warnAboutMTU()
 
 	return &conf, nil
 }
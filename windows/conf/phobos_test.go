@@ -6,10 +6,15 @@
 package conf
 
 import (
+	"bytes"
+	"net"
+	"net/netip"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.zx2c4.com/wireguard/windows/phobos"
 )
@@ -239,12 +244,14 @@ masking = none
 func TestObfuscationRejectsBadInput(t *testing.T) {
 	cases := map[string]string{
 		"unknown key":     strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dumy = 4", 1),
-		"bad masking":     strings.Replace(wireGuardModeConfig, "masking = MEDIA", "masking = quic", 1),
+		"bad masking":     strings.Replace(wireGuardModeConfig, "masking = MEDIA", "masking = sctp", 1),
 		"server role":     strings.Replace(socks5ModeConfig, "role = client", "role = server", 1),
 		"missing target":  strings.Replace(wireGuardModeConfig, "target = vpn.example.com:51823\n", "", 1),
 		"missing key":     strings.Replace(wireGuardModeConfig, "key = Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=\n", "", 1),
 		"socks5 key":      strings.Replace(socks5ModeConfig, "login = phobos-user", "user = phobos-user", 1),
 		"orphan instance": strings.Replace(wireGuardModeConfig, "masking = MEDIA", "mode = socks5", 1),
+		"socks5 quic":     strings.Replace(socks5ModeConfig, "masking = STUN", "masking = QUIC", 1),
+		"socks5 turn":     strings.Replace(socks5ModeConfig, "masking = STUN", "masking = TURN", 1),
 	}
 	for name, text := range cases {
 		if _, err := FromWgQuick(text, "test"); err == nil {
@@ -271,3 +278,515 @@ func TestRedactClearsObfuscationSecrets(t *testing.T) {
 		t.Fatal("redaction must keep the target")
 	}
 }
+
+func TestAutoMaskingSurvivesRoundTrip(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "masking = MEDIA", "masking = auto", 1)
+	config := parseConfig(t, text)
+	if got := config.Peers[0].Obfuscation.Masking; got != phobos.MaskingAuto {
+		t.Fatalf("masking = %v, want AUTO", got)
+	}
+	serialized := config.ToWgQuick()
+	if !strings.Contains(serialized, "masking = AUTO") {
+		t.Fatalf("AUTO masking lost on serialization:\n%s", serialized)
+	}
+}
+
+func TestTURNMaskingSurvivesRoundTrip(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "masking = MEDIA", "masking = turn", 1)
+	config := parseConfig(t, text)
+	if got := config.Peers[0].Obfuscation.Masking; got != phobos.MaskingTURN {
+		t.Fatalf("masking = %v, want TURN", got)
+	}
+	if serialized := config.ToWgQuick(); !strings.Contains(serialized, "masking = TURN") {
+		t.Fatalf("TURN masking lost on serialization:\n%s", serialized)
+	}
+}
+
+// datagramOnlyMasking stands for a masking registered by another package
+// that has no SOCKS5 framing.
+var datagramOnlyMasking, _ = phobos.RegisterMasking("datagram-only", func(phobos.MediaParams) phobos.Masker { return nil }, nil)
+
+func TestRegisteredMaskingSurvivesRoundTrip(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "masking = MEDIA", "masking = Datagram-Only", 1)
+	config := parseConfig(t, text)
+	if got := config.Peers[0].Obfuscation.Masking; got != datagramOnlyMasking {
+		t.Fatalf("masking = %v, want %v", got, datagramOnlyMasking)
+	}
+	if serialized := config.ToWgQuick(); !strings.Contains(serialized, "masking = datagram-only") {
+		t.Fatalf("registered masking lost on serialization:\n%s", serialized)
+	}
+	text = strings.Replace(socks5ModeConfig, "masking = STUN", "masking = datagram-only", 1)
+	if _, err := FromWgQuick(text, "test"); err == nil {
+		t.Fatal("a masking without stream framing must be rejected in SOCKS5 mode")
+	}
+}
+
+func TestObfuscationFallbackTargets(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "target = vpn.example.com:51823",
+		"target = vpn.example.com:51823, [2001:db8::7]:51830,backup.example.net:443\nfailover-timeout = 20", 1)
+	config := parseConfig(t, text)
+	o := config.Peers[0].Obfuscation
+	want := []Endpoint{{Host: "vpn.example.com", Port: 51823}, {Host: "2001:db8::7", Port: 51830}, {Host: "backup.example.net", Port: 443}}
+	if got := o.Targets(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("targets = %v, want %v", got, want)
+	}
+	if o.FailoverTimeout != 20 {
+		t.Fatalf("failover-timeout = %d", o.FailoverTimeout)
+	}
+	serialized := config.ToWgQuick()
+	if !strings.Contains(serialized, "target = vpn.example.com:51823, [2001:db8::7]:51830, backup.example.net:443\n") {
+		t.Fatalf("targets lost on serialization:\n%s", serialized)
+	}
+	if again := parseConfig(t, serialized).ToWgQuick(); again != serialized {
+		t.Fatalf("round trip is not stable:\n%s\n---\n%s", serialized, again)
+	}
+
+	socks5 := strings.Replace(socks5ModeConfig, "target = vpn.example.com:51824", "target = vpn.example.com:51824, backup.example.net:51824", 1)
+	if _, err := FromWgQuick(socks5, "test"); err == nil {
+		t.Fatal("a SOCKS5 instance must not accept fallback targets")
+	}
+	if _, err := FromWgQuick(strings.Replace(wireGuardModeConfig, "target = vpn.example.com:51823", "target = vpn.example.com:51823,", 1), "test"); err == nil {
+		t.Fatal("a trailing comma in the target list must be rejected")
+	}
+}
+
+func TestObfuscationTargetPortRange(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "target = vpn.example.com:51823", "target = vpn.example.com:51822-51861, [2001:db8::7]:51830", 1)
+	config := parseConfig(t, text)
+	o := config.Peers[0].Obfuscation
+	if o.Target.Port != 51822 || o.Target.LastPort != 51861 || o.FallbackTargets[0].LastPort != 0 {
+		t.Fatalf("targets = %v", o.TargetsString())
+	}
+	if ports := o.TargetLastPorts(); len(ports) != 2 || ports[0] != 51861 || ports[1] != 0 {
+		t.Fatalf("last ports = %v", ports)
+	}
+	if serialized := config.ToWgQuick(); !strings.Contains(serialized, "target = vpn.example.com:51822-51861, [2001:db8::7]:51830\n") {
+		t.Fatalf("port range lost on serialization:\n%s", serialized)
+	}
+	o.rememberTargetHosts()
+	if o.TargetHosts[0] != "vpn.example.com:51822" {
+		t.Fatalf("target host %q must name the first port only", o.TargetHosts[0])
+	}
+	for name, bad := range map[string]string{
+		"reversed":   strings.Replace(text, "51822-51861", "51861-51822", 1),
+		"open ended": strings.Replace(text, "51822-51861", "51822-", 1),
+		"too high":   strings.Replace(text, "51822-51861", "51822-70000", 1),
+		"SOCKS5":     strings.Replace(socks5ModeConfig, "target = vpn.example.com:51824", "target = vpn.example.com:51824-51830", 1),
+	} {
+		if _, err := FromWgQuick(bad, "test"); err == nil {
+			t.Errorf("%s: expected a parse error", name)
+		}
+	}
+}
+
+func TestObfuscationResolverSettings(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "target = vpn.example.com:51823",
+		"target = vpn.example.com:51823, 192.0.2.7:51823\nresolver = https://1.1.1.1/dns-query\nresolve-interval = 120", 1)
+	config := parseConfig(t, text)
+	o := config.Peers[0].Obfuscation
+	if o.Resolver != "https://1.1.1.1/dns-query" || o.ResolveInterval != 120 {
+		t.Fatalf("resolver settings = %q, %d", o.Resolver, o.ResolveInterval)
+	}
+	serialized := config.ToWgQuick()
+	if !strings.Contains(serialized, "resolver = https://1.1.1.1/dns-query\nresolve-interval = 120\n") {
+		t.Fatalf("resolver settings lost on serialization:\n%s", serialized)
+	}
+
+	o.rememberTargetHosts()
+	if want := []string{"vpn.example.com:51823", ""}; !reflect.DeepEqual(o.TargetHosts, want) {
+		t.Fatalf("target hosts = %q, want %q", o.TargetHosts, want)
+	}
+
+	if _, err := FromWgQuick(strings.Replace(text, "https://1.1.1.1/dns-query", "8.8.8.8", 1), "test"); err == nil {
+		t.Fatal("a resolver that is neither system nor an https URL must be rejected")
+	}
+}
+
+func TestResolveEndpointsLeavesTargetsToOwnResolver(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "target = vpn.example.com:51823",
+		"target = vpn.example.com:51823, backup.example.com:51823\nresolver = https://1.1.1.1/dns-query", 1)
+	text = strings.Replace(text, "Endpoint = 127.0.0.1:51822", "Endpoint = vpn.example.com:51822", 1)
+	config := parseConfig(t, text)
+	err := config.resolveEndpoints(func(e *Endpoint) error {
+		if _, err := netip.ParseAddr(e.Host); err != nil && !e.IsEmpty() {
+			t.Fatalf("system resolver asked for %s", e.Host)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to resolve endpoints: %v", err)
+	}
+	o := config.Peers[0].Obfuscation
+	if want := []string{"vpn.example.com:51823", "backup.example.com:51823"}; !reflect.DeepEqual(o.TargetHosts, want) {
+		t.Fatalf("target hosts = %q, want %q", o.TargetHosts, want)
+	}
+
+	config = parseConfig(t, strings.Replace(text, "resolver = https://1.1.1.1/dns-query", "resolver = system", 1))
+	var asked []string
+	config.resolveEndpoints(func(e *Endpoint) error {
+		if !e.IsEmpty() {
+			asked = append(asked, e.Host)
+		}
+		return nil
+	})
+	if want := []string{"vpn.example.com", "vpn.example.com", "backup.example.com"}; !reflect.DeepEqual(asked, want) {
+		t.Fatalf("system resolver asked for %q, want %q", asked, want)
+	}
+}
+
+func TestReloadsObfuscation(t *testing.T) {
+	running := parseConfig(t, wireGuardModeConfig)
+	cases := []struct {
+		name    string
+		from    string
+		to      string
+		reloads bool
+	}{
+		{"unchanged", "", "", true},
+		{"masking", "masking = MEDIA", "masking = STUN", true},
+		{"target", "target = vpn.example.com:51823", "target = vpn.example.com:51900", true},
+		{"key", "key = Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=", "key = 9yOqxYRAblK3xNPuTE9gCvHMDZzvUeOkKb+QqbF8SLI=", true},
+		{"local port", "source-lport = 51822", "source-lport = 51830", false},
+		{"capture", "verbose = 2", "verbose = 2\ncapture = C:\\phobos.pcap", false},
+		{"auto mtu", "verbose = 2", "verbose = 2\nauto-mtu = on", false},
+		{"allowed ips", "AllowedIPs = 0.0.0.0/0, ::/0", "AllowedIPs = 0.0.0.0/0", false},
+		{"address", "Address = 10.8.0.2/32", "Address = 10.8.0.3/32", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := parseConfig(t, strings.Replace(wireGuardModeConfig, tc.from, tc.to, 1))
+			if reloads := config.ReloadsObfuscation(running); reloads != tc.reloads {
+				t.Fatalf("reloads = %v, want %v", reloads, tc.reloads)
+			}
+		})
+	}
+
+	withAutoMTU := parseConfig(t, strings.Replace(wireGuardModeConfig, "verbose = 2", "verbose = 2\nauto-mtu = on", 1))
+	config := parseConfig(t, strings.Replace(withAutoMTU.ToWgQuick(), "masking = MEDIA", "masking = STUN", 1))
+	if config.ReloadsObfuscation(withAutoMTU) {
+		t.Fatalf("reloads a masking with another overhead under auto-mtu")
+	}
+}
+
+func startObfuscationServer(t *testing.T, o *Obfuscation, forward netip.AddrPort) *phobos.UDPServer {
+	t.Helper()
+	server := phobos.NewUDPServer(phobos.UDPServerConfig{
+		Listen:         netip.MustParseAddrPort("127.0.0.1:0"),
+		Forward:        forward,
+		Key:            []byte(o.Key),
+		Masking:        o.Masking,
+		Media:          o.MediaParams(),
+		MaxDummy:       int(o.MaxDummy),
+		ObfuscateBytes: int(o.ObfuscateBytes),
+		Logf:           t.Logf,
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	return server
+}
+
+func startHandshakeEcho(t *testing.T) netip.AddrPort {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, phobos.BufferSize)
+		for {
+			n, source, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			buf[0] = phobos.TypeHandshakeResponse
+			conn.WriteToUDPAddrPort(buf[:n], source)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestUDPProxyConfigReachesRunningProxy(t *testing.T) {
+	echo := startHandshakeEcho(t)
+	withTarget := func(port uint16, masking string) string {
+		text := strings.Replace(wireGuardModeConfig, "target = vpn.example.com:51823", "target = 127.0.0.1:"+strconv.Itoa(int(port)), 1)
+		return strings.Replace(text, "masking = MEDIA", "masking = "+masking, 1)
+	}
+	first := parseConfig(t, withTarget(0, "MEDIA"))
+	firstServer := startObfuscationServer(t, first.Peers[0].Obfuscation, echo)
+	first = parseConfig(t, withTarget(firstServer.ListenPort(), "MEDIA"))
+	second := parseConfig(t, withTarget(0, "STUN"))
+	secondServer := startObfuscationServer(t, second.Peers[0].Obfuscation, echo)
+	second = parseConfig(t, withTarget(secondServer.ListenPort(), "STUN"))
+
+	proxyConfig, err := first.Peers[0].Obfuscation.UDPProxyConfig(nil)
+	if err != nil {
+		t.Fatalf("unable to build proxy config: %v", err)
+	}
+	proxyConfig.Logf = t.Logf
+	proxy := phobos.NewUDPProxy(proxyConfig)
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	roundTrip := func() {
+		t.Helper()
+		packet := bytes.Repeat([]byte{0x5A}, 148)
+		packet[0], packet[1], packet[2], packet[3] = phobos.TypeHandshake, 0, 0, 0
+		if _, err := client.Write(packet); err != nil {
+			t.Fatalf("unable to send: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, phobos.BufferSize)
+		n, err := client.Read(reply)
+		if err != nil {
+			t.Fatalf("no reply: %v", err)
+		}
+		if reply[0] != phobos.TypeHandshakeResponse || n != len(packet) {
+			t.Fatalf("unexpected reply of %d bytes", n)
+		}
+	}
+	roundTrip()
+
+	if !second.ReloadsObfuscation(first) {
+		t.Fatalf("a new target and masking need a restart")
+	}
+	proxyConfig, err = second.Peers[0].Obfuscation.UDPProxyConfig(nil)
+	if err != nil {
+		t.Fatalf("unable to build proxy config: %v", err)
+	}
+	if err := proxy.Reconfigure(proxyConfig); err != nil {
+		t.Fatalf("unable to reconfigure: %v", err)
+	}
+	firstServer.Stop()
+	roundTrip()
+}
+
+func TestObfuscationPreviousKeys(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "masking = MEDIA",
+		"previous-keys = old-key 2026-12-01, older-key 2026-11-15T12:00:00+03:00\nmasking = MEDIA", 1)
+	config := parseConfig(t, text)
+	o := config.Peers[0].Obfuscation
+	want := []PreviousKey{
+		{"old-key", time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{"older-key", time.Date(2026, 11, 15, 9, 0, 0, 0, time.UTC)},
+	}
+	if len(o.PreviousKeys) != len(want) {
+		t.Fatalf("previous keys = %v, want %v", o.PreviousKeys, want)
+	}
+	for i := range want {
+		if o.PreviousKeys[i].Key != want[i].Key || !o.PreviousKeys[i].Expires.Equal(want[i].Expires) {
+			t.Fatalf("previous key %d = %v, want %v", i, o.PreviousKeys[i], want[i])
+		}
+	}
+	params := o.PreviousKeyParams()
+	if len(params) != 2 || string(params[1].Key) != "older-key" || !params[1].Expires.Equal(want[1].Expires) {
+		t.Fatalf("previous key params = %v", params)
+	}
+
+	serialized := config.ToWgQuick()
+	if !strings.Contains(serialized, "previous-keys = old-key 2026-12-01, older-key 2026-11-15T09:00:00Z\n") {
+		t.Fatalf("previous keys lost on serialization:\n%s", serialized)
+	}
+	if again := parseConfig(t, serialized).ToWgQuick(); again != serialized {
+		t.Fatalf("round trip is not stable:\n%s\n---\n%s", serialized, again)
+	}
+
+	config.Redact()
+	if config.Peers[0].Obfuscation.PreviousKeys != nil {
+		t.Fatal("previous keys survived redaction")
+	}
+
+	for _, bad := range []string{"old-key", "old-key 2026-13-01", "old-key soon", "old-key 2026-12-01,"} {
+		if _, err := FromWgQuick(strings.Replace(wireGuardModeConfig, "masking = MEDIA", "previous-keys = "+bad+"\nmasking = MEDIA", 1), "test"); err == nil {
+			t.Errorf("%q: expected a parse error", bad)
+		}
+	}
+}
+
+func TestObfuscationPadding(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\npadding = distribution\npadding-sizes = 200:2, 600, 1472:5", 1)
+	config := parseConfig(t, text)
+	padding := config.Peers[0].Obfuscation.Padding
+	if padding.Mode != phobos.PaddingDistribution || !reflect.DeepEqual(padding.Sizes, []int{200, 600, 1472}) || !reflect.DeepEqual(padding.Weights, []int{2, 1, 5}) {
+		t.Fatalf("padding = %+v", padding)
+	}
+	serialized := config.ToWgQuick()
+	if !strings.Contains(serialized, "padding = distribution\npadding-sizes = 200:2, 600, 1472:5\n") {
+		t.Fatalf("padding lost on serialization:\n%s", serialized)
+	}
+	if again := parseConfig(t, serialized).ToWgQuick(); again != serialized {
+		t.Fatalf("round trip is not stable:\n%s\n---\n%s", serialized, again)
+	}
+
+	if config := parseConfig(t, strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\npadding = MTU", 1)); config.Peers[0].Obfuscation.Padding.Mode != phobos.PaddingMTU {
+		t.Fatal("padding = MTU was not recognised")
+	}
+	if warnings := config.Warnings; slices.ContainsFunc(warnings, func(w string) bool { return strings.Contains(w, "Padding") }) {
+		t.Fatalf("padding within the path MTU warned: %q", warnings)
+	}
+	oversized := strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\npadding = buckets\npadding-sizes = 256, 2000", 1)
+	if warnings := parseConfig(t, oversized).Warnings; !slices.ContainsFunc(warnings, func(w string) bool { return strings.Contains(w, "2000") }) {
+		t.Fatalf("padding past the path MTU did not warn: %q", warnings)
+	}
+
+	for name, bad := range map[string]string{
+		"unknown mode":       "padding = random",
+		"buckets, no sizes":  "padding = buckets",
+		"descending buckets": "padding = buckets\npadding-sizes = 512, 256",
+		"zero size":          "padding = buckets\npadding-sizes = 0",
+		"zero weight":        "padding = distribution\npadding-sizes = 200:0",
+		"two MTUs":           "padding = mtu\npadding-sizes = 1400, 1472",
+	} {
+		if _, err := FromWgQuick(strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\n"+bad, 1), "test"); err == nil {
+			t.Errorf("%s: expected a parse error", name)
+		}
+	}
+	if _, err := FromWgQuick(strings.Replace(socks5ModeConfig, "masking = STUN", "masking = STUN\npadding = mtu", 1), "test"); err == nil {
+		t.Fatal("a SOCKS5 instance must not accept padding")
+	}
+}
+
+func TestObfuscationCoverTraffic(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\ncover-traffic = 64", 1)
+	config := parseConfig(t, text)
+	if rate := config.Peers[0].Obfuscation.CoverTraffic; rate != 64 {
+		t.Fatalf("cover-traffic = %d", rate)
+	}
+	if serialized := config.ToWgQuick(); !strings.Contains(serialized, "cover-traffic = 64\n") {
+		t.Fatalf("cover-traffic lost on serialization:\n%s", serialized)
+	}
+	auto := strings.Replace(text, "masking = MEDIA", "masking = AUTO", 1)
+	if config := parseConfig(t, auto); config.Peers[0].Obfuscation.CoverTraffic != 64 {
+		t.Fatal("AUTO masking must accept cover traffic")
+	}
+	for name, bad := range map[string]string{
+		"STUN masking": strings.Replace(text, "masking = MEDIA", "masking = STUN", 1),
+		"not a number": strings.Replace(text, "cover-traffic = 64", "cover-traffic = lots", 1),
+		"out of range": strings.Replace(text, "cover-traffic = 64", "cover-traffic = 70000", 1),
+	} {
+		if _, err := FromWgQuick(bad, "test"); err == nil {
+			t.Errorf("%s: expected a parse error", name)
+		}
+	}
+	if _, err := FromWgQuick(strings.Replace(socks5ModeConfig, "masking = STUN", "masking = MEDIA\ncover-traffic = 64", 1), "test"); err == nil {
+		t.Fatal("a SOCKS5 instance must not accept cover traffic")
+	}
+}
+
+func TestObfuscationCapture(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\ncapture = C:\\Users\\Public\\phobos.pcapng", 1)
+	config := parseConfig(t, text)
+	if path := config.Peers[0].Obfuscation.Capture; path != `C:\Users\Public\phobos.pcapng` {
+		t.Fatalf("capture = %q", path)
+	}
+	if serialized := config.ToWgQuick(); !strings.Contains(serialized, "capture = C:\\Users\\Public\\phobos.pcapng\n") {
+		t.Fatalf("capture lost on serialization:\n%s", serialized)
+	}
+	if config := parseConfig(t, wireGuardModeConfig); strings.Contains(config.ToWgQuick(), "capture") {
+		t.Fatal("capture must be opt-in")
+	}
+}
+
+func TestObfuscationPortHopping(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\nport-hop-interval = 120\nport-hop-silence = 10", 1)
+	config := parseConfig(t, text)
+	if o := config.Peers[0].Obfuscation; o.PortHopInterval != 120 || o.PortHopSilence != 10 {
+		t.Fatalf("port hopping = %d/%d", o.PortHopInterval, o.PortHopSilence)
+	}
+	serialized := config.ToWgQuick()
+	if !strings.Contains(serialized, "port-hop-interval = 120\n") || !strings.Contains(serialized, "port-hop-silence = 10\n") {
+		t.Fatalf("port hopping lost on serialization:\n%s", serialized)
+	}
+	if _, err := FromWgQuick(strings.Replace(text, "port-hop-silence = 10", "port-hop-silence = soon", 1), "test"); err == nil {
+		t.Fatal("a non-numeric port-hop-silence must be rejected")
+	}
+	if _, err := FromWgQuick(strings.Replace(socks5ModeConfig, "masking = STUN", "masking = STUN\nport-hop-interval = 120", 1), "test"); err == nil {
+		t.Fatal("a SOCKS5 instance must not accept port hopping")
+	}
+}
+
+func TestObfuscationMediaProfile(t *testing.T) {
+	text := strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\nmedia-profile = WebRTC", 1)
+	config := parseConfig(t, text)
+	if params := config.Peers[0].Obfuscation.MediaParams(); params.Profile != phobos.MediaProfileWebRTC {
+		t.Fatalf("media profile = %v", params.Profile)
+	}
+	if serialized := config.ToWgQuick(); !strings.Contains(serialized, "media-profile = webrtc\n") {
+		t.Fatalf("media-profile lost on serialization:\n%s", serialized)
+	}
+	if config := parseConfig(t, wireGuardModeConfig); config.Peers[0].Obfuscation.MediaProfile != phobos.MediaProfileRTP {
+		t.Fatal("the default media profile must be plain RTP")
+	}
+	for name, bad := range map[string]string{
+		"unknown profile": strings.Replace(text, "media-profile = WebRTC", "media-profile = srtp", 1),
+		"STUN masking":    strings.Replace(text, "masking = MEDIA", "masking = STUN", 1),
+	} {
+		if _, err := FromWgQuick(bad, "test"); err == nil {
+			t.Errorf("%s: expected a parse error", name)
+		}
+	}
+}
+
+func TestEffectiveMTU(t *testing.T) {
+	config := parseConfig(t, wireGuardModeConfig)
+	if mtu := config.EffectiveMTU(); mtu != DefaultMTU-12 {
+		t.Fatalf("MEDIA leaves %d", mtu)
+	}
+	if len(config.Warnings) != 1 || !strings.Contains(config.Warnings[0], "1420") {
+		t.Fatalf("warnings = %q", config.Warnings)
+	}
+	automatic := strings.Replace(wireGuardModeConfig, "MTU = 1420\n", "", 1)
+	for text, want := range map[string]uint16{
+		strings.Replace(wireGuardModeConfig, "masking = MEDIA", "masking = STUN", 1):                      DefaultMTU - 24,
+		strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 1024", 1):                      DefaultMTU - 12,
+		strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\nmedia-profile = webrtc", 1): DefaultMTU - 12 - 10,
+		strings.Replace(wireGuardModeConfig, "MTU = 1420", "MTU = 1280", 1):                               1280,
+		strings.Replace(automatic, "masking = MEDIA", "masking = auto", 1):                                DefaultMTU - 24,
+	} {
+		if mtu := parseConfig(t, text).EffectiveMTU(); mtu != want {
+			t.Errorf("effective MTU %d, want %d, for\n%s", mtu, want, text)
+		}
+	}
+	if config := parseConfig(t, automatic); len(config.Warnings) != 0 {
+		t.Fatalf("an automatic MTU must not warn: %q", config.Warnings)
+	}
+	if config := parseConfig(t, socks5ModeConfig); config.EffectiveMTU() != Socks5TunnelMTU || len(config.Warnings) != 0 {
+		t.Fatalf("a SOCKS5 tunnel keeps MTU %d, not %d", Socks5TunnelMTU, config.EffectiveMTU())
+	}
+}
+
+func TestObfuscationAutoMTU(t *testing.T) {
+	for value, want := range map[string]AutoMTU{"on": AutoMTUOn, "Probe": AutoMTUProbe} {
+		text := strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\nauto-mtu = "+value, 1)
+		config := parseConfig(t, text)
+		if config.AutoMTU() != want || len(config.Warnings) != 0 {
+			t.Fatalf("auto-mtu = %v with warnings %q", config.AutoMTU(), config.Warnings)
+		}
+		if serialized := config.ToWgQuick(); !strings.Contains(serialized, "auto-mtu = "+want.String()+"\n") {
+			t.Fatalf("auto-mtu lost on serialization:\n%s", serialized)
+		}
+	}
+	if config := parseConfig(t, wireGuardModeConfig); config.AutoMTU() != AutoMTUOff || strings.Contains(config.ToWgQuick(), "auto-mtu") {
+		t.Fatal("auto-mtu must be opt-in")
+	}
+	if _, err := FromWgQuick(strings.Replace(wireGuardModeConfig, "max-dummy = 4", "max-dummy = 4\nauto-mtu = yes", 1), "test"); err == nil {
+		t.Fatal("auto-mtu must be on, probe or off")
+	}
+}
+
+func TestFitMTU(t *testing.T) {
+	config := parseConfig(t, strings.Replace(wireGuardModeConfig, "masking = MEDIA", "masking = STUN", 1))
+	for pathMTU, want := range map[int]uint16{1500: 1396, 1492: 1388, 1280: 1176, 1600: 1420} {
+		if mtu := config.FitMTU(pathMTU); mtu != want {
+			t.Errorf("path MTU %d fits %d, want %d", pathMTU, mtu, want)
+		}
+	}
+}
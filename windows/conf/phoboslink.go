@@ -45,7 +45,7 @@ func DecodePhobosLink(link string) (config, name string, err error) {
 		return "", "", &ParseError{l18n.Sprintf("The link payload is not valid UTF-8 text"), payload}
 	}
 
-	return stripUnsetFields(string(decoded)), phobosLinkName(fragment), nil
+	return stripLocalFields(stripUnsetFields(string(decoded))), phobosLinkName(fragment), nil
 }
 
 func phobosLinkName(fragment string) string {
@@ -86,13 +86,28 @@ func sanitizeTunnelName(name string) string {
 }
 
 func stripUnsetFields(config string) string {
+	return dropFields(config, func(_, value string) bool {
+		return strings.EqualFold(value, phobosLinkNoValue)
+	})
+}
+
+// stripLocalFields drops the keys that name files on the importing machine,
+// which a link from someone else must not choose.
+func stripLocalFields(config string) string {
+	return dropFields(config, func(key, _ string) bool {
+		return strings.EqualFold(key, "capture")
+	})
+}
+
+func dropFields(config string, drop func(key, value string) bool) string {
 	lines := strings.Split(config, "\n")
 	kept := lines[:0]
 	for _, line := range lines {
-		if key, value, found := strings.Cut(line, "="); found &&
-			strings.EqualFold(strings.TrimSpace(value), phobosLinkNoValue) &&
-			len(strings.TrimSpace(key)) > 0 {
-			continue
+		if key, value, found := strings.Cut(line, "="); found {
+			key = strings.TrimSpace(key)
+			if len(key) > 0 && drop(key, strings.TrimSpace(value)) {
+				continue
+			}
 		}
 		kept = append(kept, line)
 	}
@@ -125,6 +125,34 @@ max-dummy = none
 	}
 }
 
+func TestDecodeDropsCapture(t *testing.T) {
+	text, _, err := DecodePhobosLink(linkFrom(`[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.8.0.2/32
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 127.0.0.1:51822
+
+[instance]
+source-lport = 51822
+target = vpn.example.com:51823
+key = secret
+Capture = C:\Windows\System32\drivers\etc\hosts
+`, "peer"))
+	if err != nil {
+		t.Fatalf("unable to decode: %v", err)
+	}
+	config, err := FromWgQuick(text, "peer")
+	if err != nil {
+		t.Fatalf("unable to parse: %v", err)
+	}
+	if path := config.Peers[0].Obfuscation.Capture; len(path) > 0 {
+		t.Fatalf("the link chose a capture file: %q", path)
+	}
+}
+
 func TestDecodeNames(t *testing.T) {
 	for fragment, want := range map[string]string{
 		"Mobil-phone":              "Mobil-phone",
@@ -8,6 +8,8 @@ package conf
 import (
 	"fmt"
 	"strings"
+
+	"golang.zx2c4.com/wireguard/windows/phobos"
 )
 
 func writeLine(output *strings.Builder, c Comments, line string) {
@@ -35,16 +37,28 @@ func writeObfuscation(output *strings.Builder, o *Obfuscation) {
 	writeLine(output, o.Comments.Header, "[Instance]")
 	writeField(output, o.Comments, "mode", o.Mode == ObfuscationModeSocks5, "socks5")
 	writeField(output, o.Comments, "source-lport", o.SourceListenPort > 0, o.SourceListenPort)
-	writeField(output, o.Comments, "target", true, o.Target.String())
+	writeField(output, o.Comments, "target", true, o.TargetsString())
+	writeField(output, o.Comments, "failover-timeout", o.FailoverTimeout > 0, o.FailoverTimeout)
+	writeField(output, o.Comments, "port-hop-interval", o.PortHopInterval > 0, o.PortHopInterval)
+	writeField(output, o.Comments, "port-hop-silence", o.PortHopSilence > 0, o.PortHopSilence)
+	writeField(output, o.Comments, "resolver", len(o.Resolver) > 0, o.Resolver)
+	writeField(output, o.Comments, "resolve-interval", o.ResolveInterval > 0, o.ResolveInterval)
 	writeField(output, o.Comments, "key", true, o.Key)
+	writeField(output, o.Comments, "previous-keys", len(o.PreviousKeys) > 0, o.PreviousKeysString())
 	writeField(output, o.Comments, "masking", true, o.Masking)
 	if o.Mode == ObfuscationModeWireGuard {
 		writeField(output, o.Comments, "obfuscate-bytes", true, o.ObfuscateBytes)
 		writeField(output, o.Comments, "max-dummy", true, o.MaxDummy)
+		writeField(output, o.Comments, "padding", o.Padding.Mode != phobos.PaddingNone, o.Padding.Mode)
+		writeField(output, o.Comments, "padding-sizes", len(o.Padding.Sizes) > 0, o.PaddingSizesString())
+		writeField(output, o.Comments, "auto-mtu", o.AutoMTU != AutoMTUOff, o.AutoMTU)
 	}
 	writeField(output, o.Comments, "media-pt", o.MediaPayloadType > 0, o.MediaPayloadType)
 	writeField(output, o.Comments, "media-ssrc", o.MediaSSRC > 0, o.MediaSSRC)
 	writeField(output, o.Comments, "media-clock", o.MediaClock > 0, o.MediaClock)
+	writeField(output, o.Comments, "media-profile", o.MediaProfile != phobos.MediaProfileRTP, o.MediaProfile)
+	writeField(output, o.Comments, "cover-traffic", o.CoverTraffic > 0, o.CoverTraffic)
+	writeField(output, o.Comments, "capture", len(o.Capture) > 0, o.Capture)
 
 	if len(o.Login) == 0 && len(o.Password) == 0 {
 		return
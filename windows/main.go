@@ -6,6 +6,7 @@
 package main
 
 import (
+	"context"
 	"debug/pe"
 	"errors"
 	"fmt"
@@ -24,6 +25,7 @@ import (
 	"golang.zx2c4.com/wireguard/windows/elevate"
 	"golang.zx2c4.com/wireguard/windows/l18n"
 	"golang.zx2c4.com/wireguard/windows/manager"
+	"golang.zx2c4.com/wireguard/windows/phobos"
 	"golang.zx2c4.com/wireguard/windows/ringlogger"
 	"golang.zx2c4.com/wireguard/windows/tunnel"
 	"golang.zx2c4.com/wireguard/windows/ui"
@@ -75,6 +77,7 @@ func usage() {
 		"/ui CMD_READ_HANDLE CMD_WRITE_HANDLE CMD_EVENT_HANDLE LOG_MAPPING_HANDLE",
 		"/dumplog [/tail]",
 		"/importlink phobos://LINK",
+		"/diagnose TUNNEL_NAME [/handshake]",
 		"/removedriver",
 	}
 	builder := strings.Builder{}
@@ -159,6 +162,48 @@ func execElevatedManagerServiceInstaller() error {
 	return windows.ERROR_UNHANDLED_EXCEPTION // Not reached
 }
 
+// diagnoseTunnel probes the server of every obfuscator in config and returns
+// the reports. With handshake, a WireGuard-mode probe is a real handshake
+// initiation made from the tunnel's keys, which checks the key end to end
+// but makes the server move the peer's endpoint to the probe.
+func diagnoseTunnel(config *conf.Config, handshake bool) (string, error) {
+	var reports []string
+	diagnose := func(settings *conf.Obfuscation, keys *phobos.WireGuardKeys) error {
+		diagnoseConfig, err := settings.DiagnoseConfig()
+		if err != nil {
+			return err
+		}
+		diagnoseConfig.WireGuard = keys
+		report, err := phobos.Diagnose(context.Background(), diagnoseConfig)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report.String())
+		return nil
+	}
+	if config.IsSocks5() {
+		if err := diagnose(config.Obfuscation, nil); err != nil {
+			return "", err
+		}
+	}
+	for i := range config.Peers {
+		if config.Peers[i].Obfuscation == nil {
+			continue
+		}
+		var keys *phobos.WireGuardKeys
+		if handshake {
+			keys = &phobos.WireGuardKeys{PrivateKey: config.Interface.PrivateKey, PeerPublicKey: config.Peers[i].PublicKey}
+		}
+		if err := diagnose(config.Peers[i].Obfuscation, keys); err != nil {
+			return "", err
+		}
+	}
+	if len(reports) == 0 {
+		return "", errors.New(l18n.Sprintf("Tunnel %s has no obfuscator", config.Name))
+	}
+	return strings.Join(reports, "\n\n"), nil
+}
+
 func pipeFromHandleArgument(handleStr string) (*os.File, error) {
 	handleInt, err := strconv.ParseUint(handleStr, 10, 64)
 	if err != nil {
@@ -256,6 +301,30 @@ func main() {
 		}
 		ui.WaitForUIThenImportLink(link, time.Minute)
 		return
+	case "/diagnose":
+		handshake := len(os.Args) == 4 && os.Args[3] == "/handshake"
+		if len(os.Args) != 3 && !handshake {
+			usage()
+		}
+		config, err := conf.LoadFromName(os.Args[2])
+		if err != nil {
+			fatal(err)
+		}
+		if handshake {
+			running, err := manager.TunnelServiceRunning(config.Name)
+			if err != nil {
+				fatal(err)
+			}
+			if running {
+				fatalf("Tunnel %s is running; stop it before probing with a real handshake", config.Name)
+			}
+		}
+		reports, err := diagnoseTunnel(config, handshake)
+		if err != nil {
+			fatal(err)
+		}
+		info(l18n.Sprintf("Obfuscator Diagnostics"), "%s", reports)
+		return
 	case "/tunnelservice":
 		if len(os.Args) != 3 {
 			usage()
@@ -204,6 +204,31 @@ func UninstallTunnel(name string) error {
 	return err2
 }
 
+// TunnelServiceRunning reports whether the service of tunnel name is up or on
+// its way up or down. A stopped tunnel has no service, as stopping deletes it.
+func TunnelServiceRunning(name string) (bool, error) {
+	m, err := serviceManager()
+	if err != nil {
+		return false, err
+	}
+	serviceName, err := conf.ServiceNameOfTunnel(name)
+	if err != nil {
+		return false, err
+	}
+	service, err := m.OpenService(serviceName)
+	if err == windows.ERROR_SERVICE_DOES_NOT_EXIST {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer service.Close()
+	status, err := service.Query()
+	if err != nil {
+		return false, err
+	}
+	return status.State != svc.Stopped, nil
+}
+
 func changeTunnelServiceConfigFilePath(name, oldPath, newPath string) {
 	var err error
 	defer func() {
@@ -20,6 +20,7 @@ import (
 	"golang.org/x/sys/windows/svc"
 
 	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/services"
 )
 
 var (
@@ -72,6 +73,7 @@ func (s *ManagerService) RuntimeConfig(tunnelName string) (*conf.Config, error)
 	}
 	conf := conf.FromDriverConfiguration(runtimeConfig, storedConfig)
 	driverAdapter.Unlock()
+	attachObfuscatorStats(conf)
 	if s.elevatedToken == 0 {
 		conf.Redact()
 	}
@@ -215,9 +217,37 @@ func (s *ManagerService) Create(tunnelConfig *conf.Config) (*Tunnel, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = reloadObfuscation(tunnelConfig.Name)
+	if err != nil {
+		log.Printf("[%s] Unable to reload obfuscation settings: %v", tunnelConfig.Name, err)
+	}
 	return &Tunnel{tunnelConfig.Name}, nil
 	// TODO: handle already existing situation
-	// TODO: handle already running and existing situation
+}
+
+// reloadObfuscation asks the service of a running tunnel to move its
+// obfuscator to the configuration just saved for it. The service applies
+// the new settings only when they need no restart.
+func reloadObfuscation(tunnelName string) error {
+	serviceName, err := conf.ServiceNameOfTunnel(tunnelName)
+	if err != nil {
+		return err
+	}
+	m, err := serviceManager()
+	if err != nil {
+		return err
+	}
+	service, err := m.OpenService(serviceName)
+	if err != nil {
+		return nil
+	}
+	defer service.Close()
+	status, err := service.Query()
+	if err != nil || status.State != svc.Running {
+		return err
+	}
+	_, err = service.Control(services.ReloadObfuscation)
+	return err
 }
 
 func (s *ManagerService) Tunnels() ([]Tunnel, error) {
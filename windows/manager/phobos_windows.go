@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package manager
+
+import (
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/phobos"
+)
+
+func attachObfuscatorStats(config *conf.Config) {
+	stats, err := phobos.ReadPublishedStats(config.Name)
+	if err != nil {
+		return
+	}
+	for i := range config.Peers {
+		o := config.Peers[i].Obfuscation
+		if o == nil {
+			continue
+		}
+		if s, ok := stats[config.Peers[i].PublicKey.String()]; ok {
+			o.Stats = &s
+			o.RxBytes = conf.Bytes(s.RxBytes)
+			o.TxBytes = conf.Bytes(s.TxBytes)
+		}
+	}
+}
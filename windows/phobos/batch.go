@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"net"
+	"net/netip"
+)
+
+// packetBatch holds the receive buffers of one proxy worker and the packets
+// it has ready to send on.
+type packetBatch struct {
+	bufs    [][]byte
+	sizes   []int
+	sources []netip.AddrPort
+	out     [][]byte
+}
+
+func newPacketBatch(size int) *packetBatch {
+	b := &packetBatch{
+		bufs:    make([][]byte, size),
+		sizes:   make([]int, size),
+		sources: make([]netip.AddrPort, size),
+		out:     make([][]byte, 0, size),
+	}
+	for i := range b.bufs {
+		b.bufs[i] = make([]byte, BufferSize)
+	}
+	return b
+}
+
+func netAddrPort(addr net.Addr) netip.AddrPort {
+	if addr, ok := addr.(*net.UDPAddr); ok {
+		return addr.AddrPort()
+	}
+	return netip.AddrPort{}
+}
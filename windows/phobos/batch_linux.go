@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"net"
+	"runtime"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchSize is how many datagrams one recvmmsg or sendmmsg moves.
+const batchSize = 16
+
+func defaultWorkers() int {
+	return min(runtime.NumCPU(), 4)
+}
+
+// batchConn moves datagrams in batches through recvmmsg and sendmmsg. It
+// keeps the message headers of one worker, so every worker wraps the shared
+// socket in its own batchConn.
+type batchConn struct {
+	conn  *net.UDPConn
+	xconn interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+	msgs []ipv4.Message
+}
+
+func newBatchConn(conn *net.UDPConn) *batchConn {
+	c := &batchConn{conn: conn, msgs: make([]ipv4.Message, batchSize)}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		c.xconn = ipv6.NewPacketConn(conn)
+	} else {
+		c.xconn = ipv4.NewPacketConn(conn)
+	}
+	for i := range c.msgs {
+		c.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return c
+}
+
+func (c *batchConn) read(b *packetBatch) (int, error) {
+	msgs := c.msgs[:len(b.bufs)]
+	for i := range msgs {
+		msgs[i].Buffers[0] = b.bufs[i]
+	}
+	n, err := c.xconn.ReadBatch(msgs, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := range n {
+		b.sizes[i] = msgs[i].N
+		b.sources[i] = netAddrPort(msgs[i].Addr)
+	}
+	return n, nil
+}
+
+// write sends packets to addr, or over the connected socket when addr is
+// nil.
+func (c *batchConn) write(packets [][]byte, addr net.Addr) error {
+	for len(packets) > 0 {
+		msgs := c.msgs[:min(len(packets), len(c.msgs))]
+		for i := range msgs {
+			msgs[i].Buffers[0] = packets[i]
+			msgs[i].Addr = addr
+		}
+		n, err := c.xconn.WriteBatch(msgs, 0)
+		if err != nil {
+			return err
+		}
+		packets = packets[n:]
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import "net"
+
+const batchSize = 1
+
+func defaultWorkers() int {
+	return 1
+}
+
+// batchConn moves one datagram per system call where the platform has no
+// recvmmsg.
+type batchConn struct {
+	conn *net.UDPConn
+}
+
+func newBatchConn(conn *net.UDPConn) *batchConn {
+	return &batchConn{conn: conn}
+}
+
+func (c *batchConn) read(b *packetBatch) (int, error) {
+	n, source, err := c.conn.ReadFromUDPAddrPort(b.bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	b.sizes[0], b.sources[0] = n, source
+	return 1, nil
+}
+
+func (c *batchConn) write(packets [][]byte, addr net.Addr) error {
+	for _, packet := range packets {
+		var err error
+		if addr == nil {
+			_, err = c.conn.Write(packet)
+		} else {
+			_, err = c.conn.WriteTo(packet, addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCaptureLimit is the size a capture file stops growing at when
+// NewCapture is given no limit.
+const DefaultCaptureLimit = 16 << 20
+
+// captureHead is how much of a plaintext WireGuard packet a capture keeps:
+// the message type and its three zero bytes, which any observer knows. The
+// rest would pair with the masked copy on the wire interface and give away
+// the keystream, and through it the key. Plaintext stream data, which
+// carries SOCKS5 credentials and the user's own traffic, is kept as lengths
+// only.
+const captureHead = 4
+
+const (
+	captureLoopback = iota
+	captureWire
+)
+
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrder       = 0x1A2B3C4D
+	pcapngLinkTypeRaw     = 101
+	pcapngOptionEnd       = 0
+	pcapngOptionComment   = 1
+	pcapngOptionName      = 2
+	pcapngOptionDesc      = 3
+	pcapngOptionUserAppl  = 4
+	ipProtocolTCP         = 6
+	ipProtocolUDP         = 17
+	captureIPv4HeaderSize = 20
+	captureIPv6HeaderSize = 40
+	captureUDPHeaderSize  = 8
+	captureTCPHeaderSize  = 20
+)
+
+// Capture records the packets of a UDPProxy or the streams of a Socks5Client
+// to a pcapng file, for attaching to bug reports. Interface 0, "loopback",
+// holds the WireGuard side, or the SOCKS5 stream before obfuscation, and
+// interface 1, "wire", what is sent to and received from the server after
+// masking. Server packets the proxy rejects carry a comment naming the stage.
+// Packets are given synthetic IP and UDP or TCP headers so Wireshark can
+// follow the flows. The obfuscation key is never written, and plaintext is
+// cut short as described at captureHead. A Capture is safe for concurrent
+// use and ignores calls on a nil receiver.
+type Capture struct {
+	mu      sync.Mutex
+	w       io.Writer
+	limit   int64
+	written int64
+	stopped bool
+	block   []byte
+}
+
+// NewCapture starts a pcapng section on w. It stops recording once the file
+// would grow past limit bytes, DefaultCaptureLimit when limit is zero.
+func NewCapture(w io.Writer, limit int64) (*Capture, error) {
+	if limit <= 0 {
+		limit = DefaultCaptureLimit
+	}
+	c := &Capture{w: w, limit: limit}
+
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrder)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	shb = appendPcapngOption(shb, pcapngOptionUserAppl, "Phobos")
+	shb = appendPcapngOption(shb, pcapngOptionComment,
+		"Plaintext is cut to the WireGuard message type; keys and SOCKS5 credentials are not recorded")
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngOptionEnd)
+	if err := c.writeBlock(pcapngSectionHeader, shb); err != nil {
+		return nil, err
+	}
+	for _, iface := range [...]struct{ name, description string }{
+		captureLoopback: {"loopback", "WireGuard side of the obfuscator, or the SOCKS5 stream before obfuscation"},
+		captureWire:     {"wire", "Traffic to and from the server after masking"},
+	} {
+		var idb []byte
+		idb = binary.LittleEndian.AppendUint16(idb, pcapngLinkTypeRaw)
+		idb = binary.LittleEndian.AppendUint16(idb, 0)
+		idb = binary.LittleEndian.AppendUint32(idb, 0)
+		idb = appendPcapngOption(idb, pcapngOptionName, iface.name)
+		idb = appendPcapngOption(idb, pcapngOptionDesc, iface.description)
+		idb = binary.LittleEndian.AppendUint32(idb, pcapngOptionEnd)
+		if err := c.writeBlock(pcapngInterface, idb); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// CreateCapture creates the file at path and starts a capture on it. It
+// fails rather than overwrite a file already there.
+func CreateCapture(path string, limit int64) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCapture(file, limit)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops the capture and closes the writer it was started on if that
+// is an io.Closer.
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	w := c.w
+	c.w = nil
+	if closer, ok := w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func appendPcapngOption(b []byte, code uint16, value string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n&3) & 3
+}
+
+// writeBlock frames body as a pcapng block. The caller holds mu, or owns c
+// outright while NewCapture sets it up.
+func (c *Capture) writeBlock(blockType uint32, body []byte) error {
+	total := 12 + len(body)
+	if c.stopped || c.written+int64(total) > c.limit {
+		c.stopped = true
+		return nil
+	}
+	c.block = binary.LittleEndian.AppendUint32(c.block[:0], blockType)
+	c.block = binary.LittleEndian.AppendUint32(c.block, uint32(total))
+	c.block = append(c.block, body...)
+	c.block = binary.LittleEndian.AppendUint32(c.block, uint32(total))
+	if _, err := c.w.Write(c.block); err != nil {
+		c.stopped = true
+		return err
+	}
+	c.written += int64(total)
+	return nil
+}
+
+// packet records payload as travelling from src to dst on iface, behind
+// synthetic IP and transport headers, keeping at most keep bytes of it.
+func (c *Capture) packet(iface uint32, src, dst netip.AddrPort, transport []byte, payload []byte, keep int, comment string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	src, dst = captureAddrs(src, dst)
+	ipHeader := captureIPv6HeaderSize
+	if src.Addr().Is4() {
+		ipHeader = captureIPv4HeaderSize
+	}
+	headers := ipHeader + len(transport)
+	kept := headers + min(keep, len(payload))
+	original := headers + len(payload)
+
+	now := time.Now().UnixMicro()
+	body := make([]byte, 20, 20+kept+3+len(comment)+16)
+	binary.LittleEndian.PutUint32(body, iface)
+	binary.LittleEndian.PutUint32(body[4:], uint32(now>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(now))
+	binary.LittleEndian.PutUint32(body[12:], uint32(kept))
+	binary.LittleEndian.PutUint32(body[16:], uint32(original))
+	body = appendCaptureIP(body, src, dst, original, transport)
+	body = append(body, payload[:kept-headers]...)
+	body = append(body, make([]byte, pad4(kept))...)
+	if comment != "" {
+		body = appendPcapngOption(body, pcapngOptionComment, comment)
+		body = binary.LittleEndian.AppendUint32(body, pcapngOptionEnd)
+	}
+	c.writeBlock(pcapngEnhancedPacket, body)
+}
+
+// captureAddrs puts src and dst in one address family, so they fit one IP
+// header.
+func captureAddrs(src, dst netip.AddrPort) (netip.AddrPort, netip.AddrPort) {
+	for _, addr := range []*netip.AddrPort{&src, &dst} {
+		ip := addr.Addr().Unmap()
+		if !ip.IsValid() {
+			ip = netip.IPv4Unspecified()
+		}
+		*addr = netip.AddrPortFrom(ip, addr.Port())
+	}
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+	return src, dst
+}
+
+// appendCaptureIP appends an IP header for a packet of total bytes from src
+// to dst, followed by the transport header.
+func appendCaptureIP(b []byte, src, dst netip.AddrPort, total int, transport []byte) []byte {
+	protocol := byte(ipProtocolUDP)
+	if len(transport) == captureTCPHeaderSize {
+		protocol = ipProtocolTCP
+	}
+	if src.Addr().Is4() {
+		start := len(b)
+		b = append(b, 0x45, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(total))
+		b = append(b, 0, 0, 0x40, 0, 64, protocol, 0, 0)
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		b = append(b, s[:]...)
+		b = append(b, d[:]...)
+		binary.BigEndian.PutUint16(b[start+10:], ipv4Checksum(b[start:]))
+	} else {
+		b = append(b, 0x60, 0, 0, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(total-captureIPv6HeaderSize))
+		b = append(b, protocol, 64)
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		b = append(b, s[:]...)
+		b = append(b, d[:]...)
+	}
+	return append(b, transport...)
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+// datagram records a UDP payload.
+func (c *Capture) datagram(iface uint32, src, dst netip.AddrPort, payload []byte, keep int, comment string) {
+	if c == nil {
+		return
+	}
+	var udp [captureUDPHeaderSize]byte
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(captureUDPHeaderSize+len(payload)))
+	c.packet(iface, src, dst, udp[:], payload, keep, comment)
+}
+
+// captureFlow numbers the bytes of one TCP connection as a capture shows
+// them, per interface and direction, so Wireshark can reassemble the stream.
+type captureFlow struct {
+	local, remote netip.AddrPort
+	seq           [2][2]uint32
+}
+
+func newCaptureFlow(conn net.Conn) *captureFlow {
+	return &captureFlow{local: addrPortOf(conn.LocalAddr()), remote: addrPortOf(conn.RemoteAddr())}
+}
+
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.AddrPort()
+	}
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+}
+
+// segment records stream data on flow, sent by the local end when outbound.
+func (c *Capture) segment(iface uint32, flow *captureFlow, outbound bool, payload []byte, keep int, comment string) {
+	if c == nil || len(payload) == 0 {
+		return
+	}
+	src, dst, dir := flow.remote, flow.local, 1
+	if outbound {
+		src, dst, dir = flow.local, flow.remote, 0
+	}
+	c.mu.Lock()
+	seq, ack := flow.seq[iface][dir], flow.seq[iface][1-dir]
+	flow.seq[iface][dir] += uint32(len(payload))
+	c.mu.Unlock()
+
+	var tcp [captureTCPHeaderSize]byte
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = captureTCPHeaderSize / 4 << 4
+	tcp[13] = 0x18
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF)
+	c.packet(iface, src, dst, tcp[:], payload, keep, comment)
+}
+
+func listenAddr(conn *net.UDPConn) netip.AddrPort {
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// rejectComment is the packet comment for a server packet rejected at stage.
+func rejectComment(stage string) string {
+	if stage == "" {
+		return ""
+	}
+	return "rejected at " + stage + " stage"
+}
@@ -0,0 +1,217 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type capturedPacket struct {
+	iface    uint32
+	data     []byte
+	original int
+	comment  string
+}
+
+// readCapture parses a pcapng file into its interface names and packets.
+func readCapture(t *testing.T, file []byte) ([]string, []capturedPacket) {
+	t.Helper()
+	var names []string
+	var packets []capturedPacket
+	for len(file) > 0 {
+		if len(file) < 12 {
+			t.Fatalf("%d stray bytes at the end", len(file))
+		}
+		blockType, total := binary.LittleEndian.Uint32(file), int(binary.LittleEndian.Uint32(file[4:]))
+		if total%4 != 0 || total > len(file) || binary.LittleEndian.Uint32(file[total-4:]) != uint32(total) {
+			t.Fatalf("block of type %#x has a bad length %d", blockType, total)
+		}
+		body := file[8 : total-4]
+		options := func(b []byte) map[uint16]string {
+			found := make(map[uint16]string)
+			for len(b) >= 4 {
+				code, length := binary.LittleEndian.Uint16(b), int(binary.LittleEndian.Uint16(b[2:]))
+				if code == pcapngOptionEnd {
+					break
+				}
+				found[code] = string(b[4 : 4+length])
+				b = b[4+length+pad4(length):]
+			}
+			return found
+		}
+		switch blockType {
+		case pcapngSectionHeader:
+			if binary.LittleEndian.Uint32(body) != pcapngByteOrder {
+				t.Fatal("section header has the wrong byte order magic")
+			}
+		case pcapngInterface:
+			if binary.LittleEndian.Uint16(body) != pcapngLinkTypeRaw {
+				t.Fatal("interface is not raw IP")
+			}
+			names = append(names, options(body[8:])[pcapngOptionName])
+		case pcapngEnhancedPacket:
+			kept := int(binary.LittleEndian.Uint32(body[12:]))
+			packets = append(packets, capturedPacket{
+				iface:    binary.LittleEndian.Uint32(body),
+				data:     body[20 : 20+kept],
+				original: int(binary.LittleEndian.Uint32(body[16:])),
+				comment:  options(body[20+kept+pad4(kept):])[pcapngOptionComment],
+			})
+		}
+		file = file[total:]
+	}
+	return names, packets
+}
+
+func TestCaptureRecordsRejectedServerPackets(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, BufferSize)
+		for {
+			_, source, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			copy(buf, handshakePacket(92))
+			n := NewObfuscator([]byte("another key")).Encode(buf, 92, 0, 0)
+			conn.WriteToUDPAddrPort(buf[:n], source)
+		}
+	}()
+	var file bytes.Buffer
+	capture, err := NewCapture(&file, 0)
+	if err != nil {
+		t.Fatalf("unable to start capture: %v", err)
+	}
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:  conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Key:     key,
+		Capture: capture,
+		Logf:    t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(handshakePacket(148)); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+	waitForStats(t, proxy, func(s UDPProxyStats) bool { return s.RejectedKey > 0 })
+	proxy.Stop()
+	capture.Close()
+
+	names, packets := readCapture(t, file.Bytes())
+	if len(names) != 2 || names[captureLoopback] != "loopback" || names[captureWire] != "wire" {
+		t.Fatalf("interfaces are %q", names)
+	}
+	var tunnel, sent, rejected int
+	for _, packet := range packets {
+		switch {
+		case packet.iface == captureLoopback:
+			tunnel++
+			if len(packet.data) != captureIPv4HeaderSize+captureUDPHeaderSize+captureHead || packet.original != captureIPv4HeaderSize+captureUDPHeaderSize+148 {
+				t.Fatalf("plaintext kept %d of %d bytes", len(packet.data), packet.original)
+			}
+		case packet.comment == "rejected at key stage":
+			rejected++
+		default:
+			sent++
+			if len(packet.data) != packet.original {
+				t.Fatalf("wire packet kept %d of %d bytes", len(packet.data), packet.original)
+			}
+		}
+	}
+	if tunnel == 0 || sent == 0 || rejected == 0 {
+		t.Fatalf("captured %d tunnel packets, %d sent and %d rejected", tunnel, sent, rejected)
+	}
+	if bytes.Contains(file.Bytes(), key) {
+		t.Fatal("the capture holds the key")
+	}
+}
+
+func TestCaptureStopsAtLimit(t *testing.T) {
+	var file bytes.Buffer
+	capture, err := NewCapture(&file, 4096)
+	if err != nil {
+		t.Fatalf("unable to start capture: %v", err)
+	}
+	addr := startWireGuardEcho(t)
+	for range 100 {
+		capture.datagram(captureWire, addr, addr, make([]byte, 200), 200, "")
+	}
+	if file.Len() > 4096 {
+		t.Fatalf("capture grew to %d bytes", file.Len())
+	}
+	if _, packets := readCapture(t, file.Bytes()); len(packets) == 0 {
+		t.Fatal("no packet fit under the limit")
+	}
+}
+
+func TestCreateCaptureKeepsExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "phobos.pcapng")
+	if err := os.WriteFile(path, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if capture, err := CreateCapture(path, DefaultCaptureLimit); err == nil {
+		capture.Close()
+		t.Fatal("capture opened over an existing file")
+	}
+	if content, _ := os.ReadFile(path); string(content) != "keep" {
+		t.Fatalf("existing file became %q", content)
+	}
+}
+
+func TestCaptureKeepsStreamPlaintextOut(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	var file bytes.Buffer
+	capture, err := NewCapture(&file, 0)
+	if err != nil {
+		t.Fatalf("unable to start capture: %v", err)
+	}
+	local, remote := net.Pipe()
+	client := newObfConn(local, key, MaskingTLS, MediaParams{}, capture)
+	server := newObfConn(remote, key, MaskingTLS, MediaParams{}, nil)
+	secret := []byte("\x01\x0bphobos-user\x0dhunter2-pass")
+	go func() {
+		client.Write(secret)
+		io.ReadFull(client, make([]byte, len(secret)))
+		client.Close()
+	}()
+	echo := make([]byte, len(secret))
+	if _, err := io.ReadFull(server, echo); err != nil || !bytes.Equal(echo, secret) {
+		t.Fatalf("stream delivered %q, %v", echo, err)
+	}
+	server.Write(echo)
+	io.Copy(io.Discard, server)
+	capture.Close()
+
+	_, packets := readCapture(t, file.Bytes())
+	if len(packets) != 4 {
+		t.Fatalf("captured %d segments, want both directions on both interfaces", len(packets))
+	}
+	for _, packet := range packets {
+		if packet.iface == captureLoopback && len(packet.data) != captureIPv4HeaderSize+captureTCPHeaderSize {
+			t.Fatalf("plaintext segment kept %d payload bytes", len(packet.data)-captureIPv4HeaderSize-captureTCPHeaderSize)
+		}
+	}
+	if bytes.Contains(file.Bytes(), []byte("hunter2")) || bytes.Contains(file.Bytes(), key) {
+		t.Fatal("the capture holds a secret")
+	}
+}
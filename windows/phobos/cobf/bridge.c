@@ -1,3 +1,5 @@
+//go:build cgo && !phobospurego
+
 /* SPDX-License-Identifier: MIT
  *
  * Phobos
@@ -16,6 +18,40 @@ int cobf_encode(uint8_t *buffer, int length, const char *key, int key_length,
                   max_dummy_data, obfuscate_bytes);
 }
 
+/* Like encode, but appends exactly dummy_length bytes of padding instead of a
+ * random amount. The framing is the one decode already understands: the
+ * length sits in bytes 2-3, and the obfuscated span is judged on the padded
+ * length, as decode sees it. */
+int cobf_encode_padded(uint8_t *buffer, int length, const char *key, int key_length,
+                       int dummy_length, int obfuscate_bytes) {
+    if (length < 4 || dummy_length < 0 || dummy_length > 0xFFFF) return -1;
+    uint8_t rnd = 1 + (fast_rand() % 255);
+    buffer[0] ^= rnd;
+    buffer[1] = rnd;
+    buffer[2] = dummy_length & 0xFF;
+    buffer[3] = dummy_length >> 8;
+    fast_rand_bytes(buffer + length, (size_t)dummy_length);
+    length += dummy_length;
+    int partial = obfuscate_bytes > 0 && obfuscate_bytes < length;
+    xor_data(buffer, partial ? obfuscate_bytes : length, (char *)key, key_length);
+    return length;
+}
+
+/* Fills buffer[:length] with a packet whose header declares all of it
+ * padding. decode strips it down to nothing, so the C server drops it at its
+ * length check before anything reaches WireGuard. */
+int cobf_encode_cover(uint8_t *buffer, int length, const char *key, int key_length,
+                      int obfuscate_bytes) {
+    if (length < 4 || length > 0xFFFF) return -1;
+    fast_rand_bytes(buffer, (size_t)length);
+    buffer[1] = 1 + (fast_rand() % 255);
+    buffer[2] = length & 0xFF;
+    buffer[3] = length >> 8;
+    int partial = obfuscate_bytes > 0 && obfuscate_bytes < length;
+    xor_data(buffer, partial ? obfuscate_bytes : length, (char *)key, key_length);
+    return length;
+}
+
 int cobf_decode(uint8_t *buffer, int length, const char *key, int key_length,
                 int obfuscate_bytes, uint8_t *version_out) {
     return decode(buffer, length, (char *)key, key_length, version_out, obfuscate_bytes);
@@ -10,6 +10,10 @@
 
 int cobf_encode(uint8_t *buffer, int length, const char *key, int key_length,
                 int max_dummy_data, int obfuscate_bytes);
+int cobf_encode_padded(uint8_t *buffer, int length, const char *key, int key_length,
+                       int dummy_length, int obfuscate_bytes);
+int cobf_encode_cover(uint8_t *buffer, int length, const char *key, int key_length,
+                      int obfuscate_bytes);
 int cobf_decode(uint8_t *buffer, int length, const char *key, int key_length,
                 int obfuscate_bytes, uint8_t *version_out);
 void cobf_xor(uint8_t *buffer, int length, const char *key, int key_length);
@@ -1,11 +1,15 @@
+//go:build cgo && !phobospurego
+
 /* SPDX-License-Identifier: MIT
  *
  * Phobos
  */
 
 // Package cobf binds the shared wg-obfuscator C sources in
-// src/phobos-obfuscator. It is the only implementation of the Phobos wire
-// protocol in this tree; there is deliberately no Go port to drift from.
+// src/phobos-obfuscator. Builds without cgo, or with the phobospurego tag,
+// get a Go port of the same functions instead; it is kept byte-exact with
+// the C sources by the golden vectors and the phoboscref tests, which run
+// against both backends.
 package cobf
 
 /*
@@ -28,6 +32,22 @@ func Encode(buffer []byte, length int, key []byte, maxDummyData, obfuscateBytes
 		keyPtr(key), C.int(len(key)), C.int(maxDummyData), C.int(obfuscateBytes)))
 }
 
+// EncodePadded obfuscates buffer[:length] in place like Encode but appends
+// exactly dummyLength bytes of padding, so the caller decides the size of the
+// result. Decode strips the padding as it does Encode's.
+func EncodePadded(buffer []byte, length int, key []byte, dummyLength, obfuscateBytes int) int {
+	return int(C.cobf_encode_padded((*C.uint8_t)(unsafe.SliceData(buffer)), C.int(length),
+		keyPtr(key), C.int(len(key)), C.int(dummyLength), C.int(obfuscateBytes)))
+}
+
+// EncodeCover fills buffer[:length] with an obfuscated packet that is
+// padding from end to end: Decode reduces it to zero bytes, which every
+// receiver drops.
+func EncodeCover(buffer []byte, length int, key []byte, obfuscateBytes int) int {
+	return int(C.cobf_encode_cover((*C.uint8_t)(unsafe.SliceData(buffer)), C.int(length),
+		keyPtr(key), C.int(len(key)), C.int(obfuscateBytes)))
+}
+
 // Decode deobfuscates buffer[:length] in place and returns the payload length.
 // version reports the protocol version detected in the packet header.
 func Decode(buffer []byte, length int, key []byte, obfuscateBytes int) (n int, version uint8) {
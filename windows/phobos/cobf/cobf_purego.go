@@ -0,0 +1,197 @@
+//go:build phobospurego || !cgo
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package cobf
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+)
+
+// The pure Go backend, for builds without cgo. It follows obfuscation.h byte
+// for byte; the golden vectors and the phoboscref tests hold it to that.
+
+const (
+	maxXORKeyLength         = 256
+	maxDummyLengthTotal     = 1024
+	maxDummyLengthHandshake = 512
+)
+
+var crc8Table = func() (table [256]byte) {
+	for i := range table {
+		var crc byte
+		in := byte(i)
+		for range 8 {
+			mix := (crc ^ in) & 1
+			crc >>= 1
+			if mix != 0 {
+				crc ^= 0x8C
+			}
+			in >>= 1
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// applyKeystream continues the CRC8 chain of crc through the adjusted key
+// bytes from ki on, XORing it into buffer.
+func applyKeystream(buffer []byte, crc byte, ki int, adjusted []byte) (byte, int) {
+	for i := range buffer {
+		crc = crc8Table[crc^adjusted[ki]]
+		buffer[i] ^= crc
+		if ki++; ki >= len(adjusted) {
+			ki = 0
+		}
+	}
+	return crc, ki
+}
+
+// adjustKey adds base to every key byte, as the C side does before running
+// the chain.
+func adjustKey(out *[maxXORKeyLength]byte, key []byte, base byte) []byte {
+	key = key[:min(len(key), maxXORKeyLength)]
+	for k, b := range key {
+		out[k] = b + base
+	}
+	return out[:max(len(key), 1)]
+}
+
+func xorData(buffer []byte, length int, key []byte) {
+	var adjusted [maxXORKeyLength]byte
+	keyLength := min(len(key), maxXORKeyLength)
+	applyKeystream(buffer[:length], 0, 0, adjustKey(&adjusted, key, byte(length+keyLength)))
+}
+
+// obfuscatedSpan is how much of a length-byte packet obfuscateBytes covers.
+func obfuscatedSpan(length, obfuscateBytes int) int {
+	if obfuscateBytes > 0 && obfuscateBytes < length {
+		return obfuscateBytes
+	}
+	return length
+}
+
+func randomBytes(p []byte) {
+	for len(p) >= 4 {
+		binary.LittleEndian.PutUint32(p, rand.Uint32())
+		p = p[4:]
+	}
+	if len(p) > 0 {
+		r := rand.Uint32()
+		for i := range p {
+			p[i] = byte(r >> (8 * i))
+		}
+	}
+}
+
+func randomNonZeroByte() byte {
+	return byte(1 + rand.Uint32()%255)
+}
+
+// Encode obfuscates buffer[:length] in place and returns the new length,
+// which may exceed length when dummy padding is appended.
+func Encode(buffer []byte, length int, key []byte, maxDummyData, obfuscateBytes int) int {
+	partial := obfuscateBytes > 0 && obfuscateBytes < length
+	packetType := binary.LittleEndian.Uint32(buffer)
+	rnd := randomNonZeroByte()
+	buffer[0] ^= rnd
+	buffer[1] = rnd
+	dummyLength := 0
+	if !partial && length < maxDummyLengthTotal {
+		maxDummy := maxDummyLengthTotal - length
+		if obfuscateBytes > 0 {
+			maxDummy = min(maxDummy, obfuscateBytes-length+1)
+		}
+		switch packetType {
+		case 1, 2:
+			dummyLength = int(rand.Uint32() % uint32(min(maxDummy, maxDummyLengthHandshake)))
+		case 3, 4:
+			if maxDummyData != 0 {
+				dummyLength = int(rand.Uint32() % uint32(min(maxDummy, maxDummyData)))
+			}
+		}
+	}
+	binary.LittleEndian.PutUint16(buffer[2:], uint16(dummyLength))
+	if dummyLength > 0 {
+		randomBytes(buffer[length : length+dummyLength])
+		length += dummyLength
+	}
+	if partial {
+		xorData(buffer, obfuscateBytes, key)
+	} else {
+		xorData(buffer, length, key)
+	}
+	return length
+}
+
+// EncodePadded obfuscates buffer[:length] in place like Encode but appends
+// exactly dummyLength bytes of padding, so the caller decides the size of the
+// result. Decode strips the padding as it does Encode's.
+func EncodePadded(buffer []byte, length int, key []byte, dummyLength, obfuscateBytes int) int {
+	if length < 4 || dummyLength < 0 || dummyLength > 0xFFFF {
+		return -1
+	}
+	rnd := randomNonZeroByte()
+	buffer[0] ^= rnd
+	buffer[1] = rnd
+	binary.LittleEndian.PutUint16(buffer[2:], uint16(dummyLength))
+	randomBytes(buffer[length : length+dummyLength])
+	length += dummyLength
+	xorData(buffer, obfuscatedSpan(length, obfuscateBytes), key)
+	return length
+}
+
+// EncodeCover fills buffer[:length] with an obfuscated packet that is
+// padding from end to end: Decode reduces it to zero bytes, which every
+// receiver drops.
+func EncodeCover(buffer []byte, length int, key []byte, obfuscateBytes int) int {
+	if length < 4 || length > 0xFFFF {
+		return -1
+	}
+	randomBytes(buffer[:length])
+	buffer[1] = randomNonZeroByte()
+	binary.LittleEndian.PutUint16(buffer[2:], uint16(length))
+	xorData(buffer, obfuscatedSpan(length, obfuscateBytes), key)
+	return length
+}
+
+// Decode deobfuscates buffer[:length] in place and returns the payload length.
+// version reports the protocol version detected in the packet header.
+func Decode(buffer []byte, length int, key []byte, obfuscateBytes int) (n int, version uint8) {
+	xorData(buffer, obfuscatedSpan(length, obfuscateBytes), key)
+	if buffer[0] >= 1 && buffer[0] <= 4 && buffer[1]|buffer[2]|buffer[3] == 0 {
+		return length, 0
+	}
+	buffer[0] ^= buffer[1]
+	length -= int(binary.LittleEndian.Uint16(buffer[2:]))
+	buffer[1], buffer[2], buffer[3] = 0, 0, 0
+	return length, 0
+}
+
+// XOR applies the keystream to buffer[:length] in place. Encode and Decode
+// already do this; it is exported for the golden-vector regression tests.
+func XOR(buffer []byte, length int, key []byte) {
+	xorData(buffer, length, key)
+}
+
+// StreamCipher is the continuous keystream used for SOCKS5 TCP streams.
+type StreamCipher struct {
+	crc      byte
+	ki       int
+	adjusted []byte
+	key      [maxXORKeyLength]byte
+}
+
+func NewStreamCipher(key []byte) *StreamCipher {
+	s := &StreamCipher{}
+	s.adjusted = adjustKey(&s.key, key, byte(min(len(key), maxXORKeyLength)))
+	return s
+}
+
+func (s *StreamCipher) Apply(buffer []byte) {
+	s.crc, s.ki = applyKeystream(buffer, s.crc, s.ki, s.adjusted)
+}
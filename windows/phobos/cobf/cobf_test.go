@@ -44,6 +44,54 @@ func roundTrip(t *testing.T, key, payload []byte, obfuscateBytes int) {
 	}
 }
 
+// Padding that carries the packet across obfuscate-bytes must still decode:
+// both sides judge the obfuscated span on the padded length.
+func TestEncodePaddedRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	buf := make([]byte, 65535)
+	for _, key := range testKeys {
+		for _, obfuscateBytes := range []int{0, 16, 148, 512} {
+			for _, length := range []int{32, 92, 148, 1420} {
+				for _, dummy := range []int{0, 1, 100, 1472 - length, 9000} {
+					payload := wirePacket(rng, length)
+					copy(buf, payload)
+					n := EncodePadded(buf, length, key, dummy, obfuscateBytes)
+					if n != length+dummy {
+						t.Fatalf("encoded %d bytes, want %d", n, length+dummy)
+					}
+					got, _ := Decode(buf, n, key, obfuscateBytes)
+					if got != length || !bytes.Equal(buf[:got], payload) {
+						t.Fatalf("padded round trip corrupted the payload: keylen=%d length=%d dummy=%d obf=%d",
+							len(key), length, dummy, obfuscateBytes)
+					}
+				}
+			}
+		}
+	}
+	if n := EncodePadded(buf, 32, testKeys[0], 0x10000, 0); n != -1 {
+		t.Fatalf("oversized padding encoded to %d bytes", n)
+	}
+}
+
+func TestEncodeCoverDecodesToNothing(t *testing.T) {
+	buf := make([]byte, 65535)
+	for _, key := range testKeys {
+		for _, obfuscateBytes := range []int{0, 16, 512} {
+			for _, length := range []int{4, 64, 1200, 9000} {
+				if n := EncodeCover(buf, length, key, obfuscateBytes); n != length {
+					t.Fatalf("cover encoded to %d bytes, want %d", n, length)
+				}
+				if got, _ := Decode(buf, length, key, obfuscateBytes); got != 0 {
+					t.Fatalf("cover of %d bytes decoded to %d bytes: keylen=%d obf=%d", length, got, len(key), obfuscateBytes)
+				}
+			}
+		}
+	}
+	if n := EncodeCover(buf, 3, testKeys[0], 0); n != -1 {
+		t.Fatalf("a 3-byte cover encoded to %d bytes", n)
+	}
+}
+
 // Covers the window where the encoder used to pick a different obfuscation
 // span than the decoder: obfuscate-bytes at or above the payload length.
 func TestEncodeDecodeRoundTrip(t *testing.T) {
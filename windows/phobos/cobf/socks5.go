@@ -1,3 +1,5 @@
+//go:build cgo && !phobospurego
+
 /* SPDX-License-Identifier: MIT
  *
  * Phobos
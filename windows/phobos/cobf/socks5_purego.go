@@ -0,0 +1,71 @@
+//go:build phobospurego || !cgo
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package cobf
+
+import "encoding/binary"
+
+// MaxTargetSize is the largest SOCKS5 address block: ATYP, domain length,
+// a 255-byte domain and the port.
+const MaxTargetSize = 1 + 1 + 255 + 2
+
+const (
+	s5AtypIPv4   = 0x01
+	s5AtypDomain = 0x03
+	s5AtypIPv6   = 0x04
+)
+
+// ParseTarget decodes the ATYP/address/port block at the start of buf.
+// consumed > 0 is the number of bytes read; consumed == 0 means buf is still
+// incomplete; consumed < 0 means the address type is not supported. addr
+// aliases buf rather than copying.
+func ParseTarget(buf []byte) (atyp byte, addr []byte, port uint16, consumed int) {
+	if len(buf) == 0 {
+		return 0, nil, 0, 0
+	}
+	start, addrLength := 1, 0
+	switch buf[0] {
+	case s5AtypIPv4:
+		addrLength = 4
+	case s5AtypIPv6:
+		addrLength = 16
+	case s5AtypDomain:
+		if len(buf) < 2 {
+			return 0, nil, 0, 0
+		}
+		start, addrLength = 2, int(buf[1])
+	default:
+		return 0, nil, 0, -1
+	}
+	end := start + addrLength
+	if len(buf) < end+2 {
+		return 0, nil, 0, 0
+	}
+	return buf[0], buf[start:end], binary.BigEndian.Uint16(buf[end:]), end + 2
+}
+
+// BuildTarget writes the ATYP/address/port block into out and returns its
+// length, or -1 when out is too small. It never allocates.
+func BuildTarget(out []byte, atyp byte, addr []byte, port uint16) int {
+	if len(out) == 0 || len(addr) > 256 {
+		return -1
+	}
+	p := 1
+	if atyp == s5AtypDomain {
+		p = 2
+	}
+	if p+len(addr)+2 > len(out) {
+		return -1
+	}
+	out[0] = atyp
+	if atyp == s5AtypDomain {
+		out[1] = byte(len(addr))
+	}
+	p += copy(out[p:], addr)
+	binary.BigEndian.PutUint16(out[p:], port)
+	return p + 2
+}
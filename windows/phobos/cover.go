@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import "time"
+
+const (
+	coverPollInterval = time.Second
+	coverMinFrame     = 64
+	coverMaxFrame     = 1200
+)
+
+// coverMasker is implemented by maskers that imitate a stream with a steady
+// frame rate, which the proxy keeps up with cover frames while WireGuard has
+// nothing to send.
+type coverMasker interface {
+	frameInterval() time.Duration
+}
+
+// coverState is what coverLoop carries between frames: a token bucket that
+// refills at CoverBudget bytes per second and holds at most a second of it.
+type coverState struct {
+	buf    []byte
+	rng    rng32
+	tokens int
+	last   time.Time
+}
+
+func (p *UDPProxy) coverLoop() {
+	cover := &coverState{buf: make([]byte, BufferSize), rng: newRNG32(), last: time.Now()}
+	timer := time.NewTimer(coverPollInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-timer.C:
+			timer.Reset(p.sendCover(cover, p.current(), now))
+		}
+	}
+}
+
+// sendCover sends a cover frame once the tunnel has been quiet for a frame
+// interval and the budget holds one, and returns when to look again. A cover
+// frame is an obfuscated packet made entirely of padding, so the server
+// decodes it to nothing and drops it, wrapped by the masker like tunnel data
+// so the RTP sequence and timestamps run on without a gap.
+func (p *UDPProxy) sendCover(cover *coverState, s *proxySettings, now time.Time) time.Duration {
+	elapsed := now.Sub(cover.last)
+	cover.last = now
+	if s.CoverBudget <= 0 {
+		cover.tokens = 0
+		return coverPollInterval
+	}
+	burst := max(s.CoverBudget, coverMaxFrame)
+	cover.tokens = min(cover.tokens+int(int64(s.CoverBudget)*int64(elapsed)/int64(time.Second)), burst)
+	if p.client.Load() == nil || p.detecting.Load() {
+		return coverPollInterval
+	}
+
+	p.maskerMu.Lock()
+	defer p.maskerMu.Unlock()
+	masker, ok := p.masker.(coverMasker)
+	if !ok {
+		return coverPollInterval
+	}
+	interval := masker.frameInterval()
+	if quiet := now.Sub(time.Unix(0, p.lastTunnel.Load())); quiet < interval {
+		return interval - quiet
+	}
+	average := int(int64(s.CoverBudget) * int64(interval) / int64(time.Second))
+	size := min(max(average/2+cover.rng.below(average+1), coverMinFrame), coverMaxFrame)
+	if size > cover.tokens {
+		return interval
+	}
+
+	obfuscator := s.keys.obfuscators[s.keys.sendIndex(now)]
+	n := obfuscator.EncodeCover(cover.buf, size-wrapOverhead(p.masking, s.Media), s.obfuscateBytes(p.masking))
+	if n < 0 {
+		return interval
+	}
+	if n = p.masker.OnDataWrap(cover.buf, n); n < 0 {
+		return interval
+	}
+	if _, err := p.sendToServer(cover.buf[:n]); err != nil {
+		return interval
+	}
+	cover.tokens -= n
+	p.counters.coverPackets.Add(1)
+	p.counters.coverBytes.Add(uint64(n))
+	return interval
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPProxyCoverTraffic(t *testing.T) {
+	const budget = 2000
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:         conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Key:            key,
+		Masking:        MaskingMEDIA,
+		Media:          MediaParams{PayloadType: 102, SSRC: 0xC0FFEE, TimestampStep: 3000},
+		MaxDummy:       DefaultMaxDummy,
+		ObfuscateBytes: MediaObfuscateBytesDefault,
+		CoverBudget:    budget,
+		Logf:           t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(dataPacket(64, 1)); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+
+	obfuscator := NewObfuscator(key)
+	buf := make([]byte, BufferSize)
+	var sequence uint16
+	var frames, bytes int
+	var window time.Time
+	for window.IsZero() || time.Since(window) < 2*time.Second {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("upstream went quiet after %d cover frames: %v", frames, err)
+		}
+		if stunHasMagic(buf[:n]) {
+			continue
+		}
+		if n < rtpHeaderSize+4 || binary.BigEndian.Uint32(buf[8:]) != 0xC0FFEE {
+			t.Fatalf("%d bytes upstream are not an RTP packet of the stream", n)
+		}
+		next := binary.BigEndian.Uint16(buf[2:])
+		if !window.IsZero() && next != sequence+1 {
+			t.Fatalf("RTP sequence jumped from %d to %d", sequence, next)
+		}
+		sequence = next
+		decoded := obfuscator.Decode(buf[rtpHeaderSize:], n-rtpHeaderSize, MediaObfuscateBytesDefault)
+		if window.IsZero() {
+			if decoded != 64 {
+				t.Fatalf("tunnel packet decoded to %d bytes", decoded)
+			}
+			window = time.Now()
+			continue
+		}
+		if decoded != 0 {
+			t.Fatalf("cover frame of %d bytes decoded to %d bytes", n, decoded)
+		}
+		frames++
+		bytes += n
+	}
+	if frames < 10 {
+		t.Fatalf("only %d cover frames in two idle seconds", frames)
+	}
+	if bytes > 3*budget {
+		t.Fatalf("%d bytes of cover in two seconds exceed a budget of %d bytes per second", bytes, budget)
+	}
+	if stats := proxy.Stats(); stats.CoverPackets < uint64(frames) {
+		t.Fatalf("%d cover packets counted, %d seen", stats.CoverPackets, frames)
+	}
+}
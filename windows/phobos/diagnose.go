@@ -0,0 +1,428 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultDiagnoseTimeout is how long Diagnose waits for each probe.
+const DefaultDiagnoseTimeout = 3 * time.Second
+
+// DiagnoseConfig is the obfuscator instance Diagnose probes.
+type DiagnoseConfig struct {
+	Socks5         bool
+	Target         string
+	TargetLastPort uint16
+	Resolver       Resolver
+	Key            []byte
+	Masking        Masking
+	Media          MediaParams
+	ObfuscateBytes int
+	Login          string
+	Password       string
+
+	// WireGuard, when set, makes the UDP handshake probe a real initiation
+	// that the WireGuard behind the server answers. The server then moves
+	// the peer's endpoint to the probe, taking a running tunnel's traffic
+	// with it until the tunnel sends again, so it is for a tunnel that is
+	// down. Without it the probe only has the shape of one, and nothing past
+	// the masking can answer.
+	WireGuard *WireGuardKeys
+
+	Timeout time.Duration
+	Control SocketControl
+}
+
+type DiagnoseVerdict int
+
+const (
+	DiagnoseOK DiagnoseVerdict = iota
+	DiagnoseUnreachable
+	DiagnoseServerDown
+	DiagnoseWrongMasking
+	DiagnoseWrongKey
+	DiagnoseAuthFailed
+	DiagnoseNoHandshake
+	DiagnoseKeyUnchecked
+)
+
+func (v DiagnoseVerdict) String() string {
+	switch v {
+	case DiagnoseOK:
+		return "the server answers"
+	case DiagnoseUnreachable:
+		return "no answer: the traffic is blocked or the server is down"
+	case DiagnoseServerDown:
+		return "connection refused: the server is down"
+	case DiagnoseWrongMasking:
+		return "wrong masking"
+	case DiagnoseWrongKey:
+		return "wrong key"
+	case DiagnoseAuthFailed:
+		return "the server turned down the SOCKS5 login and password"
+	case DiagnoseNoHandshake:
+		return "the server answers, but not the handshake: check the key"
+	case DiagnoseKeyUnchecked:
+		return "the server answers; only a real handshake probe checks the key"
+	}
+	return "unknown"
+}
+
+// DiagnoseResult is the outcome of one probe. Masking is empty for probes
+// sent unmasked.
+type DiagnoseResult struct {
+	Probe   string
+	Masking string
+	Outcome string
+	RTT     time.Duration
+}
+
+const (
+	outcomeAnswered       = "answered"
+	outcomeMaskingAnswers = "masking answered"
+	outcomeNoAnswer       = "no answer"
+	outcomeAuthFailed     = "authentication failed"
+	outcomeGarbled        = "garbled answer"
+)
+
+type DiagnoseReport struct {
+	Target  netip.AddrPort
+	Results []DiagnoseResult
+	Verdict DiagnoseVerdict
+	// Masking is the masking the server answered under, for the OK and
+	// wrong masking verdicts.
+	Masking Masking
+}
+
+func (r *DiagnoseReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Target %v\n", r.Target)
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBE\tMASKING\tRESULT\tRTT")
+	for _, result := range r.Results {
+		masking, rtt := result.Masking, "-"
+		if masking == "" {
+			masking = "-"
+		}
+		if result.RTT > 0 {
+			rtt = result.RTT.Round(time.Millisecond / 10).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Probe, masking, result.Outcome, rtt)
+	}
+	w.Flush()
+	fmt.Fprintf(&b, "Verdict: %v", r.Verdict)
+	if r.Verdict == DiagnoseWrongMasking {
+		fmt.Fprintf(&b, ", the server answers %v", r.Masking)
+	}
+	return b.String()
+}
+
+// Diagnose probes the server of an obfuscator instance to tell a blocked
+// network from a server that is down, a wrong key and a wrong masking. A
+// UDP instance gets a STUN binding request and a handshake probe under
+// every masking mode, a SOCKS5 instance a TCP connection and the SOCKS5
+// greeting under every mode. The configured masking is probed first.
+func Diagnose(ctx context.Context, config DiagnoseConfig) (*DiagnoseReport, error) {
+	if len(config.Key) == 0 {
+		return nil, errors.New("phobos: obfuscation key is empty")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultDiagnoseTimeout
+	}
+	target, err := resolveTarget(config.Resolver, config.Target)
+	if err != nil {
+		return nil, fmt.Errorf("phobos: unable to resolve obfuscator target %s: %w", config.Target, err)
+	}
+	if config.TargetLastPort > target.Port() {
+		port := scheduledPort(config.Key, target.Port(), config.TargetLastPort, portSlot(time.Now(), DefaultPortSlot))
+		target = netip.AddrPortFrom(target.Addr(), port)
+	}
+	d := &diagnosis{DiagnoseConfig: config, target: target}
+	report := &DiagnoseReport{Target: target}
+	if config.Socks5 {
+		d.diagnoseStream(ctx, report)
+	} else {
+		d.diagnoseDatagram(ctx, report)
+	}
+	return report, nil
+}
+
+type diagnosis struct {
+	DiagnoseConfig
+	target netip.AddrPort
+}
+
+// candidates lists the maskings to probe under, the configured one first.
+// AUTO stands for all of them, so it is not probed as such.
+func (d *diagnosis) candidates(supported func(Masking) bool) []Masking {
+	var maskings []Masking
+	if d.Masking != MaskingAuto {
+		maskings = append(maskings, d.Masking)
+	}
+	maskingRegistry.RLock()
+	count := len(maskingRegistry.entries)
+	maskingRegistry.RUnlock()
+	for i := range count {
+		if m := Masking(i); m != d.Masking && m != MaskingAuto && supported(m) {
+			maskings = append(maskings, m)
+		}
+	}
+	return maskings
+}
+
+// configured reports whether the configuration asks for masking.
+func (d *diagnosis) configured(masking Masking) bool {
+	return d.Masking == MaskingAuto || d.Masking == masking
+}
+
+func (d *diagnosis) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: d.Timeout, Control: d.Control}
+}
+
+// probeAll runs probe under every masking at once and returns the results
+// in the order of the maskings.
+func probeAll(maskings []Masking, probe func(Masking) DiagnoseResult) []DiagnoseResult {
+	results := make([]DiagnoseResult, len(maskings))
+	var wait sync.WaitGroup
+	for i, masking := range maskings {
+		wait.Go(func() { results[i] = probe(masking) })
+	}
+	wait.Wait()
+	return results
+}
+
+func (d *diagnosis) diagnoseDatagram(ctx context.Context, report *DiagnoseReport) {
+	maskings := d.candidates(Masking.Datagram)
+	var stun DiagnoseResult
+	var results []DiagnoseResult
+	var wait sync.WaitGroup
+	wait.Go(func() { stun = d.probeSTUN(ctx) })
+	wait.Go(func() {
+		results = probeAll(maskings, func(m Masking) DiagnoseResult { return d.probeHandshake(ctx, m) })
+	})
+	wait.Wait()
+	report.Results = append([]DiagnoseResult{stun}, results...)
+
+	report.Verdict = DiagnoseUnreachable
+	if stun.Outcome == outcomeAnswered {
+		report.Verdict = DiagnoseNoHandshake
+	}
+	for i, result := range results {
+		switch result.Outcome {
+		case outcomeAnswered:
+			if d.configured(maskings[i]) {
+				report.Verdict, report.Masking = DiagnoseOK, maskings[i]
+				return
+			}
+			if report.Verdict != DiagnoseWrongMasking {
+				report.Verdict, report.Masking = DiagnoseWrongMasking, maskings[i]
+			}
+		case rejectComment("key"), rejectComment("length"):
+			if report.Verdict != DiagnoseWrongMasking && d.configured(maskings[i]) {
+				report.Verdict = DiagnoseWrongKey
+			}
+		case outcomeMaskingAnswers:
+			if report.Verdict == DiagnoseUnreachable {
+				report.Verdict = DiagnoseNoHandshake
+			}
+		}
+	}
+	// WireGuard drops a probe that only has the shape of a handshake, so
+	// its silence says nothing about the key.
+	if report.Verdict == DiagnoseNoHandshake && d.WireGuard == nil {
+		report.Verdict = DiagnoseKeyUnchecked
+	}
+}
+
+// dial opens a socket of its own for one probe, so that what the server
+// learns from one probe does not spill into the next, and bounds it by the
+// probe timeout.
+func (d *diagnosis) dial(ctx context.Context, network string) (net.Conn, error) {
+	conn, err := d.dialer().DialContext(ctx, network, d.target.String())
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(d.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+func (d *diagnosis) probeSTUN(ctx context.Context) DiagnoseResult {
+	result := DiagnoseResult{Probe: "STUN binding", Outcome: outcomeNoAnswer}
+	conn, err := d.dial(ctx, "udp")
+	if err != nil {
+		result.Outcome = err.Error()
+		return result
+	}
+	defer conn.Close()
+	rng := newRNG32()
+	buf := make([]byte, BufferSize)
+	request := buf[:stunBuildBindingRequest(buf, &rng)]
+	txid := string(request[8:20])
+	start := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		result.Outcome = err.Error()
+		return result
+	}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return result
+		}
+		if n >= stunHeaderSize && stunHasMagic(buf[:n]) && stunMessageType(buf) == stunBindingResponse && string(buf[8:20]) == txid {
+			result.Outcome, result.RTT = outcomeAnswered, time.Since(start)
+			return result
+		}
+	}
+}
+
+// handshakeProbe is the handshake initiation a probe sends: a real one when
+// the WireGuard keys are known, else random bytes of the same size and type.
+func (d *diagnosis) handshakeProbe(buf []byte) (int, error) {
+	if d.WireGuard != nil {
+		return handshakeInitiationSize, buildHandshakeInitiation(buf, *d.WireGuard)
+	}
+	rng := newRNG32()
+	rng.fill(buf[:handshakeInitiationSize])
+	buf[0], buf[1], buf[2], buf[3] = TypeHandshake, 0, 0, 0
+	return handshakeInitiationSize, nil
+}
+
+func (d *diagnosis) probeHandshake(ctx context.Context, masking Masking) DiagnoseResult {
+	result := DiagnoseResult{Probe: "handshake", Masking: masking.String(), Outcome: outcomeNoAnswer}
+	obfuscateBytes := obfuscateBytesUnder(masking, d.Masking, d.ObfuscateBytes)
+	conn, err := d.dial(ctx, "udp")
+	if err != nil {
+		result.Outcome = err.Error()
+		return result
+	}
+	defer conn.Close()
+	send := func(p []byte) (int, error) { return conn.Write(p) }
+
+	buf := make([]byte, BufferSize)
+	n, err := d.handshakeProbe(buf)
+	if err != nil {
+		result.Outcome = err.Error()
+		return result
+	}
+	start := time.Now()
+	masker := NewMasker(masking, d.Media)
+	if masker != nil {
+		masker.OnHandshakeRequest(send)
+	}
+	n = NewObfuscator(d.Key).Encode(buf, n, DefaultMaxDummy, obfuscateBytes)
+	if masker != nil {
+		n = masker.OnDataWrap(buf, n)
+	}
+	if n < 0 {
+		result.Outcome = "unable to mask the probe"
+		return result
+	}
+	// A masker that holds the probe until its own handshake is done sends
+	// it from OnDataUnwrap instead.
+	if n > 0 {
+		if _, err := conn.Write(buf[:n]); err != nil {
+			result.Outcome = err.Error()
+			return result
+		}
+	}
+
+	keys := newKeyRing(d.Key, nil)
+	scratch := make([]byte, BufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return result
+		}
+		if masker != nil {
+			n = masker.OnDataUnwrap(buf, n, d.target, send)
+		}
+		length, stage := decodeUnwrapped(keys, buf, scratch, n, obfuscateBytes)
+		switch {
+		case length > 0:
+			result.Outcome, result.RTT = outcomeAnswered, time.Since(start)
+			return result
+		case stage != "":
+			result.Outcome, result.RTT = rejectComment(stage), time.Since(start)
+		case result.Outcome == outcomeNoAnswer:
+			result.Outcome, result.RTT = outcomeMaskingAnswers, time.Since(start)
+		}
+	}
+}
+
+func (d *diagnosis) diagnoseStream(ctx context.Context, report *DiagnoseReport) {
+	connect := DiagnoseResult{Probe: "TCP connect", Outcome: outcomeAnswered}
+	start := time.Now()
+	conn, err := d.dialer().DialContext(ctx, "tcp", d.target.String())
+	if err != nil {
+		connect.Outcome = err.Error()
+		report.Results = []DiagnoseResult{connect}
+		report.Verdict = DiagnoseUnreachable
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			report.Verdict = DiagnoseServerDown
+		}
+		return
+	}
+	connect.RTT = time.Since(start)
+	conn.Close()
+
+	maskings := d.candidates(Masking.Stream)
+	results := probeAll(maskings, func(m Masking) DiagnoseResult { return d.probeGreeting(ctx, m) })
+	report.Results = append([]DiagnoseResult{connect}, results...)
+
+	// The server drops a greeting it cannot read, so one that goes
+	// unanswered under every masking points at the key.
+	report.Verdict = DiagnoseWrongKey
+	for i, result := range results {
+		if result.Outcome != outcomeAnswered && result.Outcome != outcomeAuthFailed {
+			continue
+		}
+		if d.configured(maskings[i]) {
+			report.Verdict, report.Masking = DiagnoseOK, maskings[i]
+			if result.Outcome != outcomeAnswered {
+				report.Verdict = DiagnoseAuthFailed
+			}
+			return
+		}
+		if report.Verdict != DiagnoseWrongMasking {
+			report.Verdict, report.Masking = DiagnoseWrongMasking, maskings[i]
+		}
+	}
+}
+
+func (d *diagnosis) probeGreeting(ctx context.Context, masking Masking) DiagnoseResult {
+	result := DiagnoseResult{Probe: "SOCKS5 greeting", Masking: masking.String(), Outcome: outcomeNoAnswer}
+	conn, err := d.dial(ctx, "tcp")
+	if err != nil {
+		result.Outcome = err.Error()
+		return result
+	}
+	defer conn.Close()
+	settings := &socks5Settings{Socks5Config: Socks5Config{Login: d.Login, Password: d.Password}}
+	start := time.Now()
+	switch err := (*Socks5Client)(nil).negotiate(newObfConn(conn, d.Key, masking, d.Media, nil), settings); {
+	case err == nil:
+		result.Outcome, result.RTT = outcomeAnswered, time.Since(start)
+	case errors.Is(err, errAuthFailed):
+		result.Outcome, result.RTT = outcomeAuthFailed, time.Since(start)
+	case errors.Is(err, errNotSocks5):
+		result.Outcome, result.RTT = outcomeGarbled, time.Since(start)
+	}
+	return result
+}
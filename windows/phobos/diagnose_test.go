@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// TestHandshakeInitiationOpensForResponder consumes an initiation the way
+// the responder does and checks that it yields the initiator's static key.
+func TestHandshakeInitiationOpensForResponder(t *testing.T) {
+	var keys WireGuardKeys
+	var responderPrivate [32]byte
+	rand.Read(keys.PrivateKey[:])
+	rand.Read(responderPrivate[:])
+	responderPublic, _ := curve25519.X25519(responderPrivate[:], curve25519.Basepoint)
+	copy(keys.PeerPublicKey[:], responderPublic)
+	initiatorPublic, _ := curve25519.X25519(keys.PrivateKey[:], curve25519.Basepoint)
+
+	msg := make([]byte, handshakeInitiationSize)
+	if err := buildHandshakeInitiation(msg, keys); err != nil {
+		t.Fatalf("unable to build initiation: %v", err)
+	}
+	if PacketType(msg) != TypeHandshake {
+		t.Fatalf("initiation has type %d", PacketType(msg))
+	}
+	mac1Key := blake2sHash([]byte(noiseLabelMAC1), responderPublic)
+	mac, _ := blake2s.New128(mac1Key[:])
+	mac.Write(msg[:handshakeMAC1Offset])
+	if !bytes.Equal(mac.Sum(nil), msg[handshakeMAC1Offset:handshakeMAC1Offset+16]) {
+		t.Fatal("mac1 does not verify")
+	}
+
+	chainingKey := blake2sHash([]byte(noiseConstruction))
+	h := blake2sHash(chainingKey[:], []byte(noiseIdentifier))
+	h = blake2sHash(h[:], responderPublic)
+	ephemeral := msg[8:40]
+	prk := blake2sHMAC(chainingKey[:], ephemeral)
+	chainingKey = blake2sHMAC(prk[:], []byte{1})
+	h = blake2sHash(h[:], ephemeral)
+	shared, _ := curve25519.X25519(responderPrivate[:], ephemeral)
+	key := noiseKDF2(&chainingKey, shared)
+	aead, _ := chacha20poly1305.New(key[:])
+	static, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), msg[40:88], h[:])
+	if err != nil || !bytes.Equal(static, initiatorPublic) {
+		t.Fatalf("static key opened to %x, %v", static, err)
+	}
+	h = blake2sHash(h[:], msg[40:88])
+	shared, _ = curve25519.X25519(responderPrivate[:], static)
+	key = noiseKDF2(&chainingKey, shared)
+	aead, _ = chacha20poly1305.New(key[:])
+	if _, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), msg[88:116], h[:]); err != nil {
+		t.Fatalf("timestamp does not open: %v", err)
+	}
+}
+
+func closedPort(t *testing.T, network string) netip.AddrPort {
+	t.Helper()
+	var addr netip.AddrPort
+	if network == "tcp" {
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to listen: %v", err)
+		}
+		addr = listener.Addr().(*net.TCPAddr).AddrPort()
+		listener.Close()
+	} else {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("unable to listen: %v", err)
+		}
+		addr = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+		conn.Close()
+	}
+	return addr
+}
+
+func TestDiagnoseDatagram(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	otherKey := []byte("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	cases := []struct {
+		name    string
+		target  netip.AddrPort
+		masking Masking
+		shaped  bool
+		verdict DiagnoseVerdict
+		answers Masking
+	}{
+		{"ok", startFakeServer(t, key, MaskingSTUN, MediaParams{}, 0).addr(), MaskingSTUN, false, DiagnoseOK, MaskingSTUN},
+		{"auto", startFakeServer(t, key, MaskingSTUN, MediaParams{}, 0).addr(), MaskingAuto, false, DiagnoseOK, MaskingSTUN},
+		{"wrong masking", startFakeServer(t, key, MaskingTLS, MediaParams{}, 0).addr(), MaskingSTUN, false, DiagnoseWrongMasking, MaskingTLS},
+		{"wrong key", startFakeServer(t, otherKey, MaskingSTUN, MediaParams{}, 0).addr(), MaskingSTUN, false, DiagnoseNoHandshake, MaskingNone},
+		{"shaped probe", startFakeServer(t, otherKey, MaskingSTUN, MediaParams{}, 0).addr(), MaskingSTUN, true, DiagnoseKeyUnchecked, MaskingNone},
+		{"unreachable", closedPort(t, "udp"), MaskingSTUN, false, DiagnoseUnreachable, MaskingNone},
+	}
+	var keys WireGuardKeys
+	rand.Read(keys.PrivateKey[:])
+	rand.Read(keys.PeerPublicKey[:])
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := DiagnoseConfig{
+				Target:    c.target.String(),
+				Key:       key,
+				Masking:   c.masking,
+				WireGuard: &keys,
+				Timeout:   500 * time.Millisecond,
+			}
+			if c.shaped {
+				config.WireGuard = nil
+			}
+			report, err := Diagnose(context.Background(), config)
+			if err != nil {
+				t.Fatalf("unable to diagnose: %v", err)
+			}
+			if report.Verdict != c.verdict || (c.verdict == DiagnoseOK || c.verdict == DiagnoseWrongMasking) && report.Masking != c.answers {
+				t.Fatalf("verdict %v under %v, want %v under %v\n%v", report.Verdict, report.Masking, c.verdict, c.answers, report)
+			}
+			if report.Results[0].Probe != "STUN binding" || len(report.Results) < 2 {
+				t.Fatalf("unexpected probes:\n%v", report)
+			}
+		})
+	}
+}
+
+func TestDiagnoseStream(t *testing.T) {
+	cases := []struct {
+		name     string
+		target   netip.AddrPort
+		password string
+		verdict  DiagnoseVerdict
+	}{
+		{"ok", startFakeSocks5Server(t, socks5TestKey, MaskingSTUN, MediaParams{}, "user", "pass").addr(), "pass", DiagnoseOK},
+		{"wrong password", startFakeSocks5Server(t, socks5TestKey, MaskingSTUN, MediaParams{}, "user", "pass").addr(), "wrong", DiagnoseAuthFailed},
+		{"wrong masking", startFakeSocks5Server(t, socks5TestKey, MaskingTLS, MediaParams{}, "user", "pass").addr(), "pass", DiagnoseWrongMasking},
+		{"wrong key", startFakeSocks5Server(t, []byte("another key"), MaskingSTUN, MediaParams{}, "user", "pass").addr(), "pass", DiagnoseWrongKey},
+		{"server down", closedPort(t, "tcp"), "pass", DiagnoseServerDown},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			report, err := Diagnose(context.Background(), DiagnoseConfig{
+				Socks5:   true,
+				Target:   c.target.String(),
+				Key:      socks5TestKey,
+				Masking:  MaskingSTUN,
+				Login:    "user",
+				Password: c.password,
+				Timeout:  500 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("unable to diagnose: %v", err)
+			}
+			if report.Verdict != c.verdict {
+				t.Fatalf("verdict %v, want %v\n%v", report.Verdict, c.verdict, report)
+			}
+			if c.verdict == DiagnoseWrongMasking && !strings.Contains(report.String(), "the server answers TLS") {
+				t.Fatalf("report does not name the masking:\n%v", report)
+			}
+		})
+	}
+}
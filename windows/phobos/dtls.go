@@ -0,0 +1,300 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	dtlsContentChangeCipherSpec = 20
+	dtlsContentHandshake        = 22
+	dtlsContentApplicationData  = 23
+
+	dtlsHandshakeClientHello       = 1
+	dtlsHandshakeServerHello       = 2
+	dtlsHandshakeServerHelloDone   = 14
+	dtlsHandshakeClientKeyExchange = 16
+
+	dtlsRecordHeaderSize    = 13
+	dtlsHandshakeHeaderSize = 12
+	dtlsExplicitNonceSize   = 8
+	dtlsAEADTagSize         = 16
+	dtlsEncryptedFinished   = dtlsExplicitNonceSize + dtlsHandshakeHeaderSize + 12 + dtlsAEADTagSize
+	dtlsFlightMax           = 512
+
+	// dtlsRetransmitInitial and dtlsRetransmitMax bound the timer that
+	// resends an unanswered flight, doubled on each try (RFC 6347 §4.2.4.1).
+	dtlsRetransmitInitial = time.Second
+	dtlsRetransmitMax     = time.Minute
+)
+
+var (
+	dtlsVersion = [2]byte{0xFE, 0xFD}
+
+	// dtlsCipherSuites is the ECDHE/AEAD list a current browser offers.
+	dtlsCipherSuites = [...]uint16{0xC02B, 0xC02F, 0xCCA9, 0xCCA8, 0xC00A, 0xC014, 0xC009, 0xC013}
+)
+
+// dtlsSession numbers DTLS 1.2 records the way a real endpoint would: a
+// 48-bit sequence per epoch and one message_seq across the handshake.
+type dtlsSession struct {
+	sequence   [2]uint64
+	messageSeq uint16
+}
+
+func dtlsIsRecord(buf []byte) bool {
+	return len(buf) >= dtlsRecordHeaderSize && buf[1] == dtlsVersion[0] && buf[2] == dtlsVersion[1]
+}
+
+// isDTLS tells a DTLS record apart from the STUN and RTP sharing its
+// 5-tuple by the first byte, as RFC 7983 demultiplexes them.
+func isDTLS(buf []byte) bool {
+	return len(buf) > 0 && buf[0] >= 20 && buf[0] <= 63 && dtlsIsRecord(buf)
+}
+
+func dtlsRecordEpoch(buf []byte) uint16 {
+	return binary.BigEndian.Uint16(buf[3:])
+}
+
+func dtlsRecordLength(buf []byte) int {
+	return int(binary.BigEndian.Uint16(buf[11:]))
+}
+
+func put24(buf []byte, value int) {
+	buf[0] = byte(value >> 16)
+	buf[1] = byte(value >> 8)
+	buf[2] = byte(value)
+}
+
+func (s *dtlsSession) writeRecordHeader(buf []byte, contentType byte, epoch uint16, length int) {
+	sequence := s.sequence[epoch&1]
+	s.sequence[epoch&1]++
+	buf[0] = contentType
+	buf[1], buf[2] = dtlsVersion[0], dtlsVersion[1]
+	binary.BigEndian.PutUint16(buf[3:], epoch)
+	binary.BigEndian.PutUint16(buf[5:], uint16(sequence>>32))
+	binary.BigEndian.PutUint32(buf[7:], uint32(sequence))
+	binary.BigEndian.PutUint16(buf[11:], uint16(length))
+}
+
+func (s *dtlsSession) appendRecord(out []byte, contentType byte, epoch uint16, body func([]byte) []byte) []byte {
+	start := len(out)
+	out = append(out, make([]byte, dtlsRecordHeaderSize)...)
+	out = body(out)
+	s.writeRecordHeader(out[start:], contentType, epoch, len(out)-start-dtlsRecordHeaderSize)
+	return out
+}
+
+func (s *dtlsSession) appendHandshake(out []byte, messageType byte, body func([]byte) []byte) []byte {
+	start := len(out)
+	out = append(out, messageType, 0, 0, 0)
+	out = binary.BigEndian.AppendUint16(out, s.messageSeq)
+	out = append(out, 0, 0, 0, 0, 0, 0)
+	s.messageSeq++
+	out = body(out)
+	length := len(out) - start - dtlsHandshakeHeaderSize
+	put24(out[start+1:], length)
+	put24(out[start+9:], length)
+	return out
+}
+
+func appendExtension(out []byte, extensionType uint16, data ...byte) []byte {
+	out = binary.BigEndian.AppendUint16(out, extensionType)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(data)))
+	return append(out, data...)
+}
+
+func appendRandom(out []byte, length int, rng *rng32) []byte {
+	start := len(out)
+	out = append(out, make([]byte, length)...)
+	rng.fill(out[start:])
+	return out
+}
+
+// appendClientHello writes a single-record ClientHello. extra carries
+// ready-made extensions, such as use_srtp for a WebRTC profile.
+func (s *dtlsSession) appendClientHello(out []byte, rng *rng32, extra []byte) []byte {
+	return s.appendRecord(out, dtlsContentHandshake, 0, func(out []byte) []byte {
+		return s.appendHandshake(out, dtlsHandshakeClientHello, func(out []byte) []byte {
+			out = append(out, dtlsVersion[:]...)
+			out = appendRandom(out, 32, rng)
+			out = append(out, 0, 0)
+			out = binary.BigEndian.AppendUint16(out, uint16(2*len(dtlsCipherSuites)))
+			for _, suite := range dtlsCipherSuites {
+				out = binary.BigEndian.AppendUint16(out, suite)
+			}
+			out = append(out, 1, 0)
+
+			extensionsStart := len(out)
+			out = append(out, 0, 0)
+			out = appendExtension(out, 0x0017)
+			out = appendExtension(out, 0xFF01, 0)
+			out = appendExtension(out, 0x000A, 0, 6, 0x00, 0x1D, 0x00, 0x17, 0x00, 0x18)
+			out = appendExtension(out, 0x000B, 1, 0)
+			out = appendExtension(out, 0x000D, 0, 8, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03)
+			out = append(out, extra...)
+			binary.BigEndian.PutUint16(out[extensionsStart:], uint16(len(out)-extensionsStart-2))
+			return out
+		})
+	})
+}
+
+// appendServerHelloFlight answers a ClientHello with ServerHello and
+// ServerHelloDone. extra is echoed into the ServerHello extensions.
+func (s *dtlsSession) appendServerHelloFlight(out []byte, rng *rng32, extra []byte) []byte {
+	out = s.appendRecord(out, dtlsContentHandshake, 0, func(out []byte) []byte {
+		return s.appendHandshake(out, dtlsHandshakeServerHello, func(out []byte) []byte {
+			out = append(out, dtlsVersion[:]...)
+			out = appendRandom(out, 32, rng)
+			out = append(out, 32)
+			out = appendRandom(out, 32, rng)
+			out = binary.BigEndian.AppendUint16(out, dtlsCipherSuites[0])
+			out = append(out, 0)
+
+			extensionsStart := len(out)
+			out = append(out, 0, 0)
+			out = appendExtension(out, 0x0017)
+			out = appendExtension(out, 0xFF01, 0)
+			out = appendExtension(out, 0x000B, 1, 0)
+			out = append(out, extra...)
+			binary.BigEndian.PutUint16(out[extensionsStart:], uint16(len(out)-extensionsStart-2))
+			return out
+		})
+	})
+	return s.appendRecord(out, dtlsContentHandshake, 0, func(out []byte) []byte {
+		return s.appendHandshake(out, dtlsHandshakeServerHelloDone, func(out []byte) []byte { return out })
+	})
+}
+
+// appendClientKeyExchangeFlight finishes the client side: an X25519 public
+// key, ChangeCipherSpec and an encrypted Finished in epoch 1.
+func (s *dtlsSession) appendClientKeyExchangeFlight(out []byte, rng *rng32) []byte {
+	out = s.appendRecord(out, dtlsContentHandshake, 0, func(out []byte) []byte {
+		return s.appendHandshake(out, dtlsHandshakeClientKeyExchange, func(out []byte) []byte {
+			out = append(out, 32)
+			return appendRandom(out, 32, rng)
+		})
+	})
+	return s.appendChangeCipherSpecFlight(out, rng)
+}
+
+func (s *dtlsSession) appendChangeCipherSpecFlight(out []byte, rng *rng32) []byte {
+	out = s.appendRecord(out, dtlsContentChangeCipherSpec, 0, func(out []byte) []byte {
+		return append(out, 1)
+	})
+	return s.appendRecord(out, dtlsContentHandshake, 1, func(out []byte) []byte {
+		return appendRandom(out, dtlsEncryptedFinished, rng)
+	})
+}
+
+// dtlsHandshake plays one side of the handshake maskers open with. extra
+// carries extensions both hellos add, such as use_srtp for WebRTC. A client
+// keeps its last flight until the server's ChangeCipherSpec flight answers
+// it, so a lost flight can be sent again.
+type dtlsHandshake struct {
+	session     dtlsSession
+	extra       []byte
+	established bool
+	finished    bool
+
+	flight  []byte
+	timeout time.Duration
+}
+
+func (h *dtlsHandshake) clientHello(sendForward SendFunc, rng *rng32) {
+	if h.established {
+		return
+	}
+	var flight [dtlsFlightMax]byte
+	sendForward(h.remember(h.session.appendClientHello(flight[:0], rng, h.extra)))
+}
+
+// remember keeps flight for retransmission and restarts the timer.
+func (h *dtlsHandshake) remember(flight []byte) []byte {
+	h.flight = append(h.flight[:0], flight...)
+	h.timeout = dtlsRetransmitInitial
+	return flight
+}
+
+// answer sends the next flight for a handshake record from the peer.
+func (h *dtlsHandshake) answer(record []byte, rng *rng32, sendBack SendFunc) {
+	if dtlsRecordEpoch(record) != 0 || len(record) < dtlsRecordHeaderSize+dtlsHandshakeHeaderSize || sendBack == nil {
+		return
+	}
+	var flight [dtlsFlightMax]byte
+	switch record[dtlsRecordHeaderSize] {
+	case dtlsHandshakeClientHello:
+		sendBack(h.session.appendServerHelloFlight(flight[:0], rng, h.extra))
+	case dtlsHandshakeServerHello:
+		if !h.established {
+			h.established = true
+			sendBack(h.remember(h.session.appendClientKeyExchangeFlight(flight[:0], rng)))
+		}
+	case dtlsHandshakeClientKeyExchange:
+		h.established = true
+		sendBack(h.session.appendChangeCipherSpecFlight(flight[:0], rng))
+	}
+}
+
+// changeCipherSpec takes the server's last flight, which opens with a
+// ChangeCipherSpec, and reports whether it finished the client's handshake.
+func (h *dtlsHandshake) changeCipherSpec() bool {
+	if !h.established || h.finished || h.flight == nil {
+		return false
+	}
+	h.finished = true
+	h.flight = nil
+	return true
+}
+
+// retransmitInterval is when the unanswered flight is due again, or zero
+// when none is.
+func (h *dtlsHandshake) retransmitInterval() time.Duration {
+	if h.finished || h.flight == nil {
+		return 0
+	}
+	return h.timeout
+}
+
+// retransmit sends the unanswered flight again and doubles the timer.
+func (h *dtlsHandshake) retransmit(send SendFunc) {
+	if h.retransmitInterval() == 0 {
+		return
+	}
+	send(h.flight)
+	h.timeout = min(2*h.timeout, dtlsRetransmitMax)
+}
+
+// wrapApplicationData frames buf[:length] as an AEAD application-data record
+// in epoch 1, with the record sequence as its explicit nonce and a random
+// tag where the cipher's would be.
+func (s *dtlsSession) wrapApplicationData(buf []byte, length int, rng *rng32) int {
+	overhead := dtlsRecordHeaderSize + dtlsExplicitNonceSize
+	if length+overhead+dtlsAEADTagSize > len(buf) {
+		return -1
+	}
+	copy(buf[overhead:overhead+length], buf[:length])
+	rng.fill(buf[overhead+length : overhead+length+dtlsAEADTagSize])
+	sequence := s.sequence[1]
+	s.writeRecordHeader(buf, dtlsContentApplicationData, 1, dtlsExplicitNonceSize+length+dtlsAEADTagSize)
+	binary.BigEndian.PutUint64(buf[dtlsRecordHeaderSize:], 1<<48|sequence)
+	return overhead + length + dtlsAEADTagSize
+}
+
+func dtlsUnwrapApplicationData(buf []byte, length int) int {
+	overhead := dtlsRecordHeaderSize + dtlsExplicitNonceSize
+	if length < overhead+dtlsAEADTagSize || dtlsRecordEpoch(buf) != 1 {
+		return -1
+	}
+	if dtlsRecordHeaderSize+dtlsRecordLength(buf) != length {
+		return -1
+	}
+	payload := length - overhead - dtlsAEADTagSize
+	copy(buf[:payload], buf[overhead:overhead+payload])
+	return payload
+}
@@ -190,13 +190,14 @@ func TestParseMasking(t *testing.T) {
 		" stun": MaskingSTUN,
 		"MEDIA": MaskingMEDIA,
 		"tls":   MaskingTLS,
+		"QUIC":  MaskingQUIC,
 	} {
 		got, ok := ParseMasking(value)
 		if !ok || got != want {
 			t.Errorf("ParseMasking(%q) = %v, %v", value, got, ok)
 		}
 	}
-	if _, ok := ParseMasking("quic"); ok {
+	if _, ok := ParseMasking("sctp"); ok {
 		t.Error("expected unknown masking to be rejected")
 	}
 }
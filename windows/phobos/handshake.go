@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuardKeys are the keys a peer's handshake initiation is built from.
+// The preshared key only enters the responder's half of the handshake, so
+// an initiation needs none.
+type WireGuardKeys struct {
+	PrivateKey    [32]byte
+	PeerPublicKey [32]byte
+}
+
+const (
+	noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	noiseIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	noiseLabelMAC1    = "mac1----"
+
+	handshakeInitiationSize = 148
+	handshakeMAC1Offset     = 116
+
+	// tai64Epoch is the TAI64 label of the Unix epoch.
+	tai64Epoch = 0x400000000000000a
+)
+
+func blake2sHash(parts ...[]byte) (sum [32]byte) {
+	h, _ := blake2s.New256(nil)
+	for _, part := range parts {
+		h.Write(part)
+	}
+	h.Sum(sum[:0])
+	return sum
+}
+
+func blake2sHMAC(key []byte, parts ...[]byte) (sum [32]byte) {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	mac.Sum(sum[:0])
+	return sum
+}
+
+// noiseKDF2 advances the chaining key with input and returns the key it
+// derives alongside.
+func noiseKDF2(chainingKey *[32]byte, input []byte) [32]byte {
+	prk := blake2sHMAC(chainingKey[:], input)
+	*chainingKey = blake2sHMAC(prk[:], []byte{1})
+	return blake2sHMAC(prk[:], chainingKey[:], []byte{2})
+}
+
+// sealHandshake encrypts plaintext under key with a zero nonce, as each
+// handshake key is used once, and mixes the result into hash.
+func sealHandshake(out []byte, key [32]byte, plaintext []byte, h *[32]byte) {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	aead.Seal(out[:0], nonce[:], plaintext, h[:])
+	*h = blake2sHash(h[:], out[:len(plaintext)+aead.Overhead()])
+}
+
+// buildHandshakeInitiation writes a WireGuard handshake initiation from keys
+// into buf, which must hold handshakeInitiationSize bytes. A server running
+// WireGuard with the matching peer answers it like any other. mac2 is left
+// zero, which a server not under load accepts.
+func buildHandshakeInitiation(buf []byte, keys WireGuardKeys) error {
+	msg := buf[:handshakeInitiationSize]
+	clear(msg)
+	binary.LittleEndian.PutUint32(msg, TypeHandshake)
+	if _, err := rand.Read(msg[4:8]); err != nil {
+		return err
+	}
+
+	var ephemeralPrivate [32]byte
+	if _, err := rand.Read(ephemeralPrivate[:]); err != nil {
+		return err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeralPrivate[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	staticPublic, err := curve25519.X25519(keys.PrivateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+
+	chainingKey := blake2sHash([]byte(noiseConstruction))
+	h := blake2sHash(chainingKey[:], []byte(noiseIdentifier))
+	h = blake2sHash(h[:], keys.PeerPublicKey[:])
+
+	copy(msg[8:40], ephemeralPublic)
+	prk := blake2sHMAC(chainingKey[:], ephemeralPublic)
+	chainingKey = blake2sHMAC(prk[:], []byte{1})
+	h = blake2sHash(h[:], ephemeralPublic)
+
+	shared, err := curve25519.X25519(ephemeralPrivate[:], keys.PeerPublicKey[:])
+	if err != nil {
+		return err
+	}
+	sealHandshake(msg[40:88], noiseKDF2(&chainingKey, shared), staticPublic, &h)
+
+	if shared, err = curve25519.X25519(keys.PrivateKey[:], keys.PeerPublicKey[:]); err != nil {
+		return err
+	}
+	var timestamp [12]byte
+	now := time.Now()
+	binary.BigEndian.PutUint64(timestamp[:], tai64Epoch+uint64(now.Unix()))
+	binary.BigEndian.PutUint32(timestamp[8:], uint32(now.Nanosecond()))
+	sealHandshake(msg[88:116], noiseKDF2(&chainingKey, shared), timestamp[:], &h)
+
+	mac1Key := blake2sHash([]byte(noiseLabelMAC1), keys.PeerPublicKey[:])
+	mac, _ := blake2s.New128(mac1Key[:])
+	mac.Write(msg[:handshakeMAC1Offset])
+	mac.Sum(msg[handshakeMAC1Offset:handshakeMAC1Offset])
+	return nil
+}
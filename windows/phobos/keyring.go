@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PreviousKey is an obfuscation key a server may still be using after the
+// preset was rotated. It is accepted until Expires.
+type PreviousKey struct {
+	Key     []byte
+	Expires time.Time
+}
+
+// keyRing is the primary key followed by the previous keys, newest first.
+// It remembers which key the server was last seen using, so decoding tries
+// that one first, and the newest key the server has proven to understand by
+// answering with it, which is the one to send with.
+type keyRing struct {
+	keys        [][]byte
+	expires     []time.Time
+	obfuscators []*Obfuscator
+
+	current atomic.Int32
+	proven  atomic.Int32
+}
+
+func newKeyRing(primary []byte, previous []PreviousKey) *keyRing {
+	r := &keyRing{
+		keys:        [][]byte{primary},
+		expires:     []time.Time{{}},
+		obfuscators: []*Obfuscator{NewObfuscator(primary)},
+	}
+	for _, key := range previous {
+		if len(key.Key) == 0 {
+			continue
+		}
+		r.keys = append(r.keys, key.Key)
+		r.expires = append(r.expires, key.Expires)
+		r.obfuscators = append(r.obfuscators, NewObfuscator(key.Key))
+	}
+	r.proven.Store(-1)
+	return r
+}
+
+func (r *keyRing) live(index int, now time.Time) bool {
+	return r.expires[index].IsZero() || now.Before(r.expires[index])
+}
+
+func (r *keyRing) provenIndex(now time.Time) int {
+	if proven := int(r.proven.Load()); proven >= 0 && r.live(proven, now) {
+		return proven
+	}
+	return -1
+}
+
+// sendIndex is the newest live key the server has proven, or the primary key
+// while none is.
+func (r *keyRing) sendIndex(now time.Time) int {
+	return max(r.provenIndex(now), 0)
+}
+
+// handshakeIndices lists the keys a handshake initiation goes out under,
+// newest first: every live key up to the proven one, or all of them while
+// none is proven. WireGuard drops replayed initiations, so a server that
+// knows several of these keys acts on a single copy.
+func (r *keyRing) handshakeIndices(now time.Time) []int {
+	limit := len(r.keys) - 1
+	if proven := r.provenIndex(now); proven >= 0 {
+		limit = proven
+	}
+	var indices []int
+	for i := range limit + 1 {
+		if r.live(i, now) {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+func (r *keyRing) prove(index int) {
+	r.current.Store(int32(index))
+	for {
+		proven := r.proven.Load()
+		if proven >= 0 && int(proven) <= index {
+			return
+		}
+		if r.proven.CompareAndSwap(proven, int32(index)) {
+			return
+		}
+	}
+}
+
+// decode deobfuscates buf[:length] with the key the server was last seen
+// using, then with the other live keys newest first. scratch must hold
+// length bytes; it keeps buf intact between attempts. The key that fits is
+// remembered, and -1 is returned when none does.
+func (r *keyRing) decode(buf, scratch []byte, length, obfuscateBytes int) int {
+	if len(r.keys) == 1 {
+		n := r.obfuscators[0].Decode(buf, length, obfuscateBytes)
+		if n < 4 || !IsKnownPacketType(PacketType(buf)) {
+			return -1
+		}
+		return n
+	}
+	now := time.Now()
+	first := int(r.current.Load())
+	for attempt := range len(r.keys) {
+		index := attempt - 1
+		switch {
+		case attempt == 0:
+			index = first
+		case index >= first:
+			index++
+		}
+		if !r.live(index, now) {
+			continue
+		}
+		copy(scratch, buf[:length])
+		n := r.obfuscators[index].Decode(scratch, length, obfuscateBytes)
+		if n < 4 || !IsKnownPacketType(PacketType(scratch)) {
+			continue
+		}
+		copy(buf, scratch[:n])
+		r.prove(index)
+		return n
+	}
+	return -1
+}
+
+// order lists the live keys to open a stream with: the proven one first,
+// then the rest newest first.
+func (r *keyRing) order(now time.Time) []int {
+	proven := r.provenIndex(now)
+	var indices []int
+	if proven >= 0 {
+		indices = append(indices, proven)
+	}
+	for i := range r.keys {
+		if i != proven && r.live(i, now) {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
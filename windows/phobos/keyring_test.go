@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestKeyRingDecodeRemembersServerKey(t *testing.T) {
+	primary := []byte("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")
+	previous := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	ring := newKeyRing(primary, []PreviousKey{{Key: previous, Expires: time.Now().Add(time.Hour)}})
+	scratch := make([]byte, BufferSize)
+
+	encoded := func(key []byte) ([]byte, []byte) {
+		plain := handshakePacket(148)
+		buf := make([]byte, BufferSize)
+		copy(buf, plain)
+		n := NewObfuscator(key).Encode(buf, len(plain), DefaultMaxDummy, 0)
+		return buf[:n], plain
+	}
+
+	now := time.Now()
+	if got := ring.handshakeIndices(now); !slices.Equal(got, []int{0, 1}) {
+		t.Fatalf("unproven handshake keys = %v, want [0 1]", got)
+	}
+	wire, plain := encoded(previous)
+	buf := make([]byte, BufferSize)
+	copy(buf, wire)
+	if n := ring.decode(buf, scratch, len(wire), 0); n != len(plain) || !bytes.Equal(buf[:n], plain) {
+		t.Fatalf("previous key did not decode: %d", n)
+	}
+	if ring.sendIndex(now) != 1 || int(ring.current.Load()) != 1 {
+		t.Fatalf("send index %d, current %d after the server used the previous key", ring.sendIndex(now), ring.current.Load())
+	}
+	if got := ring.handshakeIndices(now); !slices.Equal(got, []int{0, 1}) {
+		t.Fatalf("handshake keys = %v, want [0 1]", got)
+	}
+
+	wire, plain = encoded(primary)
+	copy(buf, wire)
+	if n := ring.decode(buf, scratch, len(wire), 0); n != len(plain) || !bytes.Equal(buf[:n], plain) {
+		t.Fatalf("primary key did not decode: %d", n)
+	}
+	if ring.sendIndex(now) != 0 {
+		t.Fatal("the proxy must move up to the primary key once the server uses it")
+	}
+	if got := ring.handshakeIndices(now); !slices.Equal(got, []int{0}) {
+		t.Fatalf("handshake keys = %v, want [0]", got)
+	}
+
+	wire, _ = encoded([]byte("unrelated"))
+	copy(buf, wire)
+	if n := ring.decode(buf, scratch, len(wire), 0); n != -1 {
+		t.Fatalf("a foreign key decoded to %d bytes", n)
+	}
+	if !bytes.Equal(buf[:len(wire)], wire) {
+		t.Fatal("failed attempts must leave the packet intact")
+	}
+}
+
+func TestKeyRingSkipsExpiredKeys(t *testing.T) {
+	previous := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	ring := newKeyRing([]byte("primary"), []PreviousKey{{Key: previous, Expires: time.Now().Add(-time.Second)}})
+	plain := handshakePacket(92)
+	buf := make([]byte, BufferSize)
+	copy(buf, plain)
+	n := NewObfuscator(previous).Encode(buf, len(plain), 0, 0)
+	if n := ring.decode(buf, make([]byte, BufferSize), n, 0); n != -1 {
+		t.Fatal("an expired key must not decode")
+	}
+	if got := ring.order(time.Now()); !slices.Equal(got, []int{0}) {
+		t.Fatalf("stream key order = %v, want [0]", got)
+	}
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"net/netip"
+	"time"
+)
+
+// autoProbeInterval paces the masking timer while an AUTO proxy is trying the
+// unmasked candidate, so that it picks up the right interval once settled.
+const autoProbeInterval = 5 * time.Second
+
+// autoCandidates is the order in which an AUTO client offers maskings to the
+// server, one per handshake attempt. STUN goes first because that is what the
+// C client settles on for AUTO.
+var autoCandidates = [...]Masking{MaskingSTUN, MaskingMEDIA, MaskingNone}
+
+// autoMasking detects the masking a server speaks. It keeps one masker per
+// candidate so that a late answer to an earlier handshake still matches.
+type autoMasking struct {
+	maskers    [len(autoCandidates)]Masker
+	current    int
+	handshakes int
+	scratch    []byte
+	keyScratch []byte
+}
+
+func newAutoMasking(media MediaParams) *autoMasking {
+	a := &autoMasking{scratch: make([]byte, BufferSize), keyScratch: make([]byte, BufferSize)}
+	for i, masking := range autoCandidates {
+		a.maskers[i] = NewMasker(masking, media)
+	}
+	return a
+}
+
+func (a *autoMasking) masker() Masker {
+	return a.maskers[a.current]
+}
+
+func (a *autoMasking) masking() Masking {
+	return autoCandidates[a.current]
+}
+
+// nextHandshake moves to the next candidate for every handshake after the
+// first, since a repeated handshake means the previous one went unanswered.
+func (a *autoMasking) nextHandshake() {
+	if a.handshakes > 0 {
+		a.current = (a.current + 1) % len(autoCandidates)
+	}
+	a.handshakes++
+}
+
+// probe unwraps and decodes buf[:length] with every candidate, starting from
+// the current one, and keeps the first result that passes the key check.
+// obfuscateBytes is the configured figure, which MEDIA overrides as
+// obfuscateBytesUnder says. It returns the decoded length and the candidate index, 0 for a masking control
+// packet, or -1 when no candidate fits.
+func (a *autoMasking) probe(buf []byte, length int, keys *keyRing, obfuscateBytes int, src netip.AddrPort, sendBack SendFunc) (int, int) {
+	for i := range autoCandidates {
+		index := (a.current + i) % len(autoCandidates)
+		copy(a.scratch, buf[:length])
+		n := length
+		if masker := a.maskers[index]; masker != nil {
+			n = masker.OnDataUnwrap(a.scratch, n, src, sendBack)
+			if n == 0 {
+				return 0, index
+			}
+			if n < 0 {
+				continue
+			}
+		}
+		if n < 4 {
+			continue
+		}
+		if n = keys.decode(a.scratch, a.keyScratch, n, obfuscateBytesUnder(autoCandidates[index], MaskingAuto, obfuscateBytes)); n < 0 {
+			continue
+		}
+		copy(buf, a.scratch[:n])
+		return n, index
+	}
+	return -1, -1
+}
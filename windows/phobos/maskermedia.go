@@ -8,10 +8,18 @@ package phobos
 import (
 	"encoding/binary"
 	"net/netip"
+	"sync"
 	"time"
 )
 
-const rtpHeaderSize = 12
+const (
+	rtpHeaderSize   = 12
+	srtpAuthTagSize = 10
+)
+
+// useSRTPExtension offers and accepts SRTP_AES128_CM_HMAC_SHA1_80 without an
+// MKI, as browsers do in their DTLS hellos.
+var useSRTPExtension = appendExtension(nil, 0x000E, 0, 2, 0x00, 0x01, 0)
 
 type mediaPreset struct {
 	payloadType   uint8
@@ -38,6 +46,10 @@ type rtpStream struct {
 	timestampStep uint16
 	payloadType   uint8
 	initialized   bool
+
+	packets, octets uint32
+	srtcpIndex      uint32
+	cname           [rtcpCNAMELength]byte
 }
 
 func (s *rtpStream) init(params MediaParams, rng *rng32) {
@@ -57,6 +69,9 @@ func (s *rtpStream) init(params MediaParams, rng *rng32) {
 	if params.TimestampStep != 0 {
 		s.timestampStep = params.TimestampStep
 	}
+	for i := range s.cname {
+		s.cname[i] = cnameAlphabet[rng.below(len(cnameAlphabet))]
+	}
 	s.initialized = true
 }
 
@@ -70,10 +85,35 @@ func (s *rtpStream) writeHeader(buf []byte) {
 	s.timestamp += uint32(s.timestampStep)
 }
 
+// maskerMedia wraps tunnel packets as RTP and reports on the stream with
+// RTCP on the same 5-tuple. Under the WebRTC profile the stream is opened
+// with a DTLS-SRTP handshake and every packet carries an SRTP tag. Server
+// packets are unwrapped without maskerMu, so the reception statistics and
+// the handshake they feed have a lock and a generator of their own.
 type maskerMedia struct {
 	rng    rng32
 	params MediaParams
 	stream rtpStream
+
+	receiveMu    sync.Mutex
+	received     rtpReceiver
+	handshake    dtlsHandshake
+	handshakeRNG rng32
+}
+
+func newMaskerMedia(params MediaParams) *maskerMedia {
+	m := &maskerMedia{rng: newRNG32(), params: params, handshakeRNG: newRNG32()}
+	if params.Profile == MediaProfileWebRTC {
+		m.handshake.extra = useSRTPExtension
+	}
+	return m
+}
+
+func (m *maskerMedia) tagSize() int {
+	if m.params.Profile == MediaProfileWebRTC {
+		return srtpAuthTagSize
+	}
+	return 0
 }
 
 func (m *maskerMedia) TimerInterval() time.Duration {
@@ -82,13 +122,34 @@ func (m *maskerMedia) TimerInterval() time.Duration {
 
 func (m *maskerMedia) OnHandshakeRequest(sendForward SendFunc) {
 	sendBindingRequest(sendForward, &m.rng)
+	if m.params.Profile == MediaProfileWebRTC {
+		m.receiveMu.Lock()
+		m.handshake.clientHello(sendForward, &m.handshakeRNG)
+		m.receiveMu.Unlock()
+	}
 }
 
 func (m *maskerMedia) OnDataUnwrap(buf []byte, length int, src netip.AddrPort, sendBack SendFunc) int {
 	if stunHasMagic(buf[:length]) {
 		return stunHandleIncoming(buf, length, src, sendBack)
 	}
-	if length < rtpHeaderSize+4 {
+	if isRTCP(buf[:length], m.params.PayloadType) {
+		if buf[1] == rtcpTypeSR {
+			m.receiveMu.Lock()
+			m.received.onSR(buf[:length], time.Now())
+			m.receiveMu.Unlock()
+		}
+		return 0
+	}
+	if m.params.Profile == MediaProfileWebRTC && isDTLS(buf[:length]) {
+		if buf[0] == dtlsContentHandshake {
+			m.receiveMu.Lock()
+			m.handshake.answer(buf[:length], &m.handshakeRNG, sendBack)
+			m.receiveMu.Unlock()
+		}
+		return 0
+	}
+	if length < rtpHeaderSize+m.tagSize()+4 {
 		return -1
 	}
 	if buf[0]&0xC0 != 0x80 {
@@ -100,13 +161,17 @@ func (m *maskerMedia) OnDataUnwrap(buf []byte, length int, src netip.AddrPort, s
 	if m.params.SSRC != 0 && binary.BigEndian.Uint32(buf[8:]) != m.params.SSRC {
 		return -1
 	}
-	payloadLength := length - rtpHeaderSize
-	copy(buf[:payloadLength], buf[rtpHeaderSize:length])
+	m.receiveMu.Lock()
+	m.received.onRTP(buf, time.Now())
+	m.receiveMu.Unlock()
+	payloadLength := length - rtpHeaderSize - m.tagSize()
+	copy(buf[:payloadLength], buf[rtpHeaderSize:rtpHeaderSize+payloadLength])
 	return payloadLength
 }
 
 func (m *maskerMedia) OnDataWrap(buf []byte, length int) int {
-	if length+rtpHeaderSize > len(buf) {
+	tag := m.tagSize()
+	if length+rtpHeaderSize+tag > len(buf) {
 		return -1
 	}
 	if !m.stream.initialized {
@@ -114,9 +179,27 @@ func (m *maskerMedia) OnDataWrap(buf []byte, length int) int {
 	}
 	copy(buf[rtpHeaderSize:rtpHeaderSize+length], buf[:length])
 	m.stream.writeHeader(buf)
-	return length + rtpHeaderSize
+	m.stream.packets++
+	m.stream.octets += uint32(length)
+	m.rng.fill(buf[rtpHeaderSize+length : rtpHeaderSize+length+tag])
+	return length + rtpHeaderSize + tag
 }
 
 func (m *maskerMedia) OnTimer(sendToServer SendFunc) {
 	sendBindingRequest(sendToServer, &m.rng)
+	var buf [rtcpMaxCompoundSize]byte
+	if report := m.appendRTCP(buf[:0], time.Now()); len(report) > 0 {
+		sendToServer(report)
+	}
+}
+
+func (m *maskerMedia) independentUnwrap() {}
+
+// frameInterval is the time one frame of the stream spans on the 90 kHz
+// video clock, the cadence cover traffic keeps while the tunnel is idle.
+func (m *maskerMedia) frameInterval() time.Duration {
+	if !m.stream.initialized {
+		m.stream.init(m.params, &m.rng)
+	}
+	return time.Second * time.Duration(m.stream.timestampStep) / 90000
 }
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestWebRTCProfileHandshake(t *testing.T) {
+	params := MediaParams{Profile: MediaProfileWebRTC}
+	client, server := NewMasker(MaskingMEDIA, params), NewMasker(MaskingMEDIA, params)
+	addr := netip.MustParseAddrPort("127.0.0.1:3478")
+
+	var toServer, toClient [][]byte
+	sendToServer := func(p []byte) (int, error) { toServer = append(toServer, bytes.Clone(p)); return len(p), nil }
+	sendToClient := func(p []byte) (int, error) { toClient = append(toClient, bytes.Clone(p)); return len(p), nil }
+
+	client.OnHandshakeRequest(sendToServer)
+	if len(toServer) != 2 || !stunHasMagic(toServer[0]) || !isDTLS(toServer[1]) {
+		t.Fatalf("expected a binding request then a ClientHello, got %x", toServer)
+	}
+	if !bytes.Equal(checkDTLSRecords(t, toServer[1]), []byte{dtlsHandshakeClientHello}) || !bytes.Contains(toServer[1], useSRTPExtension) {
+		t.Fatalf("ClientHello does not offer use_srtp: %x", toServer[1])
+	}
+
+	buf := make([]byte, BufferSize)
+	n := copy(buf, toServer[1])
+	if server.OnDataUnwrap(buf, n, addr, sendToClient) != 0 {
+		t.Fatal("ClientHello must be swallowed")
+	}
+	if len(toClient) != 1 || !bytes.Contains(toClient[0], useSRTPExtension) {
+		t.Fatalf("ServerHello does not accept use_srtp: %x", toClient)
+	}
+	n = copy(buf, toClient[0])
+	if client.OnDataUnwrap(buf, n, addr, sendToServer) != 0 {
+		t.Fatal("ServerHello must be swallowed")
+	}
+	n = copy(buf, toServer[2])
+	if server.OnDataUnwrap(buf, n, addr, sendToClient) != 0 || len(toClient) != 2 {
+		t.Fatal("ClientKeyExchange must be swallowed and answered")
+	}
+
+	client.OnHandshakeRequest(sendToServer)
+	if len(toServer) != 4 || !stunHasMagic(toServer[3]) {
+		t.Fatal("an established session must only send the binding request")
+	}
+}
+
+func TestWebRTCProfileRoundTrip(t *testing.T) {
+	params := MediaParams{PayloadType: 111, Profile: MediaProfileWebRTC}
+	sender, receiver := NewMasker(MaskingMEDIA, params), NewMasker(MaskingMEDIA, params)
+	buf := make([]byte, BufferSize)
+	for _, length := range []int{4, 32, 148, 1420} {
+		payload := handshakePacket(length)
+		copy(buf, payload)
+		n := sender.OnDataWrap(buf, length)
+		if n != length+wrapOverhead(MaskingMEDIA, params) {
+			t.Fatalf("wrapped length %d for payload %d", n, length)
+		}
+		if buf[0]&0xC0 != 0x80 || buf[1]&0x7F != 111 {
+			t.Fatalf("not an SRTP header: %x", buf[:rtpHeaderSize])
+		}
+		if got := receiver.OnDataUnwrap(buf, n, netip.AddrPort{}, nil); got != length || !bytes.Equal(buf[:got], payload) {
+			t.Fatalf("round trip failed at length %d", length)
+		}
+	}
+
+	// SRTCP ends in the E flag with the index and the tag after the
+	// compound packet.
+	report := rtcpReports(t, sender)
+	trailer := report[len(report)-srtpAuthTagSize-4:]
+	splitRTCP(t, report[:len(report)-len(trailer)])
+	if trailer[0]&0x80 == 0 {
+		t.Fatalf("SRTCP index %x lacks the E flag", trailer[:4])
+	}
+	copy(buf, report)
+	if got := receiver.OnDataUnwrap(buf, len(report), netip.AddrPort{}, nil); got != 0 {
+		t.Fatalf("SRTCP unwrapped to %d bytes, want it swallowed", got)
+	}
+}
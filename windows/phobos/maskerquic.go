@@ -0,0 +1,301 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+const (
+	quicVersion1        = 0x00000001
+	quicCIDSize         = 8
+	quicCIDMax          = 20
+	quicInitialMin      = 1200
+	quicLongHeaderSize  = 1 + 4 + 1 + quicCIDSize + 1 + quicCIDSize + 1
+	quicShortHeaderSize = 1 + quicCIDSize
+	quicSampleOffset    = 4
+	quicMaskSize        = 5
+	quicLongReserved    = 0x0C
+	quicShortReserved   = 0x18
+	quicFramePadding    = 0x00
+	quicFrameCrypto     = 0x06
+)
+
+// maskerQUIC frames datagrams as QUIC v1. The packet that follows a
+// handshake request, and the peer's reply to it, travel as long-header
+// Initial packets carrying it in a CRYPTO frame, the client's padded to
+// 1200 bytes with PADDING frames; everything else uses the short 1-RTT header addressed to
+// the connection ID the peer announced. As in real QUIC, the low bits of the
+// first byte and the packet number are hidden by a header-protection mask
+// sampled from the payload, so they look random on the wire.
+type maskerQUIC struct {
+	rng      rng32
+	localCID [quicCIDSize]byte
+	peerCID  [quicCIDSize]byte
+	haveCIDs bool
+
+	client         bool
+	initialPending bool
+	initialNumber  uint64
+	appNumber      uint64
+}
+
+func (m *maskerQUIC) TimerInterval() time.Duration {
+	return 30 * time.Second
+}
+
+func (m *maskerQUIC) ensureCIDs() {
+	if !m.haveCIDs {
+		m.rng.fill(m.localCID[:])
+		m.rng.fill(m.peerCID[:])
+		m.haveCIDs = true
+	}
+}
+
+func (m *maskerQUIC) OnHandshakeRequest(sendForward SendFunc) {
+	m.ensureCIDs()
+	m.client = true
+	m.initialPending = true
+}
+
+func (m *maskerQUIC) OnDataUnwrap(buf []byte, length int, src netip.AddrPort, sendBack SendFunc) int {
+	if length < 1 || buf[0]&0x40 == 0 {
+		return -1
+	}
+	m.ensureCIDs()
+	if buf[0]&0x80 != 0 {
+		return m.unwrapLong(buf, length)
+	}
+	return m.unwrapShort(buf, length)
+}
+
+func (m *maskerQUIC) OnDataWrap(buf []byte, length int) int {
+	m.ensureCIDs()
+	if m.initialPending {
+		m.initialPending = false
+		return m.wrapLong(buf, length)
+	}
+	return m.wrapShort(buf, length)
+}
+
+func (m *maskerQUIC) OnTimer(sendToServer SendFunc) {
+}
+
+func (m *maskerQUIC) reframeHandshake() {
+	m.initialPending = m.client
+}
+
+func quicPacketNumberLength(number uint64) int {
+	switch {
+	case number < 1<<7:
+		return 1
+	case number < 1<<15:
+		return 2
+	case number < 1<<23:
+		return 3
+	}
+	return 4
+}
+
+func quicPutPacketNumber(buf []byte, number uint64, length int) {
+	for i := range length {
+		buf[i] = byte(number >> (8 * (length - 1 - i)))
+	}
+}
+
+func quicVarintSize(value int) int {
+	if value < 1<<6 {
+		return 1
+	} else if value < 1<<14 {
+		return 2
+	}
+	return 4
+}
+
+func quicPutVarint(buf []byte, value, size int) {
+	switch size {
+	case 1:
+		buf[0] = byte(value)
+	case 2:
+		binary.BigEndian.PutUint16(buf, 0x4000|uint16(value))
+	default:
+		binary.BigEndian.PutUint32(buf, 0x80000000|uint32(value))
+	}
+}
+
+func quicReadVarint(buf []byte) (int, int) {
+	if len(buf) < 1 {
+		return 0, -1
+	}
+	size := 1 << (buf[0] >> 6)
+	if size > 4 || len(buf) < size {
+		return 0, -1
+	}
+	value := int(buf[0] & 0x3F)
+	for _, b := range buf[1:size] {
+		value = value<<8 | int(b)
+	}
+	return value, size
+}
+
+// quicHeaderMask derives the header-protection mask from the bytes that
+// follow the longest possible packet number. Both ends compute it from the
+// same unmodified payload bytes; a short packet simply samples zeros.
+func quicHeaderMask(buf []byte, numberOffset, end int) (mask [quicMaskSize]byte) {
+	if sample := numberOffset + quicSampleOffset; sample < end {
+		copy(mask[:], buf[sample:end])
+	}
+	return mask
+}
+
+func quicProtect(buf []byte, firstBits byte, numberOffset, numberLength, end int) {
+	mask := quicHeaderMask(buf, numberOffset, end)
+	buf[0] ^= mask[0] & firstBits
+	for i := range numberLength {
+		buf[numberOffset+i] ^= mask[1+i]
+	}
+}
+
+func (m *maskerQUIC) wrapLong(buf []byte, length int) int {
+	number := m.initialNumber
+	m.initialNumber++
+	numberLength := quicPacketNumberLength(number)
+	dataSize := quicVarintSize(length)
+	frame := numberLength + 2 + dataSize
+	content := frame + length
+	lengthSize := quicVarintSize(max(content, quicInitialMin))
+	numberOffset := quicLongHeaderSize + lengthSize
+	padding := 0
+	if m.client {
+		// RFC 9000 §14.1: the padding goes inside the packet, so that its
+		// Length covers the whole datagram.
+		padding = max(quicInitialMin-numberOffset-content, 0)
+	}
+	end := numberOffset + content + padding
+	if end > len(buf) {
+		return -1
+	}
+	copy(buf[numberOffset+frame:numberOffset+content], buf[:length])
+
+	buf[0] = 0xC0 | byte(numberLength-1)
+	binary.BigEndian.PutUint32(buf[1:], quicVersion1)
+	buf[5] = quicCIDSize
+	copy(buf[6:], m.peerCID[:])
+	buf[6+quicCIDSize] = quicCIDSize
+	copy(buf[7+quicCIDSize:], m.localCID[:])
+	buf[quicLongHeaderSize-1] = 0
+	quicPutVarint(buf[quicLongHeaderSize:], content+padding, lengthSize)
+	quicPutPacketNumber(buf[numberOffset:], number, numberLength)
+	buf[numberOffset+numberLength] = quicFrameCrypto
+	buf[numberOffset+numberLength+1] = 0
+	quicPutVarint(buf[numberOffset+numberLength+2:], length, dataSize)
+	clear(buf[numberOffset+content : end])
+	quicProtect(buf, 0x0F, numberOffset, numberLength, end)
+	return end
+}
+
+func (m *maskerQUIC) wrapShort(buf []byte, length int) int {
+	number := m.appNumber
+	m.appNumber++
+	numberLength := quicPacketNumberLength(number)
+	end := quicShortHeaderSize + numberLength + length
+	if end > len(buf) {
+		return -1
+	}
+	copy(buf[quicShortHeaderSize+numberLength:end], buf[:length])
+
+	buf[0] = 0x40 | byte(numberLength-1)
+	copy(buf[1:], m.peerCID[:])
+	quicPutPacketNumber(buf[quicShortHeaderSize:], number, numberLength)
+	quicProtect(buf, 0x1F, quicShortHeaderSize, numberLength, end)
+	return end
+}
+
+func (m *maskerQUIC) unwrapLong(buf []byte, length int) int {
+	if length < quicLongHeaderSize || binary.BigEndian.Uint32(buf[1:]) != quicVersion1 || buf[0]&0x30 != 0 {
+		return -1
+	}
+	pos := 5
+	dcidLength := int(buf[pos])
+	pos += 1 + dcidLength
+	if dcidLength > quicCIDMax || pos >= length {
+		return -1
+	}
+	scidLength := int(buf[pos])
+	scid := pos + 1
+	pos = scid + scidLength
+	if scidLength > quicCIDMax || pos > length {
+		return -1
+	}
+	tokenLength, n := quicReadVarint(buf[pos:length])
+	if n < 0 {
+		return -1
+	}
+	pos += n + tokenLength
+	if pos > length {
+		return -1
+	}
+	packetLength, n := quicReadVarint(buf[pos:length])
+	if n < 0 {
+		return -1
+	}
+	numberOffset := pos + n
+	end := numberOffset + packetLength
+	if end > length {
+		return -1
+	}
+
+	mask := quicHeaderMask(buf, numberOffset, end)
+	first := buf[0] ^ mask[0]&0x0F
+	numberLength := int(first&3) + 1
+	if first&quicLongReserved != 0 || numberLength > packetLength {
+		return -1
+	}
+	pos = numberOffset + numberLength
+	if pos >= end || buf[pos] != quicFrameCrypto {
+		return -1
+	}
+	offset, n := quicReadVarint(buf[pos+1 : end])
+	if n < 0 || offset != 0 {
+		return -1
+	}
+	pos += 1 + n
+	payload, n := quicReadVarint(buf[pos:end])
+	if n < 0 || pos+n+payload > end {
+		return -1
+	}
+	pos += n
+	for _, b := range buf[pos+payload : end] {
+		if b != quicFramePadding {
+			return -1
+		}
+	}
+	if scidLength == quicCIDSize {
+		copy(m.peerCID[:], buf[scid:scid+scidLength])
+	}
+	if !m.client {
+		m.initialPending = true
+	}
+	copy(buf[:payload], buf[pos:pos+payload])
+	return payload
+}
+
+func (m *maskerQUIC) unwrapShort(buf []byte, length int) int {
+	if length <= quicShortHeaderSize {
+		return -1
+	}
+	mask := quicHeaderMask(buf, quicShortHeaderSize, length)
+	first := buf[0] ^ mask[0]&0x1F
+	numberLength := int(first&3) + 1
+	if first&quicShortReserved != 0 || quicShortHeaderSize+numberLength > length {
+		return -1
+	}
+	payload := length - quicShortHeaderSize - numberLength
+	copy(buf[:payload], buf[quicShortHeaderSize+numberLength:length])
+	return payload
+}
@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func quicPayload(length int) []byte {
+	payload := make([]byte, length)
+	for i := range payload {
+		payload[i] = byte(i*7 + 1)
+	}
+	return payload
+}
+
+func TestQUICMaskerInitialExchange(t *testing.T) {
+	client := NewMasker(MaskingQUIC, MediaParams{}).(*maskerQUIC)
+	server := NewMasker(MaskingQUIC, MediaParams{}).(*maskerQUIC)
+	client.OnHandshakeRequest(func(p []byte) (int, error) { return len(p), nil })
+
+	payload := quicPayload(148)
+	buf := make([]byte, BufferSize)
+	copy(buf, payload)
+	n := client.OnDataWrap(buf, len(payload))
+	if n < quicInitialMin {
+		t.Fatalf("client Initial is %d bytes, want at least %d", n, quicInitialMin)
+	}
+	if buf[0]&0xF0 != 0xC0 || binary.BigEndian.Uint32(buf[1:]) != quicVersion1 {
+		t.Fatalf("not a v1 Initial: %x", buf[:5])
+	}
+	if buf[5] != quicCIDSize || !bytes.Equal(buf[7+quicCIDSize:7+2*quicCIDSize], client.localCID[:]) {
+		t.Fatal("Initial does not carry the client connection ID")
+	}
+	if got := server.OnDataUnwrap(buf, n, netip.AddrPort{}, nil); got != len(payload) || !bytes.Equal(buf[:got], payload) {
+		t.Fatalf("server unwrapped %d bytes", got)
+	}
+
+	copy(buf, payload)
+	n = server.OnDataWrap(buf, len(payload))
+	if buf[0]&0xF0 != 0xC0 || n >= quicInitialMin {
+		t.Fatalf("server reply must be an unpadded Initial, got %d bytes", n)
+	}
+	if !bytes.Equal(buf[6:6+quicCIDSize], client.localCID[:]) {
+		t.Fatal("server Initial is not addressed to the client connection ID")
+	}
+	if got := client.OnDataUnwrap(buf, n, netip.AddrPort{}, nil); got != len(payload) || !bytes.Equal(buf[:got], payload) {
+		t.Fatalf("client unwrapped %d bytes", got)
+	}
+
+	copy(buf, payload)
+	n = client.OnDataWrap(buf, len(payload))
+	if buf[0]&0xC0 != 0x40 || !bytes.Equal(buf[1:1+quicCIDSize], server.localCID[:]) {
+		t.Fatalf("data must use a short header addressed to the server, got %x", buf[:1+quicCIDSize])
+	}
+	if got := server.OnDataUnwrap(buf, n, netip.AddrPort{}, nil); got != len(payload) || !bytes.Equal(buf[:got], payload) {
+		t.Fatalf("server unwrapped %d bytes of short-header data", got)
+	}
+}
+
+func TestQUICMaskerPacketNumbers(t *testing.T) {
+	sender := &maskerQUIC{rng: 5}
+	receiver := &maskerQUIC{rng: 6}
+	buf := make([]byte, BufferSize)
+	for _, number := range []uint64{0, 127, 128, 1<<15 - 1, 1 << 15, 1<<23 + 5, 1 << 30} {
+		sender.appNumber = number
+		for _, length := range []int{0, 3, 32, 1420} {
+			payload := quicPayload(length)
+			copy(buf, payload)
+			n := sender.OnDataWrap(buf, length)
+			if want := quicShortHeaderSize + quicPacketNumberLength(number) + length; n != want {
+				t.Fatalf("packet %d length %d: wrapped to %d bytes, want %d", number, length, n, want)
+			}
+			got := receiver.OnDataUnwrap(buf, n, netip.AddrPort{}, nil)
+			if got != length || !bytes.Equal(buf[:got], payload) {
+				t.Fatalf("packet %d length %d: unwrapped %d bytes", number, length, got)
+			}
+			sender.appNumber = number
+		}
+	}
+}
+
+func TestQUICMaskerRejectsForeignPackets(t *testing.T) {
+	masker := &maskerQUIC{rng: 9}
+	foreign := map[string][]byte{
+		"empty":           {},
+		"no fixed bit":    append([]byte{0x80}, make([]byte, 40)...),
+		"draft version":   append([]byte{0xC0, 0xFF, 0x00, 0x00, 0x1D}, make([]byte, 40)...),
+		"handshake type":  append([]byte{0xE0, 0, 0, 0, 1}, make([]byte, 40)...),
+		"truncated short": {0x40, 1, 2, 3},
+		"stun":            {0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xA4, 0x42},
+	}
+	for name, packet := range foreign {
+		buf := make([]byte, BufferSize)
+		copy(buf, packet)
+		if got := masker.OnDataUnwrap(buf, len(packet), netip.AddrPort{}, nil); got >= 0 {
+			t.Errorf("%s: accepted as %d bytes", name, got)
+		}
+	}
+}
+
+func TestQUICMaskerInitialLengthCoversDatagram(t *testing.T) {
+	for _, length := range []int{32, 148, 1100, 1300} {
+		client := NewMasker(MaskingQUIC, MediaParams{}).(*maskerQUIC)
+		client.OnHandshakeRequest(func(p []byte) (int, error) { return len(p), nil })
+		buf := make([]byte, BufferSize)
+		copy(buf, quicPayload(length))
+		n := client.OnDataWrap(buf, length)
+		if n < quicInitialMin {
+			t.Fatalf("Initial for %d bytes is %d bytes", length, n)
+		}
+		packetLength, size := quicReadVarint(buf[quicLongHeaderSize:n])
+		if size < 0 || quicLongHeaderSize+size+packetLength != n {
+			t.Fatalf("Initial for %d bytes has Length %d, leaving %d bytes of %d outside it", length, packetLength, n-quicLongHeaderSize-size-packetLength, n)
+		}
+		mask := quicHeaderMask(buf, quicLongHeaderSize+size, n)
+		frame := quicLongHeaderSize + size + int((buf[0]^mask[0])&3) + 1
+		if buf[frame] != quicFrameCrypto {
+			t.Fatalf("Initial for %d bytes does not open with a CRYPTO frame: %x", length, buf[frame])
+		}
+	}
+}
@@ -7,32 +7,177 @@ package phobos
 
 import (
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// maskerSTUN frames datagrams as the STUN Data indications the C server
+// speaks. Under TURN masking it acts as a TURN client instead: an Allocate
+// and a ChannelBind at handshake, Send indications until the channel is
+// bound and ChannelData after. Either way it answers a TURN client the way a
+// relay would, so a server needs no setting of its own for it.
+//
+// Server packets are unwrapped without maskerMu, by several workers at
+// once, so what they teach the masker is kept in atomics, and the requests
+// and answers they trigger draw on a generator of their own. Binding
+// responses are matched against the requests sent in path, which locks.
 type maskerSTUN struct {
-	rng rng32
+	rng  rng32
+	turn bool
+
+	// wantChannel and wantPeer are what a TURN client binds. Only a client
+	// sends handshake requests, so client is set by the first one; until
+	// then the masker answers as a relay.
+	wantChannel uint16
+	wantPeer    netip.AddrPort
+	client      bool
+
+	handshakeMu  sync.Mutex
+	handshakeRNG rng32
+
+	allocated atomic.Bool
+	channel   atomic.Uint32
+	peer      atomic.Uint64
+
+	path stunPath
+}
+
+func newMaskerSTUN(turn bool) *maskerSTUN {
+	m := &maskerSTUN{rng: newRNG32(), turn: turn, handshakeRNG: newRNG32()}
+	if turn {
+		m.wantChannel = uint16(turnChannelMin + m.rng.below(turnChannelMax-turnChannelMin+1))
+		m.wantPeer = turnRandomAddress(&m.rng)
+	}
+	return m
+}
+
+// setPeer records the IPv4 peer indications name, packed as address and
+// port so wrap can read it without a lock.
+func (m *maskerSTUN) setPeer(peer netip.AddrPort) {
+	if addr := peer.Addr().Unmap(); addr.Is4() {
+		raw := addr.As4()
+		m.peer.Store(uint64(raw[0])<<40 | uint64(raw[1])<<32 | uint64(raw[2])<<24 | uint64(raw[3])<<16 | uint64(peer.Port()))
+	}
+}
+
+func (m *maskerSTUN) loadPeer() (netip.AddrPort, bool) {
+	packed := m.peer.Load()
+	if packed == 0 {
+		return netip.AddrPort{}, false
+	}
+	addr := netip.AddrFrom4([4]byte{byte(packed >> 40), byte(packed >> 32), byte(packed >> 24), byte(packed >> 16)})
+	return netip.AddrPortFrom(addr, uint16(packed)), true
 }
 
 func (m *maskerSTUN) TimerInterval() time.Duration {
 	return 10 * time.Second
 }
 
+// sendBindingRequest sends a binding request and remembers it, so that its
+// response measures the path.
+func (m *maskerSTUN) sendBindingRequest(send SendFunc) {
+	var buf [stunBindingReqSize]byte
+	request := buf[:stunBuildBindingRequest(buf[:], &m.rng)]
+	m.path.sent(request, time.Now())
+	send(request)
+}
+
+func (m *maskerSTUN) pathStats() PathStats {
+	return m.path.snapshot(time.Now())
+}
+
 func (m *maskerSTUN) OnHandshakeRequest(sendForward SendFunc) {
-	sendBindingRequest(sendForward, &m.rng)
+	m.sendBindingRequest(sendForward)
+	if !m.turn || m.channel.Load() != 0 {
+		return
+	}
+	if !m.client {
+		m.client = true
+		m.setPeer(m.wantPeer)
+	}
+	var buf [turnMessageMax]byte
+	if !m.allocated.Load() {
+		sendForward(buf[:turnBuildAllocateRequest(buf[:], &m.rng)])
+	} else {
+		sendForward(buf[:turnBuildChannelBindRequest(buf[:], &m.rng, m.wantChannel, m.wantPeer)])
+	}
 }
 
 func (m *maskerSTUN) OnDataUnwrap(buf []byte, length int, src netip.AddrPort, sendBack SendFunc) int {
+	if turnIsChannelData(buf[:length]) {
+		return turnUnwrapChannelData(buf, length)
+	}
 	if !stunHasMagic(buf[:length]) {
 		return -1
 	}
+	if length < stunHeaderSize {
+		return -1
+	}
+	switch stunMessageType(buf) {
+	case stunAllocateRequest:
+		m.handshakeMu.Lock()
+		relayed := turnRandomAddress(&m.handshakeRNG)
+		m.handshakeMu.Unlock()
+		var txid [12]byte
+		copy(txid[:], buf[8:20])
+		if n := turnBuildAllocateSuccess(buf, txid[:], src, relayed); n > 0 && sendBack != nil {
+			sendBack(buf[:n])
+		}
+		return 0
+	case stunAllocateSuccess:
+		if m.turn && !m.allocated.Swap(true) && sendBack != nil {
+			var request [turnMessageMax]byte
+			m.handshakeMu.Lock()
+			n := turnBuildChannelBindRequest(request[:], &m.handshakeRNG, m.wantChannel, m.wantPeer)
+			m.handshakeMu.Unlock()
+			sendBack(request[:n])
+		}
+		return 0
+	case stunChannelBindRequest:
+		channel, peer := turnRequestedChannel(buf[:length])
+		if channel == 0 {
+			return 0
+		}
+		m.setPeer(peer)
+		m.channel.Store(uint32(channel))
+		var txid [12]byte
+		copy(txid[:], buf[8:20])
+		if sendBack != nil {
+			sendBack(buf[:turnBuildChannelBindSuccess(buf, txid[:])])
+		}
+		return 0
+	case stunChannelBindSuccess:
+		if m.turn {
+			m.channel.Store(uint32(m.wantChannel))
+		}
+		return 0
+	case stunBindingResponse:
+		m.path.answered(buf[:length], time.Now())
+	case stunSendIndication:
+		if peer, ok := stunReadXORAddress(stunAttribute(buf[:length], stunAttrXORPeer), buf[8:20]); ok && m.peer.Load() == 0 {
+			m.setPeer(peer)
+		}
+	}
 	return stunHandleIncoming(buf, length, src, sendBack)
 }
 
 func (m *maskerSTUN) OnDataWrap(buf []byte, length int) int {
+	if channel := m.channel.Load(); channel != 0 {
+		return turnWrapChannelData(buf, length, uint16(channel))
+	}
+	if peer, ok := m.loadPeer(); ok {
+		messageType := uint16(stunDataIndication)
+		if m.client {
+			messageType = stunSendIndication
+		}
+		return turnWrapIndication(buf, length, messageType, peer, &m.rng)
+	}
 	return stunWrapDataIndication(buf, length, &m.rng)
 }
 
 func (m *maskerSTUN) OnTimer(sendToServer SendFunc) {
-	sendBindingRequest(sendToServer, &m.rng)
+	m.sendBindingRequest(sendToServer)
 }
+
+func (m *maskerSTUN) independentUnwrap() {}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"net/netip"
+	"time"
+)
+
+// dtlsHeldMax is how many tunnel packets a client holds back while its
+// handshake is in flight. WireGuard sends little before its own handshake
+// completes, so the first few cover it.
+const dtlsHeldMax = 8
+
+// maskerTLS frames datagrams as DTLS 1.2. The client opens with a ClientHello,
+// the peer answers with ServerHello/ServerHelloDone, the client closes the
+// flight with ClientKeyExchange/ChangeCipherSpec/Finished, the server
+// answers with its own ChangeCipherSpec/Finished, and from then on every
+// packet is an epoch-1 application-data record. As a real DTLS client would,
+// the client sends no application data before that last flight: packets
+// wrapped earlier are held and go out once it arrives, and an unanswered
+// flight is sent again on the retransmission timer.
+type maskerTLS struct {
+	rng       rng32
+	handshake dtlsHandshake
+	held      [][]byte
+}
+
+func (m *maskerTLS) TimerInterval() time.Duration {
+	return m.handshake.retransmitInterval()
+}
+
+func (m *maskerTLS) OnHandshakeRequest(sendForward SendFunc) {
+	m.handshake.clientHello(sendForward, &m.rng)
+}
+
+func (m *maskerTLS) OnDataUnwrap(buf []byte, length int, src netip.AddrPort, sendBack SendFunc) int {
+	if !dtlsIsRecord(buf[:length]) {
+		return -1
+	}
+	switch buf[0] {
+	case dtlsContentApplicationData:
+		return dtlsUnwrapApplicationData(buf, length)
+	case dtlsContentChangeCipherSpec:
+		if m.handshake.changeCipherSpec() && sendBack != nil {
+			m.release(sendBack)
+		}
+		return 0
+	case dtlsContentHandshake:
+		m.handshake.answer(buf[:length], &m.rng, sendBack)
+		return 0
+	}
+	return -1
+}
+
+// release sends the packets held during the handshake.
+func (m *maskerTLS) release(send SendFunc) {
+	buf := make([]byte, BufferSize)
+	for _, packet := range m.held {
+		if n := m.handshake.session.wrapApplicationData(buf, copy(buf, packet), &m.rng); n > 0 {
+			send(buf[:n])
+		}
+	}
+	m.held = nil
+}
+
+// OnDataWrap returns zero for a packet it holds until the handshake is done.
+func (m *maskerTLS) OnDataWrap(buf []byte, length int) int {
+	if m.handshake.flight != nil && !m.handshake.finished {
+		if len(m.held) == dtlsHeldMax {
+			m.held = m.held[1:]
+		}
+		m.held = append(m.held, bytes.Clone(buf[:length]))
+		return 0
+	}
+	return m.handshake.session.wrapApplicationData(buf, length, &m.rng)
+}
+
+func (m *maskerTLS) OnTimer(sendToServer SendFunc) {
+	m.handshake.retransmit(sendToServer)
+}
@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func checkDTLSRecords(t *testing.T, datagram []byte) []byte {
+	t.Helper()
+	var types []byte
+	for len(datagram) > 0 {
+		if !dtlsIsRecord(datagram) {
+			t.Fatalf("not a DTLS 1.2 record: %x", datagram)
+		}
+		end := dtlsRecordHeaderSize + dtlsRecordLength(datagram)
+		if end > len(datagram) {
+			t.Fatalf("record length %d overruns datagram of %d bytes", end, len(datagram))
+		}
+		if datagram[0] == dtlsContentHandshake && dtlsRecordEpoch(datagram) == 0 {
+			body := datagram[dtlsRecordHeaderSize:end]
+			length := int(body[1])<<16 | int(body[2])<<8 | int(body[3])
+			if dtlsHandshakeHeaderSize+length != len(body) {
+				t.Fatalf("handshake length %d does not match record body of %d bytes", length, len(body))
+			}
+			types = append(types, body[0])
+		} else {
+			types = append(types, datagram[0])
+		}
+		datagram = datagram[end:]
+	}
+	return types
+}
+
+func TestTLSMaskerHandshakeFlights(t *testing.T) {
+	client := NewMasker(MaskingTLS, MediaParams{})
+	server := NewMasker(MaskingTLS, MediaParams{})
+	addr := netip.MustParseAddrPort("127.0.0.1:443")
+
+	var toServer, toClient [][]byte
+	sendToServer := func(p []byte) (int, error) { toServer = append(toServer, bytes.Clone(p)); return len(p), nil }
+	sendToClient := func(p []byte) (int, error) { toClient = append(toClient, bytes.Clone(p)); return len(p), nil }
+
+	client.OnHandshakeRequest(sendToServer)
+	if len(toServer) != 1 || !bytes.Equal(checkDTLSRecords(t, toServer[0]), []byte{dtlsHandshakeClientHello}) {
+		t.Fatalf("expected a ClientHello flight, got %x", toServer)
+	}
+
+	buf := make([]byte, BufferSize)
+	n := copy(buf, toServer[0])
+	if server.OnDataUnwrap(buf, n, addr, sendToClient) != 0 {
+		t.Fatal("ClientHello must be swallowed")
+	}
+	if len(toClient) != 1 || !bytes.Equal(checkDTLSRecords(t, toClient[0]), []byte{dtlsHandshakeServerHello, dtlsHandshakeServerHelloDone}) {
+		t.Fatalf("expected a ServerHello flight, got %x", toClient)
+	}
+
+	n = copy(buf, toClient[0])
+	if client.OnDataUnwrap(buf, n, addr, sendToServer) != 0 {
+		t.Fatal("ServerHello must be swallowed")
+	}
+	want := []byte{dtlsHandshakeClientKeyExchange, dtlsContentChangeCipherSpec, dtlsContentHandshake}
+	if len(toServer) != 2 || !bytes.Equal(checkDTLSRecords(t, toServer[1]), want) {
+		t.Fatalf("expected a ClientKeyExchange flight, got %x", toServer[1:])
+	}
+
+	if interval := client.TimerInterval(); interval != dtlsRetransmitInitial {
+		t.Fatalf("retransmission timer %v while a flight is unanswered", interval)
+	}
+	client.OnTimer(sendToServer)
+	if len(toServer) != 3 || !bytes.Equal(toServer[2], toServer[1]) || client.TimerInterval() != 2*dtlsRetransmitInitial {
+		t.Fatalf("expected the ClientKeyExchange flight again on a doubled timer, got %x", toServer[2:])
+	}
+	payload := handshakePacket(148)
+	if n := client.OnDataWrap(buf[:copy(buf, payload)], len(payload)); n != 0 || len(toServer) != 3 {
+		t.Fatal("data must be held until the server's last flight")
+	}
+
+	n = copy(buf, toServer[1])
+	if server.OnDataUnwrap(buf, n, addr, sendToClient) != 0 {
+		t.Fatal("ClientKeyExchange must be swallowed")
+	}
+	if len(toClient) != 2 || !bytes.Equal(checkDTLSRecords(t, toClient[1]), []byte{dtlsContentChangeCipherSpec, dtlsContentHandshake}) {
+		t.Fatalf("expected a ChangeCipherSpec flight, got %x", toClient[1:])
+	}
+
+	n = copy(buf, toClient[1])
+	if client.OnDataUnwrap(buf, n, addr, sendToServer) != 0 {
+		t.Fatal("ChangeCipherSpec must be swallowed")
+	}
+	if len(toServer) != 4 || !bytes.Equal(checkDTLSRecords(t, toServer[3]), []byte{dtlsContentApplicationData}) {
+		t.Fatalf("expected the held packet after the handshake, got %x", toServer[3:])
+	}
+	n = copy(buf, toServer[3])
+	if got := server.OnDataUnwrap(buf, n, addr, sendToClient); got != len(payload) || !bytes.Equal(buf[:got], payload) {
+		t.Fatal("the held packet does not unwrap")
+	}
+	if interval := client.TimerInterval(); interval != 0 {
+		t.Fatalf("retransmission timer %v after the handshake", interval)
+	}
+
+	client.OnHandshakeRequest(sendToServer)
+	if len(toServer) != 4 {
+		t.Fatal("an established session must not send another ClientHello")
+	}
+}
+
+func TestTLSMaskerRoundTrip(t *testing.T) {
+	sender := NewMasker(MaskingTLS, MediaParams{})
+	receiver := NewMasker(MaskingTLS, MediaParams{})
+	for i, length := range []int{4, 32, 148, 1420} {
+		payload := handshakePacket(length)
+		buf := make([]byte, BufferSize)
+		copy(buf, payload)
+		n := sender.OnDataWrap(buf, length)
+		if n != length+dtlsRecordHeaderSize+dtlsExplicitNonceSize+dtlsAEADTagSize {
+			t.Fatalf("wrapped length %d for payload %d", n, length)
+		}
+		if buf[0] != dtlsContentApplicationData || dtlsRecordEpoch(buf) != 1 {
+			t.Fatalf("unexpected record header %x", buf[:dtlsRecordHeaderSize])
+		}
+		if sequence := binary.BigEndian.Uint32(buf[7:]); sequence != uint32(i) {
+			t.Fatalf("record sequence %d, want %d", sequence, i)
+		}
+		if got := receiver.OnDataUnwrap(buf, n, netip.AddrPort{}, nil); got != length || !bytes.Equal(buf[:got], payload) {
+			t.Fatalf("round trip failed at length %d", length)
+		}
+	}
+}
+
+func TestTLSMaskerRejectsForeignPackets(t *testing.T) {
+	masker := NewMasker(MaskingTLS, MediaParams{})
+	buf := make([]byte, BufferSize)
+	var rng rng32 = 5
+	n := stunBuildBindingRequest(buf, &rng)
+	if masker.OnDataUnwrap(buf, n, netip.AddrPort{}, nil) >= 0 {
+		t.Fatal("a STUN packet must not pass as DTLS")
+	}
+	n = tlsStream{}.Encode(make([]byte, 64), buf)
+	if masker.OnDataUnwrap(buf, n, netip.AddrPort{}, nil) >= 0 {
+		t.Fatal("a TLS 1.2 stream record must not pass as DTLS")
+	}
+}
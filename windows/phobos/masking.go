@@ -6,8 +6,10 @@
 package phobos
 
 import (
+	"fmt"
 	"net/netip"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,40 +20,166 @@ const (
 	MaskingSTUN
 	MaskingMEDIA
 	MaskingTLS
+	MaskingAuto
+	MaskingQUIC
+	MaskingTURN
 )
 
-var maskingNames = map[Masking]string{
-	MaskingNone:  "none",
-	MaskingSTUN:  "STUN",
-	MaskingMEDIA: "MEDIA",
-	MaskingTLS:   "TLS",
+// MaskerFactory makes the masker of one flow: a proxy makes one per
+// upstream, a server one per client.
+type MaskerFactory func(media MediaParams) Masker
+
+// StreamMasker frames the obfuscated byte stream of one SOCKS5 connection.
+// Encode frames src, never more than 1024 bytes, into out and returns how
+// many bytes it wrote, or -1 when out is too small. Decode takes the frame at
+// the start of in and copies its payload to out. It returns the bytes taken
+// and the payload length, zero taken while in holds no whole frame, or -1
+// when in is not framed this way. A frame may not exceed 2048 bytes.
+type StreamMasker interface {
+	Encode(src, out []byte) int
+	Decode(in, out []byte) (int, int)
+}
+
+// StreamMaskerFactory makes the stream masker of one SOCKS5 connection.
+type StreamMaskerFactory func(media MediaParams) StreamMasker
+
+// maskingEntry is a masking mode. overhead is how many bytes its UDP masker
+// adds to each packet.
+type maskingEntry struct {
+	name     string
+	overhead int
+	udp      MaskerFactory
+	stream   StreamMaskerFactory
+}
+
+var maskingRegistry = struct {
+	sync.RWMutex
+	entries []maskingEntry
+	names   map[string]Masking
+}{
+	entries: []maskingEntry{
+		MaskingNone:  {name: "none"},
+		MaskingSTUN:  {"STUN", stunDataIndHeaderSize, func(MediaParams) Masker { return newMaskerSTUN(false) }, func(MediaParams) StreamMasker { return &stunStream{} }},
+		MaskingMEDIA: {"MEDIA", rtpHeaderSize, func(media MediaParams) Masker { return newMaskerMedia(media) }, func(media MediaParams) StreamMasker { return &mediaStream{params: media} }},
+		MaskingTLS:   {"TLS", dtlsRecordHeaderSize + dtlsExplicitNonceSize + dtlsAEADTagSize, func(MediaParams) Masker { return &maskerTLS{rng: newRNG32()} }, func(MediaParams) StreamMasker { return tlsStream{} }},
+		MaskingAuto:  {name: "AUTO"},
+		MaskingQUIC:  {"QUIC", quicShortHeaderSize + 4, func(MediaParams) Masker { return &maskerQUIC{rng: newRNG32()} }, nil},
+		MaskingTURN:  {"TURN", turnIndicationHeaderSize + 3, func(MediaParams) Masker { return newMaskerSTUN(true) }, func(MediaParams) StreamMasker { return &turnStream{} }},
+	},
+	names: map[string]Masking{
+		"": MaskingNone, "none": MaskingNone, "off": MaskingNone,
+		"stun": MaskingSTUN, "media": MaskingMEDIA, "tls": MaskingTLS,
+		"auto": MaskingAuto, "quic": MaskingQUIC, "turn": MaskingTURN,
+	},
+}
+
+// RegisterMasking adds a masking mode under name, which configurations then
+// accept in the masking key regardless of case, and returns its value. udp
+// wraps WireGuard packets and stream frames SOCKS5 connections; either may
+// be nil when the mode does not support that transport. A masker made by udp
+// reports what it adds to each packet by implementing OverheadMasker. Packages
+// call it from init, before any configuration is parsed.
+func RegisterMasking(name string, udp MaskerFactory, stream StreamMaskerFactory) (Masking, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if key == "" || strings.ContainsFunc(key, func(r rune) bool { return r <= ' ' || r == '#' }) {
+		return MaskingNone, fmt.Errorf("phobos: invalid masking name %q", name)
+	}
+	if udp == nil && stream == nil {
+		return MaskingNone, fmt.Errorf("phobos: masking %s has neither a UDP nor a stream masker", name)
+	}
+	overhead := 0
+	if udp != nil {
+		if masker, ok := udp(MediaParams{}).(OverheadMasker); ok {
+			overhead = masker.Overhead()
+		}
+		if overhead < 0 {
+			return MaskingNone, fmt.Errorf("phobos: masking %s has a negative overhead", name)
+		}
+	}
+	maskingRegistry.Lock()
+	defer maskingRegistry.Unlock()
+	if _, ok := maskingRegistry.names[key]; ok {
+		return MaskingNone, fmt.Errorf("phobos: masking %s is already registered", name)
+	}
+	m := Masking(len(maskingRegistry.entries))
+	maskingRegistry.entries = append(maskingRegistry.entries, maskingEntry{strings.TrimSpace(name), overhead, udp, stream})
+	maskingRegistry.names[key] = m
+	return m, nil
+}
+
+func (m Masking) entry() (maskingEntry, bool) {
+	maskingRegistry.RLock()
+	defer maskingRegistry.RUnlock()
+	if m < 0 || int(m) >= len(maskingRegistry.entries) {
+		return maskingEntry{}, false
+	}
+	return maskingRegistry.entries[m], true
 }
 
 func (m Masking) String() string {
-	if name, ok := maskingNames[m]; ok {
-		return name
+	if entry, ok := m.entry(); ok {
+		return entry.name
 	}
-	return maskingNames[MaskingNone]
+	return "none"
+}
+
+// Datagram reports whether m can mask WireGuard packets over UDP.
+func (m Masking) Datagram() bool {
+	entry, ok := m.entry()
+	return ok && (entry.udp != nil || m == MaskingNone || m == MaskingAuto)
+}
+
+// Stream reports whether m can frame a SOCKS5 connection. AUTO leaves those
+// unmasked.
+func (m Masking) Stream() bool {
+	entry, ok := m.entry()
+	return ok && (entry.stream != nil || m == MaskingNone || m == MaskingAuto)
 }
 
 func ParseMasking(value string) (Masking, bool) {
+	maskingRegistry.RLock()
+	defer maskingRegistry.RUnlock()
+	m, ok := maskingRegistry.names[strings.ToLower(strings.TrimSpace(value))]
+	return m, ok
+}
+
+// MediaProfile is how MEDIA masking frames its stream. MediaProfileWebRTC
+// follows a browser call: a DTLS-SRTP handshake after the ICE binding
+// request, then SRTP packets that end in an authentication tag.
+type MediaProfile int
+
+const (
+	MediaProfileRTP MediaProfile = iota
+	MediaProfileWebRTC
+)
+
+var mediaProfileNames = map[MediaProfile]string{
+	MediaProfileRTP:    "rtp",
+	MediaProfileWebRTC: "webrtc",
+}
+
+func (p MediaProfile) String() string {
+	if name, ok := mediaProfileNames[p]; ok {
+		return name
+	}
+	return mediaProfileNames[MediaProfileRTP]
+}
+
+func ParseMediaProfile(value string) (MediaProfile, bool) {
 	switch strings.ToLower(strings.TrimSpace(value)) {
-	case "", "none", "off":
-		return MaskingNone, true
-	case "stun":
-		return MaskingSTUN, true
-	case "media":
-		return MaskingMEDIA, true
-	case "tls":
-		return MaskingTLS, true
+	case "", "rtp":
+		return MediaProfileRTP, true
+	case "webrtc":
+		return MediaProfileWebRTC, true
 	}
-	return MaskingNone, false
+	return MediaProfileRTP, false
 }
 
 type MediaParams struct {
 	PayloadType   uint8
 	SSRC          uint32
 	TimestampStep uint16
+	Profile       MediaProfile
 }
 
 type SendFunc func(p []byte) (int, error)
@@ -64,12 +192,81 @@ type Masker interface {
 	OnTimer(sendToServer SendFunc)
 }
 
+// OverheadMasker is implemented by the masker of a registered masking to
+// report the most bytes its OnDataWrap adds to a packet, which padding, cover
+// traffic and the MTU are sized by. A masker without it is taken to add none.
+type OverheadMasker interface {
+	Masker
+	Overhead() int
+}
+
+// wrapOverhead is how many bytes OnDataWrap adds to a packet under masking.
+// QUIC's packet number grows with the connection, so its figure is the
+// largest the short header reaches. TURN's is that of the Send indication
+// with its DATA padded out, which carries traffic until the channel is
+// bound, rather than the ChannelData header that does so afterwards.
+func wrapOverhead(masking Masking, media MediaParams) int {
+	entry, _ := masking.entry()
+	if masking == MaskingMEDIA && media.Profile == MediaProfileWebRTC {
+		return entry.overhead + srtpAuthTagSize
+	}
+	return entry.overhead
+}
+
+// WrapOverhead is how many bytes masking adds to each datagram on the wire.
+// For AUTO it is the most any candidate adds, as the server picks which.
+func WrapOverhead(masking Masking, media MediaParams) int {
+	if masking != MaskingAuto {
+		return wrapOverhead(masking, media)
+	}
+	overhead := 0
+	for _, candidate := range autoCandidates {
+		overhead = max(overhead, wrapOverhead(candidate, media))
+	}
+	return overhead
+}
+
+// independentUnwrapper is implemented by maskers whose OnDataUnwrap keeps no
+// state shared with the wrap side, so server packets can be unwrapped while
+// tunnel packets are wrapped, and by several workers at once.
+type independentUnwrapper interface {
+	independentUnwrap()
+}
+
+// handshakeFramer is implemented by maskers that frame the packet following
+// a handshake request apart from the rest, as QUIC does with its Initial.
+// reframeHandshake gives the next packet wrapped that framing again, for
+// each copy of a handshake initiation sent under another key.
+type handshakeFramer interface {
+	reframeHandshake()
+}
+
+// obfuscateBytesUnder is how many bytes of a packet are obfuscated under
+// masking when the configuration names configured and obfuscateBytes. A
+// MEDIA peer obfuscates MediaObfuscateBytesDefault unless configured
+// otherwise, so a configuration that only lands on MEDIA, as AUTO and the
+// diagnostic probes do, follows it.
+func obfuscateBytesUnder(masking, configured Masking, obfuscateBytes int) int {
+	if masking == MaskingMEDIA && configured != MaskingMEDIA {
+		return MediaObfuscateBytesDefault
+	}
+	return obfuscateBytes
+}
+
+// NewMasker returns a masker for one flow under masking, or nil when
+// masking wraps nothing over UDP.
 func NewMasker(masking Masking, media MediaParams) Masker {
-	switch masking {
-	case MaskingSTUN:
-		return &maskerSTUN{rng: newRNG32()}
-	case MaskingMEDIA:
-		return &maskerMedia{rng: newRNG32(), params: media}
+	if entry, ok := masking.entry(); ok && entry.udp != nil {
+		return entry.udp(media)
+	}
+	return nil
+}
+
+// newStreamMasker returns the framing for one SOCKS5 connection under
+// masking, or nil when masking frames nothing.
+func newStreamMasker(masking Masking, media MediaParams) StreamMasker {
+	if entry, ok := masking.entry(); ok && entry.stream != nil {
+		return entry.stream(media)
 	}
 	return nil
 }
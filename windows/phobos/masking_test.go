@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// xorMasking is an experimental masking the way a separate package would
+// add one: packets carry a two byte tag and are XORed with its low byte, and streams
+// are cut into length-prefixed frames that are XORed the same way.
+var xorMasking = mustRegisterMasking("Xor-Test",
+	func(MediaParams) Masker { return xorMasker{} },
+	func(MediaParams) StreamMasker { return xorMasker{} })
+
+func mustRegisterMasking(name string, udp MaskerFactory, stream StreamMaskerFactory) Masking {
+	masking, err := RegisterMasking(name, udp, stream)
+	if err != nil {
+		panic(err)
+	}
+	return masking
+}
+
+type xorMasker struct{}
+
+const xorTag = 0x5AA5
+
+func xorBytes(p []byte) {
+	for i := range p {
+		p[i] ^= xorTag & 0xFF
+	}
+}
+
+func (xorMasker) TimerInterval() time.Duration { return 0 }
+func (xorMasker) OnHandshakeRequest(SendFunc)  {}
+func (xorMasker) OnTimer(SendFunc)             {}
+func (xorMasker) independentUnwrap()           {}
+func (xorMasker) Overhead() int                { return 2 }
+
+func (xorMasker) OnDataWrap(buf []byte, length int) int {
+	if length+2 > len(buf) {
+		return -1
+	}
+	copy(buf[2:], buf[:length])
+	binary.BigEndian.PutUint16(buf, xorTag)
+	xorBytes(buf[2 : 2+length])
+	return length + 2
+}
+
+func (xorMasker) OnDataUnwrap(buf []byte, length int, src netip.AddrPort, sendBack SendFunc) int {
+	if length < 2 || binary.BigEndian.Uint16(buf) != xorTag {
+		return -1
+	}
+	xorBytes(buf[2:length])
+	return copy(buf, buf[2:length])
+}
+
+func (xorMasker) Encode(src, out []byte) int {
+	if 2+len(src) > len(out) {
+		return -1
+	}
+	binary.BigEndian.PutUint16(out, uint16(len(src))^xorTag)
+	copy(out[2:], src)
+	xorBytes(out[2 : 2+len(src)])
+	return 2 + len(src)
+}
+
+func (xorMasker) Decode(in, out []byte) (int, int) {
+	if len(in) < 2 {
+		return 0, 0
+	}
+	payload := int(binary.BigEndian.Uint16(in) ^ xorTag)
+	if payload > s5FramePayloadMax || payload > len(out) {
+		return -1, 0
+	}
+	if len(in) < 2+payload {
+		return 0, 0
+	}
+	copy(out, in[2:2+payload])
+	xorBytes(out[:payload])
+	return 2 + payload, payload
+}
+
+// shrinkingMasker reports an overhead no masker can have.
+type shrinkingMasker struct{ xorMasker }
+
+func (shrinkingMasker) Overhead() int { return -1 }
+
+func TestRegisterMasking(t *testing.T) {
+	if masking, ok := ParseMasking(" xor-TEST "); !ok || masking != xorMasking {
+		t.Fatalf("ParseMasking(xor-test) = %v, %v", masking, ok)
+	}
+	if xorMasking.String() != "Xor-Test" || !xorMasking.Datagram() || !xorMasking.Stream() {
+		t.Fatalf("%v is not registered for both transports", xorMasking)
+	}
+	if _, ok := NewMasker(xorMasking, MediaParams{}).(xorMasker); !ok {
+		t.Fatal("NewMasker ignored the registered factory")
+	}
+	if overhead := WrapOverhead(xorMasking, MediaParams{}); overhead != 2 {
+		t.Fatalf("registered overhead came out as %d", overhead)
+	}
+
+	for _, name := range []string{"stun", "XOR-test", "off", "", "two words"} {
+		if _, err := RegisterMasking(name, func(MediaParams) Masker { return xorMasker{} }, nil); err == nil {
+			t.Errorf("RegisterMasking(%q) must fail", name)
+		}
+	}
+	if _, err := RegisterMasking("neither", nil, nil); err == nil {
+		t.Error("a masking without maskers must not register")
+	}
+	if _, err := RegisterMasking("shrinking", func(MediaParams) Masker { return shrinkingMasker{} }, nil); err == nil {
+		t.Error("a masking with a negative overhead must not register")
+	}
+	if MaskingQUIC.Stream() || !MaskingQUIC.Datagram() || !MaskingAuto.Stream() {
+		t.Fatal("built-in maskings lost their transports")
+	}
+}
+
+func TestRegisteredMaskingFramesStream(t *testing.T) {
+	encoder := s5Encoder{newStreamMasker(xorMasking, MediaParams{})}
+	decoder := s5Decoder{masker: newStreamMasker(xorMasking, MediaParams{})}
+	src := bytes.Repeat([]byte("phobos xor "), 400)
+	out := make([]byte, s5BufferSize)
+	n := encoder.encode(src, out)
+	if n != len(src)+2*((len(src)+s5FramePayloadMax-1)/s5FramePayloadMax) {
+		t.Fatalf("encoded %d bytes into %d", len(src), n)
+	}
+	plain := make([]byte, s5BufferSize)
+	if got := decoder.decode(out[:n], plain); !bytes.Equal(plain[:max(got, 0)], src) {
+		t.Fatalf("decoded %d bytes, want %d", got, len(src))
+	}
+}
@@ -50,6 +50,24 @@ func (o *Obfuscator) Encode(buf []byte, length, maxDummyData, obfuscateBytes int
 	return cobf.Encode(buf, length, o.key, maxDummyData, obfuscateBytes)
 }
 
+// EncodePadded obfuscates like Encode but appends exactly dummyLength bytes
+// of padding.
+func (o *Obfuscator) EncodePadded(buf []byte, length, dummyLength, obfuscateBytes int) int {
+	if length < 4 || length+dummyLength > len(buf) {
+		return -1
+	}
+	return cobf.EncodePadded(buf, length, o.key, dummyLength, obfuscateBytes)
+}
+
+// EncodeCover fills buf[:length] with an obfuscated packet that decodes to
+// nothing, for cover traffic the server drops.
+func (o *Obfuscator) EncodeCover(buf []byte, length, obfuscateBytes int) int {
+	if length > len(buf) {
+		return -1
+	}
+	return cobf.EncodeCover(buf, length, o.key, obfuscateBytes)
+}
+
 func (o *Obfuscator) Decode(buf []byte, length, obfuscateBytes int) int {
 	if length < 4 {
 		return -1
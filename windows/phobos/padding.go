@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"errors"
+	"strings"
+)
+
+type PaddingMode int
+
+const (
+	PaddingNone PaddingMode = iota
+	PaddingBuckets
+	PaddingMTU
+	PaddingDistribution
+)
+
+// DefaultPaddingMTU is the UDP payload a 1500-byte Ethernet MTU leaves
+// under an IPv4 header.
+const DefaultPaddingMTU = 1472
+
+var paddingModeNames = map[PaddingMode]string{
+	PaddingNone:         "none",
+	PaddingBuckets:      "buckets",
+	PaddingMTU:          "mtu",
+	PaddingDistribution: "distribution",
+}
+
+func (m PaddingMode) String() string {
+	if name, ok := paddingModeNames[m]; ok {
+		return name
+	}
+	return paddingModeNames[PaddingNone]
+}
+
+func ParsePaddingMode(value string) (PaddingMode, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "none", "off":
+		return PaddingNone, true
+	case "buckets":
+		return PaddingBuckets, true
+	case "mtu":
+		return PaddingMTU, true
+	case "distribution":
+		return PaddingDistribution, true
+	}
+	return PaddingNone, false
+}
+
+// PaddingPolicy decides how long the proxy makes each packet on the wire, so
+// WireGuard's fixed-size control packets stop standing out. The padding
+// travels in the obfuscation header's dummy-length field, the same framing
+// the max-dummy padding uses, so any server decodes it. While a policy is
+// set it replaces the random max-dummy padding.
+type PaddingPolicy struct {
+	Mode PaddingMode
+	// Sizes are UDP payload sizes on the wire, masking header included:
+	// the buckets to round up to, ascending, for PaddingBuckets; the size
+	// to fill for PaddingMTU, DefaultPaddingMTU when empty; and the sizes
+	// to draw from for PaddingDistribution.
+	Sizes []int
+	// Weights are the relative frequencies of Sizes for
+	// PaddingDistribution. A missing weight counts as 1.
+	Weights []int
+}
+
+func (p *PaddingPolicy) Validate() error {
+	for i, size := range p.Sizes {
+		if size <= 0 || size > BufferSize {
+			return errors.New("padding size out of range")
+		}
+		if p.Mode == PaddingBuckets && i > 0 && size <= p.Sizes[i-1] {
+			return errors.New("padding buckets must be ascending")
+		}
+	}
+	for _, weight := range p.Weights {
+		if weight <= 0 {
+			return errors.New("padding weight must be positive")
+		}
+	}
+	switch p.Mode {
+	case PaddingNone:
+	case PaddingBuckets, PaddingDistribution:
+		if len(p.Sizes) == 0 {
+			return errors.New("padding needs at least one size")
+		}
+	case PaddingMTU:
+		if len(p.Sizes) > 1 {
+			return errors.New("padding to MTU takes a single size")
+		}
+	default:
+		return errors.New("unknown padding mode")
+	}
+	return nil
+}
+
+func (p *PaddingPolicy) weight(i int) int {
+	if i < len(p.Weights) {
+		return p.Weights[i]
+	}
+	return 1
+}
+
+// size returns the wire size to pad a packet of wire length to, or length
+// itself when the policy offers nothing that large.
+func (p *PaddingPolicy) size(length int, rng *rng32) int {
+	switch p.Mode {
+	case PaddingBuckets:
+		for _, size := range p.Sizes {
+			if size >= length {
+				return size
+			}
+		}
+	case PaddingMTU:
+		mtu := DefaultPaddingMTU
+		if len(p.Sizes) > 0 {
+			mtu = p.Sizes[0]
+		}
+		return max(mtu, length)
+	case PaddingDistribution:
+		total := 0
+		for i, size := range p.Sizes {
+			if size >= length {
+				total += p.weight(i)
+			}
+		}
+		if total == 0 {
+			break
+		}
+		pick := rng.below(total)
+		for i, size := range p.Sizes {
+			if size < length {
+				continue
+			}
+			if pick -= p.weight(i); pick < 0 {
+				return size
+			}
+		}
+	}
+	return length
+}
@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPaddingPolicySize(t *testing.T) {
+	var rng rng32 = 7
+	buckets := PaddingPolicy{Mode: PaddingBuckets, Sizes: []int{128, 256, 1024}}
+	for length, want := range map[int]int{32: 128, 128: 128, 129: 256, 1024: 1024, 1400: 1400} {
+		if got := buckets.size(length, &rng); got != want {
+			t.Fatalf("bucket for %d = %d, want %d", length, got, want)
+		}
+	}
+
+	mtu := PaddingPolicy{Mode: PaddingMTU}
+	if got := mtu.size(92, &rng); got != DefaultPaddingMTU {
+		t.Fatalf("default MTU padding = %d", got)
+	}
+	mtu.Sizes = []int{1280}
+	if got := mtu.size(1300, &rng); got != 1300 {
+		t.Fatalf("a packet above the MTU grew to %d", got)
+	}
+
+	distribution := PaddingPolicy{Mode: PaddingDistribution, Sizes: []int{200, 600, 1400}, Weights: []int{1, 1000}}
+	counts := make(map[int]int)
+	for range 4096 {
+		size := distribution.size(300, &rng)
+		if size != 600 && size != 1400 {
+			t.Fatalf("drew %d for a 300-byte packet", size)
+		}
+		counts[size]++
+	}
+	if counts[600] < counts[1400]*100 {
+		t.Fatalf("weights ignored: %v", counts)
+	}
+	if got := distribution.size(1500, &rng); got != 1500 {
+		t.Fatalf("a packet above every size grew to %d", got)
+	}
+}
+
+func TestPaddingPolicyValidate(t *testing.T) {
+	valid := []PaddingPolicy{
+		{},
+		{Mode: PaddingMTU},
+		{Mode: PaddingMTU, Sizes: []int{1400}},
+		{Mode: PaddingBuckets, Sizes: []int{128, 256}},
+		{Mode: PaddingDistribution, Sizes: []int{600, 200}, Weights: []int{3}},
+	}
+	for _, policy := range valid {
+		if err := policy.Validate(); err != nil {
+			t.Fatalf("%+v rejected: %v", policy, err)
+		}
+	}
+	invalid := []PaddingPolicy{
+		{Mode: PaddingBuckets},
+		{Mode: PaddingBuckets, Sizes: []int{256, 128}},
+		{Mode: PaddingMTU, Sizes: []int{1400, 1500}},
+		{Mode: PaddingDistribution, Sizes: []int{0}},
+		{Mode: PaddingDistribution, Sizes: []int{200}, Weights: []int{0}},
+		{Mode: PaddingMode(9)},
+	}
+	for _, policy := range invalid {
+		if err := policy.Validate(); err == nil {
+			t.Fatalf("%+v accepted", policy)
+		}
+	}
+}
+
+func TestUDPProxyPadsToBuckets(t *testing.T) {
+	cases := []struct {
+		masking Masking
+		unwrap  func(buf []byte, n int) int
+	}{
+		{MaskingSTUN, stunUnwrapDataIndication},
+		{xorMasking, func(buf []byte, n int) int { return xorMasker{}.OnDataUnwrap(buf, n, netip.AddrPort{}, nil) }},
+	}
+	for _, c := range cases {
+		t.Run(c.masking.String(), func(t *testing.T) { testUDPProxyPadsToBuckets(t, c.masking, c.unwrap) })
+	}
+}
+
+// testUDPProxyPadsToBuckets checks that packets leave the proxy at the
+// bucket sizes on the wire, masking's overhead included.
+func testUDPProxyPadsToBuckets(t *testing.T, masking Masking, unwrap func(buf []byte, n int) int) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:   conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Key:      key,
+		Masking:  masking,
+		MaxDummy: DefaultMaxDummy,
+		Padding:  PaddingPolicy{Mode: PaddingBuckets, Sizes: []int{128, 256, 1024}},
+		Logf:     t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	obfuscator := NewObfuscator(key)
+	buf := make([]byte, BufferSize)
+	for length, wire := range map[int]int{32: 128, 92: 128, 148: 256, 1400: 1400 + WrapOverhead(masking, MediaParams{})} {
+		packet := dataPacket(length, uint32(length))
+		if _, err := client.Write(packet); err != nil {
+			t.Fatalf("unable to send: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("nothing upstream for %d bytes: %v", length, err)
+		}
+		if n != wire {
+			t.Fatalf("%d-byte packet went out as %d bytes, want %d", length, n, wire)
+		}
+		n = unwrap(buf, n)
+		if n = obfuscator.Decode(buf, n, 0); n != length || !bytes.Equal(buf[:n], packet) {
+			t.Fatalf("padded %d-byte packet decoded to %d bytes", length, n)
+		}
+	}
+}
+
+func TestUDPProxyPadsWithinPathMTU(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:   conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Key:      key,
+		Masking:  MaskingSTUN,
+		MaxDummy: DefaultMaxDummy,
+		Padding:  PaddingPolicy{Mode: PaddingMTU, Sizes: []int{4000}},
+		Logf:     t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	buf := make([]byte, BufferSize)
+	for _, c := range []struct{ pathMTU, wire int }{{0, DefaultPaddingMTU}, {1400, 1372}} {
+		proxy.pathMTU.Store(int64(c.pathMTU))
+		if _, err := client.Write(dataPacket(32, uint32(c.pathMTU))); err != nil {
+			t.Fatalf("unable to send: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("nothing upstream: %v", err)
+		}
+		if n != c.wire {
+			t.Fatalf("path MTU %d: padded packet went out as %d bytes, want %d", c.pathMTU, n, c.wire)
+		}
+	}
+}
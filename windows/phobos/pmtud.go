@@ -0,0 +1,184 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// DefaultPathMTUInterval is how often path MTU discovery runs again, as
+// RFC 8899 suggests, so that a path that grew or shrank is noticed.
+const DefaultPathMTUInterval = 10 * time.Minute
+
+const (
+	// pathMTUCeiling is the largest path MTU the search probes for, that of
+	// Ethernet, which few paths across the Internet exceed.
+	pathMTUCeiling = 1500
+
+	pathMTUProbes      = 3
+	pathMTUTimeout     = time.Second
+	pathMTUMinTimeout  = 100 * time.Millisecond
+	pathMTUIdlePoll    = time.Minute
+	pathMTUIPv4Header  = 20
+	pathMTUIPv6Header  = 40
+	pathMTUUDPHeader   = 8
+	pathMTUSmallestMsg = stunBindingReqSize + 4
+)
+
+// PathMTU reports the path MTU to the server that discovery last found, or
+// zero before it has found one.
+func (p *UDPProxy) PathMTU() int {
+	return int(p.pathMTU.Load())
+}
+
+// paddingCeiling is the largest UDP payload the path to the active target
+// carries unfragmented, which padding never takes a packet past: that of the
+// path MTU discovery found, or of a 1500-byte one before it has.
+func (p *UDPProxy) paddingCeiling() int {
+	mtu := int(p.pathMTU.Load())
+	if mtu == 0 {
+		mtu = pathMTUCeiling
+	}
+	if p.ActiveTarget().Addr().Is6() {
+		return mtu - pathMTUIPv6Header - pathMTUUDPHeader
+	}
+	return mtu - pathMTUIPv4Header - pathMTUUDPHeader
+}
+
+func (p *UDPProxy) pathMTULoop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	warned := false
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-timer.C:
+		}
+		s := p.current()
+		if s.PathMTUInterval <= 0 {
+			timer.Reset(pathMTUIdlePoll)
+			continue
+		}
+		target := p.ActiveTarget()
+		mtu, err := p.discoverPathMTU(s, target)
+		switch {
+		case err != nil:
+			p.fail("path MTU discovery", err)
+		case mtu == 0:
+			if !warned && p.running.Load() {
+				s.Logf("Obfuscator: %v answers no STUN binding request, path MTU unknown", target)
+				warned = true
+			}
+		case int64(mtu) != p.pathMTU.Swap(int64(mtu)):
+			s.Logf("Obfuscator: path MTU to %v is %d", target, mtu)
+			if s.PathMTUChanged != nil {
+				s.PathMTUChanged(mtu)
+			}
+		}
+		timer.Reset(s.PathMTUInterval)
+	}
+}
+
+// discoverPathMTU searches for the largest path MTU to target, up to
+// pathMTUCeiling, that carries a binding request the server answers, in the
+// manner of PLPMTUD (RFC 8899). Probes are binding requests padded to size
+// and sent with fragmentation turned off, from a socket of their own so the
+// search leaves the tunnel's flow alone. It returns zero when the server
+// answers not even the smallest probe, as a server that masks with
+// something other than STUN does.
+func (p *UDPProxy) discoverPathMTU(s *proxySettings, target netip.AddrPort) (int, error) {
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		if s.UpstreamControl != nil {
+			if err := s.UpstreamControl(network, address, c); err != nil {
+				return err
+			}
+		}
+		return setDontFragment(network, c)
+	}}
+	conn, err := dialer.DialContext(context.Background(), "udp", target.String())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	headers := pathMTUIPv4Header + pathMTUUDPHeader
+	if target.Addr().Is6() {
+		headers = pathMTUIPv6Header + pathMTUUDPHeader
+	}
+	prober := pathMTUProber{
+		p:       p,
+		conn:    conn,
+		request: make([]byte, BufferSize),
+		answer:  make([]byte, BufferSize),
+		rng:     newRNG32(),
+		timeout: pathMTUTimeout,
+	}
+	low := headers + pathMTUSmallestMsg
+	rtt, ok := prober.probe(low - headers)
+	if !ok {
+		return 0, nil
+	}
+	prober.timeout = min(max(4*rtt, pathMTUMinTimeout), pathMTUTimeout)
+	high := pathMTUCeiling
+	if _, ok := prober.probe(high - headers); ok {
+		return high, nil
+	}
+	for high-low > 4 {
+		mid := (low + high) / 2 &^ 3
+		if _, ok := prober.probe(mid - headers); ok {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return low, nil
+}
+
+type pathMTUProber struct {
+	p       *UDPProxy
+	conn    net.Conn
+	request []byte
+	answer  []byte
+	rng     rng32
+	timeout time.Duration
+}
+
+// probe sends a binding request of size bytes up to pathMTUProbes times,
+// retransmissions keeping the transaction ID as STUN's do, and reports
+// whether the server answered and how quickly. A request the local stack
+// refuses to send is too big for the first link and gets no retry.
+func (pr *pathMTUProber) probe(size int) (time.Duration, bool) {
+	request := pr.request[:stunBuildPaddedBindingRequest(pr.request, size, &pr.rng)]
+	txid := string(request[8:20])
+	for range pathMTUProbes {
+		select {
+		case <-pr.p.done:
+			return 0, false
+		default:
+		}
+		start := time.Now()
+		if _, err := pr.conn.Write(request); err != nil {
+			return 0, false
+		}
+		pr.conn.SetReadDeadline(start.Add(pr.timeout))
+		for {
+			n, err := pr.conn.Read(pr.answer)
+			if err != nil {
+				break
+			}
+			answer := pr.answer[:n]
+			if n >= stunHeaderSize && stunHasMagic(answer) && stunMessageType(answer) == stunBindingResponse && string(answer[8:20]) == txid {
+				return time.Since(start), true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setDontFragment fails where the platform offers no portable way to turn
+// fragmentation off, as probes that get fragmented would find any size fits.
+func setDontFragment(network string, c syscall.RawConn) error {
+	return errors.New("turning fragmentation off is not supported on this platform")
+}
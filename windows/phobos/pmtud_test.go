@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// startNarrowSTUNServer answers the binding requests that would fit a path
+// MTU of pathMTU and drops the rest, as a path with that MTU does.
+func startNarrowSTUNServer(t *testing.T, pathMTU int) netip.AddrPort {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, BufferSize)
+		for {
+			n, source, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if n+pathMTUIPv4Header+pathMTUUDPHeader > pathMTU || stunAttribute(buf[:n], stunAttrPadding) == nil {
+				continue
+			}
+			stunHandleIncoming(buf, n, source, func(p []byte) (int, error) { return conn.WriteToUDPAddrPort(p, source) })
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestDiscoverPathMTU(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	cases := []struct {
+		name   string
+		target netip.AddrPort
+		want   int
+	}{
+		{"clear path", startFakeServer(t, key, MaskingSTUN, MediaParams{}, 0).addr(), pathMTUCeiling},
+		{"PPPoE", startNarrowSTUNServer(t, 1492), 1492},
+		{"narrow", startNarrowSTUNServer(t, 1283), 1280},
+		{"no STUN", closedPort(t, "udp"), 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy := NewUDPProxy(UDPProxyConfig{Target: c.target, Key: key, Masking: MaskingSTUN})
+			mtu, err := proxy.discoverPathMTU(proxy.current(), c.target)
+			if err != nil {
+				t.Fatalf("unable to discover: %v", err)
+			}
+			if mtu != c.want {
+				t.Fatalf("path MTU %d, want %d", mtu, c.want)
+			}
+		})
+	}
+}
+
+func TestPathMTUReportedAtStart(t *testing.T) {
+	found := make(chan int, 1)
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:          startNarrowSTUNServer(t, 1400),
+		Key:             []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI="),
+		Masking:         MaskingSTUN,
+		PathMTUInterval: time.Hour,
+		PathMTUChanged:  func(pathMTU int) { found <- pathMTU },
+		Logf:            t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	defer proxy.Stop()
+	select {
+	case mtu := <-found:
+		if mtu != 1400 || proxy.PathMTU() != 1400 {
+			t.Fatalf("path MTU reported as %d and %d, want 1400", mtu, proxy.PathMTU())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("path MTU never reported")
+	}
+}
@@ -0,0 +1,33 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+const ipPMTUDiscProbe = 3
+
+// setDontFragment makes a socket send its datagrams whole, whatever the
+// route's cached path MTU, so a probe too big for the path is dropped rather
+// than fragmented.
+func setDontFragment(network string, c syscall.RawConn) error {
+	var setErr error
+	err := c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			setErr = windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, windows.IPV6_MTU_DISCOVER, ipPMTUDiscProbe)
+		} else {
+			setErr = windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, windows.IP_MTU_DISCOVER, ipPMTUDiscProbe)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"net/netip"
+	"time"
+)
+
+const (
+	portHopGrace     = 5 * time.Second
+	portHopPollLimit = time.Second
+)
+
+func (p *UDPProxy) hopLoop() {
+	last := time.Now()
+	timer := time.NewTimer(p.current().hopPollInterval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-timer.C:
+			s := p.current()
+			if reason := p.hopReason(s, now, last); reason != "" && p.hop(reason) {
+				last = now
+			}
+			timer.Reset(s.hopPollInterval())
+		}
+	}
+}
+
+func (s *proxySettings) hopPollInterval() time.Duration {
+	interval := portHopPollLimit
+	for _, period := range []time.Duration{s.PortHopInterval, s.PortHopSilence} {
+		if period > 0 {
+			interval = min(interval, period/4)
+		}
+	}
+	return max(interval, 10*time.Millisecond)
+}
+
+// hopReason tells why the upstream is due for a fresh source port, last
+// being when it got its current one, or returns an empty string when it is
+// not. Silence counts only while the tunnel keeps sending, so an idle tunnel
+// is left alone.
+func (p *UDPProxy) hopReason(s *proxySettings, now, last time.Time) string {
+	if s.PortHopInterval > 0 && now.Sub(last) >= s.PortHopInterval {
+		return "scheduled port hop"
+	}
+	if s.PortHopSilence <= 0 || p.client.Load() == nil {
+		return ""
+	}
+	heard := last
+	if server := time.Unix(0, p.counters.lastServerPacket.Load()); server.After(heard) {
+		heard = server
+	}
+	if time.Unix(0, p.lastTunnel.Load()).After(heard) && now.Sub(heard) >= s.PortHopSilence {
+		return "no reply for " + s.PortHopSilence.String()
+	}
+	return ""
+}
+
+// hop opens a fresh socket on the same target, and with it a fresh source
+// port, so whatever a middlebox keyed to the old flow no longer applies.
+// A server that does not run in hopping mode takes nothing but a handshake
+// initiation from a source it does not know, so the upstream stays on the
+// old socket and only handshakes go out through the new one until the server
+// answers there; completeHop then hands the upstream over. The masking state
+// is kept, as the server is the same. A hop still waiting replaces its
+// socket only once a handshake through it has gone unanswered for
+// portHopGrace. When the target has a port range, the fresh socket goes to
+// the port the schedule has now.
+func (p *UDPProxy) hop(reason string) bool {
+	p.switchMu.Lock()
+	defer p.switchMu.Unlock()
+	if !p.running.Load() {
+		return false
+	}
+	if waiting := p.hopping.Load(); waiting != nil {
+		sent := waiting.handshakeSent.Load()
+		if sent == 0 || time.Since(time.Unix(0, sent)) < portHopGrace {
+			return false
+		}
+	}
+	old := p.upstream.Load()
+	link, err := p.beginHopLocked(p.current().scheduled(p.targetIndex, p.targets[p.targetIndex], time.Now()))
+	if err != nil {
+		p.current().Logf("Obfuscator: unable to hop to a new source port: %v", err)
+		return false
+	}
+	p.current().Logf("Obfuscator: %s, source port %d -> %d with the next handshake", reason, old.local.Port(), link.local.Port())
+	return true
+}
+
+// beginHopLocked opens the socket a port hop waits on, replacing any the
+// previous one waited on. The caller holds switchMu.
+func (p *UDPProxy) beginHopLocked(target netip.AddrPort) (*upstreamLink, error) {
+	link, err := p.dial(target)
+	if err != nil {
+		return nil, err
+	}
+	p.dropHopLocked()
+	p.hopping.Store(link)
+	p.serve(link)
+	return link, nil
+}
+
+// sendHandshake sends a packet of a handshake upstream, through the socket
+// a port hop waits on when there is one, so the server meets the new source
+// port with a packet it admits from anyone.
+func (p *UDPProxy) sendHandshake(packet []byte) (int, error) {
+	link := p.hopping.Load()
+	if link == nil {
+		return p.sendToServer(packet)
+	}
+	n, err := link.conn.Write(packet)
+	if err == nil {
+		link.handshakeSent.CompareAndSwap(0, time.Now().UnixNano())
+		p.sent(link, packet)
+	}
+	return n, err
+}
+
+// completeHop makes link, the socket a port hop waits on, the upstream once
+// the server has answered through it. The previous socket keeps receiving
+// for portHopGrace, so replies already on their way still reach WireGuard.
+func (p *UDPProxy) completeHop(link *upstreamLink) {
+	p.switchMu.Lock()
+	defer p.switchMu.Unlock()
+	if !p.running.Load() || !p.hopping.CompareAndSwap(link, nil) {
+		return
+	}
+	old := p.upstream.Load()
+	p.upstream.Store(link)
+	p.retireLocked(old)
+	p.counters.portHops.Add(1)
+	if link.target != old.target {
+		p.current().Logf("Obfuscator: server answered on %v, leaving %v", link.target, old.target)
+		return
+	}
+	p.current().Logf("Obfuscator: server answered on source port %d, leaving %d", link.local.Port(), old.local.Port())
+}
+
+// dropHopLocked abandons the port hop waiting for an answer, if any, as the
+// upstream it was to replace is going away. The caller holds switchMu.
+func (p *UDPProxy) dropHopLocked() {
+	if link := p.hopping.Swap(nil); link != nil {
+		link.conn.Close()
+	}
+}
+
+// retireLocked closes link after portHopGrace, or at Stop if that comes
+// first. The caller holds switchMu.
+func (p *UDPProxy) retireLocked(link *upstreamLink) {
+	if p.retired == nil {
+		p.retired = make(map[*upstreamLink]*time.Timer)
+	}
+	p.retired[link] = time.AfterFunc(portHopGrace, func() {
+		p.switchMu.Lock()
+		defer p.switchMu.Unlock()
+		if _, ok := p.retired[link]; ok {
+			delete(p.retired, link)
+			link.conn.Close()
+		}
+	})
+}
+
+// closeRetiredLocked closes the links still in their grace period. The
+// caller holds switchMu.
+func (p *UDPProxy) closeRetiredLocked() {
+	for link, timer := range p.retired {
+		timer.Stop()
+		link.conn.Close()
+	}
+	clear(p.retired)
+}
@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// hoppingProxy starts a proxy for config towards a bare upstream socket and
+// returns that socket along with a client dialed to the proxy.
+func hoppingProxy(t *testing.T, config UDPProxyConfig) (*UDPProxy, *net.UDPConn, *net.UDPConn) {
+	t.Helper()
+	upstream, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { upstream.Close() })
+	config.Target = upstream.LocalAddr().(*net.UDPAddr).AddrPort()
+	config.Logf = t.Logf
+	proxy := NewUDPProxy(config)
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return proxy, upstream, client
+}
+
+// sourceOf sends packet through the proxy and returns the source address
+// upstream saw it from.
+func sourceOf(t *testing.T, upstream, client *net.UDPConn, packet []byte) netip.AddrPort {
+	t.Helper()
+	if _, err := client.Write(packet); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+	buf := make([]byte, BufferSize)
+	upstream.SetReadDeadline(time.Now().Add(time.Second))
+	_, source, err := upstream.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatalf("packet never arrived: %v", err)
+	}
+	return source
+}
+
+// answerHandshake sends a handshake response to the proxy's socket at
+// source and checks that it reaches the client.
+func answerHandshake(t *testing.T, key []byte, upstream, client *net.UDPConn, source netip.AddrPort) {
+	t.Helper()
+	reply := handshakePacket(92)
+	reply[0] = TypeHandshakeResponse
+	buf := make([]byte, BufferSize)
+	n := NewObfuscator(key).Encode(buf, copy(buf, reply), 0, 0)
+	if _, err := upstream.WriteToUDPAddrPort(buf[:n], source); err != nil {
+		t.Fatalf("unable to reply: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(buf); err != nil || n != len(reply) || buf[0] != TypeHandshakeResponse {
+		t.Fatalf("reply to %v was lost: %d bytes, %v", source, n, err)
+	}
+}
+
+func TestUDPProxyHopsOnSchedule(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	proxy, upstream, client := hoppingProxy(t, UDPProxyConfig{Key: key, PortHopInterval: 100 * time.Millisecond})
+
+	first := sourceOf(t, upstream, client, dataPacket(64, 0))
+	time.Sleep(300 * time.Millisecond)
+	if source := sourceOf(t, upstream, client, dataPacket(64, 1)); source != first {
+		t.Fatalf("data moved from %v to %v before a handshake", first, source)
+	}
+	hopped := sourceOf(t, upstream, client, handshakePacket(148))
+	if hopped == first {
+		t.Fatalf("handshake stayed on %v past the hop interval", first)
+	}
+	if source := sourceOf(t, upstream, client, dataPacket(64, 2)); source != first {
+		t.Fatalf("data moved to %v before the server answered there", source)
+	}
+	if hops := proxy.Stats().PortHops; hops != 0 {
+		t.Fatalf("%d hops counted before the server answered", hops)
+	}
+
+	answerHandshake(t, key, upstream, client, hopped)
+	if source := sourceOf(t, upstream, client, dataPacket(64, 3)); source != hopped {
+		t.Fatalf("data stayed on %v after the server answered on %v", source, hopped)
+	}
+	if hops := proxy.Stats().PortHops; hops != 1 {
+		t.Fatalf("%d hops counted, want 1", hops)
+	}
+	// The socket left behind still delivers replies during its grace period.
+	answerHandshake(t, key, upstream, client, first)
+}
+
+func TestUDPProxyHopsWhenServerIsSilent(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	_, upstream, client := hoppingProxy(t, UDPProxyConfig{Key: key, PortHopSilence: 200 * time.Millisecond})
+	first := sourceOf(t, upstream, client, dataPacket(64, 0))
+	for i := range uint32(20) {
+		sourceOf(t, upstream, client, dataPacket(64, i+1))
+		time.Sleep(20 * time.Millisecond)
+	}
+	if source := sourceOf(t, upstream, client, handshakePacket(148)); source == first {
+		t.Fatalf("proxy kept %v although the server never answered", first)
+	}
+}
+
+// TestUDPProxyHopsPastStrictServer hops against a server that admits a new
+// source only with a handshake initiation, as the C server and a Go server
+// outside hopping mode do, so the tunnel must not lose a packet over a hop.
+func TestUDPProxyHopsPastStrictServer(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	server := startUDPServer(t, UDPServerConfig{Forward: startWireGuardEcho(t), Key: key, Masking: MaskingSTUN})
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:          netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), server.ListenPort()),
+		Key:             key,
+		Masking:         MaskingSTUN,
+		PortHopInterval: 100 * time.Millisecond,
+		Logf:            t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	reply := make([]byte, BufferSize)
+	for i := range uint32(40) {
+		packet := dataPacket(64, i)
+		if i%10 == 0 {
+			packet = handshakePacket(148)
+		}
+		if _, err := client.Write(packet); err != nil {
+			t.Fatalf("unable to send: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := client.Read(reply); err != nil {
+			t.Fatalf("packet %d went unanswered: %v", i, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if hops := proxy.Stats().PortHops; hops < 2 {
+		t.Fatalf("%d hops in 40 packets", hops)
+	}
+}
+
+func TestUDPProxyStaysOnAnsweredPort(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	server := startFakeServer(t, key, MaskingNone, MediaParams{}, 0)
+	proxy := NewUDPProxy(UDPProxyConfig{Target: server.addr(), Key: key, PortHopSilence: 200 * time.Millisecond, Logf: t.Logf})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	reply := make([]byte, BufferSize)
+	for range 6 {
+		client.Write(handshakePacket(148))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(reply); err != nil {
+			t.Fatalf("no reply: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if hops := proxy.Stats().PortHops; hops != 0 {
+		t.Fatalf("proxy hopped %d times while the server answered", hops)
+	}
+}
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// DefaultPortSlot is how long one port of a published range stays active.
+// A server also keeps the ports of the neighbouring slots open, so client
+// clocks may be off by up to a slot.
+const DefaultPortSlot = time.Minute
+
+// portSlot numbers the slot now falls in.
+func portSlot(now time.Time, slot time.Duration) int64 {
+	return now.UnixNano() / int64(slot)
+}
+
+// scheduledPort returns the port of first through last that is active during
+// slot. It is drawn from an HMAC of the slot number under the obfuscation
+// key, so a client and a server sharing the key agree on it without talking
+// and an observer without the key cannot tell which port comes next.
+func scheduledPort(key []byte, first, last uint16, slot int64) uint16 {
+	if last <= first {
+		return first
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("phobos port schedule"))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(slot)))
+	sum := mac.Sum(nil)
+	return first + uint16(binary.BigEndian.Uint64(sum)%uint64(int(last)-int(first)+1))
+}
+
+func (s *proxySettings) portSlot() time.Duration {
+	if s.PortSlot > 0 {
+		return s.PortSlot
+	}
+	return DefaultPortSlot
+}
+
+func (s *proxySettings) lastPort(index int) uint16 {
+	if index < len(s.TargetLastPorts) {
+		return s.TargetLastPorts[index]
+	}
+	return 0
+}
+
+// scheduled moves target, the address of the target at index, to the port
+// its range has active at now. A target without a range is returned as is.
+func (s *proxySettings) scheduled(index int, target netip.AddrPort, now time.Time) netip.AddrPort {
+	last := s.lastPort(index)
+	if last <= target.Port() {
+		return target
+	}
+	return netip.AddrPortFrom(target.Addr(), scheduledPort(s.Key, target.Port(), last, portSlot(now, s.portSlot())))
+}
+
+// untilNextSlot is how long until the slot after the one now falls in.
+func (s *proxySettings) untilNextSlot(now time.Time) time.Duration {
+	slot := s.portSlot()
+	return time.Duration(portSlot(now, slot)+1)*slot - time.Duration(now.UnixNano())
+}
+
+func (p *UDPProxy) scheduleLoop() {
+	timer := time.NewTimer(p.current().untilNextSlot(time.Now()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-timer.C:
+			p.followSchedule(now)
+			timer.Reset(p.current().untilNextSlot(time.Now()))
+		}
+	}
+}
+
+// followSchedule moves the upstream to the port the active target's range
+// has for the slot now falls in. The move is a port hop: a server behind a
+// DNAT'd port range takes nothing but a handshake initiation from a flow it
+// does not know, so data stays on the previous port until the server has
+// answered a handshake on the new one.
+func (p *UDPProxy) followSchedule(now time.Time) {
+	p.switchMu.Lock()
+	defer p.switchMu.Unlock()
+	if !p.running.Load() {
+		return
+	}
+	old := p.upstream.Load()
+	next := p.current().scheduled(p.targetIndex, p.targets[p.targetIndex], now)
+	if waiting := p.hopping.Load(); waiting != nil && waiting.target == next {
+		return
+	}
+	if old.target == next {
+		p.dropHopLocked()
+		return
+	}
+	if _, err := p.beginHopLocked(next); err != nil {
+		p.current().Logf("Obfuscator: unable to move to %v: %v", next, err)
+		return
+	}
+	p.current().Logf("Obfuscator: port slot moved from %v to %v, switching with the next handshake", old.target, next)
+}
@@ -0,0 +1,262 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestScheduledPortFollowsKey(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	other := []byte("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	seen := make(map[uint16]bool)
+	differs := false
+	for slot := int64(0); slot < 400; slot++ {
+		port := scheduledPort(key, 51822, 51861, slot)
+		if port < 51822 || port > 51861 {
+			t.Fatalf("slot %d scheduled port %d outside the range", slot, port)
+		}
+		if port != scheduledPort(key, 51822, 51861, slot) {
+			t.Fatalf("slot %d is not scheduled deterministically", slot)
+		}
+		seen[port] = true
+		differs = differs || port != scheduledPort(other, 51822, 51861, slot)
+	}
+	if len(seen) < 30 {
+		t.Fatalf("400 slots used only %d of 40 ports", len(seen))
+	}
+	if !differs {
+		t.Fatal("another key must give another schedule")
+	}
+	if port := scheduledPort(key, 51822, 51822, 7); port != 51822 {
+		t.Fatalf("a single port range scheduled %d", port)
+	}
+}
+
+// startRangeServer starts a UDPServer on a range of eight ports, picking
+// another base when one of them is taken.
+func startRangeServer(t *testing.T, config UDPServerConfig) *UDPServer {
+	t.Helper()
+	config.Logf = t.Logf
+	for range 5 {
+		probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("unable to listen: %v", err)
+		}
+		base := uint16(probe.LocalAddr().(*net.UDPAddr).Port)
+		probe.Close()
+		if base > 65535-8 {
+			continue
+		}
+		config.Listen = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), base)
+		config.ListenLastPort = base + 7
+		server := NewUDPServer(config)
+		if err := server.Start(); err != nil {
+			t.Logf("range from %d is busy: %v", base, err)
+			continue
+		}
+		t.Cleanup(server.Stop)
+		return server
+	}
+	t.Fatal("no free port range")
+	return nil
+}
+
+func TestUDPProxyFollowsServerPortSchedule(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	const slot = 250 * time.Millisecond
+	server := startRangeServer(t, UDPServerConfig{
+		Forward:  startWireGuardEcho(t),
+		Key:      key,
+		Masking:  MaskingSTUN,
+		MaxDummy: DefaultMaxDummy,
+		PortSlot: slot,
+	})
+	first := server.config.Listen
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:          first,
+		TargetLastPorts: []uint16{server.config.ListenLastPort},
+		PortSlot:        slot,
+		Key:             key,
+		Masking:         MaskingSTUN,
+		MaxDummy:        DefaultMaxDummy,
+		Logf:            t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	ports := make(map[uint16]bool)
+	reply := make([]byte, BufferSize)
+	for deadline := time.Now().Add(6 * slot); time.Now().Before(deadline); {
+		target, now := proxy.ActiveTarget(), time.Now()
+		want := scheduledPort(key, first.Port(), server.config.ListenLastPort, portSlot(now, slot))
+		if target.Port() != want && now.Sub(now.Truncate(slot)) > slot/2 {
+			t.Fatalf("proxy is on port %d halfway through a slot scheduled for %d", target.Port(), want)
+		}
+		ports[target.Port()] = true
+		if _, err := client.Write(handshakePacket(148)); err != nil {
+			t.Fatalf("unable to send: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := client.Read(reply); err != nil || n != 148 || reply[0] != TypeHandshakeResponse {
+			t.Fatalf("no reply through port %d: %v", target.Port(), err)
+		}
+		time.Sleep(slot / 5)
+	}
+	if len(ports) < 2 {
+		t.Fatalf("proxy stayed on %v for six slots", ports)
+	}
+}
+
+// startStrictRange starts a UDPServer outside hopping mode on each of four
+// consecutive ports, as a single server behind a DNAT'd port range looks to
+// a client: on each port a new source is admitted only by a handshake
+// initiation. It returns the first port.
+func startStrictRange(t *testing.T, config UDPServerConfig) netip.AddrPort {
+	t.Helper()
+	config.Logf = t.Logf
+	for range 5 {
+		probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("unable to listen: %v", err)
+		}
+		base := uint16(probe.LocalAddr().(*net.UDPAddr).Port)
+		probe.Close()
+		if base > 65535-4 {
+			continue
+		}
+		var servers []*UDPServer
+		for port := base; port < base+4; port++ {
+			config.Listen = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+			server := NewUDPServer(config)
+			if err := server.Start(); err != nil {
+				t.Logf("port %d is busy: %v", port, err)
+				break
+			}
+			servers = append(servers, server)
+		}
+		for _, server := range servers {
+			t.Cleanup(server.Stop)
+		}
+		if len(servers) == 4 {
+			return netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), base)
+		}
+	}
+	t.Fatal("no free port range")
+	return netip.AddrPort{}
+}
+
+// TestUDPProxyFollowsScheduleWithoutLoss moves between the ports of a range
+// whose server takes a new flow only with a handshake, so the tunnel must
+// not lose a packet when a slot changes.
+func TestUDPProxyFollowsScheduleWithoutLoss(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	const slot = 200 * time.Millisecond
+	first := startStrictRange(t, UDPServerConfig{Forward: startWireGuardEcho(t), Key: key, Masking: MaskingSTUN})
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:          first,
+		TargetLastPorts: []uint16{first.Port() + 3},
+		PortSlot:        slot,
+		Key:             key,
+		Masking:         MaskingSTUN,
+		Logf:            t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	ports := make(map[uint16]bool)
+	reply := make([]byte, BufferSize)
+	for i := range uint32(60) {
+		packet := dataPacket(64, i)
+		if i%8 == 0 {
+			packet = handshakePacket(148)
+		}
+		ports[proxy.ActiveTarget().Port()] = true
+		if _, err := client.Write(packet); err != nil {
+			t.Fatalf("unable to send: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := client.Read(reply); err != nil {
+			t.Fatalf("packet %d through port %d went unanswered: %v", i, proxy.ActiveTarget().Port(), err)
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+	if len(ports) < 2 {
+		t.Fatalf("proxy stayed on %v for seven slots", ports)
+	}
+}
+
+func TestUDPServerDrainsPortInUse(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	const slot = time.Hour
+	server := startRangeServer(t, UDPServerConfig{
+		Forward:  startWireGuardEcho(t),
+		Key:      key,
+		MaxDummy: DefaultMaxDummy,
+		PortSlot: slot,
+	})
+	first, last := server.config.Listen.Port(), server.config.ListenLastPort
+	port := scheduledPort(key, first, last, portSlot(time.Now(), slot))
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatalf("unable to dial server: %v", err)
+	}
+	defer conn.Close()
+	obfuscator := NewObfuscator(key)
+	roundTrip := func(packet []byte) {
+		t.Helper()
+		buf := make([]byte, BufferSize)
+		if _, err := conn.Write(buf[:obfuscator.Encode(buf, copy(buf, packet), 0, 0)]); err != nil {
+			t.Fatalf("unable to send: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("no reply on port %d: %v", port, err)
+		}
+	}
+	roundTrip(handshakePacket(148))
+
+	later := time.Now()
+	for moved := false; !moved; {
+		later = later.Add(slot)
+		moved = true
+		for offset := int64(-1); offset <= 1; offset++ {
+			moved = moved && scheduledPort(key, first, last, portSlot(later, slot)+offset) != port
+		}
+	}
+	if err := server.followSchedule(later); err != nil {
+		t.Fatalf("unable to follow the schedule: %v", err)
+	}
+	roundTrip(dataPacket(64, 0))
+
+	client := server.lookup(conn.LocalAddr().(*net.UDPAddr).AddrPort())
+	if client == nil {
+		t.Fatal("client was dropped with its port")
+	}
+	server.forget(client)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.draining) != 0 || server.listeners[port] != nil {
+		t.Fatalf("port %d stayed open after its last client left", port)
+	}
+}
@@ -26,9 +26,9 @@ func TestSocks5FramingGoEncodeCDecode(t *testing.T) {
 			payload := make([]byte, length)
 			rng.Read(payload)
 
-			var encoder s5Encoder
+			encoder := s5Encoder{newStreamMasker(masking, socks5MediaParams)}
 			out := make([]byte, s5BufferSize+length)
-			n := encoder.encode(masking, socks5MediaParams, payload, out)
+			n := encoder.encode(payload, out)
 			if n < 0 {
 				t.Fatalf("%v: go encode failed at length %d", masking, length)
 			}
@@ -60,9 +60,9 @@ func TestSocks5FramingCEncodeGoDecode(t *testing.T) {
 				t.Fatalf("%v: C encode failed at length %d", masking, length)
 			}
 
-			var decoder s5Decoder
+			decoder := s5Decoder{masker: newStreamMasker(masking, socks5MediaParams)}
 			out := make([]byte, s5BufferSize+length)
-			n := decoder.decode(masking, socks5MediaParams, frames, out)
+			n := decoder.decode(frames, out)
 			if n < 0 || !bytes.Equal(out[:n], payload) {
 				t.Fatalf("%v: Go cannot decode C frames at length %d", masking, length)
 			}
@@ -80,12 +80,12 @@ func TestSocks5FramingDecodesAcrossChunks(t *testing.T) {
 		frames := cref.Socks5Encode(id, socks5MediaParams.PayloadType, socks5MediaParams.SSRC,
 			socks5MediaParams.TimestampStep, payload, s5BufferSize*2)
 
-		var decoder s5Decoder
+		decoder := s5Decoder{masker: newStreamMasker(masking, socks5MediaParams)}
 		out := make([]byte, s5BufferSize)
 		var assembled []byte
 		for offset := 0; offset < len(frames); offset += 7 {
 			chunk := frames[offset:min(offset+7, len(frames))]
-			n := decoder.decode(masking, socks5MediaParams, chunk, out)
+			n := decoder.decode(chunk, out)
 			if n < 0 {
 				t.Fatalf("%v: chunked decode failed", masking)
 			}
@@ -99,10 +99,10 @@ func TestSocks5FramingDecodesAcrossChunks(t *testing.T) {
 
 func TestSocks5FramingRejectsGarbage(t *testing.T) {
 	for masking := range socks5Maskings {
-		var decoder s5Decoder
+		decoder := s5Decoder{masker: newStreamMasker(masking, socks5MediaParams)}
 		out := make([]byte, s5BufferSize)
 		garbage := bytes.Repeat([]byte{0xA5}, 64)
-		if n := decoder.decode(masking, socks5MediaParams, garbage, out); n >= 0 {
+		if n := decoder.decode(garbage, out); n >= 0 {
 			t.Errorf("%v: garbage should not decode", masking)
 		}
 	}
@@ -0,0 +1,275 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultResolveInterval = 5 * time.Minute
+	resolveTimeout         = 10 * time.Second
+)
+
+// Resolver looks up the addresses of an obfuscator target host name.
+// *net.Resolver satisfies it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+var SystemResolver Resolver = net.DefaultResolver
+
+// NewResolver builds the resolver named by spec: empty or "system" for the
+// operating system resolver, or an https:// URL of a DNS-over-HTTPS server.
+// Connections to a DoH server go through control, so they stay off the
+// tunnel like the upstream socket does.
+func NewResolver(spec string, control SocketControl) (Resolver, error) {
+	switch {
+	case spec == "" || strings.EqualFold(spec, "system"):
+		return SystemResolver, nil
+	case len(spec) > len("https://") && strings.EqualFold(spec[:len("https://")], "https://"):
+		return NewDoHResolver(spec, control), nil
+	}
+	return nil, fmt.Errorf("phobos: unknown resolver %q", spec)
+}
+
+// DoHResolver queries an RFC 8484 DNS-over-HTTPS server with wire-format
+// messages. Give it the server by address, as in https://1.1.1.1/dns-query,
+// when the system resolver is not to be trusted with the lookup.
+type DoHResolver struct {
+	url    string
+	client *http.Client
+}
+
+func NewDoHResolver(url string, control SocketControl) *DoHResolver {
+	dialer := &net.Dialer{Control: control, Timeout: resolveTimeout}
+	return &DoHResolver{
+		url: url,
+		client: &http.Client{
+			Timeout: resolveTimeout,
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   time.Minute,
+			},
+		},
+	}
+}
+
+func (r *DoHResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var types []uint16
+	switch network {
+	case "ip":
+		types = []uint16{dnsTypeA, dnsTypeAAAA}
+	case "ip4":
+		types = []uint16{dnsTypeA}
+	case "ip6":
+		types = []uint16{dnsTypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	var addrs []netip.Addr
+	var lastErr error
+	for _, qtype := range types {
+		found, err := r.exchange(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, found...)
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.url, IsNotFound: true}
+}
+
+func (r *DoHResolver) exchange(ctx context.Context, host string, qtype uint16) ([]netip.Addr, error) {
+	query, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("phobos: DoH server answered %s", response.Status)
+	}
+	message, err := io.ReadAll(io.LimitReader(response.Body, 0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := dnsParseAnswers(message, qtype)
+	if err != nil {
+		if errors.Is(err, errDNSNotFound) {
+			return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.url, IsNotFound: true}
+		}
+		return nil, err
+	}
+	return addrs, nil
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+var (
+	errDNSMalformed = errors.New("phobos: malformed DNS response")
+	errDNSNotFound  = errors.New("phobos: DNS name does not exist")
+)
+
+func dnsQuery(host string, qtype uint16) ([]byte, error) {
+	name := strings.TrimSuffix(host, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return nil, fmt.Errorf("phobos: invalid host name %q", host)
+	}
+	message := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(message[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(message[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("phobos: invalid host name %q", host)
+		}
+		message = append(message, byte(len(label)))
+		message = append(message, label...)
+	}
+	message = append(message, 0)
+	message = binary.BigEndian.AppendUint16(message, qtype)
+	message = binary.BigEndian.AppendUint16(message, dnsClassIN)
+	return message, nil
+}
+
+func dnsSkipName(message []byte, offset int) (int, error) {
+	for offset < len(message) {
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xC0 == 0xC0:
+			if offset+2 > len(message) {
+				return 0, errDNSMalformed
+			}
+			return offset + 2, nil
+		case length&0xC0 != 0:
+			return 0, errDNSMalformed
+		}
+		offset += 1 + length
+	}
+	return 0, errDNSMalformed
+}
+
+// dnsParseAnswers returns the qtype records of a response. Other answers,
+// such as the CNAME chain that led to them, are skipped.
+func dnsParseAnswers(message []byte, qtype uint16) ([]netip.Addr, error) {
+	if len(message) < 12 || message[2]&0x80 == 0 {
+		return nil, errDNSMalformed
+	}
+	switch rcode := message[3] & 0x0F; rcode {
+	case 0:
+	case 3:
+		return nil, errDNSNotFound
+	default:
+		return nil, fmt.Errorf("phobos: DNS server answered with rcode %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(message[4:]))
+	answers := int(binary.BigEndian.Uint16(message[6:]))
+
+	offset := 12
+	var err error
+	for range questions {
+		if offset, err = dnsSkipName(message, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+	}
+	var addrs []netip.Addr
+	for range answers {
+		if offset, err = dnsSkipName(message, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(message) {
+			return nil, errDNSMalformed
+		}
+		rtype := binary.BigEndian.Uint16(message[offset:])
+		class := binary.BigEndian.Uint16(message[offset+2:])
+		length := int(binary.BigEndian.Uint16(message[offset+8:]))
+		offset += 10
+		if offset+length > len(message) {
+			return nil, errDNSMalformed
+		}
+		if rtype == qtype && class == dnsClassIN {
+			if addr, ok := netip.AddrFromSlice(message[offset : offset+length]); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+		offset += length
+	}
+	return addrs, nil
+}
+
+// resolveTarget turns a "host:port" target into an address, preferring
+// IPv4 the way conf.ResolveEndpoints does at tunnel start.
+func resolveTarget(resolver Resolver, target string) (netip.AddrPort, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("phobos: invalid port in %q", target)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+	}
+	if resolver == nil {
+		resolver = SystemResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var chosen netip.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			chosen = addr
+			break
+		}
+		if !chosen.IsValid() {
+			chosen = addr
+		}
+	}
+	if !chosen.IsValid() {
+		return netip.AddrPort{}, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return netip.AddrPortFrom(chosen, uint16(port)), nil
+}
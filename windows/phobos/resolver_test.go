@@ -0,0 +1,177 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+type fakeResolver struct {
+	mu    sync.Mutex
+	addrs map[string][]netip.Addr
+}
+
+func newFakeResolver(host string, addrs ...netip.Addr) *fakeResolver {
+	return &fakeResolver{addrs: map[string][]netip.Addr{host: addrs}}
+}
+
+func (r *fakeResolver) set(host string, addrs ...netip.Addr) {
+	r.mu.Lock()
+	r.addrs[host] = addrs
+	r.mu.Unlock()
+}
+
+func (r *fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// forbidSystemResolver fails the test if anything consults the system
+// resolver before it ends.
+func forbidSystemResolver(t *testing.T) {
+	system := SystemResolver
+	SystemResolver = forbiddenResolver{t}
+	t.Cleanup(func() { SystemResolver = system })
+}
+
+type forbiddenResolver struct{ t *testing.T }
+
+func (r forbiddenResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	r.t.Errorf("system resolver consulted for %s", host)
+	return nil, errors.New("system resolver is forbidden in this test")
+}
+
+func TestResolveTargetPrefersIPv4(t *testing.T) {
+	resolver := newFakeResolver("obfs.test", netip.MustParseAddr("2001:db8::7"), netip.MustParseAddr("192.0.2.7"))
+	target, err := resolveTarget(resolver, "obfs.test:51821")
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	if want := netip.MustParseAddrPort("192.0.2.7:51821"); target != want {
+		t.Fatalf("resolved %v, want %v", target, want)
+	}
+	if target, err := resolveTarget(nil, "[2001:db8::9]:443"); err != nil || target != netip.MustParseAddrPort("[2001:db8::9]:443") {
+		t.Fatalf("literal address resolved to %v, %v", target, err)
+	}
+	if _, err := resolveTarget(resolver, "missing.test:51821"); err == nil {
+		t.Fatal("unknown host must fail")
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	for _, spec := range []string{"", "system", "SYSTEM"} {
+		if resolver, err := NewResolver(spec, nil); err != nil || resolver != SystemResolver {
+			t.Fatalf("%q: got %v, %v", spec, resolver, err)
+		}
+	}
+	if resolver, err := NewResolver("https://1.1.1.1/dns-query", nil); err != nil {
+		t.Fatalf("DoH resolver rejected: %v", err)
+	} else if _, ok := resolver.(*DoHResolver); !ok {
+		t.Fatalf("got %T, want *DoHResolver", resolver)
+	}
+	for _, spec := range []string{"http://1.1.1.1/dns-query", "1.1.1.1", "https://"} {
+		if _, err := NewResolver(spec, nil); err == nil {
+			t.Fatalf("%q must be rejected", spec)
+		}
+	}
+}
+
+// dohAnswer echoes query back as a response carrying the records of its
+// question type, or NXDOMAIN when records has no entry for it.
+func dohAnswer(query []byte, records map[uint16][]netip.Addr) []byte {
+	qtype := binary.BigEndian.Uint16(query[len(query)-4:])
+	response := append([]byte(nil), query...)
+	response[2], response[3] = 0x81, 0x80
+	addrs, ok := records[qtype]
+	if !ok {
+		response[3] |= 3
+		return response
+	}
+	binary.BigEndian.PutUint16(response[6:], uint16(len(addrs)))
+	for _, addr := range addrs {
+		response = append(response, 0xC0, 12)
+		response = binary.BigEndian.AppendUint16(response, qtype)
+		response = binary.BigEndian.AppendUint16(response, dnsClassIN)
+		response = binary.BigEndian.AppendUint32(response, 60)
+		response = binary.BigEndian.AppendUint16(response, uint16(addr.BitLen()/8))
+		response = append(response, addr.AsSlice()...)
+	}
+	return response
+}
+
+func TestDoHResolver(t *testing.T) {
+	records := map[string]map[uint16][]netip.Addr{
+		"obfs.test": {
+			dnsTypeA:    {netip.MustParseAddr("192.0.2.7")},
+			dnsTypeAAAA: {netip.MustParseAddr("2001:db8::7")},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		name := ""
+		for offset := 12; query[offset] != 0; offset += 1 + int(query[offset]) {
+			if name != "" {
+				name += "."
+			}
+			name += string(query[offset+1 : offset+1+int(query[offset])])
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dohAnswer(query, records[name]))
+	}))
+	defer server.Close()
+
+	resolver := NewDoHResolver(server.URL, nil)
+	addrs, err := resolver.LookupNetIP(context.Background(), "ip", "obfs.test")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if len(addrs) != 2 || addrs[0] != netip.MustParseAddr("192.0.2.7") || addrs[1] != netip.MustParseAddr("2001:db8::7") {
+		t.Fatalf("got %v", addrs)
+	}
+	if addrs, err := resolver.LookupNetIP(context.Background(), "ip6", "obfs.test."); err != nil || len(addrs) != 1 || !addrs[0].Is6() {
+		t.Fatalf("ip6 lookup got %v, %v", addrs, err)
+	}
+
+	_, err = resolver.LookupNetIP(context.Background(), "ip", "missing.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("missing host error = %v, want not found", err)
+	}
+}
+
+func TestDNSParseAnswersRejectsTruncated(t *testing.T) {
+	query, err := dnsQuery("obfs.test", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := dohAnswer(query, map[uint16][]netip.Addr{dnsTypeA: {netip.MustParseAddr("192.0.2.7")}})
+	for cut := 1; cut < len(response)-len(query); cut++ {
+		if _, err := dnsParseAnswers(response[:len(response)-cut], dnsTypeA); err == nil {
+			t.Fatalf("response cut by %d bytes was accepted", cut)
+		}
+	}
+	if _, err := dnsParseAnswers(query, dnsTypeA); err == nil {
+		t.Fatal("a query must not parse as a response")
+	}
+}
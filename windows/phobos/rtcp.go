@@ -0,0 +1,187 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+const (
+	rtcpTypeSR   = 200
+	rtcpTypeRR   = 201
+	rtcpTypeSDES = 202
+
+	rtcpHeaderSize      = 8
+	rtcpSenderInfoSize  = 20
+	rtcpReportBlockSize = 24
+	rtcpSDESCNAME       = 1
+	rtcpCNAMELength     = 16
+	rtcpMaxCompoundSize = 112
+
+	rtpClockRate = 90000
+	ntpUnixEpoch = 2208988800
+)
+
+const cnameAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// isRTCP reports whether buf holds an RTCP packet multiplexed onto the RTP
+// 5-tuple. RFC 5761 tells the two apart by the second byte: a packet type
+// from 192 to 223 for RTCP, the marker bit with a payload type from 64 to 95
+// for RTP. Those payload types are kept clear of with rtcp-mux, but one the
+// preset names explicitly is still taken for RTP. The lengths of the packets
+// in the compound must also add up to the datagram, less the SRTCP trailer
+// if there is one, so an AUTO server probing a packet of another masking
+// does not take it for RTCP by its first two bytes.
+func isRTCP(buf []byte, payloadType uint8) bool {
+	if len(buf) < rtcpHeaderSize || buf[0]&0xC0 != 0x80 || buf[1] < 192 || buf[1] > 223 || buf[1]&0x7F == payloadType {
+		return false
+	}
+	offset := 0
+	for offset+4 <= len(buf) && buf[offset]&0xC0 == 0x80 {
+		offset += (int(binary.BigEndian.Uint16(buf[offset+2:])) + 1) * 4
+		if offset == len(buf)-4-srtpAuthTagSize {
+			return true
+		}
+	}
+	return offset == len(buf)
+}
+
+func ntpTime(t time.Time) uint64 {
+	return uint64(t.Unix()+ntpUnixEpoch)<<32 | uint64(t.Nanosecond())<<32/uint64(time.Second)
+}
+
+// rtpReceiver holds the reception statistics of the peer's RTP stream that a
+// report block carries, kept as in RFC 3550 appendix A.
+type rtpReceiver struct {
+	active   bool
+	ssrc     uint32
+	epoch    time.Time
+	baseSeq  uint32
+	maxSeq   uint16
+	cycles   uint32
+	received uint32
+	transit  int32
+	jitter   float64
+
+	expectedPrior, receivedPrior uint32
+
+	lastSR   uint32
+	lastSRAt time.Time
+}
+
+func (r *rtpReceiver) onRTP(buf []byte, arrival time.Time) {
+	sequence := binary.BigEndian.Uint16(buf[2:])
+	timestamp := binary.BigEndian.Uint32(buf[4:])
+	ssrc := binary.BigEndian.Uint32(buf[8:])
+	if !r.active || ssrc != r.ssrc {
+		*r = rtpReceiver{active: true, ssrc: ssrc, epoch: arrival, baseSeq: uint32(sequence), maxSeq: sequence}
+	} else if delta := sequence - r.maxSeq; delta < 0x8000 {
+		if sequence < r.maxSeq {
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = sequence
+	}
+	r.received++
+
+	transit := int32(uint32(arrival.Sub(r.epoch).Seconds()*rtpClockRate) - timestamp)
+	if r.received > 1 {
+		d := transit - r.transit
+		r.jitter += (math.Abs(float64(d)) - r.jitter) / 16
+	}
+	r.transit = transit
+}
+
+// onSR remembers when the peer's last sender report arrived, by the middle
+// 32 bits of its NTP timestamp, for the LSR and DLSR fields.
+func (r *rtpReceiver) onSR(buf []byte, arrival time.Time) {
+	if len(buf) < rtcpHeaderSize+rtcpSenderInfoSize {
+		return
+	}
+	r.lastSR = binary.BigEndian.Uint32(buf[rtcpHeaderSize+2:])
+	r.lastSRAt = arrival
+}
+
+func (r *rtpReceiver) appendReportBlock(out []byte, now time.Time) []byte {
+	extended := r.cycles + uint32(r.maxSeq)
+	expected := extended - r.baseSeq + 1
+	lost := min(max(int64(expected)-int64(r.received), -0x800000), 0x7FFFFF)
+	expectedInterval := expected - r.expectedPrior
+	lostInterval := int64(expectedInterval) - int64(r.received-r.receivedPrior)
+	r.expectedPrior, r.receivedPrior = expected, r.received
+	var fraction uint32
+	if expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint32(lostInterval << 8 / int64(expectedInterval))
+	}
+	var delay uint32
+	if r.lastSR != 0 {
+		delay = uint32(now.Sub(r.lastSRAt).Seconds() * 65536)
+	}
+	out = binary.BigEndian.AppendUint32(out, r.ssrc)
+	out = binary.BigEndian.AppendUint32(out, fraction<<24|uint32(lost)&0xFFFFFF)
+	out = binary.BigEndian.AppendUint32(out, extended)
+	out = binary.BigEndian.AppendUint32(out, uint32(r.jitter))
+	out = binary.BigEndian.AppendUint32(out, r.lastSR)
+	return binary.BigEndian.AppendUint32(out, delay)
+}
+
+// appendRTCP appends the compound RTCP packet the stream reports with: a
+// sender report once it has sent media and a receiver report before that,
+// with a block for the peer's stream when one has arrived, followed by the
+// SDES CNAME every compound packet has to carry. Nothing is appended while
+// no media has gone either way.
+func (m *maskerMedia) appendRTCP(out []byte, now time.Time) []byte {
+	m.receiveMu.Lock()
+	defer m.receiveMu.Unlock()
+	if !m.stream.initialized && !m.received.active {
+		return out
+	}
+	if !m.stream.initialized {
+		m.stream.init(m.params, &m.rng)
+	}
+
+	start := len(out)
+	var blocks byte
+	if m.received.active {
+		blocks = 1
+	}
+	packetType := byte(rtcpTypeRR)
+	if m.stream.packets > 0 {
+		packetType = rtcpTypeSR
+	}
+	out = append(out, 0x80|blocks, packetType, 0, 0)
+	out = binary.BigEndian.AppendUint32(out, m.stream.ssrc)
+	if packetType == rtcpTypeSR {
+		out = binary.BigEndian.AppendUint64(out, ntpTime(now))
+		out = binary.BigEndian.AppendUint32(out, m.stream.timestamp)
+		out = binary.BigEndian.AppendUint32(out, m.stream.packets)
+		out = binary.BigEndian.AppendUint32(out, m.stream.octets)
+	}
+	if blocks > 0 {
+		out = m.received.appendReportBlock(out, now)
+	}
+	binary.BigEndian.PutUint16(out[start+2:], uint16((len(out)-start)/4-1))
+
+	start = len(out)
+	out = append(out, 0x81, rtcpTypeSDES, 0, 0)
+	out = binary.BigEndian.AppendUint32(out, m.stream.ssrc)
+	out = append(out, rtcpSDESCNAME, byte(len(m.stream.cname)))
+	out = append(out, m.stream.cname[:]...)
+	out = append(out, 0)
+	for (len(out)-start)%4 != 0 {
+		out = append(out, 0)
+	}
+	binary.BigEndian.PutUint16(out[start+2:], uint16((len(out)-start)/4-1))
+
+	if m.params.Profile == MediaProfileWebRTC {
+		// SRTCP: the E flag with the packet index, then the tag.
+		out = binary.BigEndian.AppendUint32(out, 1<<31|m.stream.srtcpIndex)
+		m.stream.srtcpIndex = (m.stream.srtcpIndex + 1) & 0x7FFFFFFF
+		out = appendRandom(out, srtpAuthTagSize, &m.rng)
+	}
+	return out
+}
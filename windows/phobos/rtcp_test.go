@@ -0,0 +1,158 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// rtcpReports runs the masker's timer and returns the compound RTCP packet
+// it sent next to the STUN binding request.
+func rtcpReports(t *testing.T, masker Masker) []byte {
+	t.Helper()
+	var report []byte
+	masker.OnTimer(func(p []byte) (int, error) {
+		if !stunHasMagic(p) {
+			report = append([]byte(nil), p...)
+		}
+		return len(p), nil
+	})
+	return report
+}
+
+// splitRTCP checks the framing of a compound packet and returns its parts.
+func splitRTCP(t *testing.T, compound []byte) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	for len(compound) > 0 {
+		if !isRTCP(compound, 0) {
+			t.Fatalf("not an RTCP packet: %x", compound)
+		}
+		end := (int(binary.BigEndian.Uint16(compound[2:])) + 1) * 4
+		if end > len(compound) {
+			t.Fatalf("RTCP length %d overruns %d bytes", end, len(compound))
+		}
+		packets = append(packets, compound[:end])
+		compound = compound[end:]
+	}
+	return packets
+}
+
+func TestMediaRTCPSenderReport(t *testing.T) {
+	params := MediaParams{PayloadType: 102, TimestampStep: 3000}
+	masker := NewMasker(MaskingMEDIA, params)
+	if report := rtcpReports(t, masker); report != nil {
+		t.Fatalf("RTCP before any media: %x", report)
+	}
+
+	buf := make([]byte, BufferSize)
+	var rtp []byte
+	for _, length := range []int{100, 200, 300} {
+		n := masker.OnDataWrap(buf, length)
+		rtp = append(rtp[:0], buf[:n]...)
+	}
+	packets := splitRTCP(t, rtcpReports(t, masker))
+	if len(packets) != 2 || packets[0][1] != rtcpTypeSR || packets[1][1] != rtcpTypeSDES {
+		t.Fatalf("got %d packets, want SR and SDES", len(packets))
+	}
+	sr, sdes := packets[0], packets[1]
+	ssrc := binary.BigEndian.Uint32(rtp[8:])
+	if got := binary.BigEndian.Uint32(sr[4:]); got != ssrc {
+		t.Fatalf("SR from SSRC %#x, RTP from %#x", got, ssrc)
+	}
+	if len(sr) != rtcpHeaderSize+rtcpSenderInfoSize || sr[0]&0x1F != 0 {
+		t.Fatalf("SR without a peer stream has %d bytes and %d blocks", len(sr), sr[0]&0x1F)
+	}
+	if timestamp := binary.BigEndian.Uint32(sr[16:]); timestamp != binary.BigEndian.Uint32(rtp[4:])+3000 {
+		t.Fatalf("SR timestamp %d does not follow the last RTP timestamp %d", timestamp, binary.BigEndian.Uint32(rtp[4:]))
+	}
+	if packets, octets := binary.BigEndian.Uint32(sr[20:]), binary.BigEndian.Uint32(sr[24:]); packets != 3 || octets != 600 {
+		t.Fatalf("SR counts %d packets and %d octets", packets, octets)
+	}
+	if binary.BigEndian.Uint32(sdes[4:]) != ssrc || sdes[8] != rtcpSDESCNAME || sdes[9] != rtcpCNAMELength {
+		t.Fatalf("SDES does not carry the stream CNAME: %x", sdes)
+	}
+}
+
+func TestMediaRTCPReceiverReport(t *testing.T) {
+	params := MediaParams{PayloadType: 102, TimestampStep: 3000}
+	peer, masker := NewMasker(MaskingMEDIA, params), NewMasker(MaskingMEDIA, params)
+
+	buf := make([]byte, BufferSize)
+	var peerSSRC uint32
+	var lastSequence uint16
+	for i := range 10 {
+		n := peer.OnDataWrap(buf, 64)
+		if i == 4 {
+			continue
+		}
+		peerSSRC, lastSequence = binary.BigEndian.Uint32(buf[8:]), binary.BigEndian.Uint16(buf[2:])
+		if got := masker.OnDataUnwrap(buf, n, netip.AddrPort{}, nil); got != 64 {
+			t.Fatalf("RTP unwrapped to %d bytes", got)
+		}
+	}
+
+	packets := splitRTCP(t, rtcpReports(t, masker))
+	rr := packets[0]
+	if rr[1] != rtcpTypeRR || rr[0]&0x1F != 1 || len(rr) != rtcpHeaderSize+rtcpReportBlockSize {
+		t.Fatalf("want an RR with one block before sending media, got %x", rr)
+	}
+	block := rr[rtcpHeaderSize:]
+	if binary.BigEndian.Uint32(block) != peerSSRC {
+		t.Fatalf("report block is about SSRC %#x, want %#x", binary.BigEndian.Uint32(block), peerSSRC)
+	}
+	if lost := binary.BigEndian.Uint32(block[4:]) & 0xFFFFFF; lost != 1 {
+		t.Fatalf("cumulative loss %d, want 1", lost)
+	}
+	if fraction := block[4]; fraction != 256/10 {
+		t.Fatalf("fraction lost %d, want %d", fraction, 256/10)
+	}
+	if highest := binary.BigEndian.Uint32(block[8:]); uint16(highest) != lastSequence {
+		t.Fatalf("highest sequence %d, want %d", highest, lastSequence)
+	}
+
+	// The peer's sender report is swallowed and echoed back in LSR.
+	report := rtcpReports(t, peer)
+	lsr := binary.BigEndian.Uint32(report[rtcpHeaderSize+2:])
+	copy(buf, report)
+	if got := masker.OnDataUnwrap(buf, len(report), netip.AddrPort{}, nil); got != 0 {
+		t.Fatalf("RTCP unwrapped to %d bytes, want it swallowed", got)
+	}
+	block = splitRTCP(t, rtcpReports(t, masker))[0][rtcpHeaderSize:]
+	if got := binary.BigEndian.Uint32(block[16:]); got != lsr {
+		t.Fatalf("LSR %#x, want %#x", got, lsr)
+	}
+	if fraction := block[4]; fraction != 0 {
+		t.Fatalf("fraction lost %d over an interval without loss", fraction)
+	}
+}
+
+func TestMediaRTCPKeepsConfiguredPayloadType(t *testing.T) {
+	// Payload type 72 with the marker bit reads as an SR under rtcp-mux; a
+	// preset that names it still gets its RTP through.
+	params := MediaParams{PayloadType: 72}
+	buf := make([]byte, BufferSize)
+	n := NewMasker(MaskingMEDIA, params).OnDataWrap(buf, 64)
+	if got := NewMasker(MaskingMEDIA, params).OnDataUnwrap(buf, n, netip.AddrPort{}, nil); got != 64 {
+		t.Fatalf("RTP with payload type 72 unwrapped to %d bytes", got)
+	}
+}
+
+func TestAutoProbeDoesNotTakePacketsForRTCP(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	keys, obfuscator := newKeyRing(key, nil), NewObfuscator(key)
+	buf := make([]byte, BufferSize)
+	for i := range 2000 {
+		n := obfuscator.Encode(buf, copy(buf, handshakePacket(148)), DefaultMaxDummy, 0)
+		first := [2]byte{buf[0], buf[1]}
+		detector := newAutoMasking(MediaParams{})
+		if got, index := detector.probe(buf, n, keys, 0, netip.AddrPort{}, nil); got != 148 || autoCandidates[index] != MaskingNone {
+			t.Fatalf("packet %d starting %x probed as %d bytes of candidate %d", i, first, got, index)
+		}
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"net/netip"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
@@ -24,37 +25,169 @@ var (
 )
 
 type Socks5Config struct {
-	Target     netip.AddrPort
-	Key        []byte
-	Masking    Masking
-	Media      MediaParams
-	Login      string
-	Password   string
-	ListenPort uint16
-	Control    SocketControl
-	Logf       func(format string, args ...any)
+	Target netip.AddrPort
+	// TargetHost is the "host:port" name of Target. When set, the client
+	// resolves it if Target is unset and again every ResolveInterval.
+	TargetHost      string
+	Resolver        Resolver
+	ResolveInterval time.Duration
+
+	Key          []byte
+	PreviousKeys []PreviousKey
+	Masking      Masking
+	Media        MediaParams
+	Login        string
+	Password     string
+	ListenPort   uint16
+	Control      SocketControl
+	Logf         func(format string, args ...any)
+	// Capture, when set, records every connection before and after
+	// obfuscation.
+	Capture *Capture
 }
 
 type Socks5Client struct {
-	config   Socks5Config
+	settings atomic.Pointer[socks5Settings]
 	dialer   net.Dialer
 	listener net.Listener
 
 	running atomic.Bool
 	wait    sync.WaitGroup
+	done    chan struct{}
 
 	mu    sync.Mutex
 	serve map[net.Conn]struct{}
 }
 
+// socks5Settings pairs a configuration with the server address it currently
+// resolves to. open loads it once, so a connection is opened to one server
+// with one key and masking even while Reconfigure or SetTarget run.
+type socks5Settings struct {
+	Socks5Config
+	target netip.AddrPort
+	keys   *keyRing
+}
+
+// keyAttemptTimeout bounds the greeting under a key that may be stale, so
+// that a server which silently drops it does not stall the next attempt.
+const keyAttemptTimeout = 5 * time.Second
+
 func NewSocks5Client(config Socks5Config) *Socks5Client {
 	if config.Logf == nil {
 		config.Logf = func(string, ...any) {}
 	}
-	return &Socks5Client{
-		config: config,
+	c := &Socks5Client{
 		dialer: net.Dialer{Control: config.Control},
 		serve:  make(map[net.Conn]struct{}),
+		done:   make(chan struct{}),
+	}
+	c.settings.Store(newSocks5Settings(config))
+	return c
+}
+
+func newSocks5Settings(config Socks5Config) *socks5Settings {
+	if config.Resolver == nil {
+		config.Resolver = SystemResolver
+	}
+	if config.ResolveInterval <= 0 {
+		config.ResolveInterval = DefaultResolveInterval
+	}
+	return &socks5Settings{
+		Socks5Config: config,
+		target:       netip.AddrPortFrom(config.Target.Addr().Unmap(), config.Target.Port()),
+		keys:         newKeyRing(config.Key, config.PreviousKeys),
+	}
+}
+
+func (c *Socks5Client) current() *socks5Settings {
+	return c.settings.Load()
+}
+
+// Target reports the server new connections are opened to.
+func (c *Socks5Client) Target() netip.AddrPort {
+	return c.current().target
+}
+
+// SetTarget points new connections at target. Connections already open keep
+// talking to the address they were opened to until they close.
+func (c *Socks5Client) SetTarget(target netip.AddrPort) error {
+	if !target.IsValid() {
+		return errors.New("phobos: obfuscator target is not resolved")
+	}
+	target = netip.AddrPortFrom(target.Addr().Unmap(), target.Port())
+	for {
+		old := c.current()
+		next := *old
+		next.target = target
+		if c.settings.CompareAndSwap(old, &next) {
+			return nil
+		}
+	}
+}
+
+// Reconfigure applies config to the connections opened from now on.
+// Connections already open finish on the key, masking and server they were
+// opened with, and the local listener keeps its port. Logf, Control and
+// ListenPort stay as they were given to NewSocks5Client.
+func (c *Socks5Client) Reconfigure(config Socks5Config) error {
+	old := c.current()
+	config.Logf, config.Control, config.ListenPort, config.Capture = old.Logf, old.Control, old.ListenPort, old.Capture
+	next := newSocks5Settings(config)
+	if len(next.Key) == 0 {
+		return errors.New("phobos: obfuscation key is empty")
+	}
+	if !next.Masking.Stream() {
+		return fmt.Errorf("phobos: %v masking is not available for SOCKS5", next.Masking)
+	}
+	if !next.target.IsValid() && next.TargetHost != "" {
+		target, err := resolveTarget(next.Resolver, next.TargetHost)
+		if err != nil {
+			return fmt.Errorf("phobos: unable to resolve obfuscator target %s: %w", next.TargetHost, err)
+		}
+		next.target = target
+	}
+	if !next.target.IsValid() {
+		return errors.New("phobos: obfuscator target is not resolved")
+	}
+	c.settings.Store(next)
+	next.Logf("SOCKS5 proxy reconfigured: %v (masking %v)", next.target, next.Masking)
+	return nil
+}
+
+// resolve looks up the TargetHost of s and records the result, unless the
+// settings changed in the meantime.
+func (c *Socks5Client) resolve(s *socks5Settings) error {
+	target, err := resolveTarget(s.Resolver, s.TargetHost)
+	if err != nil {
+		return fmt.Errorf("phobos: unable to resolve obfuscator target %s: %w", s.TargetHost, err)
+	}
+	if target == s.target {
+		return nil
+	}
+	next := *s
+	next.target = target
+	if c.settings.CompareAndSwap(s, &next) && s.target.IsValid() {
+		s.Logf("SOCKS5 proxy: %s moved from %v to %v", s.TargetHost, s.target, target)
+	}
+	return nil
+}
+
+func (c *Socks5Client) resolveLoop() {
+	defer c.wait.Done()
+	timer := time.NewTimer(c.current().ResolveInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-timer.C:
+		}
+		if s := c.current(); s.TargetHost != "" {
+			if err := c.resolve(s); err != nil {
+				s.Logf("SOCKS5 proxy: %v", err)
+			}
+		}
+		timer.Reset(c.current().ResolveInterval)
 	}
 }
 
@@ -87,35 +220,62 @@ func (c *Socks5Client) closeServed() {
 	}
 }
 
-func (c *Socks5Client) hasCredentials() bool {
-	return len(c.config.Login) > 0 && len(c.config.Password) > 0
+func (s *socks5Settings) hasCredentials() bool {
+	return len(s.Login) > 0 && len(s.Password) > 0
 }
 
 func (c *Socks5Client) open(ctx context.Context) (*obfConn, error) {
-	if len(c.config.Key) == 0 {
+	s := c.current()
+	if len(s.Key) == 0 {
 		return nil, errors.New("phobos: obfuscation key is empty")
 	}
-	if !c.config.Target.IsValid() {
-		return nil, errors.New("phobos: obfuscator target is not resolved")
+	if !s.Masking.Stream() {
+		return nil, fmt.Errorf("phobos: %v masking is not available for SOCKS5", s.Masking)
 	}
-	conn, err := c.dialer.DialContext(ctx, "tcp", c.config.Target.String())
-	if err != nil {
-		return nil, err
+	if !s.target.IsValid() && s.TargetHost != "" {
+		if err := c.resolve(s); err != nil {
+			return nil, err
+		}
+		s = c.current()
 	}
-	if tcp, ok := conn.(*net.TCPConn); ok {
-		tcp.SetNoDelay(true)
+	if !s.target.IsValid() {
+		return nil, errors.New("phobos: obfuscator target is not resolved")
 	}
-	obfuscated := newObfConn(conn, c.config.Key, c.config.Masking, c.config.Media)
-	if err := c.negotiate(obfuscated); err != nil {
+	// A stream carries no key check of its own, so each key is tried on a
+	// fresh connection, the proven one first, until the server answers the
+	// greeting.
+	order := s.keys.order(time.Now())
+	var lastErr error
+	for attempt, index := range order {
+		conn, err := c.dialer.DialContext(ctx, "tcp", s.target.String())
+		if err != nil {
+			return nil, err
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetNoDelay(true)
+		}
+		if attempt < len(order)-1 {
+			conn.SetDeadline(time.Now().Add(keyAttemptTimeout))
+		}
+		obfuscated := newObfConn(conn, s.keys.keys[index], s.Masking, s.Media, s.Capture)
+		err = c.negotiate(obfuscated, s)
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+			s.keys.prove(index)
+			return obfuscated, nil
+		}
 		conn.Close()
-		return nil, err
+		if errors.Is(err, errAuthFailed) {
+			return nil, err
+		}
+		lastErr = err
 	}
-	return obfuscated, nil
+	return nil, lastErr
 }
 
-func (c *Socks5Client) negotiate(conn *obfConn) error {
+func (c *Socks5Client) negotiate(conn *obfConn, s *socks5Settings) error {
 	methods := []byte{methodNoAuth}
-	if c.hasCredentials() {
+	if s.hasCredentials() {
 		methods = []byte{methodNoAuth, methodUserPass}
 	}
 	if _, err := conn.Write(buildGreeting(methods...)); err != nil {
@@ -133,10 +293,10 @@ func (c *Socks5Client) negotiate(conn *obfConn) error {
 	case methodNoAuth:
 		return nil
 	case methodUserPass:
-		if !c.hasCredentials() {
+		if !s.hasCredentials() {
 			return errAuthFailed
 		}
-		auth, err := buildUserPass(c.config.Login, c.config.Password)
+		auth, err := buildUserPass(s.Login, s.Password)
 		if err != nil {
 			return err
 		}
@@ -253,18 +413,27 @@ func (c *Socks5Client) ListenPort() uint16 {
 }
 
 func (c *Socks5Client) Start() error {
-	if c.config.ListenPort == 0 {
-		return nil
+	s := c.current()
+	if s.TargetHost != "" && !s.target.IsValid() {
+		if err := c.resolve(s); err != nil {
+			return err
+		}
 	}
-	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(c.config.ListenPort)})
-	if err != nil {
-		return fmt.Errorf("unable to open the local SOCKS5 listener: %w", err)
+	if s.ListenPort != 0 {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(s.ListenPort)})
+		if err != nil {
+			return fmt.Errorf("unable to open the local SOCKS5 listener: %w", err)
+		}
+		c.listener = listener
 	}
-	c.listener = listener
 	c.running.Store(true)
+	if c.listener != nil {
+		c.wait.Add(1)
+		go c.acceptLoop()
+		s.Logf("SOCKS5 proxy listening on 127.0.0.1:%d -> %v (masking %v)", c.ListenPort(), c.Target(), s.Masking)
+	}
 	c.wait.Add(1)
-	go c.acceptLoop()
-	c.config.Logf("SOCKS5 proxy listening on 127.0.0.1:%d -> %v (masking %v)", c.ListenPort(), c.config.Target, c.config.Masking)
+	go c.resolveLoop()
 	return nil
 }
 
@@ -272,10 +441,13 @@ func (c *Socks5Client) Stop() {
 	if !c.running.Swap(false) {
 		return
 	}
-	c.listener.Close()
+	close(c.done)
+	if c.listener != nil {
+		c.listener.Close()
+	}
 	c.closeServed()
 	c.wait.Wait()
-	c.config.Logf("SOCKS5 proxy stopped")
+	c.current().Logf("SOCKS5 proxy stopped")
 }
 
 func (c *Socks5Client) acceptLoop() {
@@ -295,7 +467,7 @@ func (c *Socks5Client) acceptLoop() {
 			defer c.forgetServed(conn)
 			defer conn.Close()
 			if err := c.handle(conn); err != nil && c.running.Load() {
-				c.config.Logf("SOCKS5 proxy: %v", err)
+				c.current().Logf("SOCKS5 proxy: %v", err)
 			}
 		}()
 	}
@@ -345,7 +517,7 @@ func (c *Socks5Client) serveHandshake(conn net.Conn, reader *bufio.Reader) error
 	}
 
 	required := byte(methodNoAuth)
-	if c.hasCredentials() {
+	if c.current().hasCredentials() {
 		required = methodUserPass
 	}
 	offered := false
@@ -388,7 +560,7 @@ func (c *Socks5Client) serveUserPass(conn net.Conn, reader *bufio.Reader) error
 		return err
 	}
 
-	if string(login) != c.config.Login || string(password) != c.config.Password {
+	if s := c.current(); string(login) != s.Login || string(password) != s.Password {
 		conn.Write([]byte{userPassVersion, 0x01})
 		return errAuthFailed
 	}
@@ -50,7 +50,7 @@ func (s *fakeSocks5Server) run() {
 		if err != nil {
 			return
 		}
-		go s.handle(newObfConn(conn, s.key, s.masking, s.media))
+		go s.handle(newObfConn(conn, s.key, s.masking, s.media, nil))
 	}
 }
 
@@ -59,7 +59,7 @@ func (s *fakeSocks5Server) handle(conn *obfConn) {
 	reader := bufio.NewReader(conn)
 
 	var greeting [2]byte
-	if _, err := io.ReadFull(reader, greeting[:]); err != nil {
+	if _, err := io.ReadFull(reader, greeting[:]); err != nil || greeting[0] != socks5Version {
 		return
 	}
 	methods := make([]byte, greeting[1])
@@ -219,6 +219,8 @@ var socks5TestCases = []struct {
 }{
 	{"none", MaskingNone, MediaParams{}},
 	{"stun", MaskingSTUN, MediaParams{}},
+	{"turn", MaskingTURN, MediaParams{}},
+	{"registered", xorMasking, MediaParams{}},
 	{"media", MaskingMEDIA, MediaParams{PayloadType: 102, SSRC: 0xC0FFEE, TimestampStep: 3000}},
 	{"tls", MaskingTLS, MediaParams{}},
 }
@@ -374,6 +376,153 @@ func TestSocks5ClientRejectsWrongCredentials(t *testing.T) {
 	}
 }
 
+func TestSocks5ClientTargetHost(t *testing.T) {
+	echo := startEchoServer(t)
+	echoPort := uint16(echo.(*net.TCPAddr).Port)
+	first := startFakeSocks5Server(t, socks5TestKey, MaskingNone, MediaParams{}, "", "")
+	second := startFakeSocks5Server(t, socks5TestKey, MaskingNone, MediaParams{}, "", "")
+
+	forbidSystemResolver(t)
+	resolver := newFakeResolver("obfs.test", first.addr().Addr())
+	client := NewSocks5Client(Socks5Config{
+		TargetHost:      net.JoinHostPort("obfs.test", strconv.Itoa(int(first.addr().Port()))),
+		Resolver:        resolver,
+		ResolveInterval: 50 * time.Millisecond,
+		Key:             socks5TestKey,
+		Logf:            t.Logf,
+	})
+	if err := client.Start(); err != nil {
+		t.Fatalf("unable to start client: %v", err)
+	}
+	t.Cleanup(client.Stop)
+	if got := client.Target(); got != first.addr() {
+		t.Fatalf("target = %v, want %v", got, first.addr())
+	}
+
+	open, err := client.DialTCP(context.Background(), "127.0.0.1", echoPort)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer open.Close()
+
+	if err := client.SetTarget(second.addr()); err != nil {
+		t.Fatalf("SetTarget failed: %v", err)
+	}
+	first.listener.Close()
+	conn, err := client.DialTCP(context.Background(), "127.0.0.1", echoPort)
+	if err != nil {
+		t.Fatalf("dial after SetTarget failed: %v", err)
+	}
+	conn.Close()
+	payload := []byte("still on the old server")
+	open.Write(payload)
+	received := make([]byte, len(payload))
+	open.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(open, received); err != nil || !bytes.Equal(received, payload) {
+		t.Fatalf("connection opened before SetTarget broke: %v", err)
+	}
+
+	moved := netip.MustParseAddr("192.0.2.7")
+	resolver.set("obfs.test", moved)
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Target() != netip.AddrPortFrom(moved, first.addr().Port()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("client never re-resolved, target is %v", client.Target())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSocks5ClientReconfigure(t *testing.T) {
+	echo := startEchoServer(t)
+	echoPort := uint16(echo.(*net.TCPAddr).Port)
+	newKey := []byte("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")
+	first := startFakeSocks5Server(t, socks5TestKey, MaskingSTUN, MediaParams{}, "user", "pass")
+	second := startFakeSocks5Server(t, newKey, MaskingTLS, MediaParams{}, "", "")
+
+	client := NewSocks5Client(Socks5Config{
+		Target:   first.addr(),
+		Key:      socks5TestKey,
+		Masking:  MaskingSTUN,
+		Login:    "user",
+		Password: "pass",
+		Logf:     t.Logf,
+	})
+	inFlight, err := client.DialTCP(context.Background(), "127.0.0.1", echoPort)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer inFlight.Close()
+
+	if err := client.Reconfigure(Socks5Config{Target: second.addr(), Key: newKey, Masking: MaskingQUIC}); err == nil {
+		t.Fatal("Reconfigure must reject QUIC masking")
+	}
+	if err := client.Reconfigure(Socks5Config{Target: second.addr(), Key: newKey, Masking: MaskingTLS}); err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	if got := client.Target(); got != second.addr() {
+		t.Fatalf("target = %v, want %v", got, second.addr())
+	}
+
+	echoOver := func(conn net.Conn, payload string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		received := make([]byte, len(payload))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, received); err != nil || string(received) != payload {
+			t.Fatalf("echo of %q failed: %v", payload, err)
+		}
+	}
+	conn, err := client.DialTCP(context.Background(), "127.0.0.1", echoPort)
+	if err != nil {
+		t.Fatalf("dial after Reconfigure failed: %v", err)
+	}
+	defer conn.Close()
+	echoOver(conn, "new settings")
+	echoOver(inFlight, "old settings")
+}
+
+func TestSocks5ClientFallsBackToPreviousKey(t *testing.T) {
+	echo := startEchoServer(t)
+	echoPort := uint16(echo.(*net.TCPAddr).Port)
+	newKey := []byte("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")
+	server := startFakeSocks5Server(t, socks5TestKey, MaskingSTUN, MediaParams{}, "", "")
+
+	client := NewSocks5Client(Socks5Config{
+		Target:  server.addr(),
+		Key:     newKey,
+		Masking: MaskingSTUN,
+		PreviousKeys: []PreviousKey{
+			{Key: []byte("expired-key"), Expires: time.Now().Add(-time.Hour)},
+			{Key: socks5TestKey, Expires: time.Now().Add(time.Hour)},
+		},
+		Logf: t.Logf,
+	})
+	for range 2 {
+		conn, err := client.DialTCP(context.Background(), "127.0.0.1", echoPort)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		conn.Close()
+	}
+	if got := client.current().keys.provenIndex(time.Now()); got != 2 {
+		t.Fatalf("proven key index = %d, want 2", got)
+	}
+
+	expired := NewSocks5Client(Socks5Config{
+		Target:       server.addr(),
+		Key:          newKey,
+		PreviousKeys: []PreviousKey{{Key: socks5TestKey, Expires: time.Now().Add(-time.Minute)}},
+		Masking:      MaskingSTUN,
+		Logf:         t.Logf,
+	})
+	if _, err := expired.DialTCP(context.Background(), "127.0.0.1", echoPort); err == nil {
+		t.Fatal("an expired previous key must not be used")
+	}
+}
+
 func TestSocks5LocalListener(t *testing.T) {
 	echo := startEchoServer(t)
 	echoPort := uint16(echo.(*net.TCPAddr).Port)
@@ -389,7 +538,7 @@ func TestSocks5LocalListener(t *testing.T) {
 		ListenPort: 0,
 		Logf:       t.Logf,
 	})
-	client.config.ListenPort = freePort(t)
+	client.current().ListenPort = freePort(t)
 	if err := client.Start(); err != nil {
 		t.Fatalf("unable to start the listener: %v", err)
 	}
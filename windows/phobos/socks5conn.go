@@ -17,8 +17,9 @@ var errFrameCorrupt = errors.New("phobos: corrupt obfuscated frame")
 
 type obfConn struct {
 	net.Conn
-	masking Masking
-	media   MediaParams
+	framed  bool
+	capture *Capture
+	flow    *captureFlow
 
 	writeMu      sync.Mutex
 	writeCipher  *cobf.StreamCipher
@@ -34,16 +35,24 @@ type obfConn struct {
 	readErr    error
 }
 
-func newObfConn(conn net.Conn, key []byte, masking Masking, media MediaParams) *obfConn {
+func newObfConn(conn net.Conn, key []byte, masking Masking, media MediaParams, capture *Capture) *obfConn {
+	if masking == MaskingAuto {
+		// A TCP stream has no handshake to probe with; like the C client,
+		// AUTO leaves SOCKS5 traffic unmasked.
+		masking = MaskingNone
+	}
 	c := &obfConn{
 		Conn:        conn,
-		masking:     masking,
-		media:       media,
 		writeCipher: cobf.NewStreamCipher(key),
 		readCipher:  cobf.NewStreamCipher(key),
 		readRaw:     make([]byte, s5EncodeReadMax),
 	}
-	if masking != MaskingNone {
+	if capture != nil {
+		c.capture, c.flow = capture, newCaptureFlow(conn)
+	}
+	if masker := newStreamMasker(masking, media); masker != nil {
+		c.framed = true
+		c.encoder.masker, c.decoder.masker = masker, masker
 		c.writeScratch = make([]byte, s5EncodeReadMax)
 		c.writeFrames = make([]byte, s5BufferSize)
 		c.readPlain = make([]byte, s5BufferSize)
@@ -62,16 +71,18 @@ func (c *obfConn) Write(p []byte) (int, error) {
 		chunk := min(len(p), s5EncodeReadMax)
 		plain := c.writeScratch[:chunk]
 		copy(plain, p[:chunk])
+		c.capture.segment(captureLoopback, c.flow, true, plain, 0, "")
 		c.writeCipher.Apply(plain)
 
 		wire := plain
-		if c.masking != MaskingNone {
-			n := c.encoder.encode(c.masking, c.media, plain, c.writeFrames)
+		if c.framed {
+			n := c.encoder.encode(plain, c.writeFrames)
 			if n < 0 {
 				return written, errFrameCorrupt
 			}
 			wire = c.writeFrames[:n]
 		}
+		c.capture.segment(captureWire, c.flow, true, wire, len(wire), "")
 		if _, err := c.Conn.Write(wire); err != nil {
 			return written, err
 		}
@@ -107,15 +118,20 @@ func (c *obfConn) Read(p []byte) (int, error) {
 }
 
 func (c *obfConn) decodeChunk(raw []byte) ([]byte, error) {
-	if c.masking == MaskingNone {
+	if !c.framed {
+		c.capture.segment(captureWire, c.flow, false, raw, len(raw), "")
 		c.readCipher.Apply(raw)
+		c.capture.segment(captureLoopback, c.flow, false, raw, 0, "")
 		return raw, nil
 	}
-	n := c.decoder.decode(c.masking, c.media, raw, c.readPlain)
+	n := c.decoder.decode(raw, c.readPlain)
 	if n < 0 {
+		c.capture.segment(captureWire, c.flow, false, raw, len(raw), rejectComment("masking"))
 		return nil, errFrameCorrupt
 	}
+	c.capture.segment(captureWire, c.flow, false, raw, len(raw), "")
 	plain := c.readPlain[:n]
 	c.readCipher.Apply(plain)
+	c.capture.segment(captureLoopback, c.flow, false, plain, 0, "")
 	return plain, nil
 }
@@ -5,7 +5,10 @@
 
 package phobos
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"net/netip"
+)
 
 const (
 	s5FramePayloadMax = 1024
@@ -17,52 +20,39 @@ const (
 	tlsRecordHeader  = 5
 )
 
+// s5Encoder cuts the stream of one connection into frames of its masking.
 type s5Encoder struct {
-	stream rtpStream
-	rng    rng32
-}
-
-func (e *s5Encoder) frameSize(masking Masking, payload int) int {
-	switch masking {
-	case MaskingSTUN:
-		return stunDataIndHeaderSize + payload + stunPadding(payload)
-	case MaskingTLS:
-		return tlsRecordHeader + payload
-	default:
-		return rtpTCPHeaderSize + payload
-	}
+	masker StreamMasker
 }
 
 func stunPadding(payload int) int {
 	return (4 - payload&3) & 3
 }
 
-func (e *s5Encoder) encode(masking Masking, params MediaParams, src, out []byte) int {
-	if masking == MaskingMEDIA && !e.stream.initialized {
-		e.stream.init(params, &e.rng)
-	}
+func (e *s5Encoder) encode(src, out []byte) int {
 	written := 0
 	for len(src) > 0 {
 		chunk := min(len(src), s5FramePayloadMax)
-		if written+e.frameSize(masking, chunk) > len(out) {
+		n := e.masker.Encode(src[:chunk], out[written:])
+		if n < 0 {
 			return -1
 		}
-		switch masking {
-		case MaskingSTUN:
-			written += e.encodeSTUN(src[:chunk], out[written:])
-		case MaskingTLS:
-			written += encodeTLS(src[:chunk], out[written:])
-		default:
-			written += e.encodeMedia(src[:chunk], out[written:])
-		}
+		written += n
 		src = src[chunk:]
 	}
 	return written
 }
 
-func (e *s5Encoder) encodeSTUN(src, out []byte) int {
+type stunStream struct {
+	rng rng32
+}
+
+func (e *stunStream) Encode(src, out []byte) int {
 	payload := len(src)
 	padding := stunPadding(payload)
+	if stunDataIndHeaderSize+payload+padding > len(out) {
+		return -1
+	}
 	messageLength := 4 + payload + padding
 
 	binary.BigEndian.PutUint16(out, stunDataIndication)
@@ -76,7 +66,54 @@ func (e *s5Encoder) encodeSTUN(src, out []byte) int {
 	return stunDataIndHeaderSize + payload + padding
 }
 
-func encodeTLS(src, out []byte) int {
+func (e *stunStream) Decode(in, out []byte) (int, int) {
+	return decodeSTUNFrame(in, out)
+}
+
+// turnStream opens with an Allocate and a ChannelBind request, as a TURN
+// client over TCP does, and sends ChannelData on the channel from then on,
+// padded to four bytes as TCP framing requires.
+type turnStream struct {
+	rng     rng32
+	channel uint16
+	peer    netip.AddrPort
+}
+
+func (e *turnStream) Encode(src, out []byte) int {
+	written := 0
+	if e.channel == 0 {
+		if len(out) < 2*turnMessageMax {
+			return -1
+		}
+		e.rng = newRNG32()
+		e.channel = uint16(turnChannelMin + e.rng.below(turnChannelMax-turnChannelMin+1))
+		e.peer = turnRandomAddress(&e.rng)
+		written += turnBuildAllocateRequest(out, &e.rng)
+		written += turnBuildChannelBindRequest(out[written:], &e.rng, e.channel, e.peer)
+	}
+	payload := len(src)
+	padding := stunPadding(payload)
+	if written+turnChannelDataHeaderSize+payload+padding > len(out) {
+		return -1
+	}
+	out = out[written:]
+	binary.BigEndian.PutUint16(out, e.channel)
+	binary.BigEndian.PutUint16(out[2:], uint16(payload))
+	copy(out[turnChannelDataHeaderSize:], src)
+	clear(out[turnChannelDataHeaderSize+payload : turnChannelDataHeaderSize+payload+padding])
+	return written + turnChannelDataHeaderSize + payload + padding
+}
+
+func (e *turnStream) Decode(in, out []byte) (int, int) {
+	return decodeTURNFrame(in, out)
+}
+
+type tlsStream struct{}
+
+func (tlsStream) Encode(src, out []byte) int {
+	if tlsRecordHeader+len(src) > len(out) {
+		return -1
+	}
 	out[0] = 0x17
 	out[1] = 0x03
 	out[2] = 0x03
@@ -85,20 +122,41 @@ func encodeTLS(src, out []byte) int {
 	return tlsRecordHeader + len(src)
 }
 
-func (e *s5Encoder) encodeMedia(src, out []byte) int {
+func (tlsStream) Decode(in, out []byte) (int, int) {
+	return decodeTLSFrame(in, out)
+}
+
+type mediaStream struct {
+	params MediaParams
+	stream rtpStream
+	rng    rng32
+}
+
+func (e *mediaStream) Encode(src, out []byte) int {
+	if !e.stream.initialized {
+		e.stream.init(e.params, &e.rng)
+	}
+	if rtpTCPHeaderSize+len(src) > len(out) {
+		return -1
+	}
 	binary.BigEndian.PutUint16(out, uint16(rtpHeaderSize+len(src)))
 	e.stream.writeHeader(out[2:])
 	copy(out[rtpTCPHeaderSize:], src)
 	return rtpTCPHeaderSize + len(src)
 }
 
+func (e *mediaStream) Decode(in, out []byte) (int, int) {
+	return decodeMediaFrame(e.params, in, out)
+}
+
 type s5Decoder struct {
-	acc  [s5AccMax]byte
-	used int
-	work [s5AccMax + s5EncodeReadMax + 16]byte
+	masker StreamMasker
+	acc    [s5AccMax]byte
+	used   int
+	work   [s5AccMax + s5EncodeReadMax + 16]byte
 }
 
-func (d *s5Decoder) decode(masking Masking, params MediaParams, in, out []byte) int {
+func (d *s5Decoder) decode(in, out []byte) int {
 	if len(in) > s5EncodeReadMax {
 		return -1
 	}
@@ -107,7 +165,7 @@ func (d *s5Decoder) decode(masking Masking, params MediaParams, in, out []byte)
 
 	pos, written := 0, 0
 	for {
-		consumed, produced := d.decodeFrame(masking, params, d.work[pos:total], out[written:])
+		consumed, produced := d.masker.Decode(d.work[pos:total], out[written:])
 		if consumed < 0 {
 			return -1
 		}
@@ -127,17 +185,6 @@ func (d *s5Decoder) decode(masking Masking, params MediaParams, in, out []byte)
 	return written
 }
 
-func (d *s5Decoder) decodeFrame(masking Masking, params MediaParams, in, out []byte) (int, int) {
-	switch masking {
-	case MaskingSTUN:
-		return decodeSTUNFrame(in, out)
-	case MaskingTLS:
-		return decodeTLSFrame(in, out)
-	default:
-		return decodeMediaFrame(params, in, out)
-	}
-}
-
 func decodeSTUNFrame(in, out []byte) (int, int) {
 	if len(in) < stunDataIndHeaderSize {
 		return 0, 0
@@ -166,6 +213,49 @@ func decodeSTUNFrame(in, out []byte) (int, int) {
 	return total, payload
 }
 
+// decodeTURNFrame takes ChannelData, and the Data and Send indications a
+// relay may use before the channel is bound. Other STUN messages, such as
+// the answers to the Allocate and ChannelBind requests, are skipped whole.
+func decodeTURNFrame(in, out []byte) (int, int) {
+	if len(in) < turnChannelDataHeaderSize {
+		return 0, 0
+	}
+	if turnIsChannelData(in) {
+		payload := int(binary.BigEndian.Uint16(in[2:]))
+		total := turnChannelDataHeaderSize + payload + stunPadding(payload)
+		if total > s5AccMax || payload > len(out) {
+			return -1, 0
+		}
+		if len(in) < total {
+			return 0, 0
+		}
+		copy(out, in[turnChannelDataHeaderSize:turnChannelDataHeaderSize+payload])
+		return total, payload
+	}
+	if len(in) < stunHeaderSize {
+		return 0, 0
+	}
+	if [4]byte(in[4:8]) != stunCookie {
+		return -1, 0
+	}
+	total := stunHeaderSize + int(binary.BigEndian.Uint16(in[2:]))
+	if total > s5AccMax {
+		return -1, 0
+	}
+	if len(in) < total {
+		return 0, 0
+	}
+	switch binary.BigEndian.Uint16(in) {
+	case stunDataIndication, stunSendIndication:
+		data := stunAttribute(in[:total], stunAttrData)
+		if data == nil || len(data) > len(out) {
+			return -1, 0
+		}
+		return total, copy(out, data)
+	}
+	return total, 0
+}
+
 func decodeTLSFrame(in, out []byte) (int, int) {
 	if len(in) < tlsRecordHeader {
 		return 0, 0
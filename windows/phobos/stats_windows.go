@@ -0,0 +1,158 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"encoding/json"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const statsMappingSize = 64 << 10
+
+var procOpenFileMappingW = windows.NewLazySystemDLL("kernel32.dll").NewProc("OpenFileMappingW")
+
+func openFileMapping(access uint32, name *uint16) (windows.Handle, error) {
+	r0, _, e1 := procOpenFileMappingW.Call(uintptr(access), 0, uintptr(unsafe.Pointer(name)))
+	if r0 == 0 {
+		return 0, e1
+	}
+	return windows.Handle(r0), nil
+}
+
+// statsMemory is a seqlock-guarded JSON snapshot: the writer makes sequence
+// odd while it rewrites data, and readers retry until they see the same even
+// value before and after copying.
+type statsMemory struct {
+	sequence uint32
+	length   uint32
+	data     [statsMappingSize - 8]byte
+}
+
+// StatsPublisher shares the UDPProxy counters of a running tunnel service
+// with the manager service through a named mapping only SYSTEM can open.
+type StatsPublisher struct {
+	mapping windows.Handle
+	mem     *statsMemory
+}
+
+// mapStats maps a view of the stats section for access. The view lies
+// outside the Go heap and stays where it is until unmapped, so the address
+// MapViewOfFile returns is read back as a pointer in place, rather than
+// converted from a uintptr the way a stale Go pointer would be.
+func mapStats(mapping windows.Handle, access uint32) (*statsMemory, error) {
+	view, err := windows.MapViewOfFile(mapping, access, 0, 0, statsMappingSize)
+	if err != nil {
+		return nil, err
+	}
+	return *(**statsMemory)(unsafe.Pointer(&view)), nil
+}
+
+func unmapStats(mem *statsMemory) {
+	windows.UnmapViewOfFile(uintptr(unsafe.Pointer(mem)))
+}
+
+func statsMappingName(tunnelName string) (*uint16, error) {
+	return windows.UTF16PtrFromString(`Global\PhobosObfuscatorStats-` + tunnelName)
+}
+
+func NewStatsPublisher(tunnelName string) (*StatsPublisher, error) {
+	name, err := statsMappingName(tunnelName)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := windows.SecurityDescriptorFromString("O:SYD:P(A;;GA;;;SY)")
+	if err != nil {
+		return nil, err
+	}
+	sa := &windows.SecurityAttributes{Length: uint32(unsafe.Sizeof(windows.SecurityAttributes{})), SecurityDescriptor: sd}
+	mapping, err := windows.CreateFileMapping(windows.InvalidHandle, sa, windows.PAGE_READWRITE, 0, statsMappingSize, name)
+	if err != nil {
+		return nil, err
+	}
+	mem, err := mapStats(mapping, windows.FILE_MAP_WRITE)
+	if err != nil {
+		windows.CloseHandle(mapping)
+		return nil, err
+	}
+	return &StatsPublisher{mapping: mapping, mem: mem}, nil
+}
+
+// Publish replaces the shared snapshot. Keys identify the proxies, usually
+// by the base64 public key of the peer they serve.
+func (p *StatsPublisher) Publish(stats map[string]UDPProxyStats) error {
+	payload, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	if len(payload) > len(p.mem.data) {
+		return errors.New("obfuscator statistics do not fit the shared mapping")
+	}
+	atomic.AddUint32(&p.mem.sequence, 1)
+	copy(p.mem.data[:], payload)
+	atomic.StoreUint32(&p.mem.length, uint32(len(payload)))
+	atomic.AddUint32(&p.mem.sequence, 1)
+	return nil
+}
+
+func (p *StatsPublisher) Close() error {
+	if p.mem == nil {
+		return nil
+	}
+	unmapStats(p.mem)
+	p.mem = nil
+	return windows.CloseHandle(p.mapping)
+}
+
+// ReadPublishedStats returns the snapshot published by the tunnel service
+// of tunnelName. It fails with windows.ERROR_FILE_NOT_FOUND when the tunnel
+// is not running or has no obfuscated peers.
+func ReadPublishedStats(tunnelName string) (map[string]UDPProxyStats, error) {
+	name, err := statsMappingName(tunnelName)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := openFileMapping(windows.FILE_MAP_READ, name)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(mapping)
+	mem, err := mapStats(mapping, windows.FILE_MAP_READ)
+	if err != nil {
+		return nil, err
+	}
+	defer unmapStats(mem)
+
+	payload := make([]byte, len(mem.data))
+	for range 64 {
+		before := atomic.LoadUint32(&mem.sequence)
+		if before&1 != 0 {
+			runtime.Gosched()
+			continue
+		}
+		length := atomic.LoadUint32(&mem.length)
+		if int(length) > len(payload) {
+			break
+		}
+		copy(payload, mem.data[:length])
+		if atomic.LoadUint32(&mem.sequence) != before {
+			continue
+		}
+		var stats map[string]UDPProxyStats
+		if length == 0 {
+			return stats, nil
+		}
+		if err := json.Unmarshal(payload[:length], &stats); err != nil {
+			return nil, err
+		}
+		return stats, nil
+	}
+	return nil, errors.New("obfuscator statistics are being rewritten")
+}
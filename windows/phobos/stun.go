@@ -19,6 +19,7 @@ const (
 	stunAttrXORMapped   = 0x0020
 	stunAttrFingerprint = 0x8028
 	stunAttrData        = 0x0013
+	stunAttrPadding     = 0x0026
 
 	stunHeaderSize        = 20
 	stunDataIndHeaderSize = 24
@@ -50,19 +51,86 @@ func stunWriteFingerprint(packet []byte, offset int) int {
 	return 8
 }
 
-func stunWriteXORMappedAddress(buf []byte, addr netip.AddrPort) int {
-	binary.BigEndian.PutUint16(buf, stunAttrXORMapped)
-	binary.BigEndian.PutUint16(buf[2:], 8)
+func stunWriteXORMappedAddress(buf []byte, addr netip.AddrPort, txid []byte) int {
+	return stunWriteXORAddress(buf, stunAttrXORMapped, addr, txid)
+}
+
+// stunWriteXORAddress writes an XOR-MAPPED-ADDRESS (RFC 5389 §15.2) or an
+// attribute of the same layout, such as TURN's XOR-PEER-ADDRESS. An IPv6
+// address is XORed with the magic cookie followed by the transaction ID.
+func stunWriteXORAddress(buf []byte, attrType uint16, addr netip.AddrPort, txid []byte) int {
+	ip := addr.Addr().Unmap()
+	size := 4
+	family := byte(0x01)
+	if ip.Is6() {
+		size = 16
+		family = 0x02
+	}
+	binary.BigEndian.PutUint16(buf, attrType)
+	binary.BigEndian.PutUint16(buf[2:], uint16(4+size))
 	buf[4] = 0
-	buf[5] = 0x01
+	buf[5] = family
 	binary.BigEndian.PutUint16(buf[6:], addr.Port())
 	buf[6] ^= stunCookie[0]
 	buf[7] ^= stunCookie[1]
-	ip := addr.Addr().As4()
-	for i := range 4 {
-		buf[8+i] = ip[i] ^ stunCookie[i]
+	var mask [16]byte
+	copy(mask[:4], stunCookie[:])
+	copy(mask[4:], txid)
+	raw := ip.As16()
+	if size == 4 {
+		v4 := ip.As4()
+		copy(raw[:4], v4[:])
+	}
+	for i := range size {
+		buf[8+i] = raw[i] ^ mask[i]
+	}
+	return 8 + size
+}
+
+// stunReadXORAddress decodes the value of an attribute stunWriteXORAddress
+// wrote, with txid the transaction ID of its message.
+func stunReadXORAddress(value, txid []byte) (netip.AddrPort, bool) {
+	if len(value) < 8 {
+		return netip.AddrPort{}, false
 	}
-	return 12
+	var mask [16]byte
+	copy(mask[:4], stunCookie[:])
+	copy(mask[4:], txid)
+	port := binary.BigEndian.Uint16(value[2:]) ^ binary.BigEndian.Uint16(mask[:])
+	var raw [16]byte
+	switch {
+	case value[1] == 0x01:
+		for i := range 4 {
+			raw[i] = value[4+i] ^ mask[i]
+		}
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(raw[:4])), port), true
+	case value[1] == 0x02 && len(value) >= 20:
+		for i := range 16 {
+			raw[i] = value[4+i] ^ mask[i]
+		}
+		return netip.AddrPortFrom(netip.AddrFrom16(raw), port), true
+	}
+	return netip.AddrPort{}, false
+}
+
+// stunAttribute returns the value of the first attrType attribute of a
+// message, or nil when it has none.
+func stunAttribute(message []byte, attrType uint16) []byte {
+	if len(message) < stunHeaderSize {
+		return nil
+	}
+	end := min(stunHeaderSize+int(binary.BigEndian.Uint16(message[2:])), len(message))
+	for offset := stunHeaderSize; offset+4 <= end; {
+		length := int(binary.BigEndian.Uint16(message[offset+2:]))
+		if offset+4+length > end {
+			return nil
+		}
+		if binary.BigEndian.Uint16(message[offset:]) == attrType {
+			return message[offset+4 : offset+4+length]
+		}
+		offset += 4 + length + stunPadding(length)
+	}
+	return nil
 }
 
 func stunBuildBindingRequest(buf []byte, rng *rng32) int {
@@ -74,12 +142,29 @@ func stunBuildBindingRequest(buf []byte, rng *rng32) int {
 	return stunHeaderSize + length
 }
 
+// stunBuildPaddedBindingRequest writes a binding request of size bytes,
+// filled out with a PADDING attribute (RFC 5780 §7.6). size is a multiple of
+// 4 of at least stunBindingReqSize+4.
+func stunBuildPaddedBindingRequest(buf []byte, size int, rng *rng32) int {
+	var txid [12]byte
+	rng.fill(txid[:])
+	stunWriteHeader(buf, stunBindingRequest, 0, txid[:])
+	padding := size - stunBindingReqSize - 4
+	binary.BigEndian.PutUint16(buf[stunHeaderSize:], stunAttrPadding)
+	binary.BigEndian.PutUint16(buf[stunHeaderSize+2:], uint16(padding))
+	clear(buf[stunHeaderSize+4 : stunHeaderSize+4+padding])
+	length := 4 + padding
+	length += stunWriteFingerprint(buf, stunHeaderSize+length)
+	binary.BigEndian.PutUint16(buf[2:], uint16(length))
+	return stunHeaderSize + length
+}
+
 func stunBuildBindingSuccess(buf, txid []byte, addr netip.AddrPort) int {
-	if !addr.Addr().Is4() && !addr.Addr().Is4In6() {
+	if !addr.Addr().IsValid() {
 		return -1
 	}
 	stunWriteHeader(buf, stunBindingResponse, 0, txid)
-	length := stunWriteXORMappedAddress(buf[stunHeaderSize:], addr)
+	length := stunWriteXORMappedAddress(buf[stunHeaderSize:], addr, txid)
 	length += stunWriteFingerprint(buf, stunHeaderSize+length)
 	binary.BigEndian.PutUint16(buf[2:], uint16(length))
 	return stunHeaderSize + length
@@ -98,18 +183,26 @@ func stunWrapDataIndication(buf []byte, length int, rng *rng32) int {
 	return stunDataIndHeaderSize + length
 }
 
+// stunUnwrapDataIndication extracts the DATA attribute of a Data indication,
+// or of the Send indication a TURN client uses the other way. The C server
+// puts DATA first and leaves the message length at zero; the indications
+// of TURN masking put XOR-PEER-ADDRESS first and carry a proper length.
 func stunUnwrapDataIndication(buf []byte, length int) int {
 	if length < stunDataIndHeaderSize {
 		return -1
 	}
-	if stunMessageType(buf) != stunDataIndication {
+	if messageType := stunMessageType(buf); messageType != stunDataIndication && messageType != stunSendIndication {
 		return -1
 	}
 	if int(binary.BigEndian.Uint16(buf[2:]))+stunHeaderSize > length {
 		return -1
 	}
 	if binary.BigEndian.Uint16(buf[20:]) != stunAttrData {
-		return -1
+		data := stunAttribute(buf[:length], stunAttrData)
+		if data == nil {
+			return -1
+		}
+		return copy(buf, data)
 	}
 	dataLength := int(binary.BigEndian.Uint16(buf[22:]))
 	if dataLength+stunDataIndHeaderSize > length {
@@ -134,7 +227,7 @@ func stunHandleIncoming(buf []byte, length int, src netip.AddrPort, sendBack Sen
 		return 0
 	case stunBindingResponse:
 		return 0
-	case stunDataIndication:
+	case stunDataIndication, stunSendIndication:
 		return stunUnwrapDataIndication(buf, length)
 	default:
 		return 0
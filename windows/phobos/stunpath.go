@@ -0,0 +1,144 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// stunPathPending is how many binding requests are matched against
+	// responses at once. Requests go out every ten seconds, so a few cover
+	// any response that is merely late.
+	stunPathPending = 4
+
+	// stunPathTimeout is how long a binding request waits for its response
+	// before it counts as lost.
+	stunPathTimeout = 5 * time.Second
+)
+
+// PathStats describes the obfuscated path to the server as the STUN binding
+// transactions the masker already runs see it. RTT is smoothed as TCP does
+// (RFC 6298) and Jitter is the mean deviation between successive round
+// trips (RFC 3550). Lost counts requests unanswered after five seconds.
+type PathStats struct {
+	RTT     time.Duration
+	LastRTT time.Duration
+	Jitter  time.Duration
+
+	Requests uint64
+	Answered uint64
+	Lost     uint64
+}
+
+// Loss is the share of settled binding requests that went unanswered.
+func (s PathStats) Loss() float64 {
+	if settled := s.Answered + s.Lost; settled > 0 {
+		return float64(s.Lost) / float64(settled)
+	}
+	return 0
+}
+
+// pathStatsReporter is implemented by maskers that measure the path.
+type pathStatsReporter interface {
+	pathStats() PathStats
+}
+
+type stunTransaction struct {
+	txid [12]byte
+	sent time.Time
+}
+
+// stunPath matches binding responses to the requests that asked for them.
+// Requests are sent from the wrap side and responses arrive on unwrap
+// workers, so it keeps its own lock.
+type stunPath struct {
+	mu      sync.Mutex
+	pending [stunPathPending]stunTransaction
+	stats   PathStats
+}
+
+// sent records the binding request in request, sent at now.
+func (sp *stunPath) sent(request []byte, now time.Time) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.expireLocked(now)
+	oldest := 0
+	for i := range sp.pending {
+		if sp.pending[i].sent.IsZero() {
+			oldest = i
+			break
+		}
+		if sp.pending[i].sent.Before(sp.pending[oldest].sent) {
+			oldest = i
+		}
+	}
+	if !sp.pending[oldest].sent.IsZero() {
+		sp.stats.Lost++
+	}
+	sp.pending[oldest].sent = now
+	copy(sp.pending[oldest].txid[:], request[8:20])
+	sp.stats.Requests++
+}
+
+// answered settles the request that response answers, received at now. A
+// response to no outstanding request, a duplicate or one to a request
+// already counted as lost, is ignored.
+func (sp *stunPath) answered(response []byte, now time.Time) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.expireLocked(now)
+	for i := range sp.pending {
+		t := &sp.pending[i]
+		if t.sent.IsZero() || string(t.txid[:]) != string(response[8:20]) {
+			continue
+		}
+		rtt := now.Sub(t.sent)
+		*t = stunTransaction{}
+		s := &sp.stats
+		if s.Answered == 0 {
+			s.RTT = rtt
+		} else {
+			s.Jitter += ((rtt - s.LastRTT).Abs() - s.Jitter) / 16
+			s.RTT += (rtt - s.RTT) / 8
+		}
+		s.LastRTT = rtt
+		s.Answered++
+		return
+	}
+}
+
+func (sp *stunPath) snapshot(now time.Time) PathStats {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.expireLocked(now)
+	return sp.stats
+}
+
+func (sp *stunPath) expireLocked(now time.Time) {
+	for i := range sp.pending {
+		if t := &sp.pending[i]; !t.sent.IsZero() && now.Sub(t.sent) >= stunPathTimeout {
+			*t = stunTransaction{}
+			sp.stats.Lost++
+		}
+	}
+}
+
+// PathStats reports the round trip time, jitter and loss to the server
+// measured from the masker's STUN binding transactions, and false under a
+// masking that runs none. The figures start over with each new masker.
+func (p *UDPProxy) PathStats() (PathStats, bool) {
+	state := p.unwrapper.Load()
+	if state == nil {
+		return PathStats{}, false
+	}
+	reporter, ok := state.masker.(pathStatsReporter)
+	if !ok {
+		return PathStats{}, false
+	}
+	return reporter.pathStats(), true
+}
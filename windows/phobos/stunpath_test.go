@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSTUNPathStats(t *testing.T) {
+	var sp stunPath
+	var rng rng32 = 7
+	start := time.Unix(1000, 0)
+	request := func(at time.Duration) []byte {
+		buf := make([]byte, stunBindingReqSize)
+		stunBuildBindingRequest(buf, &rng)
+		sp.sent(buf, start.Add(at))
+		return buf
+	}
+	answer := func(req []byte, at time.Duration) {
+		response := make([]byte, stunHeaderSize)
+		stunWriteHeader(response, stunBindingResponse, 0, req[8:20])
+		sp.answered(response, start.Add(at))
+	}
+
+	first := request(0)
+	answer(first, 40*time.Millisecond)
+	answer(first, 50*time.Millisecond)
+	second := request(10 * time.Second)
+	answer(second, 10*time.Second+60*time.Millisecond)
+	request(20 * time.Second)
+	late := request(30 * time.Second)
+	answer(late, 36*time.Second)
+
+	stats := sp.snapshot(start.Add(40 * time.Second))
+	if stats.Requests != 4 || stats.Answered != 2 || stats.Lost != 2 {
+		t.Fatalf("unexpected counts: %+v", stats)
+	}
+	if stats.LastRTT != 60*time.Millisecond || stats.RTT != 42500*time.Microsecond || stats.Jitter != 1250*time.Microsecond {
+		t.Fatalf("unexpected estimates: %+v", stats)
+	}
+	if loss := stats.Loss(); loss != 0.5 {
+		t.Fatalf("loss %v, want 0.5", loss)
+	}
+}
+
+func TestSTUNPathOverflowCountsLost(t *testing.T) {
+	var sp stunPath
+	var rng rng32 = 7
+	now := time.Unix(1000, 0)
+	buf := make([]byte, stunBindingReqSize)
+	for range stunPathPending + 2 {
+		stunBuildBindingRequest(buf, &rng)
+		sp.sent(buf, now)
+	}
+	if stats := sp.snapshot(now); stats.Requests != stunPathPending+2 || stats.Lost != 2 {
+		t.Fatalf("unexpected counts: %+v", stats)
+	}
+}
@@ -0,0 +1,161 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	stunAllocateRequest    = 0x0003
+	stunAllocateSuccess    = 0x0103
+	stunChannelBindRequest = 0x0009
+	stunChannelBindSuccess = 0x0109
+	stunSendIndication     = 0x0016
+
+	stunAttrChannelNumber      = 0x000C
+	stunAttrLifetime           = 0x000D
+	stunAttrXORPeer            = 0x0012
+	stunAttrXORRelayed         = 0x0016
+	stunAttrRequestedTransport = 0x0019
+
+	turnChannelDataHeaderSize = 4
+	turnChannelMin            = 0x4000
+	turnChannelMax            = 0x4FFF
+	turnLifetime              = 600
+	turnProtocolUDP           = 17
+	turnIndicationHeaderSize  = stunHeaderSize + 12 + 4
+	turnMessageMax            = 128
+)
+
+// turnIsChannelData tells ChannelData (RFC 8656 §12.4) apart from STUN by
+// its first byte, which carries the high bits of a channel number.
+func turnIsChannelData(buf []byte) bool {
+	return len(buf) >= turnChannelDataHeaderSize && buf[0]&0xF0 == 0x40
+}
+
+// turnWrapChannelData frames buf[:length] for a bound channel. Over UDP the
+// data needs no padding.
+func turnWrapChannelData(buf []byte, length int, channel uint16) int {
+	if length+turnChannelDataHeaderSize > len(buf) {
+		return -1
+	}
+	copy(buf[turnChannelDataHeaderSize:turnChannelDataHeaderSize+length], buf[:length])
+	binary.BigEndian.PutUint16(buf, channel)
+	binary.BigEndian.PutUint16(buf[2:], uint16(length))
+	return turnChannelDataHeaderSize + length
+}
+
+func turnUnwrapChannelData(buf []byte, length int) int {
+	if length < turnChannelDataHeaderSize {
+		return -1
+	}
+	dataLength := int(binary.BigEndian.Uint16(buf[2:]))
+	if turnChannelDataHeaderSize+dataLength > length {
+		return -1
+	}
+	return copy(buf, buf[turnChannelDataHeaderSize:turnChannelDataHeaderSize+dataLength])
+}
+
+// turnRandomAddress makes up a public IPv4 address on an ephemeral port.
+// No relay exists behind the masking, so the peer a client binds to and the
+// relayed address a server hands out are both invented.
+func turnRandomAddress(rng *rng32) netip.AddrPort {
+	for {
+		var raw [4]byte
+		binary.BigEndian.PutUint32(raw[:], rng.next())
+		addr := netip.AddrFrom4(raw)
+		if addr.IsGlobalUnicast() && !addr.IsPrivate() && raw[0] != 100 && raw[0] < 224 {
+			return netip.AddrPortFrom(addr, uint16(49152+rng.below(16384)))
+		}
+	}
+}
+
+// turnWrapIndication frames buf[:length] as a Send or Data indication with
+// XOR-PEER-ADDRESS and DATA, padding DATA the way STUN attributes are.
+func turnWrapIndication(buf []byte, length int, messageType uint16, peer netip.AddrPort, rng *rng32) int {
+	padding := stunPadding(length)
+	if length+turnIndicationHeaderSize+padding > len(buf) {
+		return -1
+	}
+	copy(buf[turnIndicationHeaderSize:turnIndicationHeaderSize+length], buf[:length])
+	clear(buf[turnIndicationHeaderSize+length : turnIndicationHeaderSize+length+padding])
+	var txid [12]byte
+	rng.fill(txid[:])
+	stunWriteHeader(buf, messageType, uint16(turnIndicationHeaderSize-stunHeaderSize+length+padding), txid[:])
+	offset := stunHeaderSize + stunWriteXORAddress(buf[stunHeaderSize:], stunAttrXORPeer, peer, txid[:])
+	binary.BigEndian.PutUint16(buf[offset:], stunAttrData)
+	binary.BigEndian.PutUint16(buf[offset+2:], uint16(length))
+	return turnIndicationHeaderSize + length + padding
+}
+
+func stunWriteAttribute(buf []byte, attrType uint16, value ...byte) int {
+	binary.BigEndian.PutUint16(buf, attrType)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(value)))
+	copy(buf[4:], value)
+	clear(buf[4+len(value) : 4+len(value)+stunPadding(len(value))])
+	return 4 + len(value) + stunPadding(len(value))
+}
+
+// stunFinish writes the length of a message whose attributes end at offset,
+// counting the FINGERPRINT it appends, and returns the message size.
+func stunFinish(buf []byte, offset int) int {
+	binary.BigEndian.PutUint16(buf[2:], uint16(offset+8-stunHeaderSize))
+	return offset + stunWriteFingerprint(buf, offset)
+}
+
+func turnBuildAllocateRequest(buf []byte, rng *rng32) int {
+	var txid [12]byte
+	rng.fill(txid[:])
+	stunWriteHeader(buf, stunAllocateRequest, 0, txid[:])
+	offset := stunHeaderSize
+	offset += stunWriteAttribute(buf[offset:], stunAttrRequestedTransport, turnProtocolUDP, 0, 0, 0)
+	offset += stunWriteAttribute(buf[offset:], stunAttrLifetime, 0, 0, turnLifetime>>8, turnLifetime&0xFF)
+	return stunFinish(buf, offset)
+}
+
+func turnBuildChannelBindRequest(buf []byte, rng *rng32, channel uint16, peer netip.AddrPort) int {
+	var txid [12]byte
+	rng.fill(txid[:])
+	stunWriteHeader(buf, stunChannelBindRequest, 0, txid[:])
+	offset := stunHeaderSize
+	offset += stunWriteAttribute(buf[offset:], stunAttrChannelNumber, byte(channel>>8), byte(channel), 0, 0)
+	offset += stunWriteXORAddress(buf[offset:], stunAttrXORPeer, peer, txid[:])
+	return stunFinish(buf, offset)
+}
+
+func turnBuildAllocateSuccess(buf, txid []byte, mapped, relayed netip.AddrPort) int {
+	if !mapped.Addr().IsValid() {
+		return -1
+	}
+	stunWriteHeader(buf, stunAllocateSuccess, 0, txid)
+	offset := stunHeaderSize
+	offset += stunWriteXORAddress(buf[offset:], stunAttrXORRelayed, relayed, txid)
+	offset += stunWriteAttribute(buf[offset:], stunAttrLifetime, 0, 0, turnLifetime>>8, turnLifetime&0xFF)
+	offset += stunWriteXORMappedAddress(buf[offset:], mapped, txid)
+	return stunFinish(buf, offset)
+}
+
+func turnBuildChannelBindSuccess(buf, txid []byte) int {
+	stunWriteHeader(buf, stunChannelBindSuccess, 0, txid)
+	return stunFinish(buf, stunHeaderSize)
+}
+
+// turnRequestedChannel returns the channel and peer of a ChannelBind request,
+// or a zero channel when they are missing or out of range.
+func turnRequestedChannel(message []byte) (uint16, netip.AddrPort) {
+	number := stunAttribute(message, stunAttrChannelNumber)
+	if len(number) < 2 {
+		return 0, netip.AddrPort{}
+	}
+	channel := binary.BigEndian.Uint16(number)
+	if channel < turnChannelMin || channel > turnChannelMax {
+		return 0, netip.AddrPort{}
+	}
+	peer, _ := stunReadXORAddress(stunAttribute(message, stunAttrXORPeer), message[8:20])
+	return channel, peer
+}
@@ -0,0 +1,158 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestTURNMaskerHandshake(t *testing.T) {
+	client, server := NewMasker(MaskingTURN, MediaParams{}), NewMasker(MaskingSTUN, MediaParams{})
+	addr := netip.MustParseAddrPort("198.51.100.7:3478")
+
+	var toServer, toClient [][]byte
+	sendToServer := func(p []byte) (int, error) { toServer = append(toServer, bytes.Clone(p)); return len(p), nil }
+	sendToClient := func(p []byte) (int, error) { toClient = append(toClient, bytes.Clone(p)); return len(p), nil }
+
+	client.OnHandshakeRequest(sendToServer)
+	if len(toServer) != 2 || stunMessageType(toServer[0]) != stunBindingRequest || stunMessageType(toServer[1]) != stunAllocateRequest {
+		t.Fatalf("expected a binding request then an Allocate, got %x", toServer)
+	}
+
+	buf := make([]byte, BufferSize)
+	payload := handshakePacket(148)
+	n := client.OnDataWrap(buf, copy(buf, payload))
+	if n < 0 || stunMessageType(buf) != stunSendIndication {
+		t.Fatalf("an unbound client must send a Send indication, got %x", buf[:4])
+	}
+	if got := server.OnDataUnwrap(buf, n, addr, sendToClient); got != len(payload) || !bytes.Equal(buf[:got], payload) {
+		t.Fatal("Send indication did not unwrap")
+	}
+
+	n = copy(buf, toServer[1])
+	if server.OnDataUnwrap(buf, n, addr, sendToClient) != 0 {
+		t.Fatal("Allocate must be swallowed")
+	}
+	if len(toClient) != 1 || stunMessageType(toClient[0]) != stunAllocateSuccess {
+		t.Fatalf("expected an Allocate success, got %x", toClient)
+	}
+	relayed, ok := stunReadXORAddress(stunAttribute(toClient[0], stunAttrXORRelayed), toClient[0][8:20])
+	if !ok || !relayed.Addr().IsGlobalUnicast() {
+		t.Fatalf("Allocate success relays to %v", relayed)
+	}
+	n = copy(buf, toClient[0])
+	if client.OnDataUnwrap(buf, n, addr, sendToServer) != 0 {
+		t.Fatal("Allocate success must be swallowed")
+	}
+	if len(toServer) != 3 || stunMessageType(toServer[2]) != stunChannelBindRequest {
+		t.Fatalf("expected a ChannelBind request, got %x", toServer[2:])
+	}
+	channel, _ := turnRequestedChannel(toServer[2])
+	if channel < turnChannelMin || channel > turnChannelMax {
+		t.Fatalf("channel %#x is out of range", channel)
+	}
+
+	n = copy(buf, toServer[2])
+	if server.OnDataUnwrap(buf, n, addr, sendToClient) != 0 {
+		t.Fatal("ChannelBind must be swallowed")
+	}
+	if len(toClient) != 2 || stunMessageType(toClient[1]) != stunChannelBindSuccess {
+		t.Fatalf("expected a ChannelBind success, got %x", toClient[1:])
+	}
+	n = copy(buf, toClient[1])
+	if client.OnDataUnwrap(buf, n, addr, sendToServer) != 0 {
+		t.Fatal("ChannelBind success must be swallowed")
+	}
+
+	for _, wrapper := range []Masker{client, server} {
+		n = wrapper.OnDataWrap(buf, copy(buf, payload))
+		if n != len(payload)+turnChannelDataHeaderSize || !turnIsChannelData(buf[:n]) {
+			t.Fatalf("a bound channel must carry ChannelData, got %x", buf[:4])
+		}
+		unwrapper := server
+		if wrapper == server {
+			unwrapper = client
+		}
+		if got := unwrapper.OnDataUnwrap(buf, n, addr, nil); got != len(payload) || !bytes.Equal(buf[:got], payload) {
+			t.Fatal("ChannelData did not unwrap")
+		}
+	}
+
+	client.OnHandshakeRequest(sendToServer)
+	if len(toServer) != 4 || stunMessageType(toServer[3]) != stunBindingRequest {
+		t.Fatal("a bound client must only send the binding request")
+	}
+}
+
+func TestTURNOverheadCoversSendIndications(t *testing.T) {
+	client := NewMasker(MaskingTURN, MediaParams{})
+	client.OnHandshakeRequest(func(p []byte) (int, error) { return len(p), nil })
+	buf := make([]byte, BufferSize)
+	for length := 1420; length < 1424; length++ {
+		n := client.OnDataWrap(buf, copy(buf, handshakePacket(length)))
+		if stunMessageType(buf) != stunSendIndication {
+			t.Fatalf("an unbound client must send a Send indication, got %x", buf[:4])
+		}
+		if overhead := WrapOverhead(MaskingTURN, MediaParams{}); n-length > overhead {
+			t.Fatalf("Send indication of %d bytes adds %d, overhead is %d", length, n-length, overhead)
+		}
+	}
+}
+
+func TestTURNServerAnswersWithDataIndications(t *testing.T) {
+	client, server := NewMasker(MaskingTURN, MediaParams{}), NewMasker(MaskingSTUN, MediaParams{})
+	client.OnHandshakeRequest(func(p []byte) (int, error) { return len(p), nil })
+
+	buf := make([]byte, BufferSize)
+	payload := handshakePacket(92)
+	n := client.OnDataWrap(buf, copy(buf, payload))
+	server.OnDataUnwrap(buf, n, netip.AddrPort{}, nil)
+
+	n = server.OnDataWrap(buf, copy(buf, payload))
+	if stunMessageType(buf) != stunDataIndication {
+		t.Fatalf("a relay must answer with a Data indication, got %x", buf[:4])
+	}
+	peer, ok := stunReadXORAddress(stunAttribute(buf[:n], stunAttrXORPeer), buf[8:20])
+	if !ok || peer != client.(*maskerSTUN).wantPeer {
+		t.Fatalf("Data indication names peer %v, want %v", peer, client.(*maskerSTUN).wantPeer)
+	}
+	if got := client.OnDataUnwrap(buf, n, netip.AddrPort{}, nil); got != len(payload) || !bytes.Equal(buf[:got], payload) {
+		t.Fatal("Data indication did not unwrap")
+	}
+}
+
+func TestTURNStreamFraming(t *testing.T) {
+	encoder := s5Encoder{newStreamMasker(MaskingTURN, MediaParams{})}
+	decoder := s5Decoder{masker: newStreamMasker(MaskingTURN, MediaParams{})}
+	src := bytes.Repeat([]byte("phobos turn "), 300)
+	out := make([]byte, s5BufferSize)
+	n := encoder.encode(src, out)
+	if n < 0 || stunMessageType(out) != stunAllocateRequest {
+		t.Fatalf("stream must open with an Allocate, got %x", out[:4])
+	}
+
+	// The relay's answers arrive on the stream too and carry no data.
+	answers := make([]byte, 2*turnMessageMax)
+	var txid [12]byte
+	m := turnBuildAllocateSuccess(answers, txid[:], netip.MustParseAddrPort("192.0.2.1:50000"), netip.MustParseAddrPort("198.51.100.9:50001"))
+	m += turnBuildChannelBindSuccess(answers[m:], txid[:])
+	stream := append(answers[:m:m], out[:n]...)
+
+	var decoded []byte
+	plain := make([]byte, s5BufferSize)
+	for offset := 0; offset < len(stream); offset += 7 {
+		got := decoder.decode(stream[offset:min(offset+7, len(stream))], plain)
+		if got < 0 {
+			t.Fatalf("decode failed at offset %d", offset)
+		}
+		decoded = append(decoded, plain[:got]...)
+	}
+	if !bytes.Equal(decoded, src) {
+		t.Fatalf("decoded %d bytes, want %d", len(decoded), len(src))
+	}
+}
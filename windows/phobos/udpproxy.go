@@ -6,6 +6,7 @@
 package phobos
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -19,43 +20,209 @@ import (
 
 type SocketControl func(network, address string, c syscall.RawConn) error
 
+const DefaultFailoverTimeout = 15 * time.Second
+
 type UDPProxyConfig struct {
 	Target          netip.AddrPort
+	FallbackTargets []netip.AddrPort
+	FailoverTimeout time.Duration
+	// PortHopInterval moves the upstream socket to a fresh source port this
+	// often, and PortHopSilence does so once the tunnel has been sending for
+	// that long without a server reply. Zero turns either off.
+	PortHopInterval time.Duration
+	PortHopSilence  time.Duration
+	// TargetLastPorts widens Target followed by FallbackTargets to the port
+	// ranges a server publishes: an entry above the target's port is the
+	// last port of a range starting at it, and the proxy moves between the
+	// ports of the range every PortSlot on a schedule derived from Key.
+	// PortSlot defaults to DefaultPortSlot.
+	TargetLastPorts []uint16
+	PortSlot        time.Duration
+	// TargetHosts names Target followed by FallbackTargets as "host:port".
+	// A named target is resolved at Start when its address is unset and
+	// again every ResolveInterval; an empty entry keeps the address fixed.
+	TargetHosts     []string
+	Resolver        Resolver
+	ResolveInterval time.Duration
 	Key             []byte
+	PreviousKeys    []PreviousKey
 	Masking         Masking
 	Media           MediaParams
 	MaxDummy        int
 	ObfuscateBytes  int
+	Padding         PaddingPolicy
+	// CoverBudget is how many bytes per second of cover frames MEDIA masking
+	// may send to keep its stream at the frame rate while the tunnel is
+	// idle. Zero turns cover traffic off.
+	CoverBudget int
+	// PathMTUInterval runs path MTU discovery at Start and again this often.
+	// Zero turns it off. PathMTUChanged, when set, is called with every path
+	// MTU found that differs from the one before.
+	PathMTUInterval time.Duration
+	PathMTUChanged  func(pathMTU int)
+	// Workers is how many goroutines serve each socket, each moving a
+	// batch of datagrams per system call where the platform allows it.
+	// Zero picks one per CPU, up to four, on Linux and one elsewhere. It
+	// takes effect at Start.
+	Workers         int
 	UpstreamControl SocketControl
 	Logf            func(format string, args ...any)
+	// Capture, when set, records the proxy's packets on both sides.
+	Capture *Capture
 }
 
 type UDPProxy struct {
-	config UDPProxyConfig
+	settings atomic.Pointer[proxySettings]
 
-	listener   *net.UDPConn
-	upstream   *net.UDPConn
+	listeners  []*net.UDPConn
 	listenPort uint16
+	workers    int
+	batchSize  int
+
+	targets     []netip.AddrPort
+	targetIndex int
+	upstream    atomic.Pointer[upstreamLink]
+	hopping     atomic.Pointer[upstreamLink]
+	switchMu    sync.Mutex
+	dialer      net.Dialer
+	retired     map[*upstreamLink]*time.Timer
+
+	handshakePending atomic.Int64
 
-	maskerMu sync.Mutex
-	masker   Masker
+	maskerMu  sync.Mutex
+	masker    Masker
+	masking   Masking
+	auto      *autoMasking
+	unwrapper atomic.Pointer[unwrapState]
+	timerKick chan struct{}
 
-	client  atomic.Pointer[netip.AddrPort]
+	detecting  atomic.Bool
+	lastTunnel atomic.Int64
+
+	client  atomic.Pointer[loopbackClient]
 	running atomic.Bool
 
 	sawTunnel   atomic.Bool
 	sawServer   atomic.Bool
 	sawRejected atomic.Bool
 
+	counters proxyCounters
+	pathMTU  atomic.Int64
+
 	wait sync.WaitGroup
 	done chan struct{}
 }
 
+// proxySettings is the configuration a UDPProxy currently runs with, along
+// with the key ring built from its keys. Reconfigure replaces it as a whole while
+// holding maskerMu and publishes it with the masker, and a data packet is
+// masked only if what it was encoded with is still published, so a packet
+// is never encoded with one key and masked for another.
+type proxySettings struct {
+	UDPProxyConfig
+	keys *keyRing
+}
+
+// unwrapState is the masker server packets are unwrapped with, published
+// together with the settings it was set up for whenever either changes.
+// When independent is set the masker's unwrap side shares nothing with its
+// wrap side, so serverLoop workers use it without taking maskerMu.
+type unwrapState struct {
+	masker      Masker
+	masking     Masking
+	settings    *proxySettings
+	independent bool
+}
+
+// upstreamLink is a connected upstream socket and the target it talks to.
+// Switching targets replaces the whole link, so readers never see a socket
+// paired with the wrong address. handshakeSent is when a port hop waiting on
+// the link first sent a handshake through it.
+type upstreamLink struct {
+	conn   *net.UDPConn
+	local  netip.AddrPort
+	target netip.AddrPort
+
+	handshakeSent atomic.Int64
+}
+
+// loopbackClient is the WireGuard socket the proxy answers, together with the
+// loopback listener it reached us on.
+type loopbackClient struct {
+	listener *net.UDPConn
+	addr     netip.AddrPort
+	udpAddr  *net.UDPAddr
+}
+
+// UDPProxyStats is a snapshot of the traffic a UDPProxy has relayed. Tx
+// counts wire packets sent to the server, Rx counts server packets that
+// passed every check and were handed to WireGuard.
+type UDPProxyStats struct {
+	TxPackets uint64
+	TxBytes   uint64
+	RxPackets uint64
+	RxBytes   uint64
+
+	RejectedMasking uint64
+	RejectedLength  uint64
+	RejectedKey     uint64
+
+	LastServerPacket time.Time
+
+	STUNBindingRequests  uint64
+	STUNBindingResponses uint64
+
+	CoverPackets uint64
+	CoverBytes   uint64
+
+	PortHops uint64
+
+	Path PathStats
+}
+
+func (s UDPProxyStats) Rejected() uint64 {
+	return s.RejectedMasking + s.RejectedLength + s.RejectedKey
+}
+
+type proxyCounters struct {
+	txPackets, txBytes atomic.Uint64
+	rxPackets, rxBytes atomic.Uint64
+
+	rejectedMasking, rejectedLength, rejectedKey atomic.Uint64
+
+	lastServerPacket atomic.Int64
+
+	bindingRequests, bindingResponses atomic.Uint64
+
+	coverPackets, coverBytes atomic.Uint64
+
+	portHops atomic.Uint64
+}
+
 func NewUDPProxy(config UDPProxyConfig) *UDPProxy {
 	if config.Logf == nil {
 		config.Logf = func(string, ...any) {}
 	}
-	return &UDPProxy{config: config, done: make(chan struct{})}
+	p := &UDPProxy{done: make(chan struct{}), timerKick: make(chan struct{}, 1), batchSize: batchSize}
+	p.settings.Store(newProxySettings(config))
+	return p
+}
+
+func newProxySettings(config UDPProxyConfig) *proxySettings {
+	if config.FailoverTimeout <= 0 {
+		config.FailoverTimeout = DefaultFailoverTimeout
+	}
+	if config.Resolver == nil {
+		config.Resolver = SystemResolver
+	}
+	if config.ResolveInterval <= 0 {
+		config.ResolveInterval = DefaultResolveInterval
+	}
+	return &proxySettings{UDPProxyConfig: config, keys: newKeyRing(config.Key, config.PreviousKeys)}
+}
+
+func (p *UDPProxy) current() *proxySettings {
+	return p.settings.Load()
 }
 
 func (p *UDPProxy) ListenPort() uint16 {
@@ -63,50 +230,177 @@ func (p *UDPProxy) ListenPort() uint16 {
 }
 
 func (p *UDPProxy) Start() error {
-	if len(p.config.Key) == 0 {
+	s := p.current()
+	if len(s.Key) == 0 {
 		return errors.New("obfuscation key is empty")
 	}
-	if !p.config.Target.IsValid() {
-		return errors.New("obfuscator target is not resolved")
+	if !s.Masking.Datagram() {
+		return fmt.Errorf("%v masking is not available for UDP", s.Masking)
+	}
+	if err := s.Padding.Validate(); err != nil {
+		return err
+	}
+	targets, err := s.resolveTargets()
+	if err != nil {
+		return err
 	}
+	s.Target = targets[0]
 
-	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	listeners, err := listenLoopback()
 	if err != nil {
 		return fmt.Errorf("unable to open loopback socket: %w", err)
 	}
 
-	dialer := net.Dialer{Control: p.config.UpstreamControl}
-	conn, err := dialer.DialContext(context.Background(), "udp", p.config.Target.String())
+	p.dialer = net.Dialer{Control: s.UpstreamControl}
+	link, err := p.dial(s.scheduled(0, s.Target, time.Now()))
 	if err != nil {
-		listener.Close()
+		closeAll(listeners)
 		return fmt.Errorf("unable to open upstream socket: %w", err)
 	}
 
-	p.listener = listener
-	p.upstream = conn.(*net.UDPConn)
-	p.listenPort = uint16(listener.LocalAddr().(*net.UDPAddr).Port)
-	p.masker = NewMasker(p.config.Masking, p.config.Media)
+	p.listeners = listeners
+	p.targets = targets
+	p.upstream.Store(link)
+	p.listenPort = uint16(listeners[0].LocalAddr().(*net.UDPAddr).Port)
+	p.workers = s.Workers
+	if p.workers <= 0 {
+		p.workers = defaultWorkers()
+	}
+	p.resetMaskerLocked(s)
 	p.running.Store(true)
 
-	p.spawn(p.clientLoop)
-	p.spawn(p.serverLoop)
-	if p.masker != nil {
-		p.spawn(p.timerLoop)
+	for _, listener := range listeners {
+		for range p.workers {
+			p.spawn(func() { p.clientLoop(listener) })
+		}
 	}
+	p.serve(link)
+	p.spawn(p.timerLoop)
+	p.spawn(p.failoverLoop)
+	p.spawn(p.resolveLoop)
+	p.spawn(p.coverLoop)
+	p.spawn(p.hopLoop)
+	p.spawn(p.scheduleLoop)
+	p.spawn(p.pathMTULoop)
 
-	p.config.Logf("Obfuscator started: 127.0.0.1:%d -> %v (masking %v)", p.listenPort, p.config.Target, p.config.Masking)
+	s.Logf("Obfuscator started: 127.0.0.1:%d -> %v (masking %v)", p.listenPort, link.target, s.Masking)
 	return nil
 }
 
+// resolveTargets returns Target followed by FallbackTargets, resolving the
+// named ones that have no address yet.
+func (s *proxySettings) resolveTargets() ([]netip.AddrPort, error) {
+	configured := append([]netip.AddrPort{s.Target}, s.FallbackTargets...)
+	var targets []netip.AddrPort
+	for i := range max(len(configured), len(s.TargetHosts)) {
+		var target netip.AddrPort
+		if i < len(configured) {
+			target = configured[i]
+		}
+		if host := s.targetHost(i); !target.IsValid() && host != "" {
+			resolved, err := resolveTarget(s.Resolver, host)
+			if err != nil {
+				return nil, fmt.Errorf("unable to resolve obfuscator target %s: %w", host, err)
+			}
+			target = resolved
+		}
+		if !target.IsValid() {
+			return nil, errors.New("obfuscator target is not resolved")
+		}
+		targets = append(targets, netip.AddrPortFrom(target.Addr().Unmap(), target.Port()))
+	}
+	return targets, nil
+}
+
+// Reconfigure switches a running proxy to config without closing its
+// loopback listeners, so WireGuard keeps its endpoint and the proxy keeps
+// answering the same client. Key, masking and upstream change together: the
+// first packet after the switch already goes out under the new settings.
+// Logf, UpstreamControl, Capture and PathMTUChanged stay as they were given
+// to NewUDPProxy.
+func (p *UDPProxy) Reconfigure(config UDPProxyConfig) error {
+	old := p.current()
+	config.Logf, config.UpstreamControl, config.Capture = old.Logf, old.UpstreamControl, old.Capture
+	config.PathMTUChanged = old.PathMTUChanged
+	next := newProxySettings(config)
+	if len(next.Key) == 0 {
+		return errors.New("obfuscation key is empty")
+	}
+	if !next.Masking.Datagram() {
+		return fmt.Errorf("%v masking is not available for UDP", next.Masking)
+	}
+	if err := next.Padding.Validate(); err != nil {
+		return err
+	}
+	if !p.running.Load() {
+		p.settings.Store(next)
+		return nil
+	}
+	targets, err := next.resolveTargets()
+	if err != nil {
+		return err
+	}
+	next.Target = targets[0]
+
+	p.switchMu.Lock()
+	defer p.switchMu.Unlock()
+	if !p.running.Load() {
+		return errors.New("obfuscator is not running")
+	}
+	var link *upstreamLink
+	if active := next.scheduled(0, next.Target, time.Now()); p.upstream.Load().target != active {
+		if link, err = p.dial(active); err != nil {
+			return fmt.Errorf("unable to open upstream socket: %w", err)
+		}
+	}
+
+	p.maskerMu.Lock()
+	p.settings.Store(next)
+	if link != nil || !bytes.Equal(old.Key, next.Key) || old.Masking != next.Masking || old.Media != next.Media {
+		p.resetMaskerLocked(next)
+	} else {
+		p.publishLocked()
+	}
+	p.maskerMu.Unlock()
+
+	p.targets, p.targetIndex = targets, 0
+	p.handshakePending.Store(0)
+	if link != nil {
+		p.switchLink(link)
+	}
+	next.Logf("Obfuscator reconfigured: 127.0.0.1:%d -> %v (masking %v)", p.listenPort, next.Target, next.Masking)
+	return nil
+}
+
+// ActiveMasking reports the masking currently applied to upstream traffic.
+// For an AUTO proxy, settled stays false until a server packet has passed the
+// key check under one of the candidates.
+func (p *UDPProxy) ActiveMasking() (masking Masking, settled bool) {
+	p.maskerMu.Lock()
+	defer p.maskerMu.Unlock()
+	return p.masking, !p.detecting.Load()
+}
+
 func (p *UDPProxy) Stop() {
 	if !p.running.Swap(false) {
 		return
 	}
 	close(p.done)
-	p.listener.Close()
-	p.upstream.Close()
+	closeAll(p.listeners)
+	p.switchMu.Lock()
+	p.upstream.Load().conn.Close()
+	p.dropHopLocked()
+	p.closeRetiredLocked()
+	p.switchMu.Unlock()
 	p.wait.Wait()
-	p.config.Logf("Obfuscator stopped: 127.0.0.1:%d -> %v", p.listenPort, p.config.Target)
+	p.current().Logf("Obfuscator stopped: 127.0.0.1:%d -> %v", p.listenPort, p.ActiveTarget())
+}
+
+// serve starts the workers reading link.
+func (p *UDPProxy) serve(link *upstreamLink) {
+	for range p.workers {
+		p.spawn(func() { p.serverLoop(link) })
+	}
 }
 
 func (p *UDPProxy) spawn(loop func()) {
@@ -117,39 +411,171 @@ func (p *UDPProxy) spawn(loop func()) {
 	}()
 }
 
+// ActiveTarget reports the server the proxy currently sends to.
+func (p *UDPProxy) ActiveTarget() netip.AddrPort {
+	if link := p.upstream.Load(); link != nil {
+		return link.target
+	}
+	return p.current().Target
+}
+
+func (p *UDPProxy) dial(target netip.AddrPort) (*upstreamLink, error) {
+	conn, err := p.dialer.DialContext(context.Background(), "udp", target.String())
+	if err != nil {
+		return nil, err
+	}
+	udp := conn.(*net.UDPConn)
+	return &upstreamLink{conn: udp, local: udp.LocalAddr().(*net.UDPAddr).AddrPort(), target: target}, nil
+}
+
 func (p *UDPProxy) sendToServer(packet []byte) (int, error) {
-	return p.upstream.Write(packet)
+	link := p.upstream.Load()
+	n, err := link.conn.Write(packet)
+	if err == nil {
+		p.sent(link, packet)
+	}
+	return n, err
+}
+
+// sendBatchToServer writes the packets of a worker batch upstream. out is
+// the worker's batchConn for the upstream socket, replaced when the link
+// changes.
+func (p *UDPProxy) sendBatchToServer(out **batchConn, packets [][]byte) error {
+	link := p.upstream.Load()
+	if *out == nil || (*out).conn != link.conn {
+		*out = newBatchConn(link.conn)
+	}
+	if err := (*out).write(packets, nil); err != nil {
+		return err
+	}
+	for _, packet := range packets {
+		p.sent(link, packet)
+	}
+	return nil
+}
+
+// sent counts packet, which went out through link.
+func (p *UDPProxy) sent(link *upstreamLink, packet []byte) {
+	if capture := p.current().Capture; capture != nil {
+		capture.datagram(captureWire, link.local, link.target, packet, len(packet), "")
+	}
+	p.counters.txPackets.Add(1)
+	p.counters.txBytes.Add(uint64(len(packet)))
+	if stunHasMagic(packet) && stunMessageType(packet) == stunBindingRequest {
+		p.counters.bindingRequests.Add(1)
+	}
 }
 
-func (p *UDPProxy) sendToClient(packet []byte) (int, error) {
+// sendBatchToClient writes the packets of a worker batch to WireGuard
+// through the worker's batchConn for the client's listener.
+func (p *UDPProxy) sendBatchToClient(out map[*net.UDPConn]*batchConn, packets [][]byte) error {
 	client := p.client.Load()
 	if client == nil {
-		return 0, nil
+		return nil
+	}
+	conn := out[client.listener]
+	if conn == nil {
+		conn = newBatchConn(client.listener)
+		out[client.listener] = conn
 	}
-	return p.listener.WriteToUDPAddrPort(packet, *client)
+	return conn.write(packets, client.udpAddr)
 }
 
-func (p *UDPProxy) reject(stage string, length int) {
+// Stats returns a snapshot of the proxy counters. It is safe to call at any
+// time, including before Start and after Stop.
+func (p *UDPProxy) Stats() UDPProxyStats {
+	c := &p.counters
+	stats := UDPProxyStats{
+		TxPackets:            c.txPackets.Load(),
+		TxBytes:              c.txBytes.Load(),
+		RxPackets:            c.rxPackets.Load(),
+		RxBytes:              c.rxBytes.Load(),
+		RejectedMasking:      c.rejectedMasking.Load(),
+		RejectedLength:       c.rejectedLength.Load(),
+		RejectedKey:          c.rejectedKey.Load(),
+		STUNBindingRequests:  c.bindingRequests.Load(),
+		STUNBindingResponses: c.bindingResponses.Load(),
+		CoverPackets:         c.coverPackets.Load(),
+		CoverBytes:           c.coverBytes.Load(),
+		PortHops:             c.portHops.Load(),
+	}
+	if last := c.lastServerPacket.Load(); last != 0 {
+		stats.LastServerPacket = time.Unix(0, last)
+	}
+	stats.Path, _ = p.PathStats()
+	return stats
+}
+
+func (p *UDPProxy) accept(length int) {
+	p.counters.rxPackets.Add(1)
+	p.counters.rxBytes.Add(uint64(length))
+	p.counters.lastServerPacket.Store(time.Now().UnixNano())
+	p.handshakePending.Store(0)
+}
+
+// reject counts a server packet rejected at stage and returns the stage.
+func (p *UDPProxy) reject(stage string, length int) string {
+	switch stage {
+	case "masking":
+		p.counters.rejectedMasking.Add(1)
+	case "length":
+		p.counters.rejectedLength.Add(1)
+	case "key":
+		p.counters.rejectedKey.Add(1)
+	}
 	if !p.sawRejected.Swap(true) {
-		p.config.Logf("Obfuscator: server packet of %d bytes rejected at %s stage, check that masking and key match the server preset", length, stage)
+		p.current().Logf("Obfuscator: server packet of %d bytes rejected at %s stage, check that masking and key match the server preset", length, stage)
 	}
+	return stage
 }
 
 func (p *UDPProxy) fail(what string, err error) {
 	if p.running.Load() {
-		p.config.Logf("Obfuscator %s failed: %v", what, err)
+		p.current().Logf("Obfuscator %s failed: %v", what, err)
 	}
 }
 
-func (p *UDPProxy) clientLoop() {
-	buf := make([]byte, BufferSize)
-	obfuscator := NewObfuscator(p.config.Key)
+// wrapWorker is what one clientLoop worker encodes with besides the masker,
+// so that workers share nothing else.
+type wrapWorker struct {
+	scratch    []byte
+	paddingRNG rng32
+}
+
+func (p *UDPProxy) clientLoop(listener *net.UDPConn) {
+	conn := newBatchConn(listener)
+	batch := newPacketBatch(p.batchSize)
+	worker := &wrapWorker{scratch: make([]byte, BufferSize), paddingRNG: newRNG32()}
+	var upstream *batchConn
 	for {
-		n, source, err := p.listener.ReadFromUDPAddrPort(buf)
+		n, err := conn.read(batch)
 		if err != nil {
 			p.fail("loopback read", err)
 			return
 		}
+		packets := p.wrapBatch(listener, batch, n, worker)
+		if len(packets) == 0 {
+			continue
+		}
+		if err := p.sendBatchToServer(&upstream, packets); err != nil {
+			if errors.Is(err, net.ErrClosed) && p.running.Load() {
+				// The upstream link was replaced under us.
+				continue
+			}
+			p.fail("upstream write", err)
+			return
+		}
+	}
+}
+
+// wrapBatch obfuscates and masks the tunnel packets of a batch in place and
+// returns the ones to send upstream. Workers obfuscate data packets in
+// parallel and take maskerMu only to mask them, while a handshake, which may
+// change the masker, is wrapped under it as a whole.
+func (p *UDPProxy) wrapBatch(listener *net.UDPConn, batch *packetBatch, count int, worker *wrapWorker) [][]byte {
+	batch.out = batch.out[:0]
+	for i := range count {
+		buf, n, source := batch.bufs[i], batch.sizes[i], batch.sources[i]
 		if n < 4 {
 			continue
 		}
@@ -158,102 +584,516 @@ func (p *UDPProxy) clientLoop() {
 			continue
 		}
 
-		if client := p.client.Load(); client == nil || *client != source {
-			p.client.Store(&source)
+		if client := p.client.Load(); client == nil || client.addr != source || client.listener != listener {
+			p.client.Store(&loopbackClient{listener: listener, addr: source, udpAddr: net.UDPAddrFromAddrPort(source)})
 		}
 		if !p.sawTunnel.Swap(true) {
-			p.config.Logf("Obfuscator: first packet from tunnel, %d bytes from %v", n, source)
+			p.current().Logf("Obfuscator: first packet from tunnel, %d bytes from %v", n, source)
 		}
 
-		length := obfuscator.Encode(buf, n, p.config.MaxDummy, p.config.ObfuscateBytes)
-		if length < 0 {
-			continue
+		if capture := p.current().Capture; capture != nil {
+			capture.datagram(captureLoopback, source, listenAddr(listener), buf[:n], captureHead, "")
 		}
-		if p.masker != nil {
-			length = p.wrap(buf, length, packetType == TypeHandshake)
-			if length <= 0 {
-				continue
+		if packetType != TypeHandshake {
+			if length := p.wrapData(buf, n, worker); length > 0 {
+				batch.out = append(batch.out, buf[:length])
 			}
+			continue
 		}
-		if _, err := p.sendToServer(buf[:length]); err != nil {
-			p.fail("upstream write", err)
-			return
+		p.handshakePending.CompareAndSwap(0, time.Now().UnixNano())
+		p.maskerMu.Lock()
+		length := p.wrapHandshakeLocked(buf, n, worker)
+		p.maskerMu.Unlock()
+		if length <= 0 {
+			continue
+		}
+		if p.hopping.Load() != nil {
+			p.sendHandshake(buf[:length])
+			p.lastTunnel.Store(time.Now().UnixNano())
+			continue
 		}
+		batch.out = append(batch.out, buf[:length])
 	}
+	if len(batch.out) > 0 {
+		p.lastTunnel.Store(time.Now().UnixNano())
+	}
+	return batch.out
 }
 
-func (p *UDPProxy) serverLoop() {
-	buf := make([]byte, BufferSize)
-	obfuscator := NewObfuscator(p.config.Key)
+func (p *UDPProxy) serverLoop(link *upstreamLink) {
+	conn := newBatchConn(link.conn)
+	batch := newPacketBatch(p.batchSize)
+	scratch := make([]byte, BufferSize)
+	var captured []byte
+	if p.current().Capture != nil {
+		captured = make([]byte, BufferSize)
+	}
+	loopback := make(map[*net.UDPConn]*batchConn, len(p.listeners))
 	for {
-		n, err := p.upstream.Read(buf)
+		n, err := conn.read(batch)
 		if err != nil {
-			p.fail("upstream read", err)
+			if p.upstream.Load() == link {
+				p.fail("upstream read", err)
+			}
 			return
 		}
 		if !p.sawServer.Swap(true) {
-			p.config.Logf("Obfuscator: first packet from server, %d bytes", n)
+			p.current().Logf("Obfuscator: first packet from server, %d bytes", batch.sizes[0])
 		}
 		if p.client.Load() == nil {
 			continue
 		}
 
-		length := n
-		if p.masker != nil {
-			length = p.unwrap(buf, length)
-			if length < 0 {
-				p.reject("masking", n)
-				continue
+		batch.out = batch.out[:0]
+		capture := p.current().Capture
+		for i := range n {
+			var wire []byte
+			if capture != nil {
+				wire = append(captured[:0], batch.bufs[i][:batch.sizes[i]]...)
 			}
-			if length == 0 {
-				continue
+			length, rejected := p.receive(batch.bufs[i], batch.sizes[i], scratch)
+			if capture != nil {
+				p.captureReceived(capture, link, wire, batch.bufs[i][:max(length, 0)], rejected)
+			}
+			if length > 0 {
+				batch.out = append(batch.out, batch.bufs[i][:length])
 			}
 		}
-		if length < 4 {
-			p.reject("length", n)
+		if len(batch.out) == 0 {
 			continue
 		}
-		length = obfuscator.Decode(buf, length, p.config.ObfuscateBytes)
-		if length < 4 || !IsKnownPacketType(PacketType(buf)) {
-			p.reject("key", n)
-			continue
+		if p.hopping.Load() == link {
+			p.completeHop(link)
 		}
-		if _, err := p.sendToClient(buf[:length]); err != nil {
+		if err := p.sendBatchToClient(loopback, batch.out); err != nil {
 			p.fail("loopback write", err)
 			return
 		}
 	}
 }
 
+// receive unwraps and decodes a server packet in place and returns the
+// length of the tunnel packet to hand to WireGuard, or zero when there is
+// nothing to deliver, along with the stage that rejected the packet, if any.
+func (p *UDPProxy) receive(buf []byte, n int, scratch []byte) (int, string) {
+	if p.detecting.Load() {
+		length := p.probe(buf, n)
+		if length < 0 {
+			return 0, p.reject("masking", n)
+		}
+		if length > 0 {
+			p.accept(n)
+		}
+		return length, ""
+	}
+
+	length, state := p.unwrap(buf, n)
+	length, stage := decodeUnwrapped(state.settings.keys, buf, scratch, length, state.settings.obfuscateBytes(state.masking))
+	if stage != "" {
+		return 0, p.reject(stage, n)
+	}
+	if length > 0 {
+		p.accept(n)
+	}
+	return length, ""
+}
+
+// decodeUnwrapped decodes a server packet that OnDataUnwrap left length
+// bytes of, or rejected with a negative length. It returns the tunnel packet
+// length, zero for a masking control packet, and the stage that rejected the
+// packet, if any.
+func decodeUnwrapped(keys *keyRing, buf, scratch []byte, length, obfuscateBytes int) (int, string) {
+	switch {
+	case length < 0:
+		return 0, "masking"
+	case length == 0:
+		return 0, ""
+	case length < 4:
+		return 0, "length"
+	}
+	if length = keys.decode(buf, scratch, length, obfuscateBytes); length < 0 {
+		return 0, "key"
+	}
+	return length, ""
+}
+
+// captureReceived records a server packet as it came off link and, when it
+// was delivered, the tunnel packet it gave.
+func (p *UDPProxy) captureReceived(capture *Capture, link *upstreamLink, wire, tunnel []byte, rejected string) {
+	capture.datagram(captureWire, link.target, link.local, wire, len(wire), rejectComment(rejected))
+	if client := p.client.Load(); client != nil && len(tunnel) > 0 {
+		capture.datagram(captureLoopback, listenAddr(client.listener), client.addr, tunnel, captureHead, "")
+	}
+}
+
+func (p *UDPProxy) timerInterval() time.Duration {
+	p.maskerMu.Lock()
+	defer p.maskerMu.Unlock()
+	if p.masker == nil {
+		return autoProbeInterval
+	}
+	return p.masker.TimerInterval()
+}
+
+// timerLoop runs the masker's timer. A masker may want none for a while, as
+// TLS does outside its handshake, so the timer is left stopped then and a
+// handshake request kicks the loop to ask again.
 func (p *UDPProxy) timerLoop() {
-	ticker := time.NewTicker(p.masker.TimerInterval())
-	defer ticker.Stop()
+	timer := time.NewTimer(p.timerInterval())
+	defer timer.Stop()
+	armed := true
 	for {
 		select {
 		case <-p.done:
 			return
-		case <-ticker.C:
-			if p.client.Load() == nil {
+		case <-p.timerKick:
+			if armed {
 				continue
 			}
-			p.maskerMu.Lock()
-			p.masker.OnTimer(p.sendToServer)
-			p.maskerMu.Unlock()
+		case <-timer.C:
+			if p.client.Load() != nil {
+				p.maskerMu.Lock()
+				if p.masker != nil {
+					p.masker.OnTimer(p.sendToServer)
+				}
+				p.maskerMu.Unlock()
+			}
+		}
+		interval := p.timerInterval()
+		armed = interval > 0
+		if armed {
+			timer.Reset(interval)
 		}
 	}
 }
 
-func (p *UDPProxy) wrap(buf []byte, length int, handshake bool) int {
+// wrapData obfuscates a tunnel data packet with the key the server has
+// proven and masks it. It obfuscates with the settings published along with
+// the masker and takes maskerMu only to mask; a packet whose masker was
+// replaced meanwhile is dropped, as its key or masking may no longer match,
+// and WireGuard recovers it as it does any loss.
+func (p *UDPProxy) wrapData(buf []byte, length int, worker *wrapWorker) int {
+	state := p.unwrapper.Load()
+	s := state.settings
+	length = encode(s, state.masking, s.keys.sendIndex(time.Now()), buf, length, p.paddingCeiling(), &worker.paddingRNG)
+	if length < 0 || state.masker == nil {
+		return length
+	}
 	p.maskerMu.Lock()
 	defer p.maskerMu.Unlock()
-	if handshake {
-		p.masker.OnHandshakeRequest(p.sendToServer)
+	if p.unwrapper.Load() != state {
+		return -1
+	}
+	return state.masker.OnDataWrap(buf, length)
+}
+
+// wrapHandshakeLocked obfuscates a handshake initiation with the key the
+// server has proven and masks it. While a newer key is unproven, the
+// initiation also goes out under each newer live key first, so the proxy
+// moves up as soon as the server starts answering with one. Each copy is
+// framed as the first packet of a handshake. The caller holds maskerMu.
+func (p *UDPProxy) wrapHandshakeLocked(buf []byte, length int, worker *wrapWorker) int {
+	s := p.current()
+	if p.detecting.Load() {
+		p.auto.nextHandshake()
+		if masking := p.auto.masking(); masking != p.masking {
+			s.Logf("Obfuscator: auto masking trying %v", masking)
+		}
+		p.masker, p.masking = p.auto.masker(), p.auto.masking()
+		p.publishLocked()
+	}
+	if p.masker != nil {
+		p.masker.OnHandshakeRequest(p.sendHandshake)
+		select {
+		case p.timerKick <- struct{}{}:
+		default:
+		}
+	}
+
+	now := time.Now()
+	send := s.keys.sendIndex(now)
+	if len(s.keys.keys) > 1 {
+		for _, index := range s.keys.handshakeIndices(now) {
+			if index == send {
+				continue
+			}
+			copy(worker.scratch, buf[:length])
+			n := p.maskLocked(worker.scratch, encode(s, p.masking, index, worker.scratch, length, p.paddingCeiling(), &worker.paddingRNG))
+			if n > 0 {
+				p.sendHandshake(worker.scratch[:n])
+			}
+			if framer, ok := p.masker.(handshakeFramer); ok {
+				framer.reframeHandshake()
+			}
+		}
+	}
+	return p.maskLocked(buf, encode(s, p.masking, send, buf, length, p.paddingCeiling(), &worker.paddingRNG))
+}
+
+// maskLocked masks the length bytes encode left in buf, passing a failure
+// through. The caller holds maskerMu.
+func (p *UDPProxy) maskLocked(buf []byte, length int) int {
+	if length < 0 || p.masker == nil {
+		return length
 	}
 	return p.masker.OnDataWrap(buf, length)
 }
 
-func (p *UDPProxy) unwrap(buf []byte, length int) int {
+// encode obfuscates buf[:length] with key index of s, padding it to the
+// wire size the padding policy picks for masking but no further than
+// ceiling, and returns the obfuscated length.
+func encode(s *proxySettings, masking Masking, index int, buf []byte, length, ceiling int, paddingRNG *rng32) int {
+	obfuscator := s.keys.obfuscators[index]
+	if s.Padding.Mode == PaddingNone {
+		return obfuscator.Encode(buf, length, s.MaxDummy, s.obfuscateBytes(masking))
+	}
+	overhead := wrapOverhead(masking, s.Media)
+	dummy := min(s.Padding.size(length+overhead, paddingRNG), ceiling) - length - overhead
+	return obfuscator.EncodePadded(buf, length, min(max(dummy, 0), len(buf)-length-overhead), s.obfuscateBytes(masking))
+}
+
+// unwrap strips the masking off a server packet and returns the state its
+// payload is to be decoded with.
+func (p *UDPProxy) unwrap(buf []byte, length int) (int, *unwrapState) {
+	state := p.unwrapper.Load()
+	if !state.independent {
+		p.maskerMu.Lock()
+		defer p.maskerMu.Unlock()
+		state = p.unwrapper.Load()
+	}
+	if state.masker == nil {
+		return length, state
+	}
+	if stunHasMagic(buf[:length]) && stunMessageType(buf) == stunBindingResponse {
+		p.counters.bindingResponses.Add(1)
+	}
+	return state.masker.OnDataUnwrap(buf, length, p.ActiveTarget(), p.sendToServer), state
+}
+
+// publishLocked makes the current masker and settings the ones server
+// packets are unwrapped with. The caller holds maskerMu.
+func (p *UDPProxy) publishLocked() {
+	_, independent := p.masker.(independentUnwrapper)
+	p.unwrapper.Store(&unwrapState{
+		masker:      p.masker,
+		masking:     p.masking,
+		settings:    p.current(),
+		independent: p.masker == nil || independent,
+	})
+}
+
+func (p *UDPProxy) probe(buf []byte, length int) int {
 	p.maskerMu.Lock()
 	defer p.maskerMu.Unlock()
-	return p.masker.OnDataUnwrap(buf, length, p.config.Target, p.sendToServer)
+	if p.auto == nil || !p.detecting.Load() {
+		// Reconfigure settled the masking while this packet was in flight.
+		return -1
+	}
+	s := p.current()
+	n, index := p.auto.probe(buf, length, s.keys, s.ObfuscateBytes, p.ActiveTarget(), p.sendToServer)
+	if n > 0 {
+		p.auto.current = index
+		p.masker, p.masking = p.auto.masker(), p.auto.masking()
+		p.detecting.Store(false)
+		p.publishLocked()
+		s.Logf("Obfuscator: auto masking detected %v", p.masking)
+	}
+	return n
+}
+
+func (p *UDPProxy) failoverLoop() {
+	timer := time.NewTimer(min(p.current().FailoverTimeout/4, time.Second))
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-timer.C:
+			timeout := p.current().FailoverTimeout
+			pending := p.handshakePending.Load()
+			if pending != 0 && now.Sub(time.Unix(0, pending)) >= timeout {
+				p.failover(timeout)
+			}
+			timer.Reset(min(timeout/4, time.Second))
+		}
+	}
+}
+
+// failover moves to the next target after a handshake went unanswered for
+// FailoverTimeout. Only the upstream socket changes; WireGuard keeps talking
+// to the same loopback port and simply retries its handshake.
+func (p *UDPProxy) failover(timeout time.Duration) {
+	p.switchMu.Lock()
+	defer p.switchMu.Unlock()
+	if !p.running.Load() || len(p.targets) < 2 {
+		return
+	}
+	old := p.upstream.Load()
+	p.targetIndex = (p.targetIndex + 1) % len(p.targets)
+	next := p.current().scheduled(p.targetIndex, p.targets[p.targetIndex], time.Now())
+	p.handshakePending.Store(0)
+
+	link, err := p.dial(next)
+	if err != nil {
+		p.current().Logf("Obfuscator: unable to switch to %v: %v", next, err)
+		return
+	}
+	p.current().Logf("Obfuscator: no reply from %v for %v, switching to %v", old.target, timeout, next)
+	p.maskerMu.Lock()
+	p.resetMaskerLocked(p.current())
+	p.maskerMu.Unlock()
+	p.switchLink(link)
+}
+
+// switchLink makes link the upstream and retires the previous one, whose
+// serverLoop exits quietly once its socket is closed. The caller holds
+// switchMu.
+func (p *UDPProxy) switchLink(link *upstreamLink) {
+	old := p.upstream.Load()
+	p.dropHopLocked()
+	p.upstream.Store(link)
+	p.serve(link)
+	old.conn.Close()
+}
+
+// SetTarget moves the active upstream to target while the proxy runs. The
+// loopback port and the masking state are kept, as the new address is
+// expected to reach the same server, for example after its DNS record
+// changed.
+func (p *UDPProxy) SetTarget(target netip.AddrPort) error {
+	if !target.IsValid() {
+		return errors.New("obfuscator target is not resolved")
+	}
+	target = netip.AddrPortFrom(target.Addr().Unmap(), target.Port())
+	p.switchMu.Lock()
+	defer p.switchMu.Unlock()
+	if !p.running.Load() {
+		return errors.New("obfuscator is not running")
+	}
+	p.targets[p.targetIndex] = target
+	return p.moveUpstream(target)
+}
+
+// moveUpstream points the upstream at target, the new address of the
+// active target. The caller holds switchMu.
+func (p *UDPProxy) moveUpstream(target netip.AddrPort) error {
+	target = p.current().scheduled(p.targetIndex, target, time.Now())
+	if p.upstream.Load().target == target {
+		return nil
+	}
+	link, err := p.dial(target)
+	if err != nil {
+		return err
+	}
+	p.switchLink(link)
+	return nil
+}
+
+// obfuscateBytes is how many bytes of a packet are obfuscated while the
+// proxy is on masking.
+func (s *proxySettings) obfuscateBytes(masking Masking) int {
+	return obfuscateBytesUnder(masking, s.Masking, s.ObfuscateBytes)
+}
+
+func (s *proxySettings) targetHost(index int) string {
+	if index < len(s.TargetHosts) {
+		return s.TargetHosts[index]
+	}
+	return ""
+}
+
+func (p *UDPProxy) resolveLoop() {
+	timer := time.NewTimer(p.current().ResolveInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-timer.C:
+		}
+		s := p.current()
+		for i := range s.TargetHosts {
+			host := s.targetHost(i)
+			if host == "" {
+				continue
+			}
+			target, err := resolveTarget(s.Resolver, host)
+			if err != nil {
+				s.Logf("Obfuscator: unable to re-resolve %s: %v", host, err)
+				continue
+			}
+			p.updateTarget(s, i, target)
+		}
+		timer.Reset(p.current().ResolveInterval)
+	}
+}
+
+// updateTarget records a new address for the named target at index, unless
+// Reconfigure replaced the target list since s was loaded.
+func (p *UDPProxy) updateTarget(s *proxySettings, index int, target netip.AddrPort) {
+	p.switchMu.Lock()
+	defer p.switchMu.Unlock()
+	if !p.running.Load() || p.current() != s || index >= len(p.targets) || p.targets[index] == target {
+		return
+	}
+	s.Logf("Obfuscator: %s moved from %v to %v", s.targetHost(index), p.targets[index], target)
+	p.targets[index] = target
+	if index == p.targetIndex {
+		if err := p.moveUpstream(target); err != nil {
+			p.fail("target switch", err)
+		}
+	}
+}
+
+// resetMaskerLocked starts masking from scratch under s, as a new server or
+// a new preset has none of the state negotiated so far. The caller holds
+// maskerMu.
+func (p *UDPProxy) resetMaskerLocked(s *proxySettings) {
+	if s.Masking == MaskingAuto {
+		p.auto = newAutoMasking(s.Media)
+		p.masker, p.masking = p.auto.masker(), p.auto.masking()
+		p.detecting.Store(true)
+	} else {
+		p.auto = nil
+		p.masker, p.masking = NewMasker(s.Masking, s.Media), s.Masking
+		p.detecting.Store(false)
+	}
+	p.publishLocked()
+}
+
+// listenLoopback opens the loopback side of the proxy: 127.0.0.1 and, where
+// the host has IPv6, [::1] on the same port, so WireGuard can reach the proxy
+// whichever family its endpoint uses. The IPv4 listener comes first.
+func listenLoopback() ([]*net.UDPConn, error) {
+	const attempts = 8
+	for attempt := 1; ; attempt++ {
+		v4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return nil, err
+		}
+		port := v4.LocalAddr().(*net.UDPAddr).Port
+		v6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback, Port: port})
+		if err == nil {
+			return []*net.UDPConn{v4, v6}, nil
+		}
+		if attempt == attempts || !hasIPv6Loopback() {
+			return []*net.UDPConn{v4}, nil
+		}
+		v4.Close()
+	}
+}
+
+func hasIPv6Loopback() bool {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func closeAll(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
 }
@@ -7,8 +7,11 @@ package phobos
 
 import (
 	"bytes"
+	"encoding/binary"
 	"net"
 	"net/netip"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -23,7 +26,12 @@ type fakeServer struct {
 
 func startFakeServer(t *testing.T, key []byte, masking Masking, media MediaParams, obfuscateBytes int) *fakeServer {
 	t.Helper()
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	return startFakeServerOn(t, netip.MustParseAddr("127.0.0.1"), key, masking, media, obfuscateBytes)
+}
+
+func startFakeServerOn(t *testing.T, ip netip.Addr, key []byte, masking Masking, media MediaParams, obfuscateBytes int) *fakeServer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
 	if err != nil {
 		t.Fatalf("unable to listen: %v", err)
 	}
@@ -88,7 +96,12 @@ func TestUDPProxyRoundTrip(t *testing.T) {
 	}{
 		{"none", MaskingNone, MediaParams{}, 0},
 		{"stun", MaskingSTUN, MediaParams{}, 0},
+		{"turn", MaskingTURN, MediaParams{}, 0},
+		{"registered", xorMasking, MediaParams{}, 0},
 		{"media", MaskingMEDIA, MediaParams{PayloadType: 102, SSRC: 0xC0FFEE, TimestampStep: 3000}, MediaObfuscateBytesDefault},
+		{"webrtc", MaskingMEDIA, MediaParams{PayloadType: 111, TimestampStep: 3000, Profile: MediaProfileWebRTC}, MediaObfuscateBytesDefault},
+		{"tls", MaskingTLS, MediaParams{}, 0},
+		{"quic", MaskingQUIC, MediaParams{}, 0},
 	}
 
 	for _, tc := range cases {
@@ -163,3 +176,820 @@ func TestUDPProxyStopIsIdempotent(t *testing.T) {
 	proxy.Stop()
 	proxy.Stop()
 }
+
+func TestUDPProxyAutoMaskingLocksOntoServer(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	for _, masking := range []Masking{MaskingSTUN, MaskingMEDIA, MaskingNone} {
+		t.Run(masking.String(), func(t *testing.T) {
+			// A MEDIA server obfuscates the head of each packet only.
+			obfuscateBytes := 0
+			if masking == MaskingMEDIA {
+				obfuscateBytes = MediaObfuscateBytesDefault
+			}
+			server := startFakeServer(t, key, masking, MediaParams{}, obfuscateBytes)
+			proxy := NewUDPProxy(UDPProxyConfig{
+				Target:   server.addr(),
+				Key:      key,
+				Masking:  MaskingAuto,
+				MaxDummy: DefaultMaxDummy,
+				Logf:     t.Logf,
+			})
+			if err := proxy.Start(); err != nil {
+				t.Fatalf("unable to start proxy: %v", err)
+			}
+			t.Cleanup(proxy.Stop)
+			if _, settled := proxy.ActiveMasking(); settled {
+				t.Fatal("auto masking must not be settled before the server answers")
+			}
+
+			client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+			if err != nil {
+				t.Fatalf("unable to dial proxy: %v", err)
+			}
+			defer client.Close()
+
+			reply := make([]byte, BufferSize)
+			answered := false
+			for range 2 * len(autoCandidates) {
+				if _, err := client.Write(handshakePacket(148)); err != nil {
+					t.Fatalf("unable to send: %v", err)
+				}
+				client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+				if n, err := client.Read(reply); err == nil && n == 148 && reply[0] == TypeHandshakeResponse {
+					answered = true
+					break
+				}
+			}
+			if !answered {
+				t.Fatal("no candidate got an answer from the server")
+			}
+			active, settled := proxy.ActiveMasking()
+			if !settled || active != masking {
+				t.Fatalf("active masking = %v (settled %v), want %v", active, settled, masking)
+			}
+			packet := dataPacket(300, 1)
+			if _, err := client.Write(packet); err != nil {
+				t.Fatalf("unable to send: %v", err)
+			}
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			if n, err := client.Read(reply); err != nil || n != len(packet) || !bytes.Equal(reply[4:n], packet[4:]) {
+				t.Fatalf("data came back garbled under %v: %d bytes, %v", active, n, err)
+			}
+		})
+	}
+}
+
+func TestParseMaskingAcceptsAuto(t *testing.T) {
+	masking, ok := ParseMasking(" Auto ")
+	if !ok || masking != MaskingAuto {
+		t.Fatalf("ParseMasking(auto) = %v, %v", masking, ok)
+	}
+	if masking.String() != "AUTO" {
+		t.Fatalf("String() = %q", masking.String())
+	}
+}
+
+func skipWithoutIPv6(t *testing.T) {
+	t.Helper()
+	if !hasIPv6Loopback() {
+		t.Skip("IPv6 loopback is not available")
+	}
+}
+
+func TestUDPProxyIPv6(t *testing.T) {
+	skipWithoutIPv6(t)
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	for _, masking := range []Masking{MaskingNone, MaskingSTUN} {
+		t.Run(masking.String(), func(t *testing.T) {
+			server := startFakeServerOn(t, netip.IPv6Loopback(), key, masking, MediaParams{}, 0)
+			proxy := NewUDPProxy(UDPProxyConfig{
+				Target:   server.addr(),
+				Key:      key,
+				Masking:  masking,
+				MaxDummy: DefaultMaxDummy,
+				Logf:     t.Logf,
+			})
+			if err := proxy.Start(); err != nil {
+				t.Fatalf("unable to start proxy: %v", err)
+			}
+			t.Cleanup(proxy.Stop)
+
+			for _, loopback := range []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.IPv6Loopback()} {
+				client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(loopback, proxy.ListenPort())))
+				if err != nil {
+					t.Fatalf("unable to dial proxy on %v: %v", loopback, err)
+				}
+				defer client.Close()
+
+				packet := handshakePacket(148)
+				if _, err := client.Write(packet); err != nil {
+					t.Fatalf("unable to send: %v", err)
+				}
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				reply := make([]byte, BufferSize)
+				n, err := client.Read(reply)
+				if err != nil {
+					t.Fatalf("no reply through %v: %v", loopback, err)
+				}
+				if n != len(packet) || reply[0] != TypeHandshakeResponse || !bytes.Equal(reply[1:n], packet[1:]) {
+					t.Fatalf("reply payload mismatch through %v", loopback)
+				}
+			}
+		})
+	}
+}
+
+func stunReadXORMappedAddress(t *testing.T, message []byte) netip.AddrPort {
+	t.Helper()
+	attr := message[stunHeaderSize:]
+	if binary.BigEndian.Uint16(attr) != stunAttrXORMapped {
+		t.Fatalf("first attribute is %#04x, want XOR-MAPPED-ADDRESS", binary.BigEndian.Uint16(attr))
+	}
+	var mask [16]byte
+	copy(mask[:4], stunCookie[:])
+	copy(mask[4:], message[8:20])
+	port := binary.BigEndian.Uint16(attr[6:]) ^ binary.BigEndian.Uint16(mask[:])
+	var raw [16]byte
+	for i := range int(binary.BigEndian.Uint16(attr[2:])) - 4 {
+		raw[i] = attr[8+i] ^ mask[i]
+	}
+	switch attr[5] {
+	case 0x01:
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(raw[:4])), port)
+	case 0x02:
+		return netip.AddrPortFrom(netip.AddrFrom16(raw), port)
+	}
+	t.Fatalf("unknown address family %#02x", attr[5])
+	return netip.AddrPort{}
+}
+
+func TestSTUNBindingSuccessCarriesAddress(t *testing.T) {
+	txid := []byte("0123456789ab")
+	for _, source := range []string{"192.0.2.7:3478", "[::ffff:192.0.2.7]:3478", "[2001:db8::1:2]:51820", "[::1]:9"} {
+		addr := netip.MustParseAddrPort(source)
+		buf := make([]byte, 128)
+		n := stunBuildBindingSuccess(buf, txid, addr)
+		if n <= 0 {
+			t.Fatalf("%s: no binding response", source)
+		}
+		if stunMessageType(buf) != stunBindingResponse || int(binary.BigEndian.Uint16(buf[2:]))+stunHeaderSize != n {
+			t.Fatalf("%s: malformed response %x", source, buf[:n])
+		}
+		want := netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if got := stunReadXORMappedAddress(t, buf[:n]); got != want {
+			t.Fatalf("%s: mapped address %v", source, got)
+		}
+	}
+}
+
+func waitForStats(t *testing.T, proxy *UDPProxy, done func(UDPProxyStats) bool) UDPProxyStats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := proxy.Stats()
+		if done(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counters never settled: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPProxyStats(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	cases := []struct {
+		name           string
+		masking        Masking
+		media          MediaParams
+		obfuscateBytes int
+	}{
+		{"stun", MaskingSTUN, MediaParams{}, 0},
+		{"media", MaskingMEDIA, MediaParams{PayloadType: 102, SSRC: 0xC0FFEE, TimestampStep: 3000}, MediaObfuscateBytesDefault},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := startFakeServer(t, key, tc.masking, tc.media, tc.obfuscateBytes)
+			proxy := NewUDPProxy(UDPProxyConfig{
+				Target:         server.addr(),
+				Key:            key,
+				Masking:        tc.masking,
+				Media:          tc.media,
+				MaxDummy:       DefaultMaxDummy,
+				ObfuscateBytes: tc.obfuscateBytes,
+				Logf:           t.Logf,
+			})
+			if stats := proxy.Stats(); stats != (UDPProxyStats{}) {
+				t.Fatalf("fresh proxy reports %+v", stats)
+			}
+			if err := proxy.Start(); err != nil {
+				t.Fatalf("unable to start proxy: %v", err)
+			}
+			t.Cleanup(proxy.Stop)
+
+			client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+			if err != nil {
+				t.Fatalf("unable to dial proxy: %v", err)
+			}
+			defer client.Close()
+			if _, err := client.Write(handshakePacket(148)); err != nil {
+				t.Fatalf("unable to send: %v", err)
+			}
+
+			measured := tc.masking == MaskingSTUN
+			stats := waitForStats(t, proxy, func(s UDPProxyStats) bool {
+				return s.RxPackets > 0 && s.STUNBindingResponses > 0 && (!measured || s.Path.Answered > 0)
+			})
+			if stats.TxPackets != 2 || stats.TxBytes <= 148 || stats.STUNBindingRequests != 1 || stats.STUNBindingResponses != 1 {
+				t.Fatalf("unexpected upstream counters: %+v", stats)
+			}
+			if stats.RxBytes <= 148 || stats.LastServerPacket.IsZero() || stats.Rejected() != 0 {
+				t.Fatalf("unexpected downstream counters: %+v", stats)
+			}
+			if !measured {
+				return
+			}
+			if path := stats.Path; path.Requests != 1 || path.Answered != 1 || path.RTT <= 0 || path.Loss() != 0 {
+				t.Fatalf("unexpected path stats: %+v", path)
+			}
+		})
+	}
+}
+
+func TestUDPProxyStatsCountRejects(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, BufferSize)
+		var rng rng32 = 3
+		for {
+			_, source, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDPAddrPort([]byte("not a STUN message"), source)
+			copy(buf, handshakePacket(148))
+			n := NewObfuscator([]byte("another key")).Encode(buf, 148, 0, 0)
+			n = stunWrapDataIndication(buf, n, &rng)
+			conn.WriteToUDPAddrPort(buf[:n], source)
+		}
+	}()
+
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:  conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Key:     []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI="),
+		Masking: MaskingSTUN,
+		Logf:    t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(handshakePacket(148)); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+
+	stats := waitForStats(t, proxy, func(s UDPProxyStats) bool { return s.RejectedMasking > 0 && s.RejectedKey > 0 })
+	if stats.RxPackets != 0 || !stats.LastServerPacket.IsZero() {
+		t.Fatalf("rejected packets must not count as received: %+v", stats)
+	}
+}
+
+func TestUDPProxyFailsOverToNextTarget(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer silent.Close()
+	server := startFakeServer(t, key, MaskingSTUN, MediaParams{}, 0)
+
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:          silent.LocalAddr().(*net.UDPAddr).AddrPort(),
+		FallbackTargets: []netip.AddrPort{server.addr()},
+		FailoverTimeout: 200 * time.Millisecond,
+		Key:             key,
+		Masking:         MaskingSTUN,
+		MaxDummy:        DefaultMaxDummy,
+		Logf:            t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	port := proxy.ListenPort()
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	reply := make([]byte, BufferSize)
+	for attempt := 0; ; attempt++ {
+		if attempt == 20 {
+			t.Fatal("proxy never failed over to the fallback target")
+		}
+		if _, err := client.Write(handshakePacket(148)); err != nil {
+			t.Fatalf("unable to send: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		if n, err := client.Read(reply); err == nil && n == 148 && reply[0] == TypeHandshakeResponse {
+			break
+		}
+	}
+	if got := proxy.ActiveTarget(); got != server.addr() {
+		t.Fatalf("active target = %v, want %v", got, server.addr())
+	}
+	if proxy.ListenPort() != port {
+		t.Fatal("failover must not change the loopback port")
+	}
+}
+
+func TestUDPProxyStaysOnAnsweringTarget(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	primary := startFakeServer(t, key, MaskingNone, MediaParams{}, 0)
+	fallback := startFakeServer(t, key, MaskingNone, MediaParams{}, 0)
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:          primary.addr(),
+		FallbackTargets: []netip.AddrPort{fallback.addr()},
+		FailoverTimeout: 100 * time.Millisecond,
+		Key:             key,
+		Logf:            t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	reply := make([]byte, BufferSize)
+	for range 3 {
+		client.Write(handshakePacket(148))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(reply); err != nil {
+			t.Fatalf("no reply: %v", err)
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+	if got := proxy.ActiveTarget(); got != primary.addr() {
+		t.Fatalf("proxy left an answering target for %v", got)
+	}
+}
+
+func TestUDPProxyFollowsTargetHost(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	first := startFakeServer(t, key, MaskingSTUN, MediaParams{}, 0)
+	port := first.addr().Port()
+	moved, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: int(port)})
+	if err != nil {
+		t.Skipf("127.0.0.2 is not usable here: %v", err)
+	}
+	second := &fakeServer{conn: moved, key: key, masking: MaskingSTUN}
+	t.Cleanup(func() { moved.Close() })
+	go second.run()
+
+	forbidSystemResolver(t)
+	resolver := newFakeResolver("obfs.test", first.addr().Addr())
+	proxy := NewUDPProxy(UDPProxyConfig{
+		TargetHosts:     []string{net.JoinHostPort("obfs.test", strconv.Itoa(int(port)))},
+		Resolver:        resolver,
+		ResolveInterval: 50 * time.Millisecond,
+		Key:             key,
+		Masking:         MaskingSTUN,
+		MaxDummy:        DefaultMaxDummy,
+		Logf:            t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	if got := proxy.ActiveTarget(); got != first.addr() {
+		t.Fatalf("active target = %v, want %v", got, first.addr())
+	}
+	listenPort := proxy.ListenPort()
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(listenPort)})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	exchange := func() error {
+		if _, err := client.Write(handshakePacket(148)); err != nil {
+			return err
+		}
+		reply := make([]byte, BufferSize)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := client.Read(reply)
+		return err
+	}
+	if err := exchange(); err != nil {
+		t.Fatalf("no reply from the first address: %v", err)
+	}
+
+	first.conn.Close()
+	resolver.set("obfs.test", second.addr().Addr())
+	deadline := time.Now().Add(5 * time.Second)
+	for proxy.ActiveTarget() != second.addr() {
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy never moved to %v", second.addr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := exchange(); err != nil {
+		t.Fatalf("no reply from the new address: %v", err)
+	}
+	if proxy.ListenPort() != listenPort {
+		t.Fatal("moving the upstream must not change the loopback port")
+	}
+}
+
+func TestUDPProxySetTarget(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	first := startFakeServer(t, key, MaskingNone, MediaParams{}, 0)
+	second := startFakeServer(t, key, MaskingNone, MediaParams{}, 0)
+	proxy := NewUDPProxy(UDPProxyConfig{Target: first.addr(), Key: key, Logf: t.Logf})
+	if err := proxy.SetTarget(second.addr()); err == nil {
+		t.Fatal("SetTarget must fail before Start")
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	if err := proxy.SetTarget(second.addr()); err != nil {
+		t.Fatalf("SetTarget failed: %v", err)
+	}
+	first.conn.Close()
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	client.Write(handshakePacket(148))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, BufferSize)); err != nil {
+		t.Fatalf("no reply after SetTarget: %v", err)
+	}
+	if got := proxy.ActiveTarget(); got != second.addr() {
+		t.Fatalf("active target = %v, want %v", got, second.addr())
+	}
+}
+
+func TestUDPProxyReconfigure(t *testing.T) {
+	oldKey := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	newKey := []byte("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")
+	media := MediaParams{PayloadType: 102, SSRC: 0xC0FFEE, TimestampStep: 3000}
+	first := startFakeServer(t, oldKey, MaskingSTUN, MediaParams{}, 0)
+	second := startFakeServer(t, newKey, MaskingMEDIA, media, MediaObfuscateBytesDefault)
+
+	proxy := NewUDPProxy(UDPProxyConfig{Target: first.addr(), Key: oldKey, Masking: MaskingSTUN, MaxDummy: DefaultMaxDummy, Logf: t.Logf})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+	port := proxy.ListenPort()
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	exchange := func(stage string) {
+		t.Helper()
+		packet := handshakePacket(148)
+		client.Write(packet)
+		reply := make([]byte, BufferSize)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(reply)
+		if err != nil {
+			t.Fatalf("no reply %s: %v", stage, err)
+		}
+		packet[0] = TypeHandshakeResponse
+		if !bytes.Equal(reply[:n], packet) {
+			t.Fatalf("reply mismatch %s", stage)
+		}
+	}
+	exchange("before reconfiguring")
+
+	if err := proxy.Reconfigure(UDPProxyConfig{Target: second.addr()}); err == nil {
+		t.Fatal("Reconfigure must reject an empty key")
+	}
+	err = proxy.Reconfigure(UDPProxyConfig{
+		Target:         second.addr(),
+		Key:            newKey,
+		Masking:        MaskingMEDIA,
+		Media:          media,
+		MaxDummy:       DefaultMaxDummy,
+		ObfuscateBytes: MediaObfuscateBytesDefault,
+	})
+	if err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	first.conn.Close()
+	exchange("after reconfiguring")
+
+	if proxy.ListenPort() != port {
+		t.Fatal("Reconfigure must keep the loopback port")
+	}
+	if got := proxy.ActiveTarget(); got != second.addr() {
+		t.Fatalf("active target = %v, want %v", got, second.addr())
+	}
+	if masking, settled := proxy.ActiveMasking(); masking != MaskingMEDIA || !settled {
+		t.Fatalf("active masking = %v (settled %v), want MEDIA", masking, settled)
+	}
+}
+
+func TestUDPProxyKeyRotation(t *testing.T) {
+	oldKey := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	newKey := []byte("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")
+	rotating := startFakeServer(t, oldKey, MaskingSTUN, MediaParams{}, 0)
+	rotated := startFakeServer(t, newKey, MaskingSTUN, MediaParams{}, 0)
+
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:       rotating.addr(),
+		Key:          newKey,
+		PreviousKeys: []PreviousKey{{Key: oldKey, Expires: time.Now().Add(time.Hour)}},
+		Masking:      MaskingSTUN,
+		MaxDummy:     DefaultMaxDummy,
+		Logf:         t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+	exchange := func(packet []byte, stage string) {
+		t.Helper()
+		client.Write(packet)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, BufferSize)
+		for {
+			// A handshake goes out under both keys, so a server that
+			// knows both answers twice; lengths tell the replies apart.
+			n, err := client.Read(reply)
+			if err != nil {
+				t.Fatalf("no reply %s: %v", stage, err)
+			}
+			if n == len(packet) {
+				return
+			}
+		}
+	}
+	data := handshakePacket(120)
+	data[0] = TypeData
+
+	exchange(handshakePacket(148), "from a server that only knows the previous key")
+	exchange(data, "to data sent under the proven previous key")
+	if got := proxy.current().keys.sendIndex(time.Now()); got != 1 {
+		t.Fatalf("send index = %d, want the previous key", got)
+	}
+
+	if err := proxy.SetTarget(rotated.addr()); err != nil {
+		t.Fatalf("SetTarget failed: %v", err)
+	}
+	exchange(handshakePacket(148), "from a server that moved to the primary key")
+	exchange(data, "to data sent under the primary key")
+	if got := proxy.current().keys.sendIndex(time.Now()); got != 0 {
+		t.Fatalf("send index = %d, want the primary key", got)
+	}
+}
+
+// TestUDPProxyFramesEveryHandshakeCopy checks that under QUIC each copy of a
+// handshake goes out as an Initial, the only packet a server takes a new
+// connection from, so the copy under the previous key does not use up the
+// one the primary key's handshake needs.
+func TestUDPProxyFramesEveryHandshakeCopy(t *testing.T) {
+	oldKey := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	newKey := []byte("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")
+	_, upstream, client := hoppingProxy(t, UDPProxyConfig{
+		Key:          newKey,
+		PreviousKeys: []PreviousKey{{Key: oldKey, Expires: time.Now().Add(time.Hour)}},
+		Masking:      MaskingQUIC,
+	})
+	if _, err := client.Write(handshakePacket(148)); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+	buf := make([]byte, BufferSize)
+	for i := range 2 {
+		upstream.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := upstream.Read(buf)
+		if err != nil {
+			t.Fatalf("handshake copy %d never arrived: %v", i, err)
+		}
+		if buf[0]&0x80 == 0 || n < quicInitialMin {
+			t.Fatalf("handshake copy %d went out as a %d-byte short-header packet", i, n)
+		}
+	}
+}
+
+func dataPacket(length int, index uint32) []byte {
+	packet := handshakePacket(length)
+	packet[0] = TypeData
+	binary.LittleEndian.PutUint32(packet[4:], index)
+	return packet
+}
+
+func TestUDPProxyWorkersRelayBursts(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	server := startFakeServer(t, key, MaskingSTUN, MediaParams{}, 0)
+	proxy := NewUDPProxy(UDPProxyConfig{
+		Target:   server.addr(),
+		Key:      key,
+		Masking:  MaskingSTUN,
+		MaxDummy: DefaultMaxDummy,
+		Workers:  4,
+		Logf:     t.Logf,
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("unable to start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	const packets, burst = 128, 16
+	seen := make(map[uint32]bool)
+	reply := make([]byte, BufferSize)
+	for first := uint32(0); first < packets; first += burst {
+		for index := first; index < first+burst; index++ {
+			if _, err := client.Write(dataPacket(96+int(index), index)); err != nil {
+				t.Fatalf("unable to send: %v", err)
+			}
+		}
+		for range burst {
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := client.Read(reply)
+			if err != nil {
+				t.Fatalf("missing replies after %d packets: %v", len(seen), err)
+			}
+			index := binary.LittleEndian.Uint32(reply[4:])
+			if reply[0] != TypeHandshakeResponse || n != 96+int(index) || !bytes.Equal(reply[8:n], dataPacket(n, index)[8:]) {
+				t.Fatalf("reply %d of %d bytes is corrupt", index, n)
+			}
+			seen[index] = true
+		}
+	}
+	if len(seen) != packets {
+		t.Fatalf("got %d distinct replies, want %d", len(seen), packets)
+	}
+	if stats := proxy.Stats(); stats.TxPackets != packets || stats.RxPackets != packets {
+		t.Fatalf("counters %+v, want %d each way", stats, packets)
+	}
+}
+
+// startReflector echoes every datagram back to its sender unchanged, from
+// several goroutines, so a benchmark measures the proxy rather than the
+// server. An echoed obfuscated packet decodes on the way back like a server
+// reply would.
+func startReflector(b *testing.B) netip.AddrPort {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatalf("unable to listen: %v", err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	for range 4 {
+		go func() {
+			buf := make([]byte, BufferSize)
+			for {
+				n, source, err := conn.ReadFromUDPAddrPort(buf)
+				if err != nil {
+					return
+				}
+				conn.WriteToUDPAddrPort(buf[:n], source)
+			}
+		}()
+	}
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// BenchmarkUDPProxy pushes data packets through the proxy and back with a
+// window of packets in flight. "single" reads one packet per system call on
+// one worker, as the proxy did before batching.
+func BenchmarkUDPProxy(b *testing.B) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	cases := []struct {
+		name    string
+		workers int
+		batch   int
+	}{
+		{"single", 1, 1},
+		{"batched", 1, batchSize},
+		{"workers", 0, batchSize},
+	}
+	for _, masking := range []Masking{MaskingNone, MaskingSTUN} {
+		for _, tc := range cases {
+			b.Run(masking.String()+"/"+tc.name, func(b *testing.B) {
+				proxy := NewUDPProxy(UDPProxyConfig{
+					Target:   startReflector(b),
+					Key:      key,
+					Masking:  masking,
+					MaxDummy: DefaultMaxDummy,
+					Workers:  tc.workers,
+				})
+				proxy.batchSize = tc.batch
+				if err := proxy.Start(); err != nil {
+					b.Fatalf("unable to start proxy: %v", err)
+				}
+				b.Cleanup(proxy.Stop)
+				client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+				if err != nil {
+					b.Fatalf("unable to dial proxy: %v", err)
+				}
+				defer client.Close()
+
+				const window = 256
+				packet := dataPacket(1280, 0)
+				reply := make([]byte, BufferSize)
+				sent, outstanding, lost := 0, 0, 0
+				b.SetBytes(int64(len(packet)))
+				b.ResetTimer()
+				for sent < b.N || outstanding > 0 {
+					for ; outstanding < window && sent < b.N; sent++ {
+						client.Write(packet)
+						outstanding++
+					}
+					client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+					if _, err := client.Read(reply); err != nil {
+						lost += outstanding
+						outstanding = 0
+						continue
+					}
+					outstanding--
+				}
+				b.ReportMetric(float64(lost)/float64(b.N), "lost/op")
+			})
+		}
+	}
+}
+
+// BenchmarkUDPProxyWrap obfuscates and masks batches of data packets on
+// several workers at once: the send side of the proxy without its sockets.
+// Workers share only the masker, so throughput grows with them up to the
+// number of CPUs.
+func BenchmarkUDPProxyWrap(b *testing.B) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	for _, workers := range []int{1, 2, 4} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			proxy := NewUDPProxy(UDPProxyConfig{
+				Target:   startReflector(b),
+				Key:      key,
+				Masking:  MaskingSTUN,
+				MaxDummy: DefaultMaxDummy,
+				Padding:  PaddingPolicy{Mode: PaddingBuckets, Sizes: []int{1400}},
+				Workers:  1,
+			})
+			if err := proxy.Start(); err != nil {
+				b.Fatalf("unable to start proxy: %v", err)
+			}
+			b.Cleanup(proxy.Stop)
+			listener := proxy.listeners[0]
+			source := netip.MustParseAddrPort("127.0.0.1:51820")
+			packet := dataPacket(1280, 0)
+			batches := (b.N + batchSize - 1) / batchSize
+
+			b.SetBytes(int64(len(packet)))
+			b.ResetTimer()
+			var wait sync.WaitGroup
+			for first := range workers {
+				wait.Go(func() {
+					batch := newPacketBatch(batchSize)
+					worker := &wrapWorker{scratch: make([]byte, BufferSize), paddingRNG: newRNG32()}
+					for range (batches - first + workers - 1) / workers {
+						for i := range batchSize {
+							batch.sizes[i], batch.sources[i] = copy(batch.bufs[i], packet), source
+						}
+						if packets := proxy.wrapBatch(listener, batch, batchSize, worker); len(packets) != batchSize {
+							b.Errorf("wrapped %d of %d packets", len(packets), batchSize)
+							return
+						}
+					}
+				})
+			}
+			wait.Wait()
+		})
+	}
+}
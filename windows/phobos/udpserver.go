@@ -0,0 +1,463 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultIdleTimeout = 300 * time.Second
+
+type UDPServerConfig struct {
+	Listen         netip.AddrPort
+	Forward        netip.AddrPort
+	Key            []byte
+	Masking        Masking
+	Media          MediaParams
+	MaxDummy       int
+	ObfuscateBytes int
+	IdleTimeout    time.Duration
+	// ListenLastPort publishes the range of ports from the Listen port
+	// through this one. The server listens on the port the key-derived
+	// schedule has active, along with those of the slots either side of it,
+	// and a client moving between them is admitted by any packet that
+	// passes the key check rather than only by a handshake. A port the
+	// schedule has moved past stays open while clients still use it.
+	ListenLastPort uint16
+	PortSlot       time.Duration
+	Logf           func(format string, args ...any)
+}
+
+// UDPServer is the server role of UDPProxy: it accepts obfuscated clients on
+// a public socket and relays each of them to the WireGuard endpoint through
+// its own upstream socket, the way the C wg-obfuscator does.
+type UDPServer struct {
+	config UDPServerConfig
+
+	listenPort uint16
+
+	mu        sync.Mutex
+	listeners map[uint16]*net.UDPConn
+	draining  map[*net.UDPConn]bool
+	clients   map[netip.AddrPort]*serverClient
+
+	running atomic.Bool
+	wait    sync.WaitGroup
+	done    chan struct{}
+}
+
+type serverClient struct {
+	addr     netip.AddrPort
+	listener *net.UDPConn
+	upstream *net.UDPConn
+
+	maskerMu sync.Mutex
+	masker   Masker
+	// obfuscateBytes is how much of each packet the client obfuscates,
+	// which under AUTO follows the masking it was detected with.
+	obfuscateBytes int
+
+	lastActive atomic.Int64
+}
+
+func NewUDPServer(config UDPServerConfig) *UDPServer {
+	if config.Logf == nil {
+		config.Logf = func(string, ...any) {}
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.PortSlot <= 0 {
+		config.PortSlot = DefaultPortSlot
+	}
+	return &UDPServer{
+		config:    config,
+		listeners: make(map[uint16]*net.UDPConn),
+		draining:  make(map[*net.UDPConn]bool),
+		clients:   make(map[netip.AddrPort]*serverClient),
+		done:      make(chan struct{}),
+	}
+}
+
+func (s *UDPServer) ListenPort() uint16 {
+	return s.listenPort
+}
+
+func (s *UDPServer) Start() error {
+	if len(s.config.Key) == 0 {
+		return errors.New("obfuscation key is empty")
+	}
+	if !s.config.Forward.IsValid() {
+		return errors.New("forward endpoint is not resolved")
+	}
+	if !s.config.Masking.Datagram() {
+		return fmt.Errorf("%v masking is not available for UDP", s.config.Masking)
+	}
+
+	if s.hopping() {
+		s.listenPort = s.config.Listen.Port()
+		s.running.Store(true)
+		if err := s.followSchedule(time.Now()); err != nil {
+			s.Stop()
+			return err
+		}
+		s.spawn(s.scheduleLoop)
+		s.spawn(s.reapLoop)
+		s.config.Logf("Obfuscator server started: %v-%d -> %v (masking %v)", s.config.Listen, s.config.ListenLastPort, s.config.Forward, s.config.Masking)
+		return nil
+	}
+
+	listener, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(s.config.Listen))
+	if err != nil {
+		return fmt.Errorf("unable to open listening socket: %w", err)
+	}
+	s.listenPort = uint16(listener.LocalAddr().(*net.UDPAddr).Port)
+	s.listeners[s.listenPort] = listener
+	s.running.Store(true)
+
+	s.spawn(func() { s.listenLoop(listener) })
+	s.spawn(s.reapLoop)
+
+	s.config.Logf("Obfuscator server started: %v -> %v (masking %v)", listener.LocalAddr(), s.config.Forward, s.config.Masking)
+	return nil
+}
+
+func (s *UDPServer) hopping() bool {
+	return s.config.ListenLastPort > s.config.Listen.Port() && s.config.Listen.Port() != 0
+}
+
+func (s *UDPServer) scheduleLoop() {
+	for {
+		slot := s.config.PortSlot
+		now := time.Now()
+		timer := time.NewTimer(time.Duration(portSlot(now, slot)+1)*slot - time.Duration(now.UnixNano()))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			if err := s.followSchedule(now); err != nil {
+				s.fail("port schedule", err)
+			}
+		}
+	}
+}
+
+// followSchedule listens on the ports the schedule has active in the slot
+// now falls in and the slots either side of it. The rest are closed, but
+// for those clients still reach the server through: a client moves to a new
+// port only once a handshake through it has been answered, so these drain
+// until forget sees their last client go.
+func (s *UDPServer) followSchedule(now time.Time) error {
+	current := portSlot(now, s.config.PortSlot)
+	wanted := make(map[uint16]bool, 3)
+	for slot := current - 1; slot <= current+1; slot++ {
+		wanted[scheduledPort(s.config.Key, s.config.Listen.Port(), s.config.ListenLastPort, slot)] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running.Load() {
+		return net.ErrClosed
+	}
+	for port, listener := range s.listeners {
+		if wanted[port] {
+			continue
+		}
+		delete(s.listeners, port)
+		s.draining[listener] = true
+		s.closeDrainedLocked(listener)
+	}
+	var err error
+	for port := range wanted {
+		if s.listeners[port] != nil {
+			continue
+		}
+		if listener := s.drainingOn(port); listener != nil {
+			delete(s.draining, listener)
+			s.listeners[port] = listener
+			continue
+		}
+		listener, listenErr := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(s.config.Listen.Addr(), port)))
+		if listenErr != nil {
+			err = fmt.Errorf("unable to open listening socket on port %d: %w", port, listenErr)
+			continue
+		}
+		s.listeners[port] = listener
+		s.spawn(func() { s.listenLoop(listener) })
+	}
+	return err
+}
+
+func (s *UDPServer) Stop() {
+	if !s.running.Swap(false) {
+		return
+	}
+	close(s.done)
+	s.mu.Lock()
+	for port, listener := range s.listeners {
+		listener.Close()
+		delete(s.listeners, port)
+	}
+	for listener := range s.draining {
+		listener.Close()
+		delete(s.draining, listener)
+	}
+	for addr, client := range s.clients {
+		client.upstream.Close()
+		delete(s.clients, addr)
+	}
+	s.mu.Unlock()
+	s.wait.Wait()
+	s.config.Logf("Obfuscator server stopped: port %d -> %v", s.listenPort, s.config.Forward)
+}
+
+func (s *UDPServer) spawn(loop func()) {
+	s.wait.Add(1)
+	go func() {
+		defer s.wait.Done()
+		loop()
+	}()
+}
+
+func (s *UDPServer) fail(what string, err error) {
+	if s.running.Load() {
+		s.config.Logf("Obfuscator server %s failed: %v", what, err)
+	}
+}
+
+// listening tells whether listener is still one of the server's, rather
+// than closed because the schedule moved on.
+func (s *UDPServer) listening(listener *net.UDPConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listeners[uint16(listener.LocalAddr().(*net.UDPAddr).Port)] == listener || s.draining[listener]
+}
+
+// drainingOn returns the draining listener on port, if there is one. The
+// caller holds mu.
+func (s *UDPServer) drainingOn(port uint16) *net.UDPConn {
+	for listener := range s.draining {
+		if uint16(listener.LocalAddr().(*net.UDPAddr).Port) == port {
+			return listener
+		}
+	}
+	return nil
+}
+
+// closeDrainedLocked closes listener once it is draining and no client
+// reaches the server through it any more. The caller holds mu.
+func (s *UDPServer) closeDrainedLocked(listener *net.UDPConn) {
+	if !s.draining[listener] {
+		return
+	}
+	for _, client := range s.clients {
+		if client.listener == listener {
+			return
+		}
+	}
+	delete(s.draining, listener)
+	listener.Close()
+}
+
+func (s *UDPServer) lookup(addr netip.AddrPort) *serverClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clients[addr]
+}
+
+func (s *UDPServer) admit(listener *net.UDPConn, addr netip.AddrPort, masker Masker, obfuscateBytes int) (*serverClient, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(context.Background(), "udp", s.config.Forward.String())
+	if err != nil {
+		return nil, err
+	}
+	client := &serverClient{addr: addr, listener: listener, upstream: conn.(*net.UDPConn), masker: masker, obfuscateBytes: obfuscateBytes}
+	client.touch()
+
+	s.mu.Lock()
+	if !s.running.Load() {
+		s.mu.Unlock()
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	s.clients[addr] = client
+	s.mu.Unlock()
+
+	s.spawn(func() { s.upstreamLoop(client) })
+	s.config.Logf("Obfuscator server: new client %v", addr)
+	return client, nil
+}
+
+func (s *UDPServer) forget(client *serverClient) {
+	s.mu.Lock()
+	if s.clients[client.addr] == client {
+		delete(s.clients, client.addr)
+	}
+	s.closeDrainedLocked(client.listener)
+	s.mu.Unlock()
+	client.upstream.Close()
+}
+
+func (c *serverClient) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *serverClient) idleSince() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+func (s *UDPServer) sendToClient(listener *net.UDPConn, addr netip.AddrPort) SendFunc {
+	return func(packet []byte) (int, error) {
+		return listener.WriteToUDPAddrPort(packet, addr)
+	}
+}
+
+func (s *UDPServer) listenLoop(listener *net.UDPConn) {
+	buf := make([]byte, BufferSize)
+	keys := newKeyRing(s.config.Key, nil)
+	obfuscator := keys.obfuscators[0]
+	detector := newAutoMasking(s.config.Media)
+	for {
+		n, source, err := listener.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if s.listening(listener) {
+				s.fail("listener read", err)
+			}
+			return
+		}
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		client := s.lookup(source)
+
+		var length int
+		var masker Masker
+		obfuscateBytes := s.config.ObfuscateBytes
+		if client == nil && s.config.Masking == MaskingAuto {
+			length, masker, obfuscateBytes = s.detect(detector, buf, n, keys, source, s.sendToClient(listener, source))
+		} else {
+			if client != nil {
+				masker, obfuscateBytes = client.masker, client.obfuscateBytes
+			} else {
+				masker = NewMasker(s.config.Masking, s.config.Media)
+			}
+			length = s.unwrap(client, masker, buf, n, obfuscator, obfuscateBytes, source, s.sendToClient(listener, source))
+		}
+		if length < 4 || !IsKnownPacketType(PacketType(buf)) {
+			continue
+		}
+
+		if client == nil {
+			if PacketType(buf) != TypeHandshake && !s.hopping() {
+				continue
+			}
+			if client, err = s.admit(listener, source, masker, obfuscateBytes); err != nil {
+				s.fail("upstream dial", err)
+				continue
+			}
+		}
+		client.touch()
+		if _, err := client.upstream.Write(buf[:length]); err != nil {
+			s.fail("upstream write", err)
+		}
+	}
+}
+
+func (s *UDPServer) unwrap(client *serverClient, masker Masker, buf []byte, length int, obfuscator *Obfuscator, obfuscateBytes int, source netip.AddrPort, sendBack SendFunc) int {
+	if masker != nil {
+		if client != nil {
+			client.maskerMu.Lock()
+		}
+		length = masker.OnDataUnwrap(buf, length, source, sendBack)
+		if client != nil {
+			client.maskerMu.Unlock()
+		}
+	}
+	if length < 4 {
+		return -1
+	}
+	return obfuscator.Decode(buf, length, obfuscateBytes)
+}
+
+// detect picks the masking of a new AUTO client from its first packet, the
+// way the C server does, but also requires the key check to pass. The
+// matching masker is handed to the caller and replaced in the detector,
+// along with how much of the client's packets are obfuscated under it.
+func (s *UDPServer) detect(detector *autoMasking, buf []byte, length int, keys *keyRing, source netip.AddrPort, sendBack SendFunc) (int, Masker, int) {
+	n, index := detector.probe(buf, length, keys, s.config.ObfuscateBytes, source, sendBack)
+	if n < 4 {
+		return -1, nil, 0
+	}
+	masker := detector.maskers[index]
+	detector.maskers[index] = NewMasker(autoCandidates[index], s.config.Media)
+	if PacketType(buf) == TypeHandshake {
+		s.config.Logf("Obfuscator server: detected masking %v for %v", autoCandidates[index], source)
+	}
+	return n, masker, obfuscateBytesUnder(autoCandidates[index], MaskingAuto, s.config.ObfuscateBytes)
+}
+
+func (s *UDPServer) upstreamLoop(client *serverClient) {
+	defer s.forget(client)
+	buf := make([]byte, BufferSize)
+	obfuscator := NewObfuscator(s.config.Key)
+	send := s.sendToClient(client.listener, client.addr)
+	for {
+		n, err := client.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		if n < 4 || !IsKnownPacketType(PacketType(buf)) {
+			continue
+		}
+		client.touch()
+
+		length := obfuscator.Encode(buf, n, s.config.MaxDummy, client.obfuscateBytes)
+		if length < 0 {
+			continue
+		}
+		if client.masker != nil {
+			client.maskerMu.Lock()
+			length = client.masker.OnDataWrap(buf, length)
+			client.maskerMu.Unlock()
+			if length <= 0 {
+				continue
+			}
+		}
+		if _, err := send(buf[:length]); err != nil {
+			s.fail("client write", err)
+		}
+	}
+}
+
+func (s *UDPServer) reapLoop() {
+	ticker := time.NewTicker(min(s.config.IdleTimeout/4, 10*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			var idle []*serverClient
+			for _, client := range s.clients {
+				if now.Sub(client.idleSince()) >= s.config.IdleTimeout {
+					idle = append(idle, client)
+				}
+			}
+			s.mu.Unlock()
+			for _, client := range idle {
+				s.config.Logf("Obfuscator server: removing idle client %v", client.addr)
+				s.forget(client)
+			}
+		}
+	}
+}
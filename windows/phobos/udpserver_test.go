@@ -0,0 +1,276 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package phobos
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func startWireGuardEcho(t *testing.T) netip.AddrPort {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, BufferSize)
+		for {
+			n, source, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			buf[0] = TypeHandshakeResponse
+			conn.WriteToUDPAddrPort(buf[:n], source)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func startUDPServer(t *testing.T, config UDPServerConfig) *UDPServer {
+	t.Helper()
+	config.Listen = netip.MustParseAddrPort("127.0.0.1:0")
+	config.Logf = t.Logf
+	server := NewUDPServer(config)
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	return server
+}
+
+func (s *UDPServer) clientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+func TestUDPServerRoundTrip(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	cases := []struct {
+		name           string
+		masking        Masking
+		media          MediaParams
+		obfuscateBytes int
+	}{
+		{"none", MaskingNone, MediaParams{}, 0},
+		{"stun", MaskingSTUN, MediaParams{}, 0},
+		{"turn", MaskingTURN, MediaParams{}, 0},
+		{"registered", xorMasking, MediaParams{}, 0},
+		{"media", MaskingMEDIA, MediaParams{PayloadType: 102, SSRC: 0xC0FFEE, TimestampStep: 3000}, MediaObfuscateBytesDefault},
+		{"webrtc", MaskingMEDIA, MediaParams{PayloadType: 111, TimestampStep: 3000, Profile: MediaProfileWebRTC}, MediaObfuscateBytesDefault},
+		{"tls", MaskingTLS, MediaParams{}, 0},
+		{"quic", MaskingQUIC, MediaParams{}, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := startUDPServer(t, UDPServerConfig{
+				Forward:        startWireGuardEcho(t),
+				Key:            key,
+				Masking:        tc.masking,
+				Media:          tc.media,
+				MaxDummy:       DefaultMaxDummy,
+				ObfuscateBytes: tc.obfuscateBytes,
+			})
+
+			proxy := NewUDPProxy(UDPProxyConfig{
+				Target:         netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), server.ListenPort()),
+				Key:            key,
+				Masking:        tc.masking,
+				Media:          tc.media,
+				MaxDummy:       DefaultMaxDummy,
+				ObfuscateBytes: tc.obfuscateBytes,
+				Logf:           t.Logf,
+			})
+			if err := proxy.Start(); err != nil {
+				t.Fatalf("unable to start proxy: %v", err)
+			}
+			t.Cleanup(proxy.Stop)
+
+			client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+			if err != nil {
+				t.Fatalf("unable to dial proxy: %v", err)
+			}
+			defer client.Close()
+
+			for _, length := range []int{148, 92, 1420} {
+				packet := handshakePacket(length)
+				if _, err := client.Write(packet); err != nil {
+					t.Fatalf("unable to send: %v", err)
+				}
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				reply := make([]byte, BufferSize)
+				n, err := client.Read(reply)
+				if err != nil {
+					t.Fatalf("no reply for length %d: %v", length, err)
+				}
+				expected := bytes.Clone(packet)
+				expected[0] = TypeHandshakeResponse
+				if !bytes.Equal(reply[:n], expected) {
+					t.Fatalf("reply payload mismatch at length %d", length)
+				}
+			}
+			if got := server.clientCount(); got != 1 {
+				t.Fatalf("server tracks %d clients, want 1", got)
+			}
+		})
+	}
+}
+
+func TestUDPServerDetectsClientMasking(t *testing.T) {
+	key := []byte("Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=")
+	server := startUDPServer(t, UDPServerConfig{
+		Forward:  startWireGuardEcho(t),
+		Key:      key,
+		Masking:  MaskingAuto,
+		MaxDummy: DefaultMaxDummy,
+	})
+	for _, masking := range []Masking{MaskingSTUN, MaskingMEDIA, MaskingNone} {
+		t.Run(masking.String(), func(t *testing.T) {
+			// A MEDIA client obfuscates the head of each packet only, as
+			// its configuration defaults to.
+			obfuscateBytes := 0
+			if masking == MaskingMEDIA {
+				obfuscateBytes = MediaObfuscateBytesDefault
+			}
+			proxy := NewUDPProxy(UDPProxyConfig{
+				Target:         netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), server.ListenPort()),
+				Key:            key,
+				Masking:        masking,
+				MaxDummy:       DefaultMaxDummy,
+				ObfuscateBytes: obfuscateBytes,
+				Logf:           t.Logf,
+			})
+			if err := proxy.Start(); err != nil {
+				t.Fatalf("unable to start proxy: %v", err)
+			}
+			defer proxy.Stop()
+
+			client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(proxy.ListenPort())})
+			if err != nil {
+				t.Fatalf("unable to dial proxy: %v", err)
+			}
+			defer client.Close()
+
+			if _, err := client.Write(handshakePacket(148)); err != nil {
+				t.Fatalf("unable to send: %v", err)
+			}
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply := make([]byte, BufferSize)
+			if n, err := client.Read(reply); err != nil || n != 148 || reply[0] != TypeHandshakeResponse {
+				t.Fatalf("no valid reply: %d bytes, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestUDPServerAnswersBindingRequests(t *testing.T) {
+	server := startUDPServer(t, UDPServerConfig{
+		Forward: startWireGuardEcho(t),
+		Key:     []byte("key"),
+		Masking: MaskingSTUN,
+	})
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(server.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	var rng rng32 = 77
+	request := make([]byte, stunBindingReqSize)
+	stunBuildBindingRequest(request, &rng)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 128)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatalf("no binding response: %v", err)
+	}
+	if n < stunHeaderSize || stunMessageType(reply) != stunBindingResponse || !bytes.Equal(reply[8:20], request[8:20]) {
+		t.Fatalf("unexpected binding response %x", reply[:n])
+	}
+	if server.clientCount() != 0 {
+		t.Fatal("a binding request must not create a client entry")
+	}
+}
+
+func TestUDPServerIgnoresDataBeforeHandshake(t *testing.T) {
+	key := []byte("key")
+	server := startUDPServer(t, UDPServerConfig{Forward: startWireGuardEcho(t), Key: key})
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(server.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, BufferSize)
+	copy(buf, handshakePacket(64))
+	buf[0] = TypeData
+	n := NewObfuscator(key).Encode(buf, 64, 0, 0)
+	conn.Write(buf[:n])
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("data from an unknown client must be dropped")
+	}
+	if server.clientCount() != 0 {
+		t.Fatal("data from an unknown client must not create a client entry")
+	}
+}
+
+func TestUDPServerExpiresIdleClients(t *testing.T) {
+	key := []byte("key")
+	server := startUDPServer(t, UDPServerConfig{
+		Forward:     startWireGuardEcho(t),
+		Key:         key,
+		IdleTimeout: 200 * time.Millisecond,
+	})
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(server.ListenPort())})
+	if err != nil {
+		t.Fatalf("unable to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, BufferSize)
+	copy(buf, handshakePacket(148))
+	n := NewObfuscator(key).Encode(buf, 148, 0, 0)
+	conn.Write(buf[:n])
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("no reply: %v", err)
+	}
+	if server.clientCount() != 1 {
+		t.Fatal("handshake must create a client entry")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.clientCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle client was never removed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestUDPServerStopIsIdempotent(t *testing.T) {
+	server := NewUDPServer(UDPServerConfig{
+		Listen:  netip.MustParseAddrPort("127.0.0.1:0"),
+		Forward: netip.MustParseAddrPort("127.0.0.1:1"),
+		Key:     []byte("key"),
+		Logf:    t.Logf,
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	server.Stop()
+	server.Stop()
+}
@@ -0,0 +1,14 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Phobos
+ */
+
+package services
+
+import "golang.org/x/sys/windows/svc"
+
+// ReloadObfuscation is the control the manager sends a running tunnel
+// service once it has saved a new configuration for it, for the service to
+// move its obfuscator to the new settings. Codes from 128 on are for a
+// service to define.
+const ReloadObfuscation = svc.Cmd(128)
@@ -67,6 +67,7 @@ type interfaceWatcher struct {
 	changeCallbacks6        []winipcfg.ChangeCallback
 	storedEvents            []interfaceWatcherEvent
 	watchdog                *time.Timer
+	mtu                     uint16
 }
 
 func (iw *interfaceWatcher) setup(family winipcfg.AddressFamily) {
@@ -90,6 +91,9 @@ func (iw *interfaceWatcher) setup(family winipcfg.AddressFamily) {
 	}
 	var err error
 
+	if iw.mtu != 0 {
+		iw.conf.Interface.MTU = iw.mtu
+	}
 	if iw.conf.Interface.MTU == 0 {
 		log.Printf("Monitoring MTU of default %s routes", ipversion)
 		*changeCallbacks, err = monitorMTU(family, iw.luid)
@@ -160,6 +164,43 @@ func (iw *interfaceWatcher) Configure(adapter tunnelAdapter, conf *conf.Config,
 	iw.storedEvents = nil
 }
 
+// SetMTU changes the MTU of the adapter, at once for the address families
+// already set up and as the others come up.
+func (iw *interfaceWatcher) SetMTU(mtu uint16) {
+	iw.setupMutex.Lock()
+	defer iw.setupMutex.Unlock()
+	iw.mtu = mtu
+	if iw.luid == 0 {
+		return
+	}
+	iw.conf.Interface.MTU = mtu
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		iface, err := iw.luid.IPInterface(family)
+		if err != nil {
+			continue
+		}
+		iface.NLMTU = uint32(mtu)
+		if err := iface.Set(); err != nil {
+			log.Printf("Unable to set MTU: %v", err)
+		}
+	}
+}
+
+// SetObfuscation takes the obfuscation settings of config, which differs
+// from the configuration being watched in no more than those, for the
+// adapter to be reconfigured with when its interface comes back.
+func (iw *interfaceWatcher) SetObfuscation(config *conf.Config) {
+	iw.setupMutex.Lock()
+	defer iw.setupMutex.Unlock()
+	if iw.conf == nil {
+		return
+	}
+	iw.conf.Obfuscation = config.Obfuscation
+	for i := range iw.conf.Peers {
+		iw.conf.Peers[i].Obfuscation = config.Peers[i].Obfuscation
+	}
+}
+
 func (iw *interfaceWatcher) Destroy() {
 	iw.setupMutex.Lock()
 	iw.watchdog.Stop()
@@ -6,12 +6,14 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"net/netip"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/windows/conf"
@@ -58,11 +60,20 @@ func (b *stickyBinder) control(network, address string, c syscall.RawConn) error
 	return b.apply(stickySocket{raw: c, family: familyOf(network)})
 }
 
+// controlAndTrack binds a new upstream socket and keeps it for rebind. The
+// obfuscator opens one on every port hop, so sockets closed since are
+// dropped here rather than piling up until the next route change.
 func (b *stickyBinder) controlAndTrack(network, address string, c syscall.RawConn) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	live := b.tracked[:0]
+	for _, socket := range b.tracked {
+		if socket.raw.Control(func(uintptr) {}) == nil {
+			live = append(live, socket)
+		}
+	}
 	socket := stickySocket{raw: c, family: familyOf(network)}
-	b.tracked = append(b.tracked, socket)
+	b.tracked = append(live, socket)
 	return b.apply(socket)
 }
 
@@ -154,12 +165,29 @@ func hostToNetworkLong(value uint32) uint32 {
 	return value>>24 | value>>8&0xFF00 | value<<8&0xFF0000 | value<<24
 }
 
+const statsPublishInterval = time.Second
+
 type obfuscation struct {
-	binder  stickyBinder
-	proxies []*phobos.UDPProxy
+	binder   stickyBinder
+	proxies  []*phobos.UDPProxy
+	peers    []conf.Key
+	captures []*phobos.Capture
+
+	stats *phobos.StatsPublisher
+	done  chan struct{}
+	wait  sync.WaitGroup
+
+	// fit is the configuration as it was started, which the adapter MTU is
+	// fitted to the discovered path MTUs under, and pathMTUs holds the
+	// latest of those by peer.
+	mtuMu    sync.Mutex
+	fit      conf.Config
+	pathMTUs []int
+	mtu      uint16
+	setMTU   func(uint16)
 }
 
-func startObfuscation(config *conf.Config, ourLUID winipcfg.LUID) (*obfuscation, error) {
+func startObfuscation(config *conf.Config, ourLUID winipcfg.LUID, setMTU func(uint16)) (*obfuscation, error) {
 	needed := false
 	for i := range config.Peers {
 		if config.Peers[i].Obfuscation != nil {
@@ -171,59 +199,162 @@ func startObfuscation(config *conf.Config, ourLUID winipcfg.LUID) (*obfuscation,
 		return nil, nil
 	}
 
-	o := &obfuscation{binder: stickyBinder{ourLUID: ourLUID}}
+	o := &obfuscation{
+		binder:   stickyBinder{ourLUID: ourLUID},
+		done:     make(chan struct{}),
+		fit:      *config,
+		pathMTUs: make([]int, len(config.Peers)),
+		mtu:      config.Interface.MTU,
+		setMTU:   setMTU,
+	}
 	for i := range config.Peers {
 		settings := config.Peers[i].Obfuscation
 		if settings == nil {
 			continue
 		}
-		target, err := resolvedEndpoint(&settings.Target)
+		proxyConfig, err := settings.UDPProxyConfig(o.binder.control)
 		if err != nil {
 			o.stop()
 			return nil, err
 		}
-		proxy := phobos.NewUDPProxy(phobos.UDPProxyConfig{
-			Target:          target,
-			Key:             []byte(settings.Key),
-			Masking:         settings.Masking,
-			Media:           settings.MediaParams(),
-			MaxDummy:        int(settings.MaxDummy),
-			ObfuscateBytes:  int(settings.ObfuscateBytes),
-			UpstreamControl: o.binder.controlAndTrack,
-			Logf:            log.Printf,
-		})
+		capture := openCapture(settings.Capture)
+		o.captures = append(o.captures, capture)
+		proxyConfig.PathMTUChanged = func(pathMTU int) { o.fitPathMTU(i, pathMTU) }
+		proxyConfig.UpstreamControl = o.binder.controlAndTrack
+		proxyConfig.Capture = capture
+		proxyConfig.Logf = log.Printf
+		proxy := phobos.NewUDPProxy(proxyConfig)
 		if err := proxy.Start(); err != nil {
 			o.stop()
 			return nil, err
 		}
 		o.proxies = append(o.proxies, proxy)
+		o.peers = append(o.peers, config.Peers[i].PublicKey)
 		config.Peers[i].Endpoint = conf.Endpoint{Host: "127.0.0.1", Port: proxy.ListenPort()}
 	}
+
+	stats, err := phobos.NewStatsPublisher(config.Name)
+	if err != nil {
+		log.Printf("Unable to publish obfuscator statistics: %v", err)
+	} else {
+		o.stats = stats
+		o.wait.Add(1)
+		go o.publishStats()
+	}
 	return o, nil
 }
 
+// fitPathMTU records the path MTU discovered to the server of a peer and
+// fits the adapter MTU to the smallest one known.
+func (o *obfuscation) fitPathMTU(peer, pathMTU int) {
+	o.mtuMu.Lock()
+	defer o.mtuMu.Unlock()
+	o.pathMTUs[peer] = pathMTU
+	smallest := pathMTU
+	for _, known := range o.pathMTUs {
+		if known > 0 {
+			smallest = min(smallest, known)
+		}
+	}
+	if mtu := o.fit.FitMTU(smallest); mtu != o.mtu {
+		log.Printf("Fitting MTU to path MTU %d: %d", smallest, mtu)
+		o.mtu = mtu
+		o.setMTU(mtu)
+	}
+}
+
+func (o *obfuscation) publishStats() {
+	defer o.wait.Done()
+	ticker := time.NewTicker(statsPublishInterval)
+	defer ticker.Stop()
+	for {
+		snapshot := make(map[string]phobos.UDPProxyStats, len(o.proxies))
+		for i, proxy := range o.proxies {
+			snapshot[o.peers[i].String()] = proxy.Stats()
+		}
+		if err := o.stats.Publish(snapshot); err != nil {
+			log.Printf("Unable to publish obfuscator statistics: %v", err)
+			return
+		}
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (o *obfuscation) stop() {
 	if o == nil {
 		return
 	}
 	o.binder.stopWatching()
+	if o.stats != nil {
+		close(o.done)
+		o.wait.Wait()
+		o.stats.Close()
+		o.stats = nil
+	}
 	for _, proxy := range o.proxies {
 		proxy.Stop()
 	}
 	o.proxies = nil
+	o.peers = nil
+	for _, capture := range o.captures {
+		capture.Close()
+	}
+	o.captures = nil
 }
 
-func (o *obfuscation) watchDefaultRoutes(ourLUID winipcfg.LUID) error {
+// Reconfigure moves the proxy of each peer to the obfuscation settings
+// config has for it. The loopback listeners stay, so WireGuard keeps its
+// endpoints and is not told.
+func (o *obfuscation) Reconfigure(config *conf.Config) error {
 	if o == nil {
 		return nil
 	}
-	return o.binder.watchDefaultRoutes(ourLUID)
+	var failures []error
+	for i := range config.Peers {
+		settings := config.Peers[i].Obfuscation
+		proxy := slices.Index(o.peers, config.Peers[i].PublicKey)
+		if settings == nil || proxy < 0 {
+			continue
+		}
+		proxyConfig, err := settings.UDPProxyConfig(o.binder.control)
+		if err == nil {
+			err = o.proxies[proxy].Reconfigure(proxyConfig)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Errorf("peer %s: %w", config.Peers[i].PublicKey.String(), err))
+		}
+	}
+	return errors.Join(failures...)
 }
 
-func resolvedEndpoint(endpoint *conf.Endpoint) (netip.AddrPort, error) {
-	addr, err := netip.ParseAddr(endpoint.Host)
+// openCapture starts the packet capture asked for by the capture key, which
+// the service writes as Local System, so only when an admin allows it. A
+// capture that cannot be written is logged rather than holding the tunnel
+// down.
+func openCapture(path string) *phobos.Capture {
+	if len(path) == 0 {
+		return nil
+	}
+	if !conf.AdminBool("DangerousPacketCapture") {
+		log.Printf("Skipping packet capture, because dangerous packet capture is safely disabled: %#q", path)
+		return nil
+	}
+	capture, err := phobos.CreateCapture(path, phobos.DefaultCaptureLimit)
 	if err != nil {
-		return netip.AddrPort{}, fmt.Errorf("obfuscator target %q is not resolved: %w", endpoint.Host, err)
+		log.Printf("Unable to start packet capture: %v", err)
+		return nil
 	}
-	return netip.AddrPortFrom(addr, endpoint.Port), nil
+	log.Printf("Capturing obfuscator packets to %s", path)
+	return capture
+}
+
+func (o *obfuscation) watchDefaultRoutes(ourLUID winipcfg.LUID) error {
+	if o == nil {
+		return nil
+	}
+	return o.binder.watchDefaultRoutes(ourLUID)
 }
@@ -7,6 +7,7 @@ package tunnel
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -124,8 +125,20 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 		return
 	}
 	config.DeduplicateNetworkEntries()
+	running, err := conf.FromWgQuick(config.ToWgQuick(), config.Name)
+	if err != nil {
+		serviceError = services.ErrorLoadConfiguration
+		return
+	}
 
 	log.SetPrefix(fmt.Sprintf("[%s] ", config.Name))
+	for _, warning := range config.Warnings {
+		log.Printf("Warning: %s", warning)
+	}
+	if config.AutoMTU() != conf.AutoMTUOff {
+		config.Interface.MTU = config.EffectiveMTU()
+		log.Printf("Fitting MTU to obfuscation overhead: %d", config.Interface.MTU)
+	}
 
 	services.PrintStarting()
 
@@ -215,7 +228,7 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 	if config.IsSocks5() {
 		socks5, err = startSocks5Tunnel(config, socks5Adapter, luid)
 	} else {
-		obfuscator, err = startObfuscation(config, luid)
+		obfuscator, err = startObfuscation(config, luid, watcher.SetMTU)
 	}
 	if err != nil {
 		err = fmt.Errorf("Error starting obfuscator: %w", err)
@@ -275,6 +288,17 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 				return
 			case svc.Interrogate:
 				changes <- c.CurrentStatus
+			case services.ReloadObfuscation:
+				reconfigure := obfuscator.Reconfigure
+				if config.IsSocks5() {
+					reconfigure = socks5.Reconfigure
+				}
+				if next, err := reloadObfuscation(service.Path, running, reconfigure, watcher); err != nil {
+					log.Printf("Unable to reload obfuscation settings: %v", err)
+				} else {
+					running = next
+					log.Println("Reloaded obfuscation settings")
+				}
 			default:
 				log.Printf("Unexpected service control request #%d\n", c)
 			}
@@ -292,6 +316,32 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 	}
 }
 
+// reloadObfuscation hands reconfigure the obfuscation settings saved at path
+// since the tunnel started from running, provided they can take effect
+// without a restart, and returns the configuration the tunnel runs now.
+func reloadObfuscation(path string, running *conf.Config, reconfigure func(*conf.Config) error, watcher *interfaceWatcher) (*conf.Config, error) {
+	next, err := conf.LoadFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	next.DeduplicateNetworkEntries()
+	if !next.ReloadsObfuscation(running) {
+		return nil, errors.New("the saved configuration changes more than the obfuscation settings, so the tunnel must be restarted")
+	}
+	resolved, err := conf.FromWgQuick(next.ToWgQuick(), next.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err = resolved.ResolveEndpoints(); err != nil {
+		return nil, err
+	}
+	if err = reconfigure(resolved); err != nil {
+		return nil, err
+	}
+	watcher.SetObfuscation(resolved)
+	return next, nil
+}
+
 func Run(confPath string) error {
 	name, err := conf.NameFromPath(confPath)
 	if err != nil {
@@ -41,6 +41,7 @@ type socks5Tunnel struct {
 	client  *phobos.Socks5Client
 	stack   *tun2socks.Tunnel
 	binder  stickyBinder
+	capture *phobos.Capture
 }
 
 func createSocks5Adapter(config *conf.Config) (*wintun.Adapter, error) {
@@ -69,24 +70,16 @@ func createSocks5Adapter(config *conf.Config) (*wintun.Adapter, error) {
 
 func startSocks5Tunnel(config *conf.Config, adapter *wintun.Adapter, ourLUID winipcfg.LUID) (*socks5Tunnel, error) {
 	settings := config.Obfuscation
-	target, err := resolvedEndpoint(&settings.Target)
+	t := &socks5Tunnel{adapter: adapter, binder: stickyBinder{ourLUID: ourLUID}}
+	clientConfig, err := t.clientConfig(settings)
 	if err != nil {
 		return nil, err
 	}
-
-	t := &socks5Tunnel{adapter: adapter, binder: stickyBinder{ourLUID: ourLUID}}
-	t.client = phobos.NewSocks5Client(phobos.Socks5Config{
-		Target:     target,
-		Key:        []byte(settings.Key),
-		Masking:    settings.Masking,
-		Media:      settings.MediaParams(),
-		Login:      settings.Login,
-		Password:   settings.Password,
-		ListenPort: settings.SourceListenPort,
-		Control:    t.binder.control,
-		Logf:       log.Printf,
-	})
+	t.capture = openCapture(settings.Capture)
+	clientConfig.Capture = t.capture
+	t.client = phobos.NewSocks5Client(clientConfig)
 	if err := t.client.Start(); err != nil {
+		t.stop()
 		return nil, err
 	}
 
@@ -107,7 +100,7 @@ func startSocks5Tunnel(config *conf.Config, adapter *wintun.Adapter, ourLUID win
 		return nil, err
 	}
 
-	log.Printf("SOCKS5 tunnel up: %v (masking %v)", target, settings.Masking)
+	log.Printf("SOCKS5 tunnel up: %v (masking %v)", t.client.Target(), settings.Masking)
 	return t, nil
 }
 
@@ -128,6 +121,8 @@ func (t *socks5Tunnel) stop() {
 		t.client.Stop()
 		t.client = nil
 	}
+	t.capture.Close()
+	t.capture = nil
 }
 
 func (t *socks5Tunnel) watchDefaultRoutes(ourLUID winipcfg.LUID) error {
@@ -137,6 +132,26 @@ func (t *socks5Tunnel) watchDefaultRoutes(ourLUID winipcfg.LUID) error {
 	return t.binder.watchDefaultRoutes(ourLUID)
 }
 
-func (t *socks5Tunnel) Reconfigure(*conf.Config) error {
-	return nil
+func (t *socks5Tunnel) clientConfig(settings *conf.Obfuscation) (phobos.Socks5Config, error) {
+	config, err := settings.Socks5Config(t.binder.control)
+	if err != nil {
+		return phobos.Socks5Config{}, err
+	}
+	config.Control = t.binder.control
+	config.Logf = log.Printf
+	return config, nil
+}
+
+// Reconfigure moves the SOCKS5 client to the obfuscation settings of config
+// without touching the adapter. Connections already open finish on the
+// settings they were opened with.
+func (t *socks5Tunnel) Reconfigure(config *conf.Config) error {
+	if t.client == nil || config.Obfuscation == nil {
+		return nil
+	}
+	clientConfig, err := t.clientConfig(config.Obfuscation)
+	if err != nil {
+		return err
+	}
+	return t.client.Reconfigure(clientConfig)
 }
@@ -17,6 +17,7 @@ import (
 	"golang.zx2c4.com/wireguard/windows/conf"
 	"golang.zx2c4.com/wireguard/windows/l18n"
 	"golang.zx2c4.com/wireguard/windows/manager"
+	"golang.zx2c4.com/wireguard/windows/phobos"
 )
 
 type widgetsLine interface {
@@ -63,6 +64,7 @@ type peerView struct {
 	allowedIPs          *labelTextLine
 	endpoint            *labelTextLine
 	obfuscator          *labelTextLine
+	obfuscatorStatus    *labelTextLine
 	persistentKeepalive *labelTextLine
 	latestHandshake     *labelTextLine
 	transfer            *labelTextLine
@@ -357,6 +359,7 @@ func newPeerView(parent walk.Container) (*peerView, error) {
 		{l18n.Sprintf("Allowed IPs:"), &pv.allowedIPs},
 		{l18n.Sprintf("Endpoint:"), &pv.endpoint},
 		{l18n.Sprintf("Obfuscator:"), &pv.obfuscator},
+		{l18n.Sprintf("Obfuscator status:"), &pv.obfuscatorStatus},
 		{l18n.Sprintf("Persistent keepalive:"), &pv.persistentKeepalive},
 		{l18n.Sprintf("Latest handshake:"), &pv.latestHandshake},
 		{l18n.Sprintf("Transfer:"), &pv.transfer},
@@ -396,7 +399,7 @@ func (ov *obfuscatorView) widgetsLines() []widgetsLine {
 }
 
 func (ov *obfuscatorView) apply(o *conf.Obfuscation) {
-	ov.server.show(o.Target.String())
+	ov.server.show(o.TargetsString())
 	ov.masking.show(o.Masking.String())
 
 	if len(o.Login) > 0 && IsAdmin {
@@ -419,7 +422,23 @@ func (ov *obfuscatorView) apply(o *conf.Obfuscation) {
 }
 
 func obfuscatorSummary(o *conf.Obfuscation) string {
-	return l18n.Sprintf("%s, masking %s", o.Target.String(), o.Masking.String())
+	return l18n.Sprintf("%s, masking %s", o.TargetsString(), o.Masking.String())
+}
+
+func obfuscatorStatus(stats *phobos.UDPProxyStats) string {
+	var status string
+	if stats.LastServerPacket.IsZero() {
+		status = l18n.Sprintf("No reply from server")
+	} else {
+		status = l18n.Sprintf("Last reply: %s", conf.HandshakeTime(stats.LastServerPacket.UnixNano()).String())
+	}
+	if path := stats.Path; path.Answered > 0 {
+		status = l18n.Sprintf("%s, RTT %s (jitter %s), %s%% loss", status, path.RTT.Round(time.Millisecond).String(), path.Jitter.Round(time.Millisecond).String(), strconv.Itoa(int(path.Loss()*100+0.5)))
+	}
+	if rejected := stats.Rejected(); rejected > 0 {
+		status = l18n.Sprintf("%s, %d rejected (masking %d, length %d, key %d)", status, rejected, stats.RejectedMasking, stats.RejectedLength, stats.RejectedKey)
+	}
+	return status
 }
 
 func layoutInGrid(view widgetsLinesView, layout *walk.GridLayout) {
@@ -551,6 +570,12 @@ func (pv *peerView) apply(c *conf.Peer) {
 		pv.obfuscator.hide()
 	}
 
+	if c.Obfuscation != nil && c.Obfuscation.Stats != nil {
+		pv.obfuscatorStatus.show(obfuscatorStatus(c.Obfuscation.Stats))
+	} else {
+		pv.obfuscatorStatus.hide()
+	}
+
 	if c.PersistentKeepalive > 0 {
 		pv.persistentKeepalive.show(strconv.Itoa(int(c.PersistentKeepalive)))
 	} else {
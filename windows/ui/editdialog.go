@@ -339,6 +339,9 @@ func (dlg *EditDialog) onSaveButtonClicked() {
 		showErrorCustom(dlg, l18n.Sprintf("Unable to create new configuration"), err.Error())
 		return
 	}
+	if len(cfg.Warnings) > 0 {
+		showWarningCustom(dlg, l18n.Sprintf("Configuration warning"), strings.Join(cfg.Warnings, "\n"))
+	}
 
 	dlg.config = *cfg
 	dlg.Accept()
@@ -8,7 +8,12 @@
 
 package syntax
 
-import "unsafe"
+import (
+	"time"
+	"unsafe"
+
+	"golang.zx2c4.com/wireguard/windows/phobos"
+)
 
 type highlight int
 
@@ -260,8 +265,11 @@ func (s stringSpan) isValidMTU() bool {
 }
 
 func (s stringSpan) isValidMasking() bool {
-	return s.isCaselessSame("none") || s.isCaselessSame("auto") || s.isCaselessSame("stun") ||
-		s.isCaselessSame("media") || s.isCaselessSame("tls")
+	if s.len == 0 {
+		return false
+	}
+	_, ok := phobos.ParseMasking(unsafe.String(s.s, s.len))
+	return ok
 }
 
 func (s stringSpan) isValidObfuscationMode() bool {
@@ -284,6 +292,43 @@ func (s stringSpan) isValidSecret() bool {
 	return true
 }
 
+func (s stringSpan) isValidResolver() bool {
+	if s.isCaselessSame("system") {
+		return true
+	}
+	const scheme = "https://"
+	if s.len <= len(scheme) || !(stringSpan{s.s, len(scheme)}).isCaselessSame(scheme) {
+		return false
+	}
+	for i := range s.len {
+		if *s.at(i) <= ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s stringSpan) isValidMediaProfile() bool {
+	return s.isCaselessSame("rtp") || s.isCaselessSame("webrtc")
+}
+
+func (s stringSpan) isValidPaddingMode() bool {
+	return s.isCaselessSame("none") || s.isCaselessSame("buckets") || s.isCaselessSame("mtu") || s.isCaselessSame("distribution")
+}
+
+func (s stringSpan) isValidAutoMTU() bool {
+	return s.isCaselessSame("on") || s.isCaselessSame("off") || s.isCaselessSame("probe")
+}
+
+func (s stringSpan) isValidExpiry() bool {
+	value := unsafe.String(s.s, s.len)
+	if _, err := time.Parse(time.DateOnly, value); err == nil {
+		return true
+	}
+	_, err := time.Parse(time.RFC3339, value)
+	return err == nil
+}
+
 func (s stringSpan) isValidSourceInterface() bool {
 	return s.isValidIPv4() || s.isValidIPv6() || s.isValidHostname()
 }
@@ -413,13 +458,25 @@ const (
 	fieldSourceInterface
 	fieldSourceListenPort
 	fieldTarget
+	fieldFailoverTimeout
+	fieldPortHopInterval
+	fieldPortHopSilence
+	fieldResolver
+	fieldResolveInterval
 	fieldObfuscationKey
+	fieldPreviousKeys
 	fieldMasking
 	fieldObfuscateBytes
 	fieldMaxDummy
+	fieldPadding
+	fieldPaddingSizes
+	fieldAutoMTU
 	fieldMediaPayloadType
 	fieldMediaSSRC
 	fieldMediaClock
+	fieldMediaProfile
+	fieldCoverTraffic
+	fieldCapture
 	fieldVerbose
 	fieldSocks5Section
 	fieldLogin
@@ -485,20 +542,44 @@ func (s stringSpan) field() field {
 		return fieldSourceListenPort
 	case s.isCaselessSame("target"):
 		return fieldTarget
+	case s.isCaselessSame("failover-timeout"):
+		return fieldFailoverTimeout
+	case s.isCaselessSame("port-hop-interval"):
+		return fieldPortHopInterval
+	case s.isCaselessSame("port-hop-silence"):
+		return fieldPortHopSilence
+	case s.isCaselessSame("resolver"):
+		return fieldResolver
+	case s.isCaselessSame("resolve-interval"):
+		return fieldResolveInterval
 	case s.isCaselessSame("key"):
 		return fieldObfuscationKey
+	case s.isCaselessSame("previous-keys"):
+		return fieldPreviousKeys
 	case s.isCaselessSame("masking"):
 		return fieldMasking
 	case s.isCaselessSame("obfuscate-bytes"):
 		return fieldObfuscateBytes
 	case s.isCaselessSame("max-dummy"):
 		return fieldMaxDummy
+	case s.isCaselessSame("padding"):
+		return fieldPadding
+	case s.isCaselessSame("padding-sizes"):
+		return fieldPaddingSizes
+	case s.isCaselessSame("auto-mtu"):
+		return fieldAutoMTU
 	case s.isCaselessSame("media-pt"):
 		return fieldMediaPayloadType
 	case s.isCaselessSame("media-ssrc"):
 		return fieldMediaSSRC
 	case s.isCaselessSame("media-clock"):
 		return fieldMediaClock
+	case s.isCaselessSame("media-profile"):
+		return fieldMediaProfile
+	case s.isCaselessSame("cover-traffic"):
+		return fieldCoverTraffic
+	case s.isCaselessSame("capture"):
+		return fieldCapture
 	case s.isCaselessSame("verbose"):
 		return fieldVerbose
 	case s.isCaselessSame("login"):
@@ -532,8 +613,78 @@ func (hsa *highlightSpanArray) append(o *byte, s stringSpan, t highlight) {
 	*hsa = append(*hsa, highlightSpan{t, int((uintptr(unsafe.Pointer(s.s))) - (uintptr(unsafe.Pointer(o)))), s.len})
 }
 
+func (hsa *highlightSpanArray) highlightEndpoint(parent, s stringSpan) {
+	if !s.isValidEndpoint() {
+		hsa.append(parent.s, s, highlightError)
+		return
+	}
+	colon := s.len
+	for colon > 0 {
+		colon--
+		if *s.at(colon) == ':' {
+			break
+		}
+	}
+	hsa.append(parent.s, stringSpan{s.s, colon}, highlightHost)
+	hsa.append(parent.s, stringSpan{s.at(colon), 1}, highlightDelimiter)
+	hsa.append(parent.s, stringSpan{s.at(colon + 1), s.len - colon - 1}, highlightPort)
+}
+
+// highlightTargetEndpoint also takes the range of ports an obfuscator target
+// may publish, as in host:51822-51861.
+func (hsa *highlightSpanArray) highlightTargetEndpoint(parent, s stringSpan) {
+	dash := -1
+	for i := s.len - 1; i >= 0 && *s.at(i) != ':' && *s.at(i) != ']'; i-- {
+		if *s.at(i) == '-' {
+			dash = i
+			break
+		}
+	}
+	if dash < 0 {
+		hsa.highlightEndpoint(parent, s)
+		return
+	}
+	last := stringSpan{s.at(dash + 1), s.len - dash - 1}
+	if !last.isValidPort() || !(stringSpan{s.s, dash}).isValidEndpoint() {
+		hsa.append(parent.s, s, highlightError)
+		return
+	}
+	hsa.highlightEndpoint(parent, stringSpan{s.s, dash})
+	hsa.append(parent.s, stringSpan{s.at(dash), 1}, highlightDelimiter)
+	hsa.append(parent.s, last, highlightPort)
+}
+
 func (hsa *highlightSpanArray) highlightMultivalueValue(parent, s stringSpan, section field) {
 	switch section {
+	case fieldTarget:
+		hsa.highlightTargetEndpoint(parent, s)
+	case fieldPreviousKeys:
+		space := 0
+		for space < s.len && *s.at(space) != ' ' && *s.at(space) != '\t' {
+			space++
+		}
+		if space == 0 || space == s.len {
+			hsa.append(parent.s, s, highlightError)
+			break
+		}
+		hsa.append(parent.s, stringSpan{s.s, space}, highlightSecret)
+		for space < s.len && (*s.at(space) == ' ' || *s.at(space) == '\t') {
+			space++
+		}
+		expiry := stringSpan{s.at(space), s.len - space}
+		hsa.append(parent.s, expiry, validateHighlight(expiry.isValidExpiry(), highlightKeyword))
+	case fieldPaddingSizes:
+		colon := 0
+		for colon < s.len && *s.at(colon) != ':' {
+			colon++
+		}
+		size := stringSpan{s.s, colon}
+		hsa.append(parent.s, size, validateHighlight(size.isValidUint(false, 1, 65535), highlightMTU))
+		if colon < s.len {
+			weight := stringSpan{s.at(colon + 1), s.len - colon - 1}
+			hsa.append(parent.s, stringSpan{s.at(colon), 1}, validateHighlight(weight.len > 0, highlightDelimiter))
+			hsa.append(parent.s, weight, validateHighlight(weight.isValidUint(false, 1, 65535), highlightMTU))
+		}
 	case fieldDNS:
 		if s.isValidIPv4() || s.isValidIPv6() {
 			hsa.append(parent.s, s, highlightIP)
@@ -606,33 +757,26 @@ func (hsa *highlightSpanArray) highlightValue(parent, s stringSpan, section fiel
 		hsa.append(parent.s, s, validateHighlight(s.isValidMTU(), highlightMTU))
 	case fieldTable:
 		hsa.append(parent.s, s, validateHighlight(s.isValidTable(), highlightTable))
-	case fieldPreUp, fieldPostUp, fieldPreDown, fieldPostDown:
+	case fieldPreUp, fieldPostUp, fieldPreDown, fieldPostDown, fieldCapture:
 		hsa.append(parent.s, s, validateHighlight(s.isValidPrePostUpDown(), highlightCmd))
 	case fieldListenPort:
 		hsa.append(parent.s, s, validateHighlight(s.isValidPort(), highlightPort))
 	case fieldPersistentKeepalive:
 		hsa.append(parent.s, s, validateHighlight(s.isValidPersistentKeepAlive(), highlightKeepalive))
-	case fieldEndpoint, fieldTarget:
-		if !s.isValidEndpoint() {
-			hsa.append(parent.s, s, highlightError)
-			break
-		}
-		colon := s.len
-		for colon > 0 {
-			colon--
-			if *s.at(colon) == ':' {
-				break
-			}
-		}
-		hsa.append(parent.s, stringSpan{s.s, colon}, highlightHost)
-		hsa.append(parent.s, stringSpan{s.at(colon), 1}, highlightDelimiter)
-		hsa.append(parent.s, stringSpan{s.at(colon + 1), s.len - colon - 1}, highlightPort)
+	case fieldEndpoint:
+		hsa.highlightEndpoint(parent, s)
 	case fieldObfuscationMode:
 		hsa.append(parent.s, s, validateHighlight(s.isValidObfuscationMode(), highlightKeyword))
 	case fieldObfuscationRole:
 		hsa.append(parent.s, s, validateHighlight(s.isValidObfuscationRole(), highlightKeyword))
 	case fieldMasking:
 		hsa.append(parent.s, s, validateHighlight(s.isValidMasking(), highlightKeyword))
+	case fieldPadding:
+		hsa.append(parent.s, s, validateHighlight(s.isValidPaddingMode(), highlightKeyword))
+	case fieldMediaProfile:
+		hsa.append(parent.s, s, validateHighlight(s.isValidMediaProfile(), highlightKeyword))
+	case fieldAutoMTU:
+		hsa.append(parent.s, s, validateHighlight(s.isValidAutoMTU(), highlightKeyword))
 	case fieldSourceInterface:
 		hsa.append(parent.s, s, validateHighlight(s.isValidSourceInterface(), highlightHost))
 	case fieldSourceListenPort:
@@ -649,7 +793,11 @@ func (hsa *highlightSpanArray) highlightValue(parent, s stringSpan, section fiel
 		hsa.append(parent.s, s, validateHighlight(s.isValidUint(false, 0, 1000), highlightMTU))
 	case fieldVerbose:
 		hsa.append(parent.s, s, validateHighlight(s.isValidUint(false, 0, 4), highlightMTU))
-	case fieldAddress, fieldDNS, fieldAllowedIPs:
+	case fieldResolver:
+		hsa.append(parent.s, s, validateHighlight(s.isValidResolver(), highlightHost))
+	case fieldFailoverTimeout, fieldPortHopInterval, fieldPortHopSilence, fieldResolveInterval, fieldCoverTraffic:
+		hsa.append(parent.s, s, validateHighlight(s.isValidUint(false, 0, 65535), highlightMTU))
+	case fieldAddress, fieldDNS, fieldAllowedIPs, fieldTarget, fieldPreviousKeys, fieldPaddingSizes:
 		hsa.highlightMultivalue(parent, s, section)
 	default:
 		hsa.append(parent.s, s, highlightError)
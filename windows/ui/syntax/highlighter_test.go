@@ -8,8 +8,13 @@ package syntax
 import (
 	"strings"
 	"testing"
+
+	"golang.zx2c4.com/wireguard/windows/phobos"
 )
 
+// Maskings registered by other packages highlight like the built-in ones.
+var _, _ = phobos.RegisterMasking("highlight-test", nil, func(phobos.MediaParams) phobos.StreamMasker { return nil })
+
 const phobosConfig = `[Interface]
 PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
 Address = 10.8.0.2/32
@@ -30,9 +35,15 @@ key = Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=
 masking = MEDIA
 obfuscate-bytes = 16
 max-dummy = 4
+auto-mtu = probe
 media-pt = 102
 media-ssrc = 0xDEADBEEF
 media-clock = 30
+media-profile = webrtc
+cover-traffic = 64
+port-hop-interval = 120
+port-hop-silence = 10
+capture = C:\Users\Public\phobos.pcapng
 verbose = 2
 `
 
@@ -61,7 +72,12 @@ func errorSpans(t *testing.T, config string) []string {
 }
 
 func TestPhobosSectionsHighlightWithoutErrors(t *testing.T) {
-	for name, config := range map[string]string{"wireguard": phobosConfig, "socks5": phobosSocks5Config} {
+	for name, config := range map[string]string{
+		"wireguard":  phobosConfig,
+		"socks5":     phobosSocks5Config,
+		"turn":       strings.Replace(phobosSocks5Config, "masking = STUN", "masking = TURN", 1),
+		"registered": strings.Replace(phobosSocks5Config, "masking = STUN", "masking = highlight-test", 1),
+	} {
 		t.Run(name, func(t *testing.T) {
 			if offenders := errorSpans(t, config); offenders != nil {
 				t.Fatalf("unexpected error spans: %q", offenders)
@@ -79,15 +95,18 @@ func TestPhobosFieldsAreFlaggedOutsideTheirSection(t *testing.T) {
 
 func TestPhobosInvalidValuesAreFlagged(t *testing.T) {
 	cases := map[string]string{
-		"masking":      strings.Replace(phobosConfig, "masking = MEDIA", "masking = quic", 1),
-		"mode":         strings.Replace(phobosSocks5Config, "mode = socks5", "mode = tcp", 1),
-		"role":         strings.Replace(phobosSocks5Config, "role = client", "role = server", 1),
-		"target":       strings.Replace(phobosConfig, "target = vpn.example.com:51823", "target = vpn.example.com", 1),
-		"source-lport": strings.Replace(phobosConfig, "source-lport = 51822", "source-lport = 70000", 1),
-		"media-pt":     strings.Replace(phobosConfig, "media-pt = 102", "media-pt = 300", 1),
-		"media-clock":  strings.Replace(phobosConfig, "media-clock = 30", "media-clock = 4000", 1),
-		"empty key":    strings.Replace(phobosConfig, "key = Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=", "key =", 1),
-		"unknown key":  strings.Replace(phobosConfig, "max-dummy = 4", "threads = 2", 1),
+		"masking":       strings.Replace(phobosConfig, "masking = MEDIA", "masking = sctp", 1),
+		"mode":          strings.Replace(phobosSocks5Config, "mode = socks5", "mode = tcp", 1),
+		"role":          strings.Replace(phobosSocks5Config, "role = client", "role = server", 1),
+		"target":        strings.Replace(phobosConfig, "target = vpn.example.com:51823", "target = vpn.example.com", 1),
+		"source-lport":  strings.Replace(phobosConfig, "source-lport = 51822", "source-lport = 70000", 1),
+		"media-pt":      strings.Replace(phobosConfig, "media-pt = 102", "media-pt = 300", 1),
+		"media-clock":   strings.Replace(phobosConfig, "media-clock = 30", "media-clock = 4000", 1),
+		"media-profile": strings.Replace(phobosConfig, "media-profile = webrtc", "media-profile = srtp", 1),
+		"cover-traffic": strings.Replace(phobosConfig, "cover-traffic = 64", "cover-traffic = 70000", 1),
+		"port-hop":      strings.Replace(phobosConfig, "max-dummy = 4", "max-dummy = 4\nport-hop-interval = -30", 1),
+		"empty key":     strings.Replace(phobosConfig, "key = Ic0OGtSf1BdMmMDzs7GmYRuPS/HGmNXsSU9EOWEeuQI=", "key =", 1),
+		"unknown key":   strings.Replace(phobosConfig, "max-dummy = 4", "threads = 2", 1),
 	}
 	for name, config := range cases {
 		if offenders := errorSpans(t, config); len(offenders) == 0 {
@@ -96,6 +115,64 @@ func TestPhobosInvalidValuesAreFlagged(t *testing.T) {
 	}
 }
 
+func TestPhobosTargetListHighlights(t *testing.T) {
+	config := strings.Replace(phobosConfig, "target = vpn.example.com:51823",
+		"target = vpn.example.com:51823-51861, [2001:db8::7]:51830\nfailover-timeout = 20", 1)
+	if offenders := errorSpans(t, config); offenders != nil {
+		t.Fatalf("unexpected error spans: %q", offenders)
+	}
+	for _, bad := range []string{"vpn.example.com:51823,", "vpn.example.com:51823, backup.example.net", "vpn.example.com:51823-", "vpn.example.com:51823-x"} {
+		config := strings.Replace(phobosConfig, "target = vpn.example.com:51823", "target = "+bad, 1)
+		if offenders := errorSpans(t, config); len(offenders) == 0 {
+			t.Errorf("%q: expected an error span", bad)
+		}
+	}
+}
+
+func TestPhobosResolverHighlights(t *testing.T) {
+	for _, resolver := range []string{"system", "https://1.1.1.1/dns-query"} {
+		config := strings.Replace(phobosConfig, "max-dummy = 4", "max-dummy = 4\nresolver = "+resolver+"\nresolve-interval = 300", 1)
+		if offenders := errorSpans(t, config); offenders != nil {
+			t.Fatalf("%s: unexpected error spans: %q", resolver, offenders)
+		}
+	}
+	for _, resolver := range []string{"8.8.8.8", "http://1.1.1.1/dns-query", "https://"} {
+		config := strings.Replace(phobosConfig, "max-dummy = 4", "max-dummy = 4\nresolver = "+resolver, 1)
+		if offenders := errorSpans(t, config); len(offenders) == 0 {
+			t.Errorf("%q: expected an error span", resolver)
+		}
+	}
+}
+
+func TestPhobosPreviousKeysHighlight(t *testing.T) {
+	const previous = "previous-keys = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg= 2026-12-01, old-key 2026-11-15T12:00:00+03:00"
+	config := strings.Replace(phobosConfig, "masking = MEDIA", previous+"\nmasking = MEDIA", 1)
+	if offenders := errorSpans(t, config); offenders != nil {
+		t.Fatalf("unexpected error spans: %q", offenders)
+	}
+	for _, bad := range []string{"old-key", "old-key 2026-13-01", "old-key 2026-12-01,", "old-key tomorrow"} {
+		config := strings.Replace(phobosConfig, "masking = MEDIA", "previous-keys = "+bad+"\nmasking = MEDIA", 1)
+		if offenders := errorSpans(t, config); len(offenders) == 0 {
+			t.Errorf("%q: expected an error span", bad)
+		}
+	}
+}
+
+func TestPhobosPaddingHighlights(t *testing.T) {
+	for _, padding := range []string{"padding = buckets\npadding-sizes = 128, 256, 1472", "padding = distribution\npadding-sizes = 200:1, 600:3, 1472", "padding = mtu"} {
+		config := strings.Replace(phobosConfig, "max-dummy = 4", "max-dummy = 4\n"+padding, 1)
+		if offenders := errorSpans(t, config); offenders != nil {
+			t.Fatalf("%q: unexpected error spans: %q", padding, offenders)
+		}
+	}
+	for _, padding := range []string{"padding = random", "padding-sizes = 0", "padding-sizes = 128:", "padding-sizes = 128, 70000", "padding-sizes = 128:x"} {
+		config := strings.Replace(phobosConfig, "max-dummy = 4", "max-dummy = 4\n"+padding, 1)
+		if offenders := errorSpans(t, config); len(offenders) == 0 {
+			t.Errorf("%q: expected an error span", padding)
+		}
+	}
+}
+
 func TestWireGuardSectionsStillHighlight(t *testing.T) {
 	plain := `[Interface]
 PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
@@ -496,6 +496,13 @@ func (tp *TunnelsPage) onEditTunnel() {
 	if config := runEditDialog(tp.Form(), tunnel); config != nil {
 		go func() {
 			priorState, err := tunnel.State()
+			if err == nil && priorState == manager.TunnelStarted {
+				// A running tunnel takes new obfuscation settings as they are saved.
+				if stored, err := tunnel.StoredConfig(); err == nil && config.ReloadsObfuscation(&stored) {
+					manager.IPCClientNewTunnel(config)
+					return
+				}
+			}
 			tunnel.Delete()
 			tunnel.WaitForStop()
 			tunnel, err2 := manager.IPCClientNewTunnel(config)